@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"jhmeeting.com/adminserver/db"
+)
+
+// API Key 的授权范围
+const (
+	ScopeConferenceAction = "conference:action" // 上报会议事件
+	ScopeConferenceRead   = "conference:read"   // 查询会议
+	ScopeRoomRead         = "room:read"         // 查询房间
+	ScopeRecordRead       = "record:read"       // 查询录像
+)
+
+var APIKeyScopes = StringList{
+	ScopeConferenceAction,
+	ScopeConferenceRead,
+	ScopeRoomRead,
+	ScopeRecordRead,
+}
+
+const (
+	APIKeyContextKey = "apikey" // gin.Context 中保存 *APIKey 的键
+
+	apiKeyPrefix = "ak_"
+	// 最近使用时间的更新间隔，避免每次请求都写数据库
+	apiKeyTouchInterval = time.Minute
+)
+
+var ErrInvalidAPIKey = errors.New("API Key 无效")
+
+// IsAPIKey token 是否为 API Key 格式
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// CreateAPIKey 创建 API Key，返回的明文密钥只在创建时可见
+func (app App) CreateAPIKey(ctx context.Context, userID int64, name string, scopes StringList, expiresAt db.NullTime) (string, *APIKey, error) {
+	for _, scope := range scopes {
+		if !APIKeyScopes.Contains(scope) {
+			return "", nil, errors.New("不支持的授权范围: " + scope)
+		}
+	}
+
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiKey := &APIKey{
+		Uid:       userID,
+		Name:      name,
+		Prefix:    apiKeyPrefix + hex.EncodeToString(buf),
+		KeyHash:   hashToken(secret),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		Ctime:     time.Now(),
+	}
+	_, err = app.db.InsertInto(APIKeyTableName).
+		Columns(CommonUidCol, APIKeyNameCol, APIKeyPrefixCol, APIKeyHashCol, APIKeyScopesCol,
+			APIKeyExpiresAtCol, CommonCtimeCol).
+		Record(apiKey).ExecContext(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return apiKey.Prefix + "." + secret, apiKey, nil
+}
+
+// VerifyAPIKey 校验 API Key，并记录最近使用时间
+func (app App) VerifyAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidAPIKey
+	}
+
+	apiKey := &APIKey{}
+	err := app.db.Select(SqlStar).From(APIKeyTableName).
+		Where(WhereAPIKeyPrefix, parts[0]).LoadOneContext(ctx, apiKey)
+	if err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	if !hmac.Equal([]byte(apiKey.KeyHash), []byte(hashToken(parts[1]))) {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if apiKey.Revoked || (apiKey.ExpiresAt.Valid && now.After(apiKey.ExpiresAt.Time)) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if !apiKey.LastUsed.Valid || now.Sub(apiKey.LastUsed.Time) > apiKeyTouchInterval {
+		app.db.Update(APIKeyTableName).Set(APIKeyLastUsedCol, now).
+			Where(WhereCommonId, apiKey.Id).ExecContext(ctx)
+	}
+
+	return apiKey, nil
+}
+
+// RevokeAPIKey 吊销 API Key
+func (app App) RevokeAPIKey(ctx context.Context, id int64) error {
+	_, err := app.db.Update(APIKeyTableName).Set(APIKeyRevokedCol, true).
+		Where(dbr.Eq(CommonIdCol, id)).ExecContext(ctx)
+	return err
+}
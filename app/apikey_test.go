@@ -0,0 +1,42 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/db"
+)
+
+func TestAPIKey(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	_, _, err := app.CreateAPIKey(ctx, 1, "sfu", StringList{"unknown"}, db.NullTime{})
+	require.Error(t, err)
+
+	key, apiKey, err := app.CreateAPIKey(ctx, 1, "sfu", StringList{ScopeConferenceAction}, db.NullTime{})
+	require.NoError(t, err)
+	require.True(t, IsAPIKey(key))
+
+	verified, err := app.VerifyAPIKey(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, apiKey.Id, verified.Id)
+	require.True(t, verified.Scopes.Contains(ScopeConferenceAction))
+	require.False(t, verified.Scopes.Contains(ScopeRoomRead))
+
+	_, err = app.VerifyAPIKey(ctx, apiKey.Prefix+".wrong")
+	require.Equal(t, ErrInvalidAPIKey, err)
+
+	require.NoError(t, app.RevokeAPIKey(ctx, apiKey.Id))
+	_, err = app.VerifyAPIKey(ctx, key)
+	require.Equal(t, ErrInvalidAPIKey, err)
+
+	expired := db.NullTime{}
+	expired.Time, expired.Valid = time.Now().Add(-time.Second), true
+	key, _, err = app.CreateAPIKey(ctx, 1, "expired", StringList{ScopeRoomRead}, expired)
+	require.NoError(t, err)
+	_, err = app.VerifyAPIKey(ctx, key)
+	require.Equal(t, ErrInvalidAPIKey, err)
+}
@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -31,22 +33,47 @@ const CookieName = "rtcadmin"
 var logger = util.GetLogger()
 
 type App struct {
-	config     AppConfig
-	httpClient *http.Client
-	redisCli   redis.UniversalClient
-	db         *dbr.Session
+	config        AppConfig
+	httpClient    *http.Client
+	redisCli      redis.UniversalClient
+	store         Store
+	broker        Broker
+	codeSender    CodeSender
+	authProviders []AuthProvider
+	// 已泄露密码的 SHA-1
+	breachedPasswords map[string]struct{}
+	passwordHasher    util.PasswordHasher
+	keyring           *Keyring
+	trustedProxies    []*net.IPNet
+	db                *dbr.Session
 }
 
 type AppConfig struct {
-	Port         int         `json:"port,omitempty"`
-	Secret       string      `json:"secret,omitempty"`
-	RecordingURL string      `json:"recordingUrl,omitempty"`
-	HttpsPort    int         `json:"httpsPort,omitempty"`
-	CertPath     string      `json:"certPath,omitempty"`
-	KeyPath      string      `json:"keyPath,omitempty"`
-	API          APIConfig   `json:"api,omitempty"`
-	Redis        RedisConfig `json:"redis,omitempty"`
-	DB           db.Config   `json:"db,omitempty"`
+	Port         int     `json:"port,omitempty"`
+	Secret       string  `json:"secret,omitempty"`
+	PublicURL    string  `json:"publicUrl,omitempty"` // 管理后台对外的访问地址，如 https://meet.example.com，用于生成日历订阅地址
+	RecordingURL string  `json:"recordingUrl,omitempty"`
+	HttpsPort    int     `json:"httpsPort,omitempty"`
+	CertPath     string  `json:"certPath,omitempty"`
+	KeyPath      string  `json:"keyPath,omitempty"`
+	SuperAdmins  []int64 `json:"superAdmins,omitempty"` // 启动时设为超级管理员的用户 ID
+	// 可信反向代理的 IP 或网段，只有来自这些地址的请求才使用 X-Forwarded-For 中的客户端 IP
+	TrustedProxies []string        `json:"trustedProxies,omitempty"`
+	API            APIConfig       `json:"api,omitempty"`
+	Token          TokenConfig     `json:"token,omitempty"`
+	Callback       CallbackConfig  `json:"callback,omitempty"`
+	Reaper         ReaperConfig    `json:"reaper,omitempty"`
+	Mail           MailConfig      `json:"mail,omitempty"`
+	SMS            SMSConfig       `json:"sms,omitempty"`
+	Verify         VerifyConfig    `json:"verify,omitempty"`
+	RoomToken      RoomTokenConfig `json:"roomToken,omitempty"`
+	Webhook        WebhookConfig   `json:"webhook,omitempty"`
+	Lockout        LockoutConfig   `json:"lockout,omitempty"`
+	Password       PasswordPolicy  `json:"password,omitempty"`
+	LDAP           LDAPConfig      `json:"ldap,omitempty"`
+	OIDC           OIDCConfig      `json:"oidc,omitempty"`
+	Redis          RedisConfig     `json:"redis,omitempty"`
+	DB             db.Config       `json:"db,omitempty"`
 }
 
 type APIConfig struct {
@@ -54,6 +81,19 @@ type APIConfig struct {
 	Token string `json:"token,omitempty"`
 }
 
+type TokenConfig struct {
+	AccessTokenTTL  int                `json:"accessTokenTTL,omitempty"`  // 访问 token 有效期（秒）
+	RefreshTokenTTL int                `json:"refreshTokenTTL,omitempty"` // 刷新 token 有效期（秒），每次刷新后重新计算
+	Keys            []SigningKeyConfig `json:"keys,omitempty"`            // 签名密钥，为空时使用 secret 以 HS256 签名
+	SigningKid      string             `json:"signingKid,omitempty"`      // 签名使用的密钥，默认为第一个
+	RetireSecret    bool               `json:"retireSecret,omitempty"`    // 不再接受使用 secret 签名、不带 kid 的旧 token
+}
+
+type ReaperConfig struct {
+	Interval         int `json:"interval,omitempty"`         // 与媒体服务器核对会议的间隔（秒）
+	HeartbeatTimeout int `json:"heartbeatTimeout,omitempty"` // 无法连接媒体服务器时，超过该时间没有会议事件则结束会议（秒）
+}
+
 type RedisConfig struct {
 	Addr     []string `json:"addr,omitempty"`
 	Password string   `json:"password,omitempty"`
@@ -82,6 +122,14 @@ func NewApp(configLocations ...string) *App {
 
 	appConfig := AppConfig{
 		Port: 8004,
+		Token: TokenConfig{
+			AccessTokenTTL:  15 * 60,
+			RefreshTokenTTL: 7 * 24 * 60 * 60,
+		},
+		Reaper: ReaperConfig{
+			Interval:         60,
+			HeartbeatTimeout: 2 * 60 * 60,
+		},
 	}
 
 	if err := viper.Unmarshal(&appConfig); err != nil {
@@ -89,7 +137,7 @@ func NewApp(configLocations ...string) *App {
 	}
 
 	if gin.Mode() != gin.TestMode {
-		data, _ := json.MarshalIndent(viper.AllSettings(), "", "\t")
+		data, _ := json.MarshalIndent(redactConfig(viper.AllSettings(), ""), "", "\t")
 
 		log.Printf("config: %s", data)
 	}
@@ -101,14 +149,98 @@ func NewApp(configLocations ...string) *App {
 	sqlDB := db.NewSQLDB(appConfig.DB, gin.Mode() == gin.DebugMode)
 	InitSqlDB(sqlDB)
 
-	return &App{
+	app, err := New(appConfig, sqlDB)
+	if err != nil {
+		panic(err)
+	}
+	return app
+}
+
+// redactedValue 打印配置时替换密钥和密码
+const redactedValue = "******"
+
+var dsnPasswordPattern = regexp.MustCompile(`^([^:@/]*):[^@]*@`)
+
+// redactConfig 隐藏配置中的密钥、密码和 token，数据库 dsn 只隐藏其中的密码。viper 的键均为小写。
+func redactConfig(value interface{}, key string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			redacted[k] = redactConfig(item, k)
+		}
+		return redacted
+	case []map[string]interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = redactConfig(item, key)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = redactConfig(item, key)
+		}
+		return redacted
+	case string:
+		if len(v) == 0 {
+			return v
+		}
+		if key == "dsn" {
+			return dsnPasswordPattern.ReplaceAllString(v, "${1}:"+redactedValue+"@")
+		}
+		if key == "token" || strings.Contains(key, "secret") || strings.Contains(key, "password") {
+			return redactedValue
+		}
+	}
+	return value
+}
+
+// New 使用已加载的配置和已初始化的数据库创建 App
+func New(appConfig AppConfig, sqlDB *dbr.Session) (*App, error) {
+	// 回调签名密钥不能复用 secret，secret 泄露后可以伪造回调
+	if len(appConfig.Callback.Secret) > 0 && appConfig.Callback.Secret == appConfig.Secret {
+		return nil, errors.New("callback.secret must differ from secret")
+	}
+
+	redisCli := newRedis(appConfig.Redis)
+
+	breachedPasswords, err := loadBreachedPasswords(appConfig.Password.BreachedList)
+	if err != nil {
+		return nil, err
+	}
+	passwordHasher, err := appConfig.Password.newPasswordHasher()
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := newKeyring(appConfig.Secret, appConfig.Token)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseTrustedProxies(appConfig.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	app := &App{
 		config: appConfig,
 		httpClient: &http.Client{
 			Timeout: 5 * time.Second,
 		},
-		redisCli: newRedis(appConfig.Redis),
+		redisCli: redisCli,
+		store:    newStore(redisCli),
+		broker:   newBroker(redisCli),
 		db:       sqlDB,
+
+		breachedPasswords: breachedPasswords,
+		passwordHasher:    passwordHasher,
+		keyring:           keyring,
+		trustedProxies:    trustedProxies,
+	}
+	if err = app.BootstrapSuperAdmins(); err != nil {
+		return nil, err
 	}
+	return app, nil
 }
 
 func (app App) Config() AppConfig {
@@ -119,51 +251,57 @@ func (app App) RedisCli() redis.UniversalClient {
 	return app.redisCli
 }
 
+// Broker 未配置 Redis 时只在进程内分发消息
+func (app App) Broker() Broker {
+	return app.broker
+}
+
+// Store 未配置 Redis 时为进程内存存储
+func (app App) Store() Store {
+	return app.store
+}
+
 func (app App) DB() *dbr.Session {
 	return app.db
 }
 
-// 根据用户 ID 创建 Token
-func (app App) CreateToken(userID int64) string {
+// 根据用户 ID 和会话 ID 创建短期访问 Token，tokenClaims 的 Jti 和 ExpiresAt 由此生成
+func (app App) CreateToken(tokenClaims TokenClaims) (string, TokenClaims) {
+	now := time.Now().Unix()
+	tokenClaims.Jti = xid.New().String()
+	tokenClaims.ExpiresAt = now + int64(app.config.Token.AccessTokenTTL)
+
 	claims := make(jwt.MapClaims)
-	claims["jti"] = xid.New().String()
-	claims["aud"] = fmt.Sprintf("%d", userID)
+	claims["jti"] = tokenClaims.Jti
+	claims["sid"] = tokenClaims.Sid
+	if tokenClaims.Impersonator > 0 {
+		claims["imp"] = fmt.Sprintf("%d", tokenClaims.Impersonator)
+	}
+	claims["aud"] = fmt.Sprintf("%d", tokenClaims.Uid)
 	claims["iss"] = CookieName
-	claims["iat"] = time.Now().Unix()
-	claims["exp"] = time.Now().Unix() + int64(12*60*60) // 12 小时后 token 过期
-	token := jwt.New(jwt.SigningMethodHS256)
-	token.Claims = claims
-	tokenString, err := token.SignedString([]byte(app.config.Secret))
+	claims["iat"] = now
+	claims["exp"] = tokenClaims.ExpiresAt
+	tokenString, err := app.Keyring().Sign(claims)
 	if err != nil {
 		panic(err)
 	}
-	return tokenString
+	return tokenString, tokenClaims
 }
 
-// 解析 token
-func (app App) ParseToken(tokenString string) (userID string, err error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		if token.Header["alg"] != "HS256" {
-			return nil, fmt.Errorf("Unexpected signing method%v", "")
-		}
-		return []byte(app.config.Secret), nil
-	})
+// 解析 token，按头部的 kid 选择验证密钥
+func (app App) ParseToken(tokenString string) (*TokenClaims, error) {
+	token, err := jwt.Parse(tokenString, app.Keyring().Keyfunc)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	claims := token.Claims.(jwt.MapClaims)
-	err = claims.Valid()
-
-	if err == nil {
-		return claims["aud"].(string), nil
-	} else {
-		return "", err
+	if err = claims.Valid(); err != nil {
+		return nil, err
 	}
+
+	return parseTokenClaims(claims)
 }
 
 func (app App) HttpClient() *http.Client {
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactConfig(t *testing.T) {
+	settings := map[string]interface{}{
+		"port":   8004,
+		"secret": "test",
+		"api":    map[string]interface{}{"url": "https://api.example.com", "token": "apitoken"},
+		"token": map[string]interface{}{
+			"accesstokenttl": 900,
+			"keys":           []interface{}{map[string]interface{}{"kid": "k1", "secret": "hs256secret"}},
+		},
+		"mail":      map[string]interface{}{"username": "noreply", "password": "mailpass"},
+		"ldap":      map[string]interface{}{"binddn": "cn=admin", "bindpassword": "ldappass"},
+		"oidc":      map[string]interface{}{"clientid": "admin", "clientsecret": "oidcsecret"},
+		"roomtoken": map[string]interface{}{"appid": "admin", "appsecret": "roomsecret"},
+		"redis":     map[string]interface{}{"addr": []interface{}{"127.0.0.1:6379"}, "password": ""},
+		"db":        map[string]interface{}{"driver": "mysql", "dsn": "root:dbpass@tcp(127.0.0.1:3306)/rtc"},
+	}
+
+	redacted := redactConfig(settings, "").(map[string]interface{})
+	require.Equal(t, map[string]interface{}{
+		"port":   8004,
+		"secret": redactedValue,
+		"api":    map[string]interface{}{"url": "https://api.example.com", "token": redactedValue},
+		"token": map[string]interface{}{
+			"accesstokenttl": 900,
+			"keys":           []interface{}{map[string]interface{}{"kid": "k1", "secret": redactedValue}},
+		},
+		"mail":      map[string]interface{}{"username": "noreply", "password": redactedValue},
+		"ldap":      map[string]interface{}{"binddn": "cn=admin", "bindpassword": redactedValue},
+		"oidc":      map[string]interface{}{"clientid": "admin", "clientsecret": redactedValue},
+		"roomtoken": map[string]interface{}{"appid": "admin", "appsecret": redactedValue},
+		"redis":     map[string]interface{}{"addr": []interface{}{"127.0.0.1:6379"}, "password": ""},
+		"db":        map[string]interface{}{"driver": "mysql", "dsn": "root:" + redactedValue + "@tcp(127.0.0.1:3306)/rtc"},
+	}, redacted)
+	// 原配置不变
+	require.Equal(t, "test", settings["secret"])
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+	"jhmeeting.com/adminserver/util"
+)
+
+// 用户来源，本地账号为空
+const (
+	UserSourceLocal = ""
+	UserSourceLDAP  = "ldap"
+	UserSourceOIDC  = "oidc"
+)
+
+var ErrBadCredentials = errors.New("用户名或密码错误")
+
+// AuthProvider 校验登录名和密码，成功时返回对应的用户。
+// 账号不存在或密码错误时返回 ErrBadCredentials，由下一个 AuthProvider 继续校验。
+type AuthProvider interface {
+	Name() string
+	Authenticate(ctx context.Context, name, password string) (*User, error)
+}
+
+// AuthProviders 登录时依次尝试的校验方式，默认先校验本地账号，配置了 LDAP 时再校验目录账号
+func (app App) AuthProviders() []AuthProvider {
+	if app.authProviders != nil {
+		return app.authProviders
+	}
+	providers := []AuthProvider{dbAuthProvider{app: app}}
+	if len(app.config.LDAP.URL) > 0 {
+		providers = append(providers, ldapAuthProvider{app: app, config: app.config.LDAP})
+	}
+	return providers
+}
+
+// SetAuthProviders 替换登录校验方式
+func (app *App) SetAuthProviders(providers ...AuthProvider) {
+	app.authProviders = providers
+}
+
+// Authenticate 使用 AuthProviders 依次校验登录名和密码，全部失败时返回 ErrBadCredentials
+func (app App) Authenticate(ctx context.Context, name, password string) (*User, error) {
+	if len(name) == 0 || len(password) == 0 {
+		return nil, ErrBadCredentials
+	}
+	for _, provider := range app.AuthProviders() {
+		user, err := provider.Authenticate(ctx, name, password)
+		if err == nil {
+			return user, nil
+		}
+		if err != ErrBadCredentials {
+			// 目录服务不可用时不影响本地账号登录
+			logger.Error("authenticate failed.", zap.String("provider", provider.Name()),
+				zap.String("name", name), zap.Error(err))
+		}
+	}
+	return nil, ErrBadCredentials
+}
+
+// dbAuthProvider 校验 users 表中保存的密码哈希
+type dbAuthProvider struct {
+	app App
+}
+
+func (provider dbAuthProvider) Name() string {
+	return "db"
+}
+
+func (provider dbAuthProvider) Authenticate(ctx context.Context, name, password string) (*User, error) {
+	user := &User{}
+	err := provider.app.db.Select(SqlStar).From(UserTableName).
+		Where(WhereUserName, name).LoadOneContext(ctx, user)
+	if err == dbr.ErrNotFound {
+		return nil, ErrBadCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Source != UserSourceLocal || !util.CheckPasswordHash(password, user.Password) {
+		return nil, ErrBadCredentials
+	}
+	return user, nil
+}
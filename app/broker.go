@@ -0,0 +1,120 @@
+package app
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	streamUserPrefix = "rtcadmin:stream:user:"
+	streamOrgPrefix  = "rtcadmin:stream:org:"
+
+	brokerBufferSize = 64
+)
+
+// StreamUserChannel 用户的实时消息频道
+func StreamUserChannel(userID int64) string {
+	return streamUserPrefix + strconv.FormatInt(userID, 10)
+}
+
+// StreamOrgChannel 组织的实时消息频道
+func StreamOrgChannel(orgID int64) string {
+	return streamOrgPrefix + strconv.FormatInt(orgID, 10)
+}
+
+// Broker 消息发布订阅，配置了 Redis 时通过 Redis 在多个实例间分发，否则只在进程内分发
+type Broker interface {
+	Publish(channel string, message []byte) error
+	// Subscribe 订阅频道，调用返回的函数取消订阅。接收不及时的消息会被丢弃。
+	Subscribe(channels ...string) (<-chan []byte, func())
+}
+
+func newBroker(redisCli redis.UniversalClient) Broker {
+	if redisCli != nil {
+		return &redisBroker{cli: redisCli}
+	}
+	return NewMemoryBroker()
+}
+
+type redisBroker struct {
+	cli redis.UniversalClient
+}
+
+func (b *redisBroker) Publish(channel string, message []byte) error {
+	return b.cli.Publish(channel, message).Err()
+}
+
+func (b *redisBroker) Subscribe(channels ...string) (<-chan []byte, func()) {
+	pubsub := b.cli.Subscribe(channels...)
+	messages := make(chan []byte, brokerBufferSize)
+
+	go func() {
+		defer close(messages)
+		for msg := range pubsub.Channel() {
+			select {
+			case messages <- []byte(msg.Payload):
+			default:
+				logger.Warn("drop stream message.", zap.String("channel", msg.Channel))
+			}
+		}
+	}()
+
+	return messages, func() { pubsub.Close() }
+}
+
+// MemoryBroker 进程内的消息发布订阅
+type MemoryBroker struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[chan []byte]struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subscribers: make(map[string]map[chan []byte]struct{}),
+	}
+}
+
+func (b *MemoryBroker) Publish(channel string, message []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for messages := range b.subscribers[channel] {
+		select {
+		case messages <- message:
+		default:
+			logger.Warn("drop stream message.", zap.String("channel", channel))
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(channels ...string) (<-chan []byte, func()) {
+	messages := make(chan []byte, brokerBufferSize)
+
+	b.mu.Lock()
+	for _, channel := range channels {
+		if b.subscribers[channel] == nil {
+			b.subscribers[channel] = make(map[chan []byte]struct{})
+		}
+		b.subscribers[channel][messages] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return messages, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for _, channel := range channels {
+				delete(b.subscribers[channel], messages)
+				if len(b.subscribers[channel]) == 0 {
+					delete(b.subscribers, channel)
+				}
+			}
+			close(messages)
+		})
+	}
+}
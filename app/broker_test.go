@@ -0,0 +1,26 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+
+	messages, cancel := broker.Subscribe(StreamUserChannel(1), StreamOrgChannel(1))
+	require.NoError(t, broker.Publish(StreamUserChannel(1), []byte("user")))
+	require.NoError(t, broker.Publish(StreamUserChannel(2), []byte("other")))
+	require.NoError(t, broker.Publish(StreamOrgChannel(1), []byte("org")))
+
+	require.Equal(t, "user", string(<-messages))
+	require.Equal(t, "org", string(<-messages))
+	require.Len(t, messages, 0)
+
+	cancel()
+	cancel()
+	_, ok := <-messages
+	require.False(t, ok)
+	require.NoError(t, broker.Publish(StreamUserChannel(1), []byte("user")))
+}
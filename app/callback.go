@@ -0,0 +1,85 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// 媒体服务器事件回调的签名请求头
+const (
+	CallbackSignatureHeader = "X-Signature" // sha256=<hex>，HMAC-SHA256(timestamp.nonce.body)
+	CallbackTimestampHeader = "X-Timestamp" // unix 时间戳（秒）
+	CallbackNonceHeader     = "X-Nonce"     // 每次投递唯一的随机串
+
+	callbackNoncePrefix      = "rtcadmin:nonce:"
+	callbackSignaturePrefix  = "sha256="
+	defaultCallbackTolerance = 5 * 60
+)
+
+var (
+	ErrCallbackSignature = errors.New("回调签名无效")
+	ErrCallbackStale     = errors.New("回调已过期")
+	ErrCallbackReplayed  = errors.New("回调重复投递")
+	ErrCallbackDisabled  = errors.New("未配置回调签名密钥")
+)
+
+type CallbackConfig struct {
+	Secret    string `json:"secret,omitempty"`    // 签名密钥，不能与 secret 相同，为空时不接受签名回调
+	Tolerance int    `json:"tolerance,omitempty"` // 允许的时间偏差（秒）
+}
+
+// SignCallback 计算回调签名
+func SignCallback(secret string, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return callbackSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// CallbackEnabled 是否配置了独立的回调签名密钥
+func (app App) CallbackEnabled() bool {
+	return len(app.config.Callback.Secret) > 0
+}
+
+// VerifyCallback 校验回调签名和时间戳，并拒绝重复的 nonce
+func (app App) VerifyCallback(timestamp, nonce, signature string, body []byte) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(nonce) == 0 || len(nonce) > 64 {
+		return ErrCallbackSignature
+	}
+
+	secret := app.config.Callback.Secret
+	if len(secret) == 0 {
+		return ErrCallbackDisabled
+	}
+	expected := SignCallback(secret, ts, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrCallbackSignature
+	}
+
+	tolerance := time.Duration(app.config.Callback.Tolerance) * time.Second
+	if tolerance <= 0 {
+		tolerance = defaultCallbackTolerance * time.Second
+	}
+	diff := time.Since(time.Unix(ts, 0))
+	if diff > tolerance || diff < -tolerance {
+		return ErrCallbackStale
+	}
+
+	// nonce 保留到时间戳过期之后，超出时间窗口的投递已被上面拒绝
+	ok, err := app.store.SetNX(callbackNoncePrefix+nonce, timestamp, 2*tolerance)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCallbackReplayed
+	}
+	return nil
+}
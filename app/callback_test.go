@@ -0,0 +1,37 @@
+package app
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCallback(t *testing.T) {
+	app := newTestApp()
+	body := []byte(`{"action":"muc-room-destroyed","room":"test"}`)
+
+	now := time.Now().Unix()
+	ts := strconv.FormatInt(now, 10)
+
+	// 未配置 callback.secret 时不使用 secret 校验
+	require.Equal(t, ErrCallbackDisabled, app.VerifyCallback(ts, "nonce0", SignCallback("test", now, "nonce0", body), body))
+	app.config.Callback.Secret = "callback"
+
+	signature := SignCallback("callback", now, "nonce1", body)
+
+	require.NoError(t, app.VerifyCallback(ts, "nonce1", signature, body))
+	require.Equal(t, ErrCallbackReplayed, app.VerifyCallback(ts, "nonce1", signature, body))
+
+	// 篡改请求体
+	require.Equal(t, ErrCallbackSignature,
+		app.VerifyCallback(ts, "nonce2", SignCallback("callback", now, "nonce2", body), []byte(`{}`)))
+	// 使用 secret 签名
+	require.Equal(t, ErrCallbackSignature,
+		app.VerifyCallback(ts, "nonce3", SignCallback("test", now, "nonce3", body), body))
+
+	stale := now - 3600
+	require.Equal(t, ErrCallbackStale, app.VerifyCallback(strconv.FormatInt(stale, 10), "nonce4",
+		SignCallback("callback", stale, "nonce4", body), body))
+}
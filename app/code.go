@@ -0,0 +1,208 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// 验证码的发送渠道
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// 验证码用途
+const (
+	CodePurposeResetPassword = "reset-password" // 重置密码
+	CodePurposeVerifyEmail   = "verify-email"   // 验证邮箱
+	CodePurposeVerifyPhone   = "verify-phone"   // 验证手机号码
+)
+
+const (
+	codeKeyPrefix     = storeKeyPrefix + "code:"
+	codeFailKeyPrefix = storeKeyPrefix + "code-fail:"
+	rateKeyPrefix     = storeKeyPrefix + "rate:"
+
+	codeLength = 6
+	// 验证码错误次数上限，超过后验证码作废
+	codeMaxFailures = 5
+	// 已使用的验证码，不是有效的哈希值
+	codeUsed = "used"
+)
+
+var (
+	ErrInvalidCode   = errors.New("验证码错误或已过期")
+	ErrRateLimited   = errors.New("请求过于频繁，请稍后再试")
+	ErrNoCodeChannel = errors.New("未配置该验证码发送渠道")
+)
+
+// SMSConfig 短信网关，验证码以 JSON POST 到 URL，URL 为空时不支持短信验证码
+type SMSConfig struct {
+	URL   string `json:"url,omitempty"`
+	Token string `json:"token,omitempty"` // 以 Bearer 方式放在 Authorization 头中
+}
+
+// CodeSender 发送验证码，channel 为 ChannelEmail 或 ChannelSMS，to 为邮箱或手机号
+type CodeSender interface {
+	SendCode(ctx context.Context, channel, to, purpose, code string, ttl time.Duration) error
+}
+
+// CodeSender 验证码发送方式，默认邮件使用发件箱，短信使用 SMSConfig 配置的网关
+func (app App) CodeSender() CodeSender {
+	if app.codeSender != nil {
+		return app.codeSender
+	}
+	return defaultCodeSender{app: app}
+}
+
+// SetCodeSender 替换验证码发送方式，用于接入其他短信或邮件服务
+func (app *App) SetCodeSender(sender CodeSender) {
+	app.codeSender = sender
+}
+
+type defaultCodeSender struct {
+	app App
+}
+
+// 各用途的验证码邮件模板
+var codeMailTemplates = map[string]string{
+	CodePurposeResetPassword: MailTemplatePasswordReset,
+	CodePurposeVerifyEmail:   MailTemplateVerifyEmail,
+}
+
+func (sender defaultCodeSender) SendCode(ctx context.Context, channel, to, purpose, code string, ttl time.Duration) error {
+	switch channel {
+	case ChannelEmail:
+		if !sender.app.MailEnabled() {
+			return ErrNoCodeChannel
+		}
+		data := CodeMailData{Code: code, ExpiresIn: int(ttl / time.Minute)}
+		return sender.app.EnqueueMail(ctx, sender.app.db, []string{to}, codeMailTemplates[purpose], data)
+
+	case ChannelSMS:
+		return sender.sendSMS(ctx, to, purpose, code, ttl)
+	}
+	return ErrNoCodeChannel
+}
+
+// sendSMS 调用短信网关，非 2xx 视为失败
+func (sender defaultCodeSender) sendSMS(ctx context.Context, phone, purpose, code string, ttl time.Duration) error {
+	config := sender.app.config.SMS
+	if len(config.URL) == 0 {
+		return ErrNoCodeChannel
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"phone":     phone,
+		"purpose":   purpose,
+		"code":      code,
+		"expiresIn": int(ttl / time.Second),
+	})
+	req, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if len(config.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+
+	resp, err := sender.app.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("sms gateway: unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// issueCode 生成数字验证码，Store 中只保存哈希值，同一用途和对象的旧验证码失效
+func (app App) issueCode(purpose, subject string, ttl time.Duration) (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < codeLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%0*d", codeLength, n)
+
+	key := purpose + ":" + subject
+	if err = app.store.Del(codeFailKeyPrefix + key); err != nil {
+		return "", err
+	}
+	if err = app.store.Set(codeKeyPrefix+key, hashToken(code), ttl); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// checkCode 校验验证码，通过后立即作废，只能使用一次；错误次数过多时验证码作废
+func (app App) checkCode(purpose, subject, code string) error {
+	hash, err := app.matchCode(purpose, subject, code)
+	if err != nil {
+		return err
+	}
+	return app.consumeCode(purpose, subject, hash)
+}
+
+// matchCode 校验验证码但不作废，返回 consumeCode 需要的哈希值；错误次数过多时验证码作废
+func (app App) matchCode(purpose, subject, code string) (string, error) {
+	key := purpose + ":" + subject
+	hash, err := app.store.Get(codeKeyPrefix + key)
+	if err == ErrStoreNil {
+		return "", ErrInvalidCode
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !hmac.Equal([]byte(hash), []byte(hashToken(code))) {
+		failures, err := app.store.Incr(codeFailKeyPrefix+key, time.Hour)
+		if err != nil {
+			return "", err
+		}
+		if failures >= codeMaxFailures {
+			app.store.Del(codeKeyPrefix+key, codeFailKeyPrefix+key)
+		}
+		return "", ErrInvalidCode
+	}
+	return hash, nil
+}
+
+// consumeCode 作废 matchCode 校验通过的验证码
+func (app App) consumeCode(purpose, subject, hash string) error {
+	key := purpose + ":" + subject
+	// 并发使用同一个验证码时只有一个能替换成功
+	ok, err := app.store.CompareAndSwap(codeKeyPrefix+key, hash, codeUsed, time.Minute)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+	return app.store.Del(codeKeyPrefix+key, codeFailKeyPrefix+key)
+}
+
+// allowRate 固定窗口限流，window 内超过 limit 次时返回 false
+func (app App) allowRate(key string, limit int64, window time.Duration) (bool, error) {
+	count, err := app.store.Incr(rateKeyPrefix+key, window)
+	if err != nil {
+		return false, err
+	}
+	return count <= limit, nil
+}
@@ -6,10 +6,25 @@ import (
 )
 
 var DBTables = map[string]interface{}{
-	UserTableName:       User{},
-	RoomTableName:       RoomInfo{},
-	ConferenceTableName: ConferenceInfo{},
-	RecordTableName:     RecordInfo{},
+	UserTableName:             User{},
+	RoomTableName:             RoomInfo{},
+	ConferenceTableName:       ConferenceInfo{},
+	RecordTableName:           RecordInfo{},
+	ParticipantTableName:      ParticipantInfo{},
+	ConferenceEventTableName:  ConferenceEvent{},
+	SessionTableName:          SessionInfo{},
+	OrgTableName:              Organization{},
+	OrgMemberTableName:        OrgMember{},
+	APIKeyTableName:           APIKey{},
+	WebhookTableName:          Webhook{},
+	WebhookDeliveryTableName:  WebhookDelivery{},
+	MeetingTableName:          Meeting{},
+	MeetingExceptionTableName: MeetingException{},
+	MailOutboxTableName:       MailOutbox{},
+	RecoveryCodeTableName:     RecoveryCode{},
+	UserIdentityTableName:     UserIdentity{},
+	PasswordHistoryTableName:  PasswordHistory{},
+	RoomTokenTableName:        RoomToken{},
 }
 
 func InitSqlDB(session *dbr.Session) {
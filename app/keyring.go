@@ -0,0 +1,231 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningKeyConfig 访问 token 的签名密钥。
+// HS256 使用 Secret；RS256、ES256 使用 PEM 格式的私钥文件，只配置公钥文件时只用于验证。
+type SigningKeyConfig struct {
+	Kid        string `json:"kid,omitempty"`        // 密钥 ID，写入 token 头部，不能重复
+	Alg        string `json:"alg,omitempty"`        // HS256、RS256 或 ES256
+	Secret     string `json:"secret,omitempty"`     // HS256 的密钥
+	PrivateKey string `json:"privateKey,omitempty"` // 私钥文件
+	PublicKey  string `json:"publicKey,omitempty"`  // 公钥文件，已停止签名、等待退役的密钥可以只保留公钥
+}
+
+// JWK JSON Web Key，只用于公开 RS256、ES256 密钥的公钥
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// signingKey 密钥环中的一个密钥，signKey 为空时只用于验证
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Keyring 签名和验证访问 token 的密钥。
+// 轮换时先加入新密钥并设为 signingKid，旧密钥保留到其签发的 token 全部过期后再删除。
+type Keyring struct {
+	signer *signingKey
+	keys   map[string]*signingKey
+}
+
+// newKeyring 未配置密钥时使用 secret 以 HS256 签名，token 头部不带 kid，与之前签发的 token 兼容。
+// 配置了密钥后，不带 kid 的旧 token 仍使用 secret 验证，直到设置 retireSecret。
+func newKeyring(secret string, config TokenConfig) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]*signingKey{}}
+	legacy := &signingKey{method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}
+	if len(config.Keys) == 0 {
+		keyring.signer = legacy
+		keyring.keys[""] = legacy
+		return keyring, nil
+	}
+	if !config.RetireSecret && len(secret) > 0 {
+		keyring.keys[""] = &signingKey{method: jwt.SigningMethodHS256, verifyKey: []byte(secret)}
+	}
+
+	for _, keyConfig := range config.Keys {
+		key, err := loadSigningKey(keyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("token key %q: %w", keyConfig.Kid, err)
+		}
+		if _, ok := keyring.keys[key.kid]; ok {
+			return nil, fmt.Errorf("token key %q: duplicate kid", key.kid)
+		}
+		keyring.keys[key.kid] = key
+	}
+
+	signingKid := config.SigningKid
+	if len(signingKid) == 0 {
+		signingKid = config.Keys[0].Kid
+	}
+	keyring.signer = keyring.keys[signingKid]
+	if keyring.signer == nil || keyring.signer.signKey == nil {
+		return nil, fmt.Errorf("token signing key %q not found or has no private key", signingKid)
+	}
+	return keyring, nil
+}
+
+func loadSigningKey(config SigningKeyConfig) (*signingKey, error) {
+	if len(config.Kid) == 0 {
+		return nil, errors.New("kid is required")
+	}
+	key := &signingKey{kid: config.Kid}
+	switch config.Alg {
+	case "", jwt.SigningMethodHS256.Alg():
+		if len(config.Secret) < 32 {
+			return nil, errors.New("HS256 secret must be at least 32 bytes")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey, key.verifyKey = []byte(config.Secret), []byte(config.Secret)
+		return key, nil
+	case jwt.SigningMethodRS256.Alg():
+		key.method = jwt.SigningMethodRS256
+	case jwt.SigningMethodES256.Alg():
+		key.method = jwt.SigningMethodES256
+	default:
+		return nil, fmt.Errorf("unsupported alg: %s", config.Alg)
+	}
+
+	var err error
+	if len(config.PrivateKey) > 0 {
+		key.signKey, key.verifyKey, err = loadPrivateKey(key.method, config.PrivateKey)
+	} else if len(config.PublicKey) > 0 {
+		key.verifyKey, err = loadPublicKey(key.method, config.PublicKey)
+	} else {
+		err = errors.New("privateKey or publicKey is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch public := key.verifyKey.(type) {
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 requires a P-256 key")
+		}
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, errors.New("RS256 requires a key of at least 2048 bits")
+		}
+	}
+	return key, nil
+}
+
+func loadPrivateKey(method jwt.SigningMethod, path string) (interface{}, interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if method == jwt.SigningMethodRS256 {
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &key.PublicKey, nil
+}
+
+func loadPublicKey(method jwt.SigningMethod, path string) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if method == jwt.SigningMethodRS256 {
+		return jwt.ParseRSAPublicKeyFromPEM(data)
+	}
+	return jwt.ParseECPublicKeyFromPEM(data)
+}
+
+// Sign 使用当前签名密钥签名，配置了 kid 时写入头部
+func (keyring *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(keyring.signer.method, claims)
+	if len(keyring.signer.kid) > 0 {
+		token.Header["kid"] = keyring.signer.kid
+	}
+	return token.SignedString(keyring.signer.signKey)
+}
+
+// Keyfunc 按头部的 kid 查找验证密钥，算法必须与密钥一致，避免算法混淆
+func (keyring *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := keyring.keys[kid]
+	if key == nil {
+		return nil, fmt.Errorf("Unknown signing key: %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
+
+// JWKS 公开的 RS256、ES256 公钥，供其他服务验证访问 token，HS256 密钥不公开
+func (keyring *Keyring) JWKS() []JWK {
+	keys := []JWK{}
+	for _, key := range keyring.keys {
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "RSA", Use: "sig", Kid: key.kid, Alg: key.method.Alg(),
+				N: base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			keys = append(keys, JWK{
+				Kty: "EC", Use: "sig", Kid: key.kid, Alg: key.method.Alg(), Crv: public.Curve.Params().Name,
+				X: base64.RawURLEncoding.EncodeToString(padBytes(public.X.Bytes(), size)),
+				Y: base64.RawURLEncoding.EncodeToString(padBytes(public.Y.Bytes(), size)),
+			})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+	return keys
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// Keyring 访问 token 的密钥环
+func (app App) Keyring() *Keyring {
+	if app.keyring != nil {
+		return app.keyring
+	}
+	keyring, err := newKeyring(app.config.Secret, app.config.Token)
+	if err != nil {
+		panic(err)
+	}
+	return keyring
+}
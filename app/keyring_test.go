@@ -0,0 +1,143 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+	return path
+}
+
+func tokenKid(t *testing.T, tokenString string) interface{} {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	require.NoError(t, err)
+	return token.Header["kid"]
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaPrivate := writePEM(t, dir, "k1.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	rsaPublicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	rsaPublic := writePEM(t, dir, "k1.pub", "PUBLIC KEY", rsaPublicDER)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	ecPrivate := writePEM(t, dir, "k2.pem", "EC PRIVATE KEY", ecDER)
+
+	app := newTestApp()
+	app.config.Token.AccessTokenTTL = 60
+
+	// 未配置密钥时使用 secret 签名，不带 kid
+	legacy, _ := app.CreateToken(TokenClaims{Uid: 1, Sid: "s"})
+	require.Nil(t, tokenKid(t, legacy))
+	require.Empty(t, app.Keyring().JWKS())
+
+	// 切换到 RS256，旧 token 仍有效
+	app.config.Token.Keys = []SigningKeyConfig{{Kid: "k1", Alg: "RS256", PrivateKey: rsaPrivate}}
+	k1Token, _ := app.CreateToken(TokenClaims{Uid: 1, Sid: "s"})
+	require.Equal(t, "k1", tokenKid(t, k1Token))
+	for _, token := range []string{legacy, k1Token} {
+		claims, err := app.ParseToken(token)
+		require.NoError(t, err)
+		require.EqualValues(t, 1, claims.Uid)
+	}
+	jwks := app.Keyring().JWKS()
+	require.Len(t, jwks, 1)
+	require.Equal(t, "RSA", jwks[0].Kty)
+
+	// 轮换到 ES256，k1 只保留公钥用于验证
+	app.config.Token.Keys = []SigningKeyConfig{
+		{Kid: "k2", Alg: "ES256", PrivateKey: ecPrivate},
+		{Kid: "k1", Alg: "RS256", PublicKey: rsaPublic},
+	}
+	k2Token, _ := app.CreateToken(TokenClaims{Uid: 2, Sid: "s"})
+	require.Equal(t, "k2", tokenKid(t, k2Token))
+	for _, token := range []string{legacy, k1Token, k2Token} {
+		_, err := app.ParseToken(token)
+		require.NoError(t, err)
+	}
+	jwks = app.Keyring().JWKS()
+	require.Len(t, jwks, 2)
+	require.Equal(t, "k1", jwks[0].Kid)
+	require.Equal(t, "k2", jwks[1].Kid)
+	require.Equal(t, "P-256", jwks[1].Crv)
+	require.Len(t, jwks[1].X, 43)
+
+	// 退役 k1 和 secret
+	app.config.Token.Keys = app.config.Token.Keys[:1]
+	app.config.Token.RetireSecret = true
+	for _, token := range []string{legacy, k1Token} {
+		_, err := app.ParseToken(token)
+		require.Error(t, err)
+	}
+	_, err = app.ParseToken(k2Token)
+	require.NoError(t, err)
+}
+
+func TestKeyringRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	rsaPublic := writePEM(t, dir, "k1.pub", "PUBLIC KEY", publicDER)
+
+	// 使用公钥作为 HMAC 密钥伪造的 token
+	keyring, err := newKeyring("test", TokenConfig{Keys: []SigningKeyConfig{
+		{Kid: "h1", Secret: "0123456789abcdef0123456789abcdef"},
+		{Kid: "k1", Alg: "RS256", PublicKey: rsaPublic},
+	}})
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"aud": "1"})
+	forged.Header["kid"] = "k1"
+	forgedString, err := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	require.NoError(t, err)
+	_, err = jwt.Parse(forgedString, keyring.Keyfunc)
+	require.Error(t, err)
+
+	// 未知的 kid
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"aud": "1"})
+	unknown.Header["kid"] = "h2"
+	unknownString, _ := unknown.SignedString([]byte("0123456789abcdef0123456789abcdef"))
+	_, err = jwt.Parse(unknownString, keyring.Keyfunc)
+	require.Error(t, err)
+
+	for _, config := range []TokenConfig{
+		{Keys: []SigningKeyConfig{{Kid: "h1", Secret: "short"}}},
+		{Keys: []SigningKeyConfig{{Kid: "k1", Alg: "RS256", PublicKey: rsaPublic}}},
+		{Keys: []SigningKeyConfig{{Kid: "k1", Alg: "PS256", PublicKey: rsaPublic}}},
+		{Keys: []SigningKeyConfig{{Alg: "RS256", PublicKey: rsaPublic}}},
+		{Keys: []SigningKeyConfig{
+			{Kid: "h1", Secret: "0123456789abcdef0123456789abcdef"},
+			{Kid: "h1", Secret: "0123456789abcdef0123456789abcdef"},
+		}},
+		{SigningKid: "h2", Keys: []SigningKeyConfig{{Kid: "h1", Secret: "0123456789abcdef0123456789abcdef"}}},
+	} {
+		_, err := newKeyring("test", config)
+		require.Error(t, err)
+	}
+}
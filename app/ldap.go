@@ -0,0 +1,180 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// LDAPConfig LDAP / Active Directory 登录，URL 为空时不启用。
+// 先使用 BindDN 查找用户，再以用户的 DN 和密码绑定校验密码。
+type LDAPConfig struct {
+	URL                string `json:"url,omitempty"`                // 如 ldap://ldap.example.com:389 或 ldaps://ad.example.com:636
+	StartTLS           bool   `json:"startTLS,omitempty"`           // 使用 ldap:// 时是否启用 StartTLS
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"` // 不校验服务器证书，仅用于测试环境
+	BindDN             string `json:"bindDN,omitempty"`             // 查找用户使用的账号，为空时匿名查找
+	BindPassword       string `json:"bindPassword,omitempty"`
+	BaseDN             string `json:"baseDN,omitempty"`          // 查找用户的起始 DN
+	UserFilter         string `json:"userFilter,omitempty"`      // 查找用户的过滤器，%s 替换为登录名，默认 (uid=%s)，AD 使用 (sAMAccountName=%s)
+	NameAttr           string `json:"nameAttr,omitempty"`        // 用户名属性，与 UserFilter 中的属性一致，默认 uid，AD 使用 sAMAccountName
+	DisplayNameAttr    string `json:"displayNameAttr,omitempty"` // 姓名属性，默认 displayName
+	EmailAttr          string `json:"emailAttr,omitempty"`       // 邮箱属性，默认 mail
+	PhoneAttr          string `json:"phoneAttr,omitempty"`       // 手机号码属性，默认 mobile
+}
+
+func (config LDAPConfig) withDefaults() LDAPConfig {
+	if len(config.UserFilter) == 0 {
+		config.UserFilter = "(uid=%s)"
+	}
+	if len(config.NameAttr) == 0 {
+		config.NameAttr = "uid"
+	}
+	if len(config.DisplayNameAttr) == 0 {
+		config.DisplayNameAttr = "displayName"
+	}
+	if len(config.EmailAttr) == 0 {
+		config.EmailAttr = "mail"
+	}
+	if len(config.PhoneAttr) == 0 {
+		config.PhoneAttr = "mobile"
+	}
+	return config
+}
+
+// ldapAuthProvider 使用 LDAP 目录校验密码，首次登录时自动创建用户，之后每次登录同步姓名、邮箱和手机号码
+type ldapAuthProvider struct {
+	app    App
+	config LDAPConfig
+}
+
+func (provider ldapAuthProvider) Name() string {
+	return UserSourceLDAP
+}
+
+func (provider ldapAuthProvider) dial() (*ldap.Conn, error) {
+	config := provider.config
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if config.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (provider ldapAuthProvider) Authenticate(ctx context.Context, name, password string) (*User, error) {
+	config := provider.config.withDefaults()
+	conn, err := provider.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if len(config.BindDN) > 0 {
+		if err = conn.Bind(config.BindDN, config.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		fmt.Sprintf(config.UserFilter, ldap.EscapeFilter(name)),
+		[]string{config.NameAttr, config.DisplayNameAttr, config.EmailAttr, config.PhoneAttr},
+		nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrBadCredentials
+	}
+
+	entry := result.Entries[0]
+	// 密码为空时部分服务器视为匿名绑定并返回成功，Authenticate 已拒绝空密码
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrBadCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 目录的属性匹配通常不区分大小写，使用目录中的用户名，避免同一账号以不同写法登录时创建多个用户
+	canonical := entry.GetAttributeValue(config.NameAttr)
+	if len(canonical) == 0 {
+		logger.Warn("ldap entry has no name attribute.", zap.String("dn", entry.DN), zap.String("attr", config.NameAttr))
+		return nil, ErrBadCredentials
+	}
+	return provider.app.provisionUser(ctx, UserSourceLDAP, User{
+		Name:        canonical,
+		DisplayName: entry.GetAttributeValue(config.DisplayNameAttr),
+		Email:       entry.GetAttributeValue(config.EmailAttr),
+		Phone:       entry.GetAttributeValue(config.PhoneAttr),
+	})
+}
+
+// provisionUser 外部目录的用户登录后创建或更新对应的用户，同名的本地账号不会被目录账号接管。
+// 目录中的邮箱和手机号码由企业维护，视为已验证。
+func (app App) provisionUser(ctx context.Context, source string, profile User) (*User, error) {
+	user := &User{}
+	err := app.db.Select(SqlStar).From(UserTableName).
+		Where(WhereUserName, profile.Name).LoadOneContext(ctx, user)
+	if err != nil && err != dbr.ErrNotFound {
+		return nil, err
+	}
+
+	if err == dbr.ErrNotFound {
+		profile.Password = ""
+		profile.EmailVerified = len(profile.Email) > 0
+		profile.PhoneVerified = len(profile.Phone) > 0
+		profile.Role = RoleUser
+		profile.Source = source
+		profile.Ctime = time.Now()
+		_, err = app.db.InsertInto(UserTableName).
+			Columns(UserNameCol, UserPasswordCol, UserDisNameCol, UserEmailCol, UserPhoneCol,
+				UserEmailVerifiedCol, UserPhoneVerifiedCol, UserRoleCol, UserSourceCol, CommonCtimeCol).
+			Record(&profile).ExecContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("user provisioned.", zap.Int64("uid", profile.Id), zap.String("name", profile.Name),
+			zap.String("source", source))
+		return &profile, nil
+	}
+
+	if user.Source != source {
+		logger.Warn("directory user conflicts with existing account.", zap.Int64("uid", user.Id),
+			zap.String("name", user.Name), zap.String("source", source))
+		return nil, ErrBadCredentials
+	}
+	user.DisplayName = profile.DisplayName
+	user.Email = profile.Email
+	user.Phone = profile.Phone
+	user.EmailVerified = len(profile.Email) > 0
+	user.PhoneVerified = len(profile.Phone) > 0
+	_, err = app.db.Update(UserTableName).
+		Set(UserDisNameCol, user.DisplayName).
+		Set(UserEmailCol, user.Email).
+		Set(UserPhoneCol, user.Phone).
+		Set(UserEmailVerifiedCol, user.EmailVerified).
+		Set(UserPhoneVerifiedCol, user.PhoneVerified).
+		Where(WhereCommonId, user.Id).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
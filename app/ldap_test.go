@@ -0,0 +1,210 @@
+package app
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/util"
+)
+
+// ldapEntry 测试目录中的条目
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string]string
+}
+
+// ldapServer 只支持简单绑定和等值、与过滤器查找的本地 LDAP 服务器
+type ldapServer struct {
+	listener net.Listener
+	entries  []ldapEntry
+}
+
+func newLDAPServer(t *testing.T, entries ...ldapEntry) *ldapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &ldapServer{listener: listener, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *ldapServer) url() string {
+	return "ldap://" + server.listener.Addr().String()
+}
+
+func (server *ldapServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case 0: // BindRequest
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := int64(49) // invalidCredentials
+			if dn == "cn=admin,dc=example,dc=com" && password == "secret" {
+				code = 0
+			}
+			for _, entry := range server.entries {
+				if entry.dn == dn && entry.password == password {
+					code = 0
+				}
+			}
+			conn.Write(ldapResponse(id, 1, code).Bytes())
+
+		case 3: // SearchRequest
+			base := op.Children[0].Value.(string)
+			for _, entry := range server.entries {
+				if !strings.HasSuffix(entry.dn, base) || !ldapMatch(op.Children[6], entry) {
+					continue
+				}
+				result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "SearchResultEntry")
+				result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "objectName"))
+				attrs := ber.NewSequence("attributes")
+				for name, value := range entry.attrs {
+					attr := ber.NewSequence("attribute")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+					vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+					vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+					attr.AppendChild(vals)
+					attrs.AppendChild(attr)
+				}
+				result.AppendChild(attrs)
+				conn.Write(ldapMessage(id, result).Bytes())
+			}
+			conn.Write(ldapResponse(id, 5, 0).Bytes())
+
+		default: // UnbindRequest 等
+			return
+		}
+	}
+}
+
+// ldapMatch 支持 (&...) 和 (attr=value)，与多数目录一样值不区分大小写
+func ldapMatch(filter *ber.Packet, entry ldapEntry) bool {
+	switch filter.Tag {
+	case 0:
+		for _, child := range filter.Children {
+			if !ldapMatch(child, entry) {
+				return false
+			}
+		}
+		return true
+	case 3:
+		name := filter.Children[0].Data.String()
+		value := filter.Children[1].Data.String()
+		if strings.EqualFold(name, "objectClass") {
+			return true
+		}
+		return strings.EqualFold(entry.attrs[name], value)
+	}
+	return false
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	message := ber.NewSequence("LDAPMessage")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "messageID"))
+	message.AppendChild(op)
+	return message
+}
+
+func ldapResponse(id int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "LDAPResult")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return ldapMessage(id, op)
+}
+
+func TestLDAPLogin(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	server := newLDAPServer(t, ldapEntry{
+		dn:       "uid=alice,ou=people,dc=example,dc=com",
+		password: "directory",
+		attrs: map[string]string{
+			"uid":         "alice",
+			"displayName": "Alice",
+			"mail":        "alice@example.com",
+			"mobile":      "13800000000",
+		},
+	}, ldapEntry{
+		dn:       "uid=admin,ou=people,dc=example,dc=com",
+		password: "directory",
+		attrs:    map[string]string{"uid": "admin"},
+	})
+	defer server.listener.Close()
+	app.config.LDAP = LDAPConfig{
+		URL:          server.url(),
+		BindDN:       "cn=admin,dc=example,dc=com",
+		BindPassword: "secret",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+	}
+
+	hash, _ := util.HashPassword("local")
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, CommonCtimeCol).
+		Values("admin", hash, "2020-01-01 00:00:00").Exec()
+	require.NoError(t, err)
+
+	// 首次登录时创建用户，属性从目录同步
+	user, err := app.Authenticate(ctx, "alice", "directory")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, user.Id)
+	user, err = app.loadUser(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, "Alice", user.DisplayName)
+	require.Equal(t, "alice@example.com", user.Email)
+	require.Equal(t, "13800000000", user.Phone)
+	require.True(t, user.EmailVerified)
+	require.Equal(t, UserSourceLDAP, user.Source)
+	require.Equal(t, RoleUser, user.Role)
+
+	// 再次登录不会重复创建，大小写不同的登录名使用目录中的用户名
+	user, err = app.Authenticate(ctx, "alice", "directory")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, user.Id)
+	user, err = app.Authenticate(ctx, "ALICE", "directory")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, user.Id)
+	require.Equal(t, "alice", user.Name)
+
+	_, err = app.Authenticate(ctx, "alice", "wrong")
+	require.Equal(t, ErrBadCredentials, err)
+	_, err = app.Authenticate(ctx, "alice", "")
+	require.Equal(t, ErrBadCredentials, err)
+	_, err = app.Authenticate(ctx, "bob", "directory")
+	require.Equal(t, ErrBadCredentials, err)
+
+	// 目录账号不能接管同名的本地账号，本地账号仍使用本地密码
+	_, err = app.Authenticate(ctx, "admin", "directory")
+	require.Equal(t, ErrBadCredentials, err)
+	user, err = app.Authenticate(ctx, "admin", "local")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, user.Id)
+
+	// 目录服务不可用时本地账号仍可登录
+	server.listener.Close()
+	_, err = app.Authenticate(ctx, "alice", "directory")
+	require.Equal(t, ErrBadCredentials, err)
+	_, err = app.Authenticate(ctx, "admin", "local")
+	require.NoError(t, err)
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	loginFailAccountKeyPrefix = storeKeyPrefix + "login-fail:account:"
+	loginFailIPKeyPrefix      = storeKeyPrefix + "login-fail:ip:"
+	loginLockKeyPrefix        = storeKeyPrefix + "login-lock:"
+)
+
+var (
+	ErrAccountLocked   = errors.New("登录失败次数过多，账号已被临时锁定，请稍后再试")
+	ErrTooManyAttempts = errors.New("登录失败次数过多，请稍后再试")
+)
+
+// LockoutConfig 登录失败限制，计数保存在 Store 中，配置了 Redis 时多实例共享
+type LockoutConfig struct {
+	MaxFailures   int `json:"maxFailures,omitempty"`   // 同一账号在 Window 内失败该次数后锁定，默认 5
+	LockDuration  int `json:"lockDuration,omitempty"`  // 账号锁定时长（秒），默认 900
+	IPMaxFailures int `json:"ipMaxFailures,omitempty"` // 同一 IP 在 Window 内失败该次数后拒绝其登录，不区分账号，默认 20
+	Window        int `json:"window,omitempty"`        // 失败计数的时间窗口（秒），默认 900
+}
+
+func (config LockoutConfig) withDefaults() LockoutConfig {
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 5
+	}
+	if config.LockDuration <= 0 {
+		config.LockDuration = 15 * 60
+	}
+	if config.IPMaxFailures <= 0 {
+		config.IPMaxFailures = 20
+	}
+	if config.Window <= 0 {
+		config.Window = 15 * 60
+	}
+	return config
+}
+
+// lockoutAccount 登录名不区分大小写，避免变换大小写绕过计数
+func lockoutAccount(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// CheckLoginAllowed 登录前检查账号是否被锁定，以及 IP 的失败次数是否超过限制
+func (app App) CheckLoginAllowed(name, ip string) error {
+	config := app.config.Lockout.withDefaults()
+	if _, err := app.store.Get(loginLockKeyPrefix + lockoutAccount(name)); err == nil {
+		logger.Warn("login rejected, account locked.", zap.String("name", name), zap.String("ip", ip))
+		return ErrAccountLocked
+	} else if err != ErrStoreNil {
+		return err
+	}
+
+	value, err := app.store.Get(loginFailIPKeyPrefix + ip)
+	if err == ErrStoreNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if failures, _ := strconv.Atoi(value); failures >= config.IPMaxFailures {
+		logger.Warn("login rejected, too many failures from ip.", zap.String("name", name), zap.String("ip", ip),
+			zap.Int("failures", failures))
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+// RecordLoginFailure 记录登录失败，账号失败次数达到上限时锁定账号。
+// 账号不存在时同样计数，避免通过锁定行为探测账号。
+func (app App) RecordLoginFailure(name, ip, reason string) error {
+	config := app.config.Lockout.withDefaults()
+	window := time.Duration(config.Window) * time.Second
+	account := lockoutAccount(name)
+
+	ipFailures, err := app.store.Incr(loginFailIPKeyPrefix+ip, window)
+	if err != nil {
+		return err
+	}
+	failures, err := app.store.Incr(loginFailAccountKeyPrefix+account, window)
+	if err != nil {
+		return err
+	}
+	logger.Warn("login failed.", zap.String("name", name), zap.String("ip", ip), zap.String("reason", reason),
+		zap.Int64("failures", failures), zap.Int64("ipFailures", ipFailures))
+
+	if failures >= int64(config.MaxFailures) {
+		lock := time.Duration(config.LockDuration) * time.Second
+		if err = app.store.Set(loginLockKeyPrefix+account, ip, lock); err != nil {
+			return err
+		}
+		if err = app.store.Del(loginFailAccountKeyPrefix + account); err != nil {
+			return err
+		}
+		logger.Warn("account locked.", zap.String("name", name), zap.String("ip", ip), zap.Duration("duration", lock))
+	}
+	return nil
+}
+
+// RecordLoginSuccess 登录成功后清除账号的失败计数，IP 的计数不清除，避免用自己的账号重置撞库计数
+func (app App) RecordLoginSuccess(name string) error {
+	return app.store.Del(loginFailAccountKeyPrefix + lockoutAccount(name))
+}
+
+// UnlockAccount 解除账号锁定并清除失败计数
+func (app App) UnlockAccount(name string) error {
+	account := lockoutAccount(name)
+	return app.store.Del(loginLockKeyPrefix+account, loginFailAccountKeyPrefix+account)
+}
+
+// AccountLocked 账号是否处于锁定状态
+func (app App) AccountLocked(name string) bool {
+	_, err := app.store.Get(loginLockKeyPrefix + lockoutAccount(name))
+	return err == nil
+}
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountLockout(t *testing.T) {
+	app := newTestApp()
+	app.config.Lockout = LockoutConfig{MaxFailures: 3, IPMaxFailures: 10}
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, app.CheckLoginAllowed("alice", "10.0.0.1"))
+		require.NoError(t, app.RecordLoginFailure("alice", "10.0.0.1", "bad password"))
+	}
+	// 登录成功后清除账号的失败计数
+	require.NoError(t, app.RecordLoginSuccess("alice"))
+	require.NoError(t, app.RecordLoginFailure("alice", "10.0.0.2", "bad password"))
+	require.NoError(t, app.RecordLoginFailure("Alice", "10.0.0.3", "bad password"))
+	require.NoError(t, app.CheckLoginAllowed("alice", "10.0.0.4"))
+	require.NoError(t, app.RecordLoginFailure("alice", "10.0.0.4", "bad password"))
+
+	// 锁定后换 IP 和大小写也不能登录
+	require.True(t, app.AccountLocked("alice"))
+	require.Equal(t, ErrAccountLocked, app.CheckLoginAllowed("ALICE", "10.0.0.5"))
+	require.NoError(t, app.CheckLoginAllowed("bob", "10.0.0.5"))
+
+	require.NoError(t, app.UnlockAccount("alice"))
+	require.False(t, app.AccountLocked("alice"))
+	require.NoError(t, app.CheckLoginAllowed("alice", "10.0.0.5"))
+}
+
+func TestIPLockout(t *testing.T) {
+	app := newTestApp()
+	app.config.Lockout = LockoutConfig{MaxFailures: 3, IPMaxFailures: 10}
+
+	// 同一 IP 尝试大量不同账号时按 IP 限制
+	for i := 0; i < 10; i++ {
+		name := "user" + strconv.Itoa(i)
+		require.NoError(t, app.CheckLoginAllowed(name, "10.0.0.1"))
+		require.NoError(t, app.RecordLoginFailure(name, "10.0.0.1", "bad password"))
+		require.False(t, app.AccountLocked(name))
+	}
+	require.Equal(t, ErrTooManyAttempts, app.CheckLoginAllowed("user99", "10.0.0.1"))
+	require.NoError(t, app.CheckLoginAllowed("user99", "10.0.0.2"))
+
+	// 登录成功不会清除 IP 的失败计数
+	require.NoError(t, app.RecordLoginSuccess("user0"))
+	require.Equal(t, ErrTooManyAttempts, app.CheckLoginAllowed("user0", "10.0.0.1"))
+}
@@ -0,0 +1,336 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+	"jhmeeting.com/adminserver/db"
+)
+
+// MailConfig SMTP 配置，Host 为空时不发送邮件
+type MailConfig struct {
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"`     // 默认 25，SSL 时为 465
+	Username string `json:"username,omitempty"` // 为空时不登录
+	Password string `json:"password,omitempty"`
+	From     string `json:"from,omitempty"` // 发件人，如 "会议系统 <noreply@example.com>"
+	SSL      bool   `json:"ssl,omitempty"`  // 是否使用 SSL 连接，否则在服务器支持时使用 STARTTLS
+}
+
+const (
+	mailMaxAttempts  = 6
+	mailPollInterval = 3 * time.Second
+	mailBatchSize    = 50
+	mailTimeout      = 30 * time.Second
+	// mailLease 领取邮件后推迟 next_time，连接和发送各最多 mailTimeout，期间其他实例不会再次领取
+	mailLease = 2 * mailTimeout
+)
+
+// MailAttachment 邮件附件
+type MailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// MailEnabled 是否配置了 SMTP
+func (app App) MailEnabled() bool {
+	return len(app.config.Mail.Host) > 0
+}
+
+// mailFrom 发件人地址
+func (app App) mailFrom() (*mail.Address, error) {
+	return mail.ParseAddress(app.config.Mail.From)
+}
+
+// EnqueueMail 按模板生成邮件并放入发件箱，由 RunMailer 发送。
+// runner 可以是业务的事务，事务回滚时不会发送；未配置 SMTP 时忽略。
+func (app App) EnqueueMail(ctx context.Context, runner dbr.SessionRunner, recipients []string, name string, data interface{}, attachments ...MailAttachment) error {
+	if !app.MailEnabled() || len(recipients) == 0 {
+		return nil
+	}
+	tpl, ok := mailTemplates[name]
+	if !ok {
+		return errors.New("mail template not found: " + name)
+	}
+	from, err := app.mailFrom()
+	if err != nil {
+		return err
+	}
+
+	subject, text, html := &strings.Builder{}, &bytes.Buffer{}, &bytes.Buffer{}
+	if err = tpl.subject.Execute(subject, data); err != nil {
+		return err
+	}
+	if err = tpl.text.Execute(text, data); err != nil {
+		return err
+	}
+	if err = tpl.html.Execute(html, data); err != nil {
+		return err
+	}
+	message, err := buildMail(from, recipients, subject.String(), text.Bytes(), html.Bytes(), attachments)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	outbox := MailOutbox{
+		Recipients: recipients,
+		Template:   name,
+		Subject:    truncate(subject.String(), 512),
+		Message:    string(message),
+		Status:     DeliveryPending,
+		NextTime:   db.NewNullTime(now),
+		Ctime:      now,
+	}
+	_, err = runner.InsertInto(MailOutboxTableName).
+		Columns(MailRecipientsCol, MailTemplateCol, MailSubjectCol, MailMessageCol, MailStatusCol,
+			MailNextTimeCol, CommonCtimeCol).
+		Record(&outbox).ExecContext(ctx)
+	return err
+}
+
+// buildMail 生成 MIME 邮件，正文包含纯文本和 HTML 两种格式
+func buildMail(from *mail.Address, recipients []string, subject string, text, html []byte, attachments []MailAttachment) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+	header := textproto.MIMEHeader{}
+	header.Set("From", from.String())
+	header.Set("To", strings.Join(recipients, ", "))
+	header.Set("Subject", mime.BEncoding.Encode("utf-8", subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", "<"+xid.New().String()+"@"+domain+">")
+	header.Set("MIME-Version", "1.0")
+
+	mixed := multipart.NewWriter(buf)
+	header.Set("Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	writeMailHeader(buf, header)
+
+	alternative := &bytes.Buffer{}
+	alternativeWriter := multipart.NewWriter(alternative)
+	if err := writeMailPart(alternativeWriter, "text/plain; charset=utf-8", "", text); err != nil {
+		return nil, err
+	}
+	if err := writeMailPart(alternativeWriter, "text/html; charset=utf-8", "", html); err != nil {
+		return nil, err
+	}
+	if err := alternativeWriter.Close(); err != nil {
+		return nil, err
+	}
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternativeWriter.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(alternative.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range attachments {
+		if err = writeMailPart(mixed, attachment.ContentType, attachment.Filename, attachment.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err = mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeMailHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"} {
+		buf.WriteString(key + ": " + header.Get(key) + "\r\n")
+	}
+	buf.WriteString("\r\n")
+}
+
+// writeMailPart 写入 base64 编码的内容，filename 不为空时为附件
+func writeMailPart(writer *multipart.Writer, contentType, filename string, data []byte) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	if len(filename) > 0 {
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err = part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = part.Write([]byte(encoded + "\r\n"))
+	return err
+}
+
+// RunMailer 定时发送发件箱中到期的邮件，直到 stop 关闭
+func (app App) RunMailer(stop <-chan struct{}) {
+	if !app.MailEnabled() {
+		return
+	}
+	ticker := time.NewTicker(mailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := app.DeliverMails(context.Background()); err != nil {
+				logger.Error("deliver mails failed.", zap.Error(err))
+			}
+		}
+	}
+}
+
+// DeliverMails 发送一批到期的邮件，返回发送的数量
+func (app App) DeliverMails(ctx context.Context) (int, error) {
+	mails := []MailOutbox{}
+	_, err := app.db.Select(SqlStar).From(MailOutboxTableName).
+		Where(WhereDeliveryDue, DeliveryPending, time.Now()).
+		OrderAsc(CommonIdCol).
+		Limit(mailBatchSize).
+		LoadContext(ctx, &mails)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, outbox := range mails {
+		// 多个实例同时发送时，只有更新成功的实例负责本次发送
+		result, err := app.db.Update(MailOutboxTableName).
+			Set(MailAttemptsCol, outbox.Attempts+1).
+			Set(MailNextTimeCol, time.Now().Add(mailLease)).
+			Where(WhereDeliveryClaim, outbox.Id, outbox.Attempts, DeliveryPending).
+			ExecContext(ctx)
+		if err != nil {
+			return count, err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			continue
+		}
+		outbox.Attempts++
+
+		err = app.sendMail(outbox.Recipients, []byte(outbox.Message))
+		if err = app.finishMail(ctx, &outbox, err); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// sendMail 通过 SMTP 发送邮件
+func (app App) sendMail(recipients []string, message []byte) error {
+	config := app.config.Mail
+	from, err := app.mailFrom()
+	if err != nil {
+		return err
+	}
+	port := config.Port
+	if port == 0 {
+		port = 25
+		if config.SSL {
+			port = 465
+		}
+	}
+
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: mailTimeout}
+	var conn net.Conn
+	if config.SSL {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: config.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !config.SSL {
+		if err = client.StartTLS(&tls.Config{ServerName: config.Host}); err != nil {
+			return err
+		}
+	}
+	if len(config.Username) > 0 {
+		if err = client.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err = client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("rcpt %s: %v", recipient, err)
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// finishMail 记录发送结果，失败时使用与 Webhook 相同的退避策略重试
+func (app App) finishMail(ctx context.Context, outbox *MailOutbox, sendErr error) error {
+	now := time.Now()
+	stmt := app.db.Update(MailOutboxTableName).Set(MailUtimeCol, now)
+
+	switch {
+	case sendErr == nil:
+		stmt.Set(MailStatusCol, DeliverySuccess).
+			Set(MailErrorCol, "").
+			Set(MailNextTimeCol, nil)
+
+	case outbox.Attempts >= mailMaxAttempts:
+		logger.Warn("send mail failed.", zap.Int64("id", outbox.Id), zap.String("template", outbox.Template),
+			zap.Int("attempts", outbox.Attempts), zap.Error(sendErr))
+		stmt.Set(MailStatusCol, DeliveryFailed).
+			Set(MailErrorCol, truncate(sendErr.Error(), 512)).
+			Set(MailNextTimeCol, nil)
+
+	default:
+		stmt.Set(MailErrorCol, truncate(sendErr.Error(), 512)).
+			Set(MailNextTimeCol, now.Add(webhookBackoff(outbox.Attempts)))
+	}
+
+	_, err := stmt.Where(WhereCommonId, outbox.Id).ExecContext(ctx)
+	return err
+}
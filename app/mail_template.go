@@ -0,0 +1,149 @@
+package app
+
+import (
+	htmltemplate "html/template"
+	"text/template"
+	"time"
+)
+
+// 邮件模板
+const (
+	MailTemplateInvitation     = "invitation"      // 会议邀请，会议修改和取消时也使用该模板
+	MailTemplateRecordingReady = "recording-ready" // 录像已生成
+	MailTemplatePasswordReset  = "password-reset"  // 重置密码验证码
+	MailTemplateVerifyEmail    = "verify-email"    // 邮箱验证码
+)
+
+// MeetingMailData 会议邀请邮件的内容
+type MeetingMailData struct {
+	Title       string
+	Description string
+	RoomName    string
+	URL         string
+	Start       time.Time
+	Duration    int
+	Timezone    string
+	Recurrence  string
+	Cancelled   bool
+	Updated     bool
+}
+
+// RecordingMailData 录像已生成邮件的内容
+type RecordingMailData struct {
+	RoomName string
+	URL      string
+	Duration int64
+	Size     int64
+	Ctime    time.Time
+}
+
+// CodeMailData 验证码邮件的内容
+type CodeMailData struct {
+	Code      string
+	ExpiresIn int // 验证码有效期（分钟）
+}
+
+// 邮件模板，主题和纯文本使用 text/template，HTML 使用 html/template
+type mailTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+var mailFuncs = template.FuncMap{
+	"datetime": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04 MST")
+	},
+}
+
+func newMailTemplate(name, subject, text, html string) *mailTemplate {
+	return &mailTemplate{
+		subject: template.Must(template.New(name).Funcs(mailFuncs).Parse(subject)),
+		text:    template.Must(template.New(name).Funcs(mailFuncs).Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name).Funcs(htmltemplate.FuncMap(mailFuncs)).Parse(html)),
+	}
+}
+
+const mailLayoutStart = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"></head>
+<body style="font-family: sans-serif; font-size: 14px; color: #333;">
+`
+
+const mailLayoutEnd = `
+<p style="color: #999; font-size: 12px;">此邮件由系统自动发送，请勿回复。</p>
+</body>
+</html>
+`
+
+var mailTemplates = map[string]*mailTemplate{
+	MailTemplateInvitation: newMailTemplate(MailTemplateInvitation,
+		`{{if .Cancelled}}会议已取消{{else if .Updated}}会议已更新{{else}}会议邀请{{end}}：{{.Title}}`,
+		`{{if .Cancelled}}以下会议已取消。{{else if .Updated}}以下会议已更新。{{else}}您被邀请参加以下会议。{{end}}
+
+会议主题：{{.Title}}
+开始时间：{{datetime .Start}}
+会议时长：{{.Duration}} 分钟
+{{- if .Recurrence}}
+重复规则：{{.Recurrence}}
+{{- end}}
+{{- if not .Cancelled}}
+入会地址：{{.URL}}
+{{- end}}
+{{- if .Description}}
+
+{{.Description}}
+{{- end}}
+
+附件中的日程可导入 Outlook、Google 日历等日历应用。
+`,
+		mailLayoutStart+`<p>{{if .Cancelled}}以下会议已取消。{{else if .Updated}}以下会议已更新。{{else}}您被邀请参加以下会议。{{end}}</p>
+<table>
+<tr><td>会议主题：</td><td>{{.Title}}</td></tr>
+<tr><td>开始时间：</td><td>{{datetime .Start}}</td></tr>
+<tr><td>会议时长：</td><td>{{.Duration}} 分钟</td></tr>
+{{- if .Recurrence}}
+<tr><td>重复规则：</td><td>{{.Recurrence}}</td></tr>
+{{- end}}
+{{- if not .Cancelled}}
+<tr><td>入会地址：</td><td><a href="{{.URL}}">{{.URL}}</a></td></tr>
+{{- end}}
+</table>
+{{- if .Description}}
+<p style="white-space: pre-wrap;">{{.Description}}</p>
+{{- end}}
+<p>附件中的日程可导入 Outlook、Google 日历等日历应用。</p>`+mailLayoutEnd),
+
+	MailTemplateRecordingReady: newMailTemplate(MailTemplateRecordingReady,
+		`会议录像已生成：{{.RoomName}}`,
+		`房间 {{.RoomName}} 在 {{datetime .Ctime}} 的会议录像已生成。
+
+录制时长：{{.Duration}} 秒
+下载地址：{{.URL}}
+`,
+		mailLayoutStart+`<p>房间 {{.RoomName}} 在 {{datetime .Ctime}} 的会议录像已生成。</p>
+<p>录制时长：{{.Duration}} 秒</p>
+<p><a href="{{.URL}}">下载录像</a></p>`+mailLayoutEnd),
+
+	MailTemplatePasswordReset: newMailTemplate(MailTemplatePasswordReset,
+		`重置密码验证码`,
+		`您好：
+
+您正在重置密码，验证码为 {{.Code}}，{{.ExpiresIn}} 分钟内有效。
+如果不是您本人操作，请忽略此邮件。
+`,
+		mailLayoutStart+`<p>您好：</p>
+<p>您正在重置密码，验证码为 <strong style="font-size: 18px;">{{.Code}}</strong>，{{.ExpiresIn}} 分钟内有效。</p>
+<p>如果不是您本人操作，请忽略此邮件。</p>`+mailLayoutEnd),
+
+	MailTemplateVerifyEmail: newMailTemplate(MailTemplateVerifyEmail,
+		`邮箱验证码`,
+		`您好：
+
+您正在验证邮箱，验证码为 {{.Code}}，{{.ExpiresIn}} 分钟内有效。
+如果不是您本人操作，请忽略此邮件。
+`,
+		mailLayoutStart+`<p>您好：</p>
+<p>您正在验证邮箱，验证码为 <strong style="font-size: 18px;">{{.Code}}</strong>，{{.ExpiresIn}} 分钟内有效。</p>
+<p>如果不是您本人操作，请忽略此邮件。</p>`+mailLayoutEnd),
+}
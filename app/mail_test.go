@@ -0,0 +1,159 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// smtpSink 只接收邮件的本地 SMTP 服务器
+type smtpSink struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	rcpts    [][]string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sink := &smtpSink{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink
+}
+
+func (sink *smtpSink) port() int {
+	return sink.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (sink *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 sink ready")
+
+	rcpts := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 sink")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			rcpts = append(rcpts, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			data := &strings.Builder{}
+			for {
+				line, err = reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			sink.mu.Lock()
+			sink.messages = append(sink.messages, data.String())
+			sink.rcpts = append(sink.rcpts, rcpts)
+			sink.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestMailDelivery(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	// 未配置 SMTP 时不放入发件箱
+	require.NoError(t, app.EnqueueMail(ctx, app.db, []string{"a@example.com"}, MailTemplatePasswordReset,
+		CodeMailData{Code: "123456", ExpiresIn: 10}))
+	count, err := app.db.Select("count(*)").From(MailOutboxTableName).ReturnInt64()
+	require.NoError(t, err)
+	require.EqualValues(t, 0, count)
+
+	sink := newSMTPSink(t)
+	app.config.Mail = MailConfig{
+		Host: "127.0.0.1",
+		Port: sink.port(),
+		From: "会议系统 <noreply@example.com>",
+	}
+	require.NoError(t, app.EnqueueMail(ctx, app.db, []string{"a@example.com", "b@example.com"}, MailTemplateInvitation,
+		MeetingMailData{Title: "周会 <1>", URL: "https://example.com/r1", Start: time.Now(), Duration: 30},
+		MailAttachment{Filename: "invite.ics", ContentType: "text/calendar; charset=utf-8; method=REQUEST", Data: []byte("BEGIN:VCALENDAR")}))
+
+	sent, err := app.DeliverMails(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, sent)
+	require.Len(t, sink.messages, 1)
+	require.Equal(t, []string{"a@example.com", "b@example.com"}, sink.rcpts[0])
+
+	msg, err := mail.ReadMessage(strings.NewReader(sink.messages[0]))
+	require.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "会议邀请：周会 <1>", subject)
+
+	// multipart/mixed 包含正文和 .ics 附件
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := reader.NextPart()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(part.Header.Get("Content-Type"), "multipart/alternative"))
+	part, err = reader.NextPart()
+	require.NoError(t, err)
+	require.Equal(t, "invite.ics", part.FileName())
+	data, _ := ioutil.ReadAll(part)
+	require.Contains(t, string(data), "QkVHSU46VkNBTEVOREFS")
+
+	outbox := MailOutbox{}
+	require.NoError(t, app.db.Select(SqlStar).From(MailOutboxTableName).LoadOne(&outbox))
+	require.Equal(t, DeliverySuccess, outbox.Status)
+	require.Equal(t, 1, outbox.Attempts)
+
+	// 连接失败时保留在发件箱中等待重试
+	sink.listener.Close()
+	require.NoError(t, app.EnqueueMail(ctx, app.db, []string{"a@example.com"}, MailTemplatePasswordReset,
+		CodeMailData{Code: "123456", ExpiresIn: 10}))
+	_, err = app.DeliverMails(ctx)
+	require.NoError(t, err)
+	outbox = MailOutbox{}
+	require.NoError(t, app.db.Select(SqlStar).From(MailOutboxTableName).
+		Where(WhereCommonId, 2).LoadOne(&outbox))
+	require.Equal(t, DeliveryPending, outbox.Status)
+	require.Equal(t, 1, outbox.Attempts)
+	require.NotEmpty(t, outbox.Error)
+	require.True(t, outbox.NextTime.Time.After(time.Now()))
+}
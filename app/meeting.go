@@ -0,0 +1,338 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"jhmeeting.com/adminserver/util"
+)
+
+const (
+	// 会议开始前多久进入房间视为参加该次会议
+	meetingEarlyJoin = 15 * time.Minute
+	// 一次查询最多展开的日程数
+	MeetingOccurrenceLimit = 500
+	// 预约会议最多的参会者数量
+	MeetingMaxAttendees = 100
+	// 同一用户每小时最多发送的会议邀请次数，每次创建、修改、取消都会发送
+	meetingInviteLimit  = 20
+	meetingInviteWindow = time.Hour
+)
+
+var (
+	ErrMeetingRecurrence = errors.New("重复规则无效")
+	ErrNoPublicURL       = errors.New("未配置 publicUrl")
+	ErrEmailNotVerified  = errors.New("请先验证邮箱")
+)
+
+// MeetingOccurrence 预约会议的一次日程
+type MeetingOccurrence struct {
+	MeetingId int64     `json:"meetingId"`
+	Title     string    `json:"title"`
+	RoomName  string    `json:"roomName"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+}
+
+// Location 会议的时区，无效时使用本地时区
+func (m Meeting) Location() *time.Location {
+	if loc, err := time.LoadLocation(m.Timezone); err == nil && len(m.Timezone) > 0 {
+		return loc
+	}
+	return time.Local
+}
+
+// Validate 校验会议时间和重复规则
+func (m Meeting) Validate() error {
+	if len(strings.TrimSpace(m.Title)) == 0 {
+		return errors.New("会议主题不能为空")
+	}
+	if m.Start.IsZero() {
+		return errors.New("开始时间不能为空")
+	}
+	if m.Duration <= 0 || m.Duration > 24*60 {
+		return errors.New("会议时长无效")
+	}
+	if _, err := time.LoadLocation(m.Timezone); err != nil || len(m.Timezone) == 0 {
+		return errors.New("时区无效")
+	}
+	if len(m.Recurrence) > 0 {
+		if _, err := util.ParseRRule(m.Recurrence); err != nil {
+			return ErrMeetingRecurrence
+		}
+	}
+	if len(m.Attendees) > MeetingMaxAttendees {
+		return errors.New("参会者不能超过 " + strconv.Itoa(MeetingMaxAttendees) + " 人")
+	}
+	for _, attendee := range m.Attendees {
+		if address, err := mail.ParseAddress(attendee); err != nil || address.Address != attendee {
+			return errors.New("参会者邮箱无效: " + attendee)
+		}
+	}
+	return nil
+}
+
+// Occurrences 展开 [after, before) 之间开始的日程，不包含 exdates 中已取消的日程
+func (m Meeting) Occurrences(after, before time.Time, exdates []time.Time, limit int) []time.Time {
+	start := m.Start.In(m.Location())
+	times := []time.Time{}
+	if len(m.Recurrence) == 0 {
+		if !start.Before(after) && start.Before(before) {
+			times = append(times, start)
+		}
+	} else if rule, err := util.ParseRRule(m.Recurrence); err == nil {
+		times = rule.Between(start, after, before, 0)
+	}
+
+	result := []time.Time{}
+	for _, t := range times {
+		if containsTime(exdates, t) {
+			continue
+		}
+		result = append(result, t)
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+// HasOccurrence 会议是否有在 t 开始的日程
+func (m Meeting) HasOccurrence(t time.Time, exdates []time.Time) bool {
+	times := m.Occurrences(t, t.Add(time.Second), exdates, 1)
+	return len(times) > 0
+}
+
+func containsTime(times []time.Time, t time.Time) bool {
+	for _, item := range times {
+		if item.Unix() == t.Unix() {
+			return true
+		}
+	}
+	return false
+}
+
+// MeetingExDates 会议中已取消的日程开始时间，按会议id分组
+func (app App) MeetingExDates(ctx context.Context, runner dbr.SessionRunner, meetingIDs []int64) (map[int64][]time.Time, error) {
+	result := map[int64][]time.Time{}
+	if len(meetingIDs) == 0 {
+		return result, nil
+	}
+	exceptions := []MeetingException{}
+	_, err := runner.Select(SqlStar).From(MeetingExceptionTableName).
+		Where(dbr.Eq(MeetingExceptionMeetingCol, meetingIDs)).LoadContext(ctx, &exceptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, exception := range exceptions {
+		result[exception.MeetingId] = append(result[exception.MeetingId], exception.Start)
+	}
+	return result, nil
+}
+
+// ExpandMeetings 展开多个会议在 [after, before) 之间的日程，按开始时间排序
+func (app App) ExpandMeetings(ctx context.Context, meetings []Meeting, after, before time.Time) ([]MeetingOccurrence, error) {
+	ids := []int64{}
+	for _, meeting := range meetings {
+		ids = append(ids, meeting.Id)
+	}
+	exdates, err := app.MeetingExDates(ctx, app.db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	occurrences := []MeetingOccurrence{}
+	for _, meeting := range meetings {
+		duration := time.Duration(meeting.Duration) * time.Minute
+		for _, t := range meeting.Occurrences(after, before, exdates[meeting.Id], MeetingOccurrenceLimit) {
+			occurrences = append(occurrences, MeetingOccurrence{
+				MeetingId: meeting.Id,
+				Title:     meeting.Title,
+				RoomName:  meeting.RoomName,
+				Start:     t,
+				End:       t.Add(duration),
+			})
+		}
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].Start.Before(occurrences[j].Start)
+	})
+	if len(occurrences) > MeetingOccurrenceLimit {
+		occurrences = occurrences[:MeetingOccurrenceLimit]
+	}
+	return occurrences, nil
+}
+
+// MatchMeetingOccurrence 房间在 t 时开始的会议对应的预约日程。
+// 日程开始前 15 分钟至结束前进入房间都视为参加该次日程，有多个时取开始时间最近的一个。
+func (app App) MatchMeetingOccurrence(ctx context.Context, runner dbr.SessionRunner, roomID int64, t time.Time) (*Meeting, time.Time, error) {
+	meetings := []Meeting{}
+	_, err := runner.Select(SqlStar).From(MeetingTableName).
+		Where(WhereMeetingRoom, roomID, false).LoadContext(ctx, &meetings)
+	if err != nil || len(meetings) == 0 {
+		return nil, time.Time{}, err
+	}
+	ids := []int64{}
+	for _, meeting := range meetings {
+		ids = append(ids, meeting.Id)
+	}
+	exdates, err := app.MeetingExDates(ctx, runner, ids)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var matched *Meeting
+	var matchedStart time.Time
+	for i, meeting := range meetings {
+		duration := time.Duration(meeting.Duration) * time.Minute
+		for _, start := range meeting.Occurrences(t.Add(-duration), t.Add(meetingEarlyJoin), exdates[meeting.Id], 0) {
+			if matched == nil || absDuration(start.Sub(t)) < absDuration(matchedStart.Sub(t)) {
+				matched, matchedStart = &meetings[i], start
+			}
+		}
+	}
+	return matched, matchedStart, nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// RoomURL 房间的入会地址
+func (app App) RoomURL(roomName string) string {
+	if len(app.config.API.URL) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(app.config.API.URL, "/") + "/" + url.PathEscape(roomName)
+}
+
+// MeetingICalEvent 会议对应的日历日程
+func (app App) MeetingICalEvent(meeting Meeting, exdates []time.Time) util.ICalEvent {
+	roomURL := app.RoomURL(meeting.RoomName)
+	description := meeting.Description
+	if len(roomURL) > 0 {
+		description = strings.TrimSpace(description + "\n\n" + roomURL)
+	}
+	return util.ICalEvent{
+		UID:         "meeting-" + strconv.FormatInt(meeting.Id, 10) + "@jhmeeting.com",
+		Sequence:    meeting.Sequence,
+		Summary:     meeting.Title,
+		Description: description,
+		Location:    roomURL,
+		URL:         roomURL,
+		Start:       meeting.Start.In(meeting.Location()),
+		Duration:    time.Duration(meeting.Duration) * time.Minute,
+		RRule:       meeting.Recurrence,
+		ExDates:     exdates,
+		Cancelled:   meeting.Cancelled,
+		Created:     meeting.Ctime,
+		Modified:    meeting.Utime,
+	}
+}
+
+// EnqueueMeetingInvitation 用户 uid 创建或修改会议后给参会者发送会议邀请邮件，附带 .ics 日程。
+// 会议取消时使用 CANCEL，否则使用 REQUEST，日历应用按 UID 和 SEQUENCE 更新已导入的日程。
+// 收件人和内容由用户填写，只有已验证邮箱的用户可以发送，并限制发送次数，避免被用来发送垃圾邮件。
+func (app App) EnqueueMeetingInvitation(ctx context.Context, runner dbr.SessionRunner, uid int64, meeting Meeting, exdates []time.Time) error {
+	if !app.MailEnabled() || len(meeting.Attendees) == 0 {
+		return nil
+	}
+	sender, err := app.loadUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if !sender.EmailVerified {
+		return ErrEmailNotVerified
+	}
+	if ok, err := app.allowRate("invite-user:"+strconv.FormatInt(uid, 10), meetingInviteLimit, meetingInviteWindow); err != nil || !ok {
+		return rateError(err)
+	}
+	from, err := app.mailFrom()
+	if err != nil {
+		return err
+	}
+
+	method := "REQUEST"
+	if meeting.Cancelled {
+		method = "CANCEL"
+	}
+	event := app.MeetingICalEvent(meeting, exdates)
+	event.Organizer = from.Address
+	event.Attendees = meeting.Attendees
+	ics := &bytes.Buffer{}
+	if err = util.WriteICalendar(ics, "", method, []util.ICalEvent{event}); err != nil {
+		return err
+	}
+
+	data := MeetingMailData{
+		Title:       meeting.Title,
+		Description: meeting.Description,
+		RoomName:    meeting.RoomName,
+		URL:         app.RoomURL(meeting.RoomName),
+		Start:       event.Start,
+		Duration:    meeting.Duration,
+		Timezone:    meeting.Timezone,
+		Recurrence:  meeting.Recurrence,
+		Cancelled:   meeting.Cancelled,
+		Updated:     meeting.Sequence > 0,
+	}
+	return app.EnqueueMail(ctx, runner, meeting.Attendees, MailTemplateInvitation, data, MailAttachment{
+		Filename:    "invite.ics",
+		ContentType: "text/calendar; charset=utf-8; method=" + method,
+		Data:        ics.Bytes(),
+	})
+}
+
+// CalendarToken 用户的日历订阅 token，不存在或 reset 为 true 时重新生成，旧的订阅地址随之失效
+func (app App) CalendarToken(ctx context.Context, userID int64, reset bool) (string, error) {
+	if !reset {
+		token, err := app.db.Select(UserCalendarTokenCol).From(UserTableName).
+			Where(WhereCommonId, userID).ReturnString()
+		if err != nil {
+			return "", err
+		}
+		if len(token) > 0 {
+			return token, nil
+		}
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = app.db.Update(UserTableName).Set(UserCalendarTokenCol, token).
+		Where(WhereCommonId, userID).ExecContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CalendarUser 日历订阅 token 对应的用户id，已禁用的用户视为不存在
+func (app App) CalendarUser(ctx context.Context, token string) (int64, error) {
+	if len(token) == 0 {
+		return 0, dbr.ErrNotFound
+	}
+	return app.db.Select(CommonIdCol).From(UserTableName).
+		Where(WhereUserCalendarToken, token).
+		Where(dbr.Eq(UserDisabledCol, false)).ReturnInt64()
+}
+
+// CalendarFeedURL 日历订阅地址，使用配置的 publicUrl，不依赖请求的 Host 头
+func (app App) CalendarFeedURL(token string) (string, error) {
+	if len(app.config.PublicURL) == 0 {
+		return "", ErrNoPublicURL
+	}
+	return strings.TrimSuffix(app.config.PublicURL, "/") + "/admin/calendar/" + token + ".ics", nil
+}
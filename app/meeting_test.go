@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchMeetingOccurrence(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	require.NoError(t, err)
+	// 2026-01-05 是周一，每周一、三 10:00 开会 1 小时
+	meeting := Meeting{
+		Uid:        1,
+		RoomId:     3,
+		RoomName:   "weekly",
+		Title:      "周会",
+		Start:      time.Date(2026, 1, 5, 10, 0, 0, 0, loc),
+		Duration:   60,
+		Timezone:   "Asia/Shanghai",
+		Recurrence: "FREQ=WEEKLY;BYDAY=MO,WE",
+		Ctime:      time.Now(),
+		Utime:      time.Now(),
+	}
+	require.NoError(t, meeting.Validate())
+	_, err = app.db.InsertInto(MeetingTableName).
+		Columns(CommonUidCol, MeetingRoomIdCol, MeetingRoomNameCol, MeetingTitleCol, MeetingDescriptionCol, MeetingStartCol,
+			MeetingDurationCol, MeetingTimezoneCol, MeetingRecurrenceCol, CommonCtimeCol, MeetingUtimeCol).
+		Record(&meeting).Exec()
+	require.NoError(t, err)
+
+	// 提前 10 分钟进入房间
+	matched, start, err := app.MatchMeetingOccurrence(ctx, app.db, 3, time.Date(2026, 1, 7, 9, 50, 0, 0, loc))
+	require.NoError(t, err)
+	require.NotNil(t, matched)
+	require.Equal(t, meeting.Id, matched.Id)
+	require.True(t, start.Equal(time.Date(2026, 1, 7, 10, 0, 0, 0, loc)))
+
+	// 不在日程时间内或其他房间
+	matched, _, err = app.MatchMeetingOccurrence(ctx, app.db, 3, time.Date(2026, 1, 7, 11, 30, 0, 0, loc))
+	require.NoError(t, err)
+	require.Nil(t, matched)
+	matched, _, err = app.MatchMeetingOccurrence(ctx, app.db, 4, time.Date(2026, 1, 7, 10, 0, 0, 0, loc))
+	require.NoError(t, err)
+	require.Nil(t, matched)
+
+	// 已取消的日程不再匹配
+	_, err = app.db.InsertInto(MeetingExceptionTableName).
+		Columns(MeetingExceptionMeetingCol, MeetingExceptionStartCol, CommonCtimeCol).
+		Values(meeting.Id, time.Date(2026, 1, 12, 10, 0, 0, 0, loc), time.Now()).Exec()
+	require.NoError(t, err)
+	matched, _, err = app.MatchMeetingOccurrence(ctx, app.db, 3, time.Date(2026, 1, 12, 10, 5, 0, 0, loc))
+	require.NoError(t, err)
+	require.Nil(t, matched)
+
+	occurrences, err := app.ExpandMeetings(ctx, []Meeting{meeting},
+		time.Date(2026, 1, 6, 0, 0, 0, 0, loc), time.Date(2026, 1, 20, 0, 0, 0, 0, loc))
+	require.NoError(t, err)
+	require.Len(t, occurrences, 3)
+	require.True(t, occurrences[1].Start.Equal(time.Date(2026, 1, 14, 10, 0, 0, 0, loc)))
+	require.True(t, occurrences[1].End.Equal(time.Date(2026, 1, 14, 11, 0, 0, 0, loc)))
+}
+
+func TestCalendarFeed(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, CommonCtimeCol).
+		Values("alice", "", time.Now()).Exec()
+	require.NoError(t, err)
+
+	token, err := app.CalendarToken(ctx, 1, false)
+	require.NoError(t, err)
+	_, err = app.CalendarFeedURL(token)
+	require.Equal(t, ErrNoPublicURL, err)
+	app.config.PublicURL = "https://meet.example.com/"
+	feedURL, err := app.CalendarFeedURL(token)
+	require.NoError(t, err)
+	require.Equal(t, "https://meet.example.com/admin/calendar/"+token+".ics", feedURL)
+
+	uid, err := app.CalendarUser(ctx, token)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, uid)
+
+	// 用户被禁用后订阅地址失效
+	_, err = app.db.Update(UserTableName).Set(UserDisabledCol, true).Where(WhereCommonId, 1).Exec()
+	require.NoError(t, err)
+	_, err = app.CalendarUser(ctx, token)
+	require.Error(t, err)
+}
+
+func TestMeetingInvitation(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+	app.config.Mail = MailConfig{Host: "127.0.0.1", Port: 25, From: "noreply@example.com"}
+
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, UserEmailCol, CommonCtimeCol).
+		Values("alice", "", "alice@example.com", time.Now()).Exec()
+	require.NoError(t, err)
+	meeting := Meeting{
+		Id:        1,
+		Title:     "周会",
+		Start:     time.Now().Add(time.Hour),
+		Duration:  30,
+		Timezone:  "Asia/Shanghai",
+		Attendees: []string{"bob@example.com"},
+	}
+	require.NoError(t, meeting.Validate())
+	for i := len(meeting.Attendees); i <= MeetingMaxAttendees; i++ {
+		meeting.Attendees = append(meeting.Attendees, "user"+strconv.Itoa(i)+"@example.com")
+	}
+	require.Error(t, meeting.Validate())
+	meeting.Attendees = meeting.Attendees[:1]
+
+	// 未验证邮箱的用户不能发送邀请
+	require.Equal(t, ErrEmailNotVerified, app.EnqueueMeetingInvitation(ctx, app.db, 1, meeting, nil))
+	_, err = app.db.Update(UserTableName).Set(UserEmailVerifiedCol, true).Where(WhereCommonId, 1).Exec()
+	require.NoError(t, err)
+
+	// 限制每个用户的发送次数
+	for i := 0; i < meetingInviteLimit; i++ {
+		require.NoError(t, app.EnqueueMeetingInvitation(ctx, app.db, 1, meeting, nil))
+	}
+	require.Equal(t, ErrRateLimited, app.EnqueueMeetingInvitation(ctx, app.db, 1, meeting, nil))
+	count, err := app.db.Select("count(*)").From(MailOutboxTableName).ReturnInt64()
+	require.NoError(t, err)
+	require.EqualValues(t, meetingInviteLimit, count)
+}
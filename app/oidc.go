@@ -0,0 +1,542 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+)
+
+// OIDCStateCookieName 保存 state 哈希的 cookie，回调时校验，确保回调来自发起登录的浏览器
+const OIDCStateCookieName = CookieName + "_oidc"
+
+const (
+	// 发起单点登录后需要在该时间内完成登录
+	OIDCStateTTL     = 10 * time.Minute
+	oidcCacheTTL     = time.Hour
+	oidcRefreshDelay = time.Minute // JWKS 中找不到 kid 时，两次重新获取的最小间隔
+
+	oidcStateKeyPrefix  = storeKeyPrefix + "oidc-state:"
+	oidcDiscoveryKey    = storeKeyPrefix + "oidc-discovery"
+	oidcJWKSKey         = storeKeyPrefix + "oidc-jwks"
+	oidcJWKSRefreshKey  = storeKeyPrefix + "oidc-jwks-refresh"
+	oidcMaxResponseSize = 1 << 20
+)
+
+var (
+	ErrOIDCDisabled  = errors.New("未配置单点登录")
+	ErrOIDCState     = errors.New("单点登录已过期，请重新登录")
+	ErrOIDCNoAccount = errors.New("没有与该账号关联的用户")
+	ErrOIDCBadToken  = errors.New("单点登录返回的身份信息无效")
+)
+
+// OIDCConfig OpenID Connect 单点登录，Issuer 为空时不启用
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer,omitempty"` // 身份提供方地址，从 {Issuer}/.well-known/openid-configuration 获取配置
+	ClientID     string   `json:"clientID,omitempty"`
+	ClientSecret string   `json:"clientSecret,omitempty"` // 公开客户端为空，只使用 PKCE
+	RedirectURL  string   `json:"redirectURL,omitempty"`  // 回调地址，如 https://example.com/admin/passport/oidc/callback
+	Scopes       []string `json:"scopes,omitempty"`       // 默认 openid email profile
+	AutoCreate   bool     `json:"autoCreate,omitempty"`   // 没有可关联的用户时是否自动创建
+}
+
+// OIDCEnabled 是否配置了单点登录
+func (app App) OIDCEnabled() bool {
+	return len(app.config.OIDC.Issuer) > 0
+}
+
+// oidcDiscovery 身份提供方的配置，只使用需要的字段
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcState struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+}
+
+// oidcClaims ID Token 中使用的声明
+type oidcClaims struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	PhoneNumber       string
+}
+
+// oidcGetJSON 获取 JSON，结果缓存在 Store 中，多个实例共享
+func (app App) oidcGetJSON(ctx context.Context, rawurl, cacheKey string, refresh bool, v interface{}) error {
+	if !refresh {
+		if data, err := app.store.Get(cacheKey); err == nil {
+			return json.Unmarshal([]byte(data), v)
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := app.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, oidcMaxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: unexpected status code %d", rawurl, resp.StatusCode)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	return app.store.Set(cacheKey, string(data), oidcCacheTTL)
+}
+
+func (app App) oidcDiscover(ctx context.Context) (*oidcDiscovery, error) {
+	issuer := strings.TrimSuffix(app.config.OIDC.Issuer, "/")
+	discovery := &oidcDiscovery{}
+	err := app.oidcGetJSON(ctx, issuer+"/.well-known/openid-configuration", oidcDiscoveryKey, false, discovery)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch: %s", discovery.Issuer)
+	}
+	return discovery, nil
+}
+
+// OIDCAuthURL 生成跳转到身份提供方的登录地址，redirect 为登录完成后返回的前端页面。
+// binding 为 state 的哈希，需要写入发起登录的浏览器的 OIDCStateCookieName cookie。
+func (app App) OIDCAuthURL(ctx context.Context, redirect string) (authURL, binding string, err error) {
+	if !app.OIDCEnabled() {
+		return "", "", ErrOIDCDisabled
+	}
+	discovery, err := app.oidcDiscover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	record := oidcState{Redirect: safeRedirect(redirect)}
+	if record.Verifier, err = randomToken(); err != nil {
+		return "", "", err
+	}
+	if record.Nonce, err = randomToken(); err != nil {
+		return "", "", err
+	}
+	data, _ := json.Marshal(record)
+	if err = app.store.Set(oidcStateKeyPrefix+state, string(data), OIDCStateTTL); err != nil {
+		return "", "", err
+	}
+
+	config := app.config.OIDC
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	challenge := sha256.Sum256([]byte(record.Verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", config.ClientID)
+	query.Set("redirect_uri", config.RedirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", record.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return discovery.AuthorizationEndpoint + sep + query.Encode(), hashToken(state), nil
+}
+
+// safeRedirect 只允许跳转到本站的相对路径
+func safeRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+// OIDCCallback 使用授权码换取 ID Token，校验后返回对应的用户和登录完成后返回的前端页面。
+// binding 为浏览器 OIDCStateCookieName cookie 的值，与 state 不匹配时拒绝，
+// 避免攻击者把自己的回调地址发给他人，使其登录到攻击者的账号。
+func (app App) OIDCCallback(ctx context.Context, code, state, binding string) (*User, string, error) {
+	if !app.OIDCEnabled() {
+		return nil, "", ErrOIDCDisabled
+	}
+	if len(binding) == 0 || subtle.ConstantTimeCompare([]byte(hashToken(state)), []byte(binding)) != 1 {
+		logger.Warn("oidc state not bound to browser.")
+		return nil, "", ErrOIDCState
+	}
+	// state 只能使用一次
+	data, err := app.store.Get(oidcStateKeyPrefix + state)
+	if err == ErrStoreNil || len(state) == 0 {
+		return nil, "", ErrOIDCState
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err = app.store.Del(oidcStateKeyPrefix + state); err != nil {
+		return nil, "", err
+	}
+	record := oidcState{}
+	if err = json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, "", err
+	}
+
+	discovery, err := app.oidcDiscover(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	rawIDToken, err := app.oidcExchange(ctx, discovery, code, record.Verifier)
+	if err != nil {
+		return nil, "", err
+	}
+	claims, err := app.oidcVerify(ctx, discovery, rawIDToken, record.Nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	user, err := app.oidcUser(ctx, claims)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, record.Redirect, nil
+}
+
+// oidcExchange 使用授权码和 PKCE verifier 换取 ID Token
+func (app App) oidcExchange(ctx context.Context, discovery *oidcDiscovery, code, verifier string) (string, error) {
+	config := app.config.OIDC
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.RedirectURL)
+	form.Set("client_id", config.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(config.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+	resp, err := app.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, oidcMaxResponseSize))
+	if err != nil {
+		return "", err
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("oidc: token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || len(result.IDToken) == 0 {
+		logger.Warn("oidc token exchange failed.", zap.Int("status", resp.StatusCode),
+			zap.String("error", result.Error), zap.String("description", result.ErrorDescription))
+		return "", ErrOIDCBadToken
+	}
+	return result.IDToken, nil
+}
+
+// oidcVerify 使用 JWKS 校验 ID Token 的签名、issuer、audience、有效期和 nonce
+func (app App) oidcVerify(ctx context.Context, discovery *oidcDiscovery, rawIDToken, nonce string) (*oidcClaims, error) {
+	token, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return app.oidcKey(ctx, discovery, kid)
+	})
+	if err != nil {
+		logger.Warn("oidc id token invalid.", zap.Error(err))
+		return nil, ErrOIDCBadToken
+	}
+
+	mapClaims := token.Claims.(jwt.MapClaims)
+	claims := &oidcClaims{}
+	claims.Issuer, _ = mapClaims["iss"].(string)
+	claims.Subject, _ = mapClaims["sub"].(string)
+	claims.Email, _ = mapClaims["email"].(string)
+	claims.EmailVerified, _ = mapClaims["email_verified"].(bool)
+	claims.Name, _ = mapClaims["name"].(string)
+	claims.PreferredUsername, _ = mapClaims["preferred_username"].(string)
+	claims.PhoneNumber, _ = mapClaims["phone_number"].(string)
+	tokenNonce, _ := mapClaims["nonce"].(string)
+
+	clientID := app.config.OIDC.ClientID
+	audiences := []string{}
+	switch aud := mapClaims["aud"].(type) {
+	case string:
+		audiences = append(audiences, aud)
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	azp, _ := mapClaims["azp"].(string)
+
+	switch {
+	case claims.Issuer != discovery.Issuer:
+		err = fmt.Errorf("issuer mismatch: %s", claims.Issuer)
+	case !containsString(audiences, clientID):
+		err = fmt.Errorf("audience mismatch: %v", audiences)
+	case len(audiences) > 1 && azp != clientID:
+		err = fmt.Errorf("authorized party mismatch: %s", azp)
+	case tokenNonce != nonce:
+		err = errors.New("nonce mismatch")
+	case len(claims.Subject) == 0:
+		err = errors.New("missing subject")
+	case mapClaims["exp"] == nil:
+		err = errors.New("missing exp")
+	}
+	if err != nil {
+		logger.Warn("oidc id token invalid.", zap.Error(err))
+		return nil, ErrOIDCBadToken
+	}
+	return claims, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcKey 从 JWKS 中查找签名公钥，找不到时重新获取一次，应对身份提供方轮换密钥
+func (app App) oidcKey(ctx context.Context, discovery *oidcDiscovery, kid string) (interface{}, error) {
+	var jwks struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := app.oidcGetJSON(ctx, discovery.JWKSURI, oidcJWKSKey, false, &jwks); err != nil {
+		return nil, err
+	}
+	key := findJWK(jwks.Keys, kid)
+	if key == nil {
+		if ok, _ := app.store.SetNX(oidcJWKSRefreshKey, "1", oidcRefreshDelay); ok {
+			if err := app.oidcGetJSON(ctx, discovery.JWKSURI, oidcJWKSKey, true, &jwks); err != nil {
+				return nil, err
+			}
+			key = findJWK(jwks.Keys, kid)
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("key not found: %s", kid)
+	}
+	return key.publicKey()
+}
+
+func findJWK(keys []oidcJWK, kid string) *oidcJWK {
+	for i, key := range keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.Kid == kid || (len(kid) == 0 && len(keys) == 1) {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+func (key oidcJWK) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+
+	switch key.Kty {
+	case "RSA":
+		n, err := decode(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", key.Crv)
+		}
+		x, err := decode(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", key.Kty)
+}
+
+// oidcUser 查找外部身份对应的用户。首次登录时按已验证的邮箱关联已有用户，
+// 配置了 AutoCreate 时没有可关联的用户则自动创建。
+func (app App) oidcUser(ctx context.Context, claims *oidcClaims) (*User, error) {
+	user := &User{}
+	err := app.db.Select("u.*").From(dbr.I(UserTableName).As("u")).
+		Join(dbr.I(UserIdentityTableName).As("i"), "i.uid=u.id").
+		Where("i.issuer=? and i.subject=?", claims.Issuer, claims.Subject).
+		LoadOneContext(ctx, user)
+	if err == nil {
+		return user, nil
+	}
+	if err != dbr.ErrNotFound {
+		return nil, err
+	}
+
+	// 只有身份提供方确认过的邮箱才能用于关联，且只关联本系统中已验证该邮箱的用户，
+	// 避免他人预先把邮箱填写到自己的账号上抢先关联
+	var users []User
+	if len(claims.Email) > 0 && claims.EmailVerified {
+		_, err = app.db.Select(SqlStar).From(UserTableName).
+			Where(WhereUserVerifiedEmail, claims.Email, true).LoadContext(ctx, &users)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case len(users) == 1:
+		user = &users[0]
+
+	case len(users) > 1:
+		logger.Warn("oidc email matches multiple users.", zap.String("email", claims.Email))
+		return nil, ErrOIDCNoAccount
+
+	case app.config.OIDC.AutoCreate:
+		if user, err = app.oidcCreateUser(ctx, claims); err != nil {
+			return nil, err
+		}
+
+	default:
+		logger.Info("oidc account not linked.", zap.String("subject", claims.Subject), zap.String("email", claims.Email))
+		return nil, ErrOIDCNoAccount
+	}
+
+	identity := UserIdentity{
+		Uid:     user.Id,
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Ctime:   time.Now(),
+	}
+	_, err = app.db.InsertInto(UserIdentityTableName).
+		Columns(CommonUidCol, UserIdentityIssuerCol, UserIdentitySubjectCol, UserIdentityEmailCol, CommonCtimeCol).
+		Record(&identity).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("oidc identity linked.", zap.Int64("uid", user.Id), zap.String("subject", claims.Subject))
+	return user, nil
+}
+
+// oidcCreateUser 创建单点登录用户，登录名优先使用 preferred_username，重名时加上标识后缀
+func (app App) oidcCreateUser(ctx context.Context, claims *oidcClaims) (*User, error) {
+	name := claims.PreferredUsername
+	if len(name) == 0 {
+		name = claims.Email
+	}
+	if len(name) == 0 {
+		name = claims.Subject
+	}
+	count, err := app.db.Select("count(*)").From(UserTableName).Where(WhereUserName, name).ReturnInt64()
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		name = truncate(name, 200) + "-" + hashToken(claims.Issuer + claims.Subject)[:8]
+	}
+
+	user := &User{
+		Name:          name,
+		DisplayName:   claims.Name,
+		Email:         claims.Email,
+		Phone:         claims.PhoneNumber,
+		EmailVerified: len(claims.Email) > 0 && claims.EmailVerified,
+		Role:          RoleUser,
+		Source:        UserSourceOIDC,
+		Ctime:         time.Now(),
+	}
+	_, err = app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, UserDisNameCol, UserEmailCol, UserPhoneCol,
+			UserEmailVerifiedCol, UserRoleCol, UserSourceCol, CommonCtimeCol).
+		Record(user).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("user provisioned.", zap.Int64("uid", user.Id), zap.String("name", user.Name),
+		zap.String("source", UserSourceOIDC))
+	return user, nil
+}
@@ -0,0 +1,236 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+// mockIdP 本地 OpenID Connect 身份提供方，授权页面由测试直接调用 authorize 代替
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idp := &mockIdP{key: key, kid: "k1", codes: map[string]mockGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": idp.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		grant, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(grant)})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// authorize 模拟用户在身份提供方登录，返回授权码
+func (idp *mockIdP) authorize(t *testing.T, authURL string, claims jwt.MapClaims) (code, state string) {
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	query := u.Query()
+	require.Equal(t, "S256", query.Get("code_challenge_method"))
+
+	code, _ = randomToken()
+	idp.mu.Lock()
+	idp.codes[code] = mockGrant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+	idp.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (idp *mockIdP) sign(grant mockGrant) string {
+	claims := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   "admin",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": grant.nonce,
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idp.mu.Lock()
+	token.Header["kid"] = idp.kid
+	signed, _ := token.SignedString(idp.key)
+	idp.mu.Unlock()
+	return signed
+}
+
+func (idp *mockIdP) login(t *testing.T, app *App, claims jwt.MapClaims) (*User, string, error) {
+	ctx := context.Background()
+	authURL, binding, err := app.OIDCAuthURL(ctx, "/rooms")
+	require.NoError(t, err)
+	code, state := idp.authorize(t, authURL, claims)
+	return app.OIDCCallback(ctx, code, state, binding)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	app := newTestApp()
+	app.httpClient = http.DefaultClient
+	ctx := context.Background()
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+
+	_, _, err := app.OIDCAuthURL(ctx, "/")
+	require.Equal(t, ErrOIDCDisabled, err)
+	app.config.OIDC = OIDCConfig{
+		Issuer:      idp.server.URL,
+		ClientID:    "admin",
+		RedirectURL: "http://localhost:8004/admin/passport/oidc/callback",
+	}
+
+	_, err = app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, UserEmailCol, CommonCtimeCol).
+		Values("alice", "", "alice@example.com", time.Now()).Exec()
+	require.NoError(t, err)
+
+	// 邮箱未经身份提供方确认时不关联，也不自动创建
+	_, _, err = idp.login(t, app, jwt.MapClaims{"sub": "s1", "email": "alice@example.com"})
+	require.Equal(t, ErrOIDCNoAccount, err)
+	// 本系统中未验证的邮箱可以由任何人填写，同样不关联
+	_, _, err = idp.login(t, app, jwt.MapClaims{"sub": "s1", "email": "alice@example.com", "email_verified": true})
+	require.Equal(t, ErrOIDCNoAccount, err)
+	_, err = app.db.Update(UserTableName).Set(UserEmailVerifiedCol, true).Where(WhereCommonId, 1).Exec()
+	require.NoError(t, err)
+	_, err = app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, UserEmailCol, CommonCtimeCol).
+		Values("mallory", "", "alice@example.com", time.Now()).Exec()
+	require.NoError(t, err)
+
+	// 按已确认的邮箱关联已有用户
+	user, redirect, err := idp.login(t, app, jwt.MapClaims{"sub": "s1", "email": "alice@example.com", "email_verified": true})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, user.Id)
+	require.True(t, user.EmailVerified)
+	require.Equal(t, "/rooms", redirect)
+
+	// 之后通过外部身份查找，不再依赖邮箱
+	user, _, err = idp.login(t, app, jwt.MapClaims{"sub": "s1", "email": "changed@example.com"})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, user.Id)
+
+	// 身份提供方轮换密钥后重新获取 JWKS
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idp.mu.Lock()
+	idp.key, idp.kid = key, "k2"
+	idp.mu.Unlock()
+	user, _, err = idp.login(t, app, jwt.MapClaims{"sub": "s1"})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, user.Id)
+
+	// 自动创建用户，登录名重复时加上后缀
+	app.config.OIDC.AutoCreate = true
+	user, _, err = idp.login(t, app, jwt.MapClaims{"sub": "s2", "preferred_username": "alice", "name": "Alice 2"})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, user.Id)
+	require.Equal(t, UserSourceOIDC, user.Source)
+	require.Contains(t, user.Name, "alice-")
+	require.Equal(t, "Alice 2", user.DisplayName)
+}
+
+func TestOIDCRejects(t *testing.T) {
+	app := newTestApp()
+	app.httpClient = http.DefaultClient
+	ctx := context.Background()
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+	app.config.OIDC = OIDCConfig{
+		Issuer:      idp.server.URL,
+		ClientID:    "admin",
+		RedirectURL: "http://localhost:8004/admin/passport/oidc/callback",
+		AutoCreate:  true,
+	}
+
+	// state 需要与发起登录的浏览器绑定，且只能使用一次
+	authURL, binding, err := app.OIDCAuthURL(ctx, "//evil.example.com")
+	require.NoError(t, err)
+	code, state := idp.authorize(t, authURL, jwt.MapClaims{"sub": "s1"})
+	_, _, err = app.OIDCCallback(ctx, code, state, "")
+	require.Equal(t, ErrOIDCState, err)
+	_, otherBinding, err := app.OIDCAuthURL(ctx, "/")
+	require.NoError(t, err)
+	_, _, err = app.OIDCCallback(ctx, code, state, otherBinding)
+	require.Equal(t, ErrOIDCState, err)
+	_, redirect, err := app.OIDCCallback(ctx, code, state, binding)
+	require.NoError(t, err)
+	require.Equal(t, "/", redirect)
+	_, _, err = app.OIDCCallback(ctx, code, state, binding)
+	require.Equal(t, ErrOIDCState, err)
+
+	// nonce 和 audience 不匹配
+	_, _, err = idp.login(t, app, jwt.MapClaims{"sub": "s1", "nonce": "other"})
+	require.Equal(t, ErrOIDCBadToken, err)
+	_, _, err = idp.login(t, app, jwt.MapClaims{"sub": "s1", "aud": "other"})
+	require.Equal(t, ErrOIDCBadToken, err)
+	_, _, err = idp.login(t, app, jwt.MapClaims{"sub": "s1", "exp": time.Now().Add(-time.Minute).Unix()})
+	require.Equal(t, ErrOIDCBadToken, err)
+
+	// 授权码被截获后没有 PKCE verifier 无法换取 token
+	authURL, _, err = app.OIDCAuthURL(ctx, "/")
+	require.NoError(t, err)
+	code, _ = idp.authorize(t, authURL, jwt.MapClaims{"sub": "s1"})
+	authURL, binding, err = app.OIDCAuthURL(ctx, "/")
+	require.NoError(t, err)
+	_, state = idp.authorize(t, authURL, jwt.MapClaims{"sub": "s1"})
+	_, _, err = app.OIDCCallback(ctx, code, state, binding)
+	require.Equal(t, ErrOIDCBadToken, err)
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"context"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// 组织内角色
+const (
+	OrgRoleAdmin  = "admin"  // 管理组织的成员、房间和录像
+	OrgRoleMember = "member" // 使用组织的房间，查看会议和录像
+)
+
+// ValidOrgRole 是否为已定义的组织内角色
+func ValidOrgRole(role string) bool {
+	return role == OrgRoleAdmin || role == OrgRoleMember
+}
+
+// UserOrgIds 用户所属的组织，adminOnly 为 true 时只返回用户担任管理员的组织
+func (app App) UserOrgIds(ctx context.Context, userID int64, adminOnly bool) (orgIds []int64, err error) {
+	stmt := app.db.Select(OrgMemberOrgIdCol).From(OrgMemberTableName).Where(dbr.Eq(CommonUidCol, userID))
+	if adminOnly {
+		stmt.Where(dbr.Eq(OrgMemberRoleCol, OrgRoleAdmin))
+	}
+	_, err = stmt.LoadContext(ctx, &orgIds)
+	return
+}
+
+// OrgRole 用户在组织内的角色，不是组织成员时返回空字符串
+func (app App) OrgRole(ctx context.Context, orgID, userID int64) string {
+	role, _ := app.db.Select(OrgMemberRoleCol).From(OrgMemberTableName).
+		Where(WhereOrgMember, orgID, userID).ReturnString()
+	return role
+}
+
+// OwnerScope 数据的访问范围：用户本人的个人数据，以及用户所在组织的数据。
+// manage 为 true 时表示修改或删除，只包含用户担任管理员的组织。
+// 组织的数据只按当前的成员和角色判断，创建者被移出组织或降为成员后不能再访问或管理。
+func (app App) OwnerScope(ctx context.Context, userID int64, manage bool) (dbr.Builder, error) {
+	orgIds, err := app.UserOrgIds(ctx, userID, manage)
+	if err != nil {
+		return nil, err
+	}
+	personal := dbr.And(dbr.Eq(CommonOrgIdCol, 0), dbr.Eq(CommonUidCol, userID))
+	if len(orgIds) == 0 {
+		return personal, nil
+	}
+	return dbr.Or(personal, dbr.Eq(CommonOrgIdCol, orgIds)), nil
+}
@@ -0,0 +1,289 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"jhmeeting.com/adminserver/util"
+)
+
+// 密码规则，校验失败时返回给前端，用于提示具体未满足的规则
+const (
+	PasswordRuleMinLength = "minLength" // 长度不足，Param 为最小长度
+	PasswordRuleUpper     = "upper"     // 缺少大写字母
+	PasswordRuleLower     = "lower"     // 缺少小写字母
+	PasswordRuleDigit     = "digit"     // 缺少数字
+	PasswordRuleSymbol    = "symbol"    // 缺少特殊字符
+	PasswordRuleHistory   = "history"   // 与最近使用过的密码相同，Param 为检查的次数
+	PasswordRuleBreached  = "breached"  // 在已泄露密码列表中
+)
+
+const defaultPasswordMinLength = 8
+
+// 内置的常见弱密码，BreachedList 文件中的密码会追加到其中
+var commonPasswords = []string{
+	"123456", "12345678", "123456789", "1234567890", "111111", "000000", "123123", "654321",
+	"password", "password1", "passw0rd", "qwerty", "qwerty123", "abc123", "abcd1234",
+	"a123456", "admin", "admin123", "root", "iloveyou", "welcome", "1q2w3e4r", "qwertyuiop",
+}
+
+var sha1LinePattern = regexp.MustCompile(`^[0-9A-Fa-f]{40}(:\d+)?$`)
+
+// PasswordPolicy 密码规则
+type PasswordPolicy struct {
+	MinLength     int    `json:"minLength,omitempty"`     // 最小长度，默认 8
+	RequireUpper  bool   `json:"requireUpper,omitempty"`  // 必须包含大写字母
+	RequireLower  bool   `json:"requireLower,omitempty"`  // 必须包含小写字母
+	RequireDigit  bool   `json:"requireDigit,omitempty"`  // 必须包含数字
+	RequireSymbol bool   `json:"requireSymbol,omitempty"` // 必须包含字母和数字以外的字符
+	History       int    `json:"history,omitempty"`       // 不能与最近 N 次使用过的密码（含当前密码）相同，0 表示不检查
+	BreachedList  string `json:"breachedList,omitempty"`  // 已泄露密码列表文件，每行一个明文密码或 SHA-1（兼容 Have I Been Pwned 的 HASH:次数 格式）
+
+	// 新密码使用的哈希算法，bcrypt 或 argon2id，默认 bcrypt。
+	// 修改算法或参数后，已有用户在下次登录时自动升级。
+	Algorithm  string              `json:"algorithm,omitempty"`
+	BcryptCost int                 `json:"bcryptCost,omitempty"` // bcrypt 的 cost，默认 10
+	Argon2     util.Argon2idHasher `json:"argon2,omitempty"`
+}
+
+// newPasswordHasher 按配置创建密码哈希算法
+func (policy PasswordPolicy) newPasswordHasher() (util.PasswordHasher, error) {
+	return util.NewPasswordHasher(policy.Algorithm, policy.BcryptCost, policy.Argon2)
+}
+
+// PasswordError 密码不满足 Rule 规则
+type PasswordError struct {
+	Rule  string `json:"rule"`
+	Param int    `json:"param,omitempty"`
+}
+
+func (err *PasswordError) Error() string {
+	switch err.Rule {
+	case PasswordRuleMinLength:
+		return fmt.Sprintf("密码长度不能少于 %d 位", err.Param)
+	case PasswordRuleUpper:
+		return "密码必须包含大写字母"
+	case PasswordRuleLower:
+		return "密码必须包含小写字母"
+	case PasswordRuleDigit:
+		return "密码必须包含数字"
+	case PasswordRuleSymbol:
+		return "密码必须包含特殊字符"
+	case PasswordRuleHistory:
+		return fmt.Sprintf("不能使用最近 %d 次使用过的密码", err.Param)
+	case PasswordRuleBreached:
+		return "该密码已在公开泄露的密码中出现，请更换"
+	}
+	return "密码不符合要求"
+}
+
+func passwordDigest(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// loadBreachedPasswords 读取已泄露密码列表，保存 SHA-1，不保留明文
+func loadBreachedPasswords(path string) (map[string]struct{}, error) {
+	breached := make(map[string]struct{}, len(commonPasswords))
+	for _, password := range commonPasswords {
+		breached[passwordDigest(password)] = struct{}{}
+	}
+	if len(path) == 0 {
+		return breached, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if sha1LinePattern.MatchString(line) {
+			breached[strings.ToUpper(line[:40])] = struct{}{}
+		} else {
+			breached[passwordDigest(line)] = struct{}{}
+		}
+	}
+	return breached, scanner.Err()
+}
+
+// CheckPassword 校验密码是否满足长度、字符类型和泄露列表规则，不检查历史密码
+func (app App) CheckPassword(password string) error {
+	policy := app.config.Password
+	minLength := policy.MinLength
+	if minLength <= 0 {
+		minLength = defaultPasswordMinLength
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		return &PasswordError{Rule: PasswordRuleMinLength, Param: minLength}
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	switch {
+	case policy.RequireUpper && !upper:
+		return &PasswordError{Rule: PasswordRuleUpper}
+	case policy.RequireLower && !lower:
+		return &PasswordError{Rule: PasswordRuleLower}
+	case policy.RequireDigit && !digit:
+		return &PasswordError{Rule: PasswordRuleDigit}
+	case policy.RequireSymbol && !symbol:
+		return &PasswordError{Rule: PasswordRuleSymbol}
+	}
+
+	breached := app.breachedPasswords
+	if breached == nil {
+		breached, _ = loadBreachedPasswords("")
+	}
+	if _, ok := breached[passwordDigest(password)]; ok {
+		return &PasswordError{Rule: PasswordRuleBreached}
+	}
+	if _, ok := breached[passwordDigest(strings.ToLower(password))]; ok {
+		return &PasswordError{Rule: PasswordRuleBreached}
+	}
+	return nil
+}
+
+// SetPassword 校验密码规则和历史密码后设置新密码，原密码记入历史。
+// runner 可以是业务的事务。
+func (app App) SetPassword(ctx context.Context, runner dbr.SessionRunner, uid int64, password string) error {
+	if err := app.CheckPassword(password); err != nil {
+		return err
+	}
+	user := User{}
+	err := runner.Select(SqlStar).From(UserTableName).Where(WhereCommonId, uid).LoadOneContext(ctx, &user)
+	if err != nil {
+		return err
+	}
+
+	if err = app.checkPasswordHistory(ctx, runner, user, password); err != nil {
+		return err
+	}
+
+	hash, err := app.PasswordHasher().Hash(password)
+	if err != nil {
+		return err
+	}
+	_, err = runner.Update(UserTableName).Set(UserPasswordCol, hash).
+		Where(WhereCommonId, uid).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if history := app.config.Password.History; history > 0 && len(user.Password) > 0 {
+		err = app.recordPasswordHistory(ctx, runner, uid, user.Password, history-1)
+	}
+	return err
+}
+
+// checkPasswordHistory 新密码不能与当前密码和最近使用过的密码相同
+func (app App) checkPasswordHistory(ctx context.Context, runner dbr.SessionRunner, user User, password string) error {
+	history := app.config.Password.History
+	if history <= 0 {
+		return nil
+	}
+	hashes := []string{user.Password}
+	_, err := runner.Select(PasswordHistoryHashCol).From(PasswordHistoryTableName).
+		Where(dbr.Eq(CommonUidCol, user.Id)).
+		OrderDesc(CommonIdCol).Limit(uint64(history-1)).
+		LoadContext(ctx, &hashes)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if len(hash) > 0 && util.CheckPasswordHash(password, hash) {
+			return &PasswordError{Rule: PasswordRuleHistory, Param: history}
+		}
+	}
+	return nil
+}
+
+// PasswordHasher 生成新密码哈希使用的算法
+func (app App) PasswordHasher() util.PasswordHasher {
+	if app.passwordHasher != nil {
+		return app.passwordHasher
+	}
+	hasher, err := app.config.Password.newPasswordHasher()
+	if err != nil {
+		return util.BcryptHasher{Cost: bcrypt.DefaultCost}
+	}
+	return hasher
+}
+
+// UpgradePasswordHash 登录成功后，密码哈希的算法或参数已过时则使用当前配置重新生成。
+// 只在哈希未被修改时更新，避免覆盖同时进行的密码修改。
+func (app App) UpgradePasswordHash(ctx context.Context, user *User, password string) error {
+	hasher := app.PasswordHasher()
+	if user.Source != UserSourceLocal || len(user.Password) == 0 || !hasher.NeedsRehash(user.Password) {
+		return nil
+	}
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	result, err := app.db.Update(UserTableName).Set(UserPasswordCol, hash).
+		Where(WhereUserPassword, user.Id, user.Password).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		user.Password = hash
+		logger.Info("password hash upgraded.", zap.Int64("uid", user.Id))
+	}
+	return nil
+}
+
+// recordPasswordHistory 记录历史密码哈希，每个用户只保留最近 keep 条
+func (app App) recordPasswordHistory(ctx context.Context, runner dbr.SessionRunner, uid int64, hash string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	record := PasswordHistory{Uid: uid, Hash: hash, Ctime: time.Now()}
+	_, err := runner.InsertInto(PasswordHistoryTableName).
+		Columns(CommonUidCol, PasswordHistoryHashCol, CommonCtimeCol).
+		Record(&record).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	_, err = runner.Select(CommonIdCol).From(PasswordHistoryTableName).
+		Where(dbr.Eq(CommonUidCol, uid)).
+		OrderDesc(CommonIdCol).Offset(uint64(keep)).Limit(1000).
+		LoadContext(ctx, &ids)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	_, err = runner.DeleteFrom(PasswordHistoryTableName).Where(dbr.Eq(CommonIdCol, ids)).ExecContext(ctx)
+	if err == nil {
+		logger.Debug("password history trimmed.", zap.Int64("uid", uid), zap.Int("count", len(ids)))
+	}
+	return err
+}
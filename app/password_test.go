@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/util"
+)
+
+func requireRule(t *testing.T, rule string, err error) {
+	passwordErr, ok := err.(*PasswordError)
+	require.True(t, ok, "expected PasswordError, got %v", err)
+	require.Equal(t, rule, passwordErr.Rule)
+}
+
+func TestCheckPassword(t *testing.T) {
+	app := newTestApp()
+
+	requireRule(t, PasswordRuleMinLength, app.CheckPassword(""))
+	requireRule(t, PasswordRuleMinLength, app.CheckPassword("short"))
+	requireRule(t, PasswordRuleBreached, app.CheckPassword("password1"))
+	requireRule(t, PasswordRuleBreached, app.CheckPassword("PassWord1"))
+	require.NoError(t, app.CheckPassword("correct horse"))
+
+	app.config.Password = PasswordPolicy{MinLength: 10, RequireUpper: true, RequireDigit: true, RequireSymbol: true}
+	err := app.CheckPassword("horse")
+	requireRule(t, PasswordRuleMinLength, err)
+	require.Equal(t, 10, err.(*PasswordError).Param)
+	requireRule(t, PasswordRuleUpper, app.CheckPassword("correct horse"))
+	requireRule(t, PasswordRuleDigit, app.CheckPassword("Correct horse"))
+	requireRule(t, PasswordRuleSymbol, app.CheckPassword("Correcthorse1"))
+	require.NoError(t, app.CheckPassword("Correct horse 1"))
+}
+
+func TestBreachedList(t *testing.T) {
+	file, err := ioutil.TempFile("", "breached")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	// 明文和 Have I Been Pwned 格式的 SHA-1 混合
+	_, err = file.WriteString("letmein-2020\r\n" + passwordDigest("correct horse") + ":42\n")
+	require.NoError(t, err)
+	file.Close()
+
+	app := newTestApp()
+	app.breachedPasswords, err = loadBreachedPasswords(file.Name())
+	require.NoError(t, err)
+	requireRule(t, PasswordRuleBreached, app.CheckPassword("letmein-2020"))
+	requireRule(t, PasswordRuleBreached, app.CheckPassword("correct horse"))
+	requireRule(t, PasswordRuleBreached, app.CheckPassword("12345678"))
+	require.NoError(t, app.CheckPassword("battery staple"))
+
+	_, err = loadBreachedPasswords(file.Name() + ".missing")
+	require.Error(t, err)
+}
+
+func TestPasswordHistory(t *testing.T) {
+	app := newTestApp()
+	app.config.Password.History = 3
+	ctx := context.Background()
+
+	hash, _ := util.HashPassword("first secret")
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, CommonCtimeCol).
+		Values("alice", hash, time.Now()).Exec()
+	require.NoError(t, err)
+
+	requireRule(t, PasswordRuleHistory, app.SetPassword(ctx, app.db, 1, "first secret"))
+	require.NoError(t, app.SetPassword(ctx, app.db, 1, "second secret"))
+	require.NoError(t, app.SetPassword(ctx, app.db, 1, "third secret"))
+	requireRule(t, PasswordRuleHistory, app.SetPassword(ctx, app.db, 1, "first secret"))
+	requireRule(t, PasswordRuleHistory, app.SetPassword(ctx, app.db, 1, "third secret"))
+	require.NoError(t, app.SetPassword(ctx, app.db, 1, "fourth secret"))
+
+	// 只保留最近 History-1 条历史，更早的密码可以再次使用
+	count, err := app.db.Select("count(*)").From(PasswordHistoryTableName).ReturnInt64()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+	require.NoError(t, app.SetPassword(ctx, app.db, 1, "first secret"))
+
+	user := User{}
+	require.NoError(t, app.db.Select(SqlStar).From(UserTableName).Where(WhereCommonId, 1).LoadOne(&user))
+	require.True(t, util.CheckPasswordHash("first secret", user.Password))
+}
+
+func TestUpgradePasswordHash(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	hash, _ := util.HashPassword("correct horse")
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, CommonCtimeCol).
+		Values("alice", hash, time.Now()).Exec()
+	require.NoError(t, err)
+
+	// 配置未变化时不重新生成
+	user, err := app.Authenticate(ctx, "alice", "correct horse")
+	require.NoError(t, err)
+	require.NoError(t, app.UpgradePasswordHash(ctx, user, "correct horse"))
+	require.Equal(t, hash, user.Password)
+
+	app.config.Password.Algorithm = util.PasswordAlgArgon2id
+	app.config.Password.Argon2 = util.Argon2idHasher{Time: 1, Memory: 1024, Threads: 1}
+	require.NoError(t, app.UpgradePasswordHash(ctx, user, "correct horse"))
+	require.True(t, strings.HasPrefix(user.Password, "$argon2id$"))
+
+	// 升级后旧密码仍可登录，哈希已保存
+	user, err = app.Authenticate(ctx, "alice", "correct horse")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(user.Password, "$argon2id$"))
+	require.False(t, app.PasswordHasher().NeedsRehash(user.Password))
+
+	// 哈希已被其他请求修改时不覆盖
+	stale := *user
+	stale.Password = hash
+	app.config.Password.Argon2.Time = 2
+	require.NoError(t, app.UpgradePasswordHash(ctx, &stale, "correct horse"))
+	require.Equal(t, hash, stale.Password)
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies 解析可信反向代理的 IP 或网段
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: proxy}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// TrustedProxy ip 是否为配置的可信反向代理
+func (app App) TrustedProxy(ip string) bool {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range app.trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardedClientIP 请求的客户端 IP。只有直接来自可信代理的请求才使用 X-Forwarded-For 和 X-Real-Ip，
+// X-Forwarded-For 从右向左跳过可信代理，最左侧的值由客户端填写，不可信。
+func (app App) ForwardedClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		remote = strings.TrimSpace(r.RemoteAddr)
+	}
+	if !app.TrustedProxy(remote) {
+		return remote
+	}
+
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); net.ParseIP(ip) != nil {
+			return ip
+		}
+		return remote
+	}
+	items := strings.Split(forwarded, ",")
+	for i := len(items) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(items[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		if !app.TrustedProxy(ip) {
+			return ip
+		}
+		remote = ip
+	}
+	return remote
+}
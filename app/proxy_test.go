@@ -0,0 +1,40 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	app := newTestApp()
+	_, err := parseTrustedProxies([]string{"proxy"})
+	require.Error(t, err)
+	app.trustedProxies, err = parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "::1"})
+	require.NoError(t, err)
+
+	request := func(remote, forwarded, realIP string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		if len(forwarded) > 0 {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		if len(realIP) > 0 {
+			r.Header.Set("X-Real-Ip", realIP)
+		}
+		return r
+	}
+
+	// 不是可信代理时忽略客户端填写的头
+	require.Equal(t, "1.2.3.4", app.ForwardedClientIP(request("1.2.3.4:5000", "5.6.7.8", "5.6.7.8")))
+	require.Equal(t, "1.2.3.4", app.ForwardedClientIP(request("1.2.3.4:5000", "", "")))
+	// 可信代理追加的地址，客户端伪造的最左侧地址不使用
+	require.Equal(t, "1.2.3.4", app.ForwardedClientIP(request("10.0.0.1:5000", "5.6.7.8, 1.2.3.4", "")))
+	require.Equal(t, "1.2.3.4", app.ForwardedClientIP(request("10.0.0.1:5000", "1.2.3.4, 192.168.1.1", "")))
+	require.Equal(t, "1.2.3.4", app.ForwardedClientIP(request("[::1]:5000", "", "1.2.3.4")))
+	// 全部为可信代理时使用最左侧的代理，无效值之前的地址不可信
+	require.Equal(t, "192.168.1.1", app.ForwardedClientIP(request("10.0.0.1:5000", "192.168.1.1", "")))
+	require.Equal(t, "192.168.1.1", app.ForwardedClientIP(request("10.0.0.1:5000", "5.6.7.8, bad, 192.168.1.1", "")))
+	require.Equal(t, "10.0.0.1", app.ForwardedClientIP(request("10.0.0.1:5000", "", "")))
+}
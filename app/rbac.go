@@ -0,0 +1,73 @@
+package app
+
+import "go.uber.org/zap"
+
+// 用户角色
+const (
+	RoleSuperAdmin = "super-admin" // 超级管理员，可管理所有租户的数据
+	RoleOrgAdmin   = "org-admin"   // 组织管理员
+	RoleUser       = "user"        // 普通用户，只能访问自己的数据
+)
+
+const UserRole = "role" // gin.Context 中保存当前用户角色的键
+
+// 权限
+const (
+	PermUserManage        = "user:manage"         // 查看、禁用、模拟登录用户
+	PermRoomViewAll       = "room:view-all"       // 查看所有房间
+	PermConferenceViewAll = "conference:view-all" // 查看所有会议
+	PermRecordViewAll     = "record:view-all"     // 查看所有录像
+	PermOrgCreate         = "org:create"          // 创建组织
+	PermOrgManage         = "org:manage"          // 查看所有组织，设置组织配额
+	PermAPIKeyManage      = "apikey:manage"       // 创建、吊销内部服务的 API Key
+)
+
+var rolePermissions = map[string][]string{
+	RoleSuperAdmin: {
+		PermUserManage,
+		PermRoomViewAll,
+		PermConferenceViewAll,
+		PermRecordViewAll,
+		PermOrgCreate,
+		PermOrgManage,
+		PermAPIKeyManage,
+	},
+	RoleOrgAdmin: {
+		PermOrgCreate,
+	},
+	RoleUser: {},
+}
+
+// ValidRole 是否为已定义的角色
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasPermission 角色是否拥有权限
+func HasPermission(role, permission string) bool {
+	for _, perm := range rolePermissions[role] {
+		if perm == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// BootstrapSuperAdmins 将配置的 superAdmins 用户设为超级管理员，不存在的用户忽略。
+// 按用户 ID 指定，不按用户名，避免他人抢先注册配置中的用户名获得超级管理员。
+// 只提升角色不降级，移除超级管理员需要在用户管理中修改。
+func (app App) BootstrapSuperAdmins() error {
+	if len(app.config.SuperAdmins) == 0 {
+		return nil
+	}
+	result, err := app.db.Update(UserTableName).Set(UserRoleCol, RoleSuperAdmin).
+		Where(WhereUserIds, app.config.SuperAdmins).Where(WhereUserNotRole, RoleSuperAdmin).Exec()
+	if err != nil {
+		return err
+	}
+	if count, _ := result.RowsAffected(); count > 0 {
+		logger.Info("super admins bootstrapped.", zap.Int64s("ids", app.config.SuperAdmins), zap.Int64("count", count))
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapSuperAdmins(t *testing.T) {
+	app := newTestApp()
+	for _, name := range []string{"alice", "bob"} {
+		_, err := app.db.InsertInto(UserTableName).
+			Columns(UserNameCol, UserPasswordCol, UserRoleCol, CommonCtimeCol).
+			Values(name, "", RoleUser, time.Now()).Exec()
+		require.NoError(t, err)
+	}
+
+	// 不存在的用户忽略
+	app.config.SuperAdmins = []int64{1, 100}
+	require.NoError(t, app.BootstrapSuperAdmins())
+	require.NoError(t, app.BootstrapSuperAdmins())
+
+	roles := map[string]string{}
+	users := []User{}
+	_, err := app.db.Select(SqlStar).From(UserTableName).Load(&users)
+	require.NoError(t, err)
+	for _, user := range users {
+		roles[user.Name] = user.Role
+	}
+	require.Equal(t, map[string]string{"alice": RoleSuperAdmin, "bob": RoleUser}, roles)
+}
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	resetCodeTTL = 15 * time.Minute
+	// 同一账号每小时最多请求的验证码次数，同一 IP 每小时最多请求的次数
+	resetAccountLimit = 5
+	resetIPLimit      = 20
+	resetRateWindow   = time.Hour
+	// 同一账号两次请求验证码的最小间隔
+	resetCooldown = time.Minute
+)
+
+// findResetUser 按登录名、已验证的邮箱或已验证的手机号依次查找用户。
+// 未验证的联系方式任何人都可以填写，不能用于查找，避免他人把邮箱或手机号设为受害者的登录名。
+func (app App) findResetUser(ctx context.Context, account string) (*User, error) {
+	conditions := []dbr.Builder{
+		dbr.Expr(WhereUserName, account),
+		dbr.Expr(WhereUserVerifiedEmail, account, true),
+		dbr.Expr(WhereUserVerifiedPhone, account, true),
+	}
+	for _, condition := range conditions {
+		user := &User{}
+		err := app.db.Select(SqlStar).From(UserTableName).Where(condition).
+			OrderAsc(CommonIdCol).Limit(1).LoadOneContext(ctx, user)
+		if err == nil {
+			return user, nil
+		}
+		if err != dbr.ErrNotFound {
+			return nil, err
+		}
+	}
+	return nil, dbr.ErrNotFound
+}
+
+// RequestPasswordReset 向账号的邮箱或手机号发送重置密码验证码。
+// 账号不存在或未设置联系方式时同样返回成功，避免通过该接口探测账号。
+func (app App) RequestPasswordReset(ctx context.Context, account, channel, ip string) error {
+	account = strings.TrimSpace(account)
+	// 先校验参数，无论账号是否存在都返回相同的结果
+	if channel != ChannelEmail && channel != ChannelSMS {
+		return ErrNoCodeChannel
+	}
+	if ok, err := app.allowRate("reset-ip:"+ip, resetIPLimit, resetRateWindow); err != nil || !ok {
+		return rateError(err)
+	}
+	if ok, err := app.allowRate("reset-account:"+account, resetAccountLimit, resetRateWindow); err != nil || !ok {
+		return rateError(err)
+	}
+
+	user, err := app.findResetUser(ctx, account)
+	if err != nil {
+		logger.Info("password reset for unknown account.", zap.String("account", account), zap.String("ip", ip))
+		return nil
+	}
+	// 目录账号的密码由目录服务管理
+	if user.Disabled || user.Source != UserSourceLocal {
+		return nil
+	}
+
+	to := user.Email
+	if channel == ChannelSMS {
+		to = user.Phone
+	}
+	if len(to) == 0 {
+		logger.Info("password reset without contact.", zap.Int64("uid", user.Id), zap.String("channel", channel))
+		return nil
+	}
+
+	subject := strconv.FormatInt(user.Id, 10)
+	if ok, err := app.store.SetNX(rateKeyPrefix+"reset-cooldown:"+subject, "1", resetCooldown); err != nil || !ok {
+		return rateError(err)
+	}
+	code, err := app.issueCode(CodePurposeResetPassword, subject, resetCodeTTL)
+	if err != nil {
+		return err
+	}
+	return app.CodeSender().SendCode(ctx, channel, to, CodePurposeResetPassword, code, resetCodeTTL)
+}
+
+// ConfirmPasswordReset 校验验证码并设置新密码，成功后吊销账号的所有会话
+func (app App) ConfirmPasswordReset(ctx context.Context, account, code, password string) error {
+	// 先校验密码规则，避免不符合规则时验证码已被使用
+	if err := app.CheckPassword(password); err != nil {
+		return err
+	}
+	user, err := app.findResetUser(ctx, strings.TrimSpace(account))
+	if err != nil {
+		return ErrInvalidCode
+	}
+	subject := strconv.FormatInt(user.Id, 10)
+	hash, err := app.matchCode(CodePurposeResetPassword, subject, code)
+	if err != nil {
+		return err
+	}
+	// 验证码正确后再检查历史密码，不符合时验证码仍可使用；检查放在验证码之后，避免被用来试探密码
+	if err = app.checkPasswordHistory(ctx, app.db, *user, password); err != nil {
+		return err
+	}
+	if err = app.consumeCode(CodePurposeResetPassword, subject, hash); err != nil {
+		return err
+	}
+
+	if err = app.SetPassword(ctx, app.db, user.Id, password); err != nil {
+		return err
+	}
+	logger.Info("password reset.", zap.Int64("uid", user.Id))
+	return app.RevokeUserSessions(user.Id, "")
+}
+
+func rateError(err error) error {
+	if err != nil {
+		return err
+	}
+	return ErrRateLimited
+}
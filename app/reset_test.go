@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/util"
+)
+
+// fakeCodeSender 记录发送的验证码
+type fakeCodeSender struct {
+	sent []fakeCode
+}
+
+type fakeCode struct {
+	channel, to, purpose, code string
+}
+
+func (sender *fakeCodeSender) SendCode(ctx context.Context, channel, to, purpose, code string, ttl time.Duration) error {
+	sender.sent = append(sender.sent, fakeCode{channel, to, purpose, code})
+	return nil
+}
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+	sender := &fakeCodeSender{}
+	app.SetCodeSender(sender)
+
+	hash, _ := util.HashPassword("old-secret-0")
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, UserEmailCol, UserPhoneCol, CommonCtimeCol).
+		Values("alice", hash, "alice@example.com", "", time.Now()).Exec()
+	require.NoError(t, err)
+	tokens, err := app.CreateSession(1, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	// 账号不存在或未设置手机号时不发送，也不报错
+	require.NoError(t, app.RequestPasswordReset(ctx, "bob", ChannelEmail, "127.0.0.1"))
+	require.NoError(t, app.RequestPasswordReset(ctx, "alice", ChannelSMS, "127.0.0.1"))
+	require.Empty(t, sender.sent)
+	// 不支持的发送方式与账号是否存在无关
+	require.Equal(t, ErrNoCodeChannel, app.RequestPasswordReset(ctx, "bob", "fax", "127.0.0.1"))
+	require.Equal(t, ErrNoCodeChannel, app.RequestPasswordReset(ctx, "alice", "fax", "127.0.0.1"))
+
+	// 未验证的邮箱不能用于查找账号，他人把邮箱填成 alice 也不影响 alice 的重置
+	_, err = app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, UserEmailCol, UserPhoneCol, CommonCtimeCol).
+		Values("mallory", hash, "alice", "", time.Now()).Exec()
+	require.NoError(t, err)
+	require.NoError(t, app.RequestPasswordReset(ctx, "alice@example.com", ChannelEmail, "127.0.0.1"))
+	require.Empty(t, sender.sent)
+	user, err := app.findResetUser(ctx, "alice")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, user.Id)
+	_, err = app.db.Update(UserTableName).Set(UserEmailVerifiedCol, true).Where(WhereCommonId, 1).Exec()
+	require.NoError(t, err)
+
+	require.NoError(t, app.RequestPasswordReset(ctx, "alice@example.com", ChannelEmail, "127.0.0.1"))
+	require.Len(t, sender.sent, 1)
+	require.Equal(t, "alice@example.com", sender.sent[0].to)
+	require.Len(t, sender.sent[0].code, 6)
+
+	// 一分钟内不能重复发送
+	require.Equal(t, ErrRateLimited, app.RequestPasswordReset(ctx, "alice", ChannelEmail, "127.0.0.1"))
+
+	require.Equal(t, ErrInvalidCode, app.ConfirmPasswordReset(ctx, "alice", "000000x", "new-secret-1"))
+	// 历史密码在验证码之后检查，验证码错误时不提示，不符合时验证码仍可使用
+	app.config.Password.History = 2
+	require.Equal(t, ErrInvalidCode, app.ConfirmPasswordReset(ctx, "alice", "000000x", "old-secret-0"))
+	err = app.ConfirmPasswordReset(ctx, "alice", sender.sent[0].code, "old-secret-0")
+	require.Equal(t, &PasswordError{Rule: PasswordRuleHistory, Param: 2}, err)
+	require.NoError(t, app.ConfirmPasswordReset(ctx, "alice", sender.sent[0].code, "new-secret-1"))
+
+	user, err = app.loadUser(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, util.CheckPasswordHash("new-secret-1", user.Password))
+
+	// 验证码只能使用一次，已登录的会话被吊销
+	require.Equal(t, ErrInvalidCode, app.ConfirmPasswordReset(ctx, "alice", sender.sent[0].code, "again-secret-2"))
+	_, err = app.RefreshSession(tokens.RefreshToken)
+	require.Equal(t, ErrSessionRevoked, err)
+}
+
+func TestCodeFailures(t *testing.T) {
+	app := newTestApp()
+
+	code, err := app.issueCode(CodePurposeResetPassword, "1", time.Minute)
+	require.NoError(t, err)
+	for i := 0; i < codeMaxFailures; i++ {
+		require.Equal(t, ErrInvalidCode, app.checkCode(CodePurposeResetPassword, "1", "wrong"))
+	}
+	// 错误次数过多后正确的验证码也失效
+	require.Equal(t, ErrInvalidCode, app.checkCode(CodePurposeResetPassword, "1", code))
+
+	for i := 0; i < resetAccountLimit; i++ {
+		ok, err := app.allowRate("test", resetAccountLimit, time.Minute)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	ok, err := app.allowRate("test", resetAccountLimit, time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestCodeSingleUse(t *testing.T) {
+	app := newTestApp()
+
+	// 同一个验证码并发使用时只有一个成功
+	code, err := app.issueCode(CodePurposeResetPassword, "1", time.Minute)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = app.checkCode(CodePurposeResetPassword, "1", code)
+		}(i)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else {
+			require.Equal(t, ErrInvalidCode, err)
+		}
+	}
+	require.Equal(t, 1, succeeded)
+}
@@ -0,0 +1,274 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/gocraft/dbr/v2"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRoomNotFound         = errors.New("房间不存在")
+	ErrNotRoomModerator     = errors.New("只有房间所有者或组织管理员可以申请主持人 token")
+	ErrAnonymousNotAllowed  = errors.New("该房间不允许匿名参会")
+	ErrInvalidRoomExpiresAt = errors.New("expiresAt 无效")
+	ErrRoomTokenUpstream    = errors.New("API 服务签发 token 失败")
+)
+
+// RoomTokenConfig 入会 token 的签发方式。
+// 配置 appId 和 appSecret 后在本地签发，否则或 proxy 为 true 时转发到 API 服务签发。
+type RoomTokenConfig struct {
+	Proxy     bool   `json:"proxy,omitempty"`     // 转发到 API 服务的 /api/conference/token 签发
+	AppID     string `json:"appId,omitempty"`     // 媒体服务器配置的 app_id，作为 token 的 iss
+	AppSecret string `json:"appSecret,omitempty"` // 媒体服务器配置的 app_secret，用于 HS256 签名
+	Audience  string `json:"audience,omitempty"`  // token 的 aud，默认 jitsi
+	Subject   string `json:"subject,omitempty"`   // token 的 sub，媒体服务器的域名，默认 * 表示任意域名
+	TTL       int    `json:"ttl,omitempty"`       // 未指定 expiresAt 时的有效期（秒），默认 7200
+	MaxTTL    int    `json:"maxTTL,omitempty"`    // 最长有效期（秒），默认 86400
+}
+
+func (config RoomTokenConfig) withDefaults() RoomTokenConfig {
+	if len(config.Audience) == 0 {
+		config.Audience = "jitsi"
+	}
+	if len(config.Subject) == 0 {
+		config.Subject = "*"
+	}
+	if config.TTL <= 0 {
+		config.TTL = 2 * 60 * 60
+	}
+	if config.MaxTTL <= 0 {
+		config.MaxTTL = 24 * 60 * 60
+	}
+	return config
+}
+
+// RoomTokenUser 入会 token 中的参会者或被叫信息
+type RoomTokenUser struct {
+	Id        string `json:"id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	AvatarUrl string `json:"avatarUrl,omitempty"`
+}
+
+// RoomTokenParams 签发入会 token 的参数
+type RoomTokenParams struct {
+	Room      RoomInfo
+	Uid       int64          // 申请 token 的用户
+	ExpiresAt int64          // 过期时间（Unix 秒），0 表示使用默认有效期
+	User      *RoomTokenUser // 参会者，只使用其中的名称和头像，id 始终是申请者
+	Callee    *RoomTokenUser // 被叫，用于一对一呼叫
+	Moderator bool
+	Anonymous bool
+	IP        string
+}
+
+// RoomTokenProxy 是否转发到 API 服务签发
+func (app App) RoomTokenProxy() bool {
+	config := app.config.RoomToken
+	return config.Proxy || len(config.AppID) == 0 || len(config.AppSecret) == 0
+}
+
+// RoomForToken 查找用户可以申请入会 token 的房间：本人的房间和所在组织的房间，
+// 申请主持人 token 时只能是本人的房间或担任管理员的组织的房间。
+func (app App) RoomForToken(ctx context.Context, uid int64, roomName string, moderator bool) (*RoomInfo, error) {
+	scope, err := app.OwnerScope(ctx, uid, false)
+	if err != nil {
+		return nil, err
+	}
+	room := &RoomInfo{}
+	err = app.db.Select(SqlStar).From(RoomTableName).
+		Where(WhereRoomName, roomName).Where(scope).LoadOneContext(ctx, room)
+	if err == dbr.ErrNotFound {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil || !moderator {
+		return room, err
+	}
+
+	scope, err = app.OwnerScope(ctx, uid, true)
+	if err != nil {
+		return nil, err
+	}
+	count, err := app.db.Select("count(*)").From(RoomTableName).
+		Where(WhereCommonId, room.Id).Where(scope).ReturnInt64()
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrNotRoomModerator
+	}
+	return room, nil
+}
+
+// prepareRoomToken 校验匿名参会和有效期，补全参会者信息。
+// 参会者的 id 始终是申请者，申请者只能修改显示的名称和头像，避免冒用他人身份入会。
+func (app App) prepareRoomToken(ctx context.Context, params *RoomTokenParams) (time.Time, error) {
+	config := app.config.RoomToken.withDefaults()
+	if params.Anonymous {
+		if !params.Room.AllowAnonymous {
+			return time.Time{}, ErrAnonymousNotAllowed
+		}
+		params.User = nil
+		params.Moderator = false
+	} else {
+		user, err := app.loadUser(ctx, params.Uid)
+		if err != nil {
+			return time.Time{}, err
+		}
+		name := user.DisplayName
+		if len(name) == 0 {
+			name = user.Name
+		}
+		tokenUser := &RoomTokenUser{Id: strconv.FormatInt(user.Id, 10), Name: name}
+		if params.User != nil {
+			if len(params.User.Name) > 0 {
+				tokenUser.Name = params.User.Name
+			}
+			tokenUser.AvatarUrl = params.User.AvatarUrl
+		}
+		params.User = tokenUser
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(config.TTL) * time.Second)
+	if params.ExpiresAt > 0 {
+		expiresAt = time.Unix(params.ExpiresAt, 0)
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > time.Duration(config.MaxTTL)*time.Second {
+		return time.Time{}, ErrInvalidRoomExpiresAt
+	}
+	return expiresAt, nil
+}
+
+// IssueRoomToken 签发媒体服务器的入会 token 并记录
+func (app App) IssueRoomToken(ctx context.Context, params RoomTokenParams) (string, time.Time, error) {
+	config := app.config.RoomToken.withDefaults()
+	expiresAt, err := app.prepareRoomToken(ctx, &params)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now().Unix()
+	jti := xid.New().String()
+	tokenContext := gin.H{}
+	if params.User != nil {
+		tokenContext["user"] = gin.H{
+			"id":     params.User.Id,
+			"name":   params.User.Name,
+			"avatar": params.User.AvatarUrl,
+			// 部分插件从 context.user 中读取主持人标志
+			"moderator": params.Moderator,
+		}
+	}
+	if params.Callee != nil {
+		tokenContext["callee"] = gin.H{
+			"id":     params.Callee.Id,
+			"name":   params.Callee.Name,
+			"avatar": params.Callee.AvatarUrl,
+		}
+	}
+	claims := jwt.MapClaims{
+		"jti":       jti,
+		"iss":       config.AppID,
+		"aud":       config.Audience,
+		"sub":       config.Subject,
+		"room":      params.Room.RoomName,
+		"iat":       now,
+		"nbf":       now,
+		"exp":       expiresAt.Unix(),
+		"moderator": params.Moderator,
+		"context":   tokenContext,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.AppSecret))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err = app.recordRoomToken(ctx, params, jti, expiresAt, false); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// ProxyRoomToken 校验后将补全的参数转发到 API 服务签发，API 服务签发成功后才记录
+func (app App) ProxyRoomToken(c *gin.Context, params RoomTokenParams) error {
+	expiresAt, err := app.prepareRoomToken(c, &params)
+	if err != nil {
+		return err
+	}
+
+	tokenContext := gin.H{}
+	if params.User != nil {
+		tokenContext["user"] = params.User
+	}
+	if params.Callee != nil {
+		tokenContext["callee"] = params.Callee
+	}
+	req := app.NewAPIRequest("/api/conference/token", gin.H{
+		"roomName":  params.Room.RoomName,
+		"expiresAt": expiresAt.Unix(),
+		"context":   tokenContext,
+		"anonymous": params.Anonymous,
+		"moderator": params.Moderator,
+	})
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Uid", strconv.FormatInt(params.Uid, 10))
+	resp, err := app.HttpClient().Do(req.WithContext(c))
+	if err != nil {
+		logger.Warn("proxy room token failed.", zap.String("room", params.Room.RoomName), zap.Error(err))
+		return ErrRoomTokenUpstream
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Warn("proxy room token failed.", zap.String("room", params.Room.RoomName), zap.Error(err))
+		return ErrRoomTokenUpstream
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if err = app.recordRoomToken(c, params, "", expiresAt, true); err != nil {
+			return err
+		}
+	} else {
+		logger.Warn("proxy room token rejected.", zap.String("room", params.Room.RoomName),
+			zap.Int("status", resp.StatusCode))
+	}
+	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), data)
+	return nil
+}
+
+func (app App) recordRoomToken(ctx context.Context, params RoomTokenParams, jti string, expiresAt time.Time, proxy bool) error {
+	record := RoomToken{
+		Uid:       params.Uid,
+		RoomId:    params.Room.Id,
+		RoomName:  params.Room.RoomName,
+		Jti:       jti,
+		Moderator: params.Moderator,
+		Anonymous: params.Anonymous,
+		Proxy:     proxy,
+		ExpiresAt: expiresAt,
+		Ip:        params.IP,
+		Ctime:     time.Now(),
+	}
+	if params.User != nil {
+		record.UserId, record.UserName = params.User.Id, params.User.Name
+	}
+	_, err := app.db.InsertInto(RoomTokenTableName).
+		Columns(CommonUidCol, RoomTokenRoomIdCol, RoomTokenRoomNameCol, RoomTokenJtiCol, RoomTokenUserIdCol,
+			RoomTokenUserNameCol, RoomTokenModeratorCol, RoomTokenAnonymousCol, RoomTokenProxyCol,
+			RoomTokenExpiresAtCol, RoomTokenIpCol, CommonCtimeCol).
+		Record(&record).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	logger.Info("room token issued.", zap.Int64("uid", params.Uid), zap.String("room", params.Room.RoomName),
+		zap.String("user", record.UserId), zap.Bool("moderator", params.Moderator),
+		zap.Bool("anonymous", params.Anonymous), zap.Bool("proxy", proxy))
+	return nil
+}
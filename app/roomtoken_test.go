@@ -0,0 +1,212 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomForToken(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		_, err := app.db.InsertInto(UserTableName).
+			Columns(UserNameCol, UserPasswordCol, CommonCtimeCol).
+			Values(name, "", time.Now()).Exec()
+		require.NoError(t, err)
+	}
+	// alice 的个人房间，以及 alice 管理、bob 参加的组织房间
+	_, err := app.db.InsertInto(RoomTableName).
+		Columns(CommonUidCol, CommonOrgIdCol, RoomNameCol, RoomConfigCol, CommonCtimeCol).
+		Values(1, 0, "personal", RoomConfig{}, time.Now()).
+		Values(1, 1, "team", RoomConfig{}, time.Now()).Exec()
+	require.NoError(t, err)
+	_, err = app.db.InsertInto(OrgMemberTableName).
+		Columns(OrgMemberOrgIdCol, CommonUidCol, OrgMemberRoleCol, CommonCtimeCol).
+		Values(1, 1, OrgRoleAdmin, time.Now()).
+		Values(1, 2, OrgRoleMember, time.Now()).Exec()
+	require.NoError(t, err)
+
+	room, err := app.RoomForToken(ctx, 1, "personal", true)
+	require.NoError(t, err)
+	require.Equal(t, "personal", room.RoomName)
+	_, err = app.RoomForToken(ctx, 1, "team", true)
+	require.NoError(t, err)
+
+	// 组织成员可以申请普通 token，不能申请主持人 token
+	_, err = app.RoomForToken(ctx, 2, "team", false)
+	require.NoError(t, err)
+	_, err = app.RoomForToken(ctx, 2, "team", true)
+	require.Equal(t, ErrNotRoomModerator, err)
+	_, err = app.RoomForToken(ctx, 2, "personal", false)
+	require.Equal(t, ErrRoomNotFound, err)
+
+	_, err = app.RoomForToken(ctx, 3, "team", false)
+	require.Equal(t, ErrRoomNotFound, err)
+	_, err = app.RoomForToken(ctx, 1, "missing", false)
+	require.Equal(t, ErrRoomNotFound, err)
+
+	// 组织房间按当前的成员和角色判断，创建者降为成员或被移出后不再有权限
+	_, err = app.db.Update(OrgMemberTableName).Set(OrgMemberRoleCol, OrgRoleMember).
+		Where(WhereOrgMember, 1, 1).Exec()
+	require.NoError(t, err)
+	_, err = app.RoomForToken(ctx, 1, "team", true)
+	require.Equal(t, ErrNotRoomModerator, err)
+	_, err = app.db.DeleteFrom(OrgMemberTableName).Where(WhereOrgMember, 1, 1).Exec()
+	require.NoError(t, err)
+	_, err = app.RoomForToken(ctx, 1, "team", false)
+	require.Equal(t, ErrRoomNotFound, err)
+	_, err = app.RoomForToken(ctx, 1, "personal", true)
+	require.NoError(t, err)
+}
+
+func TestIssueRoomToken(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+	require.True(t, app.RoomTokenProxy())
+	app.config.RoomToken = RoomTokenConfig{AppID: "admin", AppSecret: "room-secret", Subject: "meet.example.com"}
+	require.False(t, app.RoomTokenProxy())
+
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, UserDisNameCol, CommonCtimeCol).
+		Values("alice", "", "Alice", time.Now()).Exec()
+	require.NoError(t, err)
+	room := RoomInfo{Id: 1, Uid: 1, RoomName: "team"}
+
+	// 未指定参会者时使用申请者的信息
+	tokenString, expiresAt, err := app.IssueRoomToken(ctx, RoomTokenParams{Room: room, Uid: 1, Moderator: true})
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(2*time.Hour), expiresAt, time.Minute)
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte("room-secret"), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "admin", claims["iss"])
+	require.Equal(t, "jitsi", claims["aud"])
+	require.Equal(t, "meet.example.com", claims["sub"])
+	require.Equal(t, "team", claims["room"])
+	require.Equal(t, true, claims["moderator"])
+	user := claims["context"].(map[string]interface{})["user"].(map[string]interface{})
+	require.Equal(t, "1", user["id"])
+	require.Equal(t, "Alice", user["name"])
+
+	// 参会者的 id 始终是申请者，只能修改名称和头像
+	tokenString, _, err = app.IssueRoomToken(ctx, RoomTokenParams{Room: room, Uid: 1,
+		User: &RoomTokenUser{Id: "2", Name: "Boss", AvatarUrl: "https://example.com/a.png"}})
+	require.NoError(t, err)
+	claims = jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(tokenString, claims)
+	require.NoError(t, err)
+	user = claims["context"].(map[string]interface{})["user"].(map[string]interface{})
+	require.Equal(t, "1", user["id"])
+	require.Equal(t, "Boss", user["name"])
+	require.Equal(t, "https://example.com/a.png", user["avatar"])
+
+	// 匿名参会需要房间允许，且不能是主持人
+	params := RoomTokenParams{Room: room, Uid: 1, Anonymous: true, Moderator: true,
+		User: &RoomTokenUser{Id: "guest", Name: "Guest"}}
+	_, _, err = app.IssueRoomToken(ctx, params)
+	require.Equal(t, ErrAnonymousNotAllowed, err)
+	params.Room.AllowAnonymous = true
+	params.Callee = &RoomTokenUser{Id: "2", Name: "Bob"}
+	tokenString, _, err = app.IssueRoomToken(ctx, params)
+	require.NoError(t, err)
+	claims = jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(tokenString, claims)
+	require.NoError(t, err)
+	require.Equal(t, false, claims["moderator"])
+	require.NotContains(t, claims["context"], "user")
+	require.Contains(t, claims["context"], "callee")
+
+	for _, expires := range []int64{time.Now().Add(-time.Minute).Unix(), time.Now().Add(48 * time.Hour).Unix()} {
+		_, _, err = app.IssueRoomToken(ctx, RoomTokenParams{Room: room, Uid: 1, ExpiresAt: expires})
+		require.Equal(t, ErrInvalidRoomExpiresAt, err)
+	}
+
+	// 签发记录
+	records := []RoomToken{}
+	_, err = app.db.Select(SqlStar).From(RoomTokenTableName).OrderAsc(CommonIdCol).Load(&records)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, "1", records[0].UserId)
+	require.True(t, records[0].Moderator)
+	require.NotEmpty(t, records[0].Jti)
+	require.Equal(t, "1", records[1].UserId)
+	require.Equal(t, "Boss", records[1].UserName)
+	require.True(t, records[2].Anonymous)
+	require.Empty(t, records[2].UserId)
+}
+
+func TestProxyRoomToken(t *testing.T) {
+	app := newTestApp()
+	app.httpClient = http.DefaultClient
+	gin.SetMode(gin.TestMode)
+
+	var forwarded map[string]interface{}
+	status := http.StatusOK
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/conference/token", r.URL.Path)
+		require.Equal(t, "1", r.Header.Get("X-Uid"))
+		forwarded = map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&forwarded))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"token":"t"}`))
+	}))
+	defer api.Close()
+	app.config.API.URL = api.URL
+	require.True(t, app.RoomTokenProxy())
+
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, CommonCtimeCol).
+		Values("alice", "", time.Now()).Exec()
+	require.NoError(t, err)
+	room := RoomInfo{Id: 1, Uid: 1, RoomName: "team", AllowAnonymous: true}
+	proxy := func(params RoomTokenParams) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/admin/room/token", nil)
+		require.NoError(t, app.ProxyRoomToken(c, params))
+		return w
+	}
+
+	// 转发补全后的参数，不使用请求中的参会者 id
+	w := proxy(RoomTokenParams{Room: room, Uid: 1, User: &RoomTokenUser{Id: "2", Name: "Boss"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"token":"t"}`, w.Body.String())
+	user := forwarded["context"].(map[string]interface{})["user"].(map[string]interface{})
+	require.Equal(t, "1", user["id"])
+	require.Equal(t, "Boss", user["name"])
+
+	// 匿名参会不转发参会者信息
+	proxy(RoomTokenParams{Room: room, Uid: 1, Anonymous: true, User: &RoomTokenUser{Id: "2", Name: "Boss"}})
+	require.NotContains(t, forwarded["context"], "user")
+	require.Equal(t, true, forwarded["anonymous"])
+
+	// API 服务签发失败时不记录
+	status = http.StatusBadRequest
+	w = proxy(RoomTokenParams{Room: room, Uid: 1})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	records := []RoomToken{}
+	_, err = app.db.Select(SqlStar).From(RoomTokenTableName).OrderAsc(CommonIdCol).Load(&records)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.True(t, records[0].Proxy)
+	require.Equal(t, "1", records[0].UserId)
+	require.True(t, records[1].Anonymous)
+
+	api.Close()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/admin/room/token", nil)
+	require.Equal(t, ErrRoomTokenUpstream, app.ProxyRoomToken(c, RoomTokenParams{Room: room, Uid: 1}))
+}
@@ -18,6 +18,7 @@ const (
 	CommonCtimeCol      = "ctime"
 	CommonIdCol         = "id"
 	CommonUidCol        = UserID
+	CommonOrgIdCol      = "org_id"
 	WhereCommonId       = "id=?"
 	WhereCommonIdAndUid = "id=? and uid=?"
 )
@@ -25,26 +26,48 @@ const (
 //*****************************************用户数据*********************************************************/
 // 用户
 type User struct {
-	Id          int64     `json:"id,omitempty"`       // id
-	Name        string    `json:"name,omitempty"`     // 登录名
-	Password    string    `json:"password,omitempty"` // 密码
-	DisplayName string    `json:"displayName"`        // 姓名
-	Email       string    `json:"email"`              // 邮箱
-	Phone       string    `json:"phone"`              // 手机号码
-	Company     string    `json:"company"`            // 公司名称
-	Ctime       time.Time `json:"ctime,omitempty"`    // 创建时间
+	Id            int64     `json:"id,omitempty"`                   // id
+	Name          string    `json:"name,omitempty"`                 // 登录名
+	Password      string    `json:"password,omitempty"`             // 密码
+	DisplayName   string    `json:"displayName"`                    // 姓名
+	Email         string    `json:"email"`                          // 邮箱
+	Phone         string    `json:"phone"`                          // 手机号码
+	EmailVerified bool      `json:"emailVerified"`                  // 邮箱是否已验证
+	PhoneVerified bool      `json:"phoneVerified"`                  // 手机号码是否已验证
+	Company       string    `json:"company"`                        // 公司名称
+	Role          string    `json:"role" sql:"default:'user'"`      // 角色，见 RoleSuperAdmin 等
+	Disabled      bool      `json:"disabled"`                       // 是否已禁用
+	Source        string    `json:"source"`                         // 用户来源，本地账号为空，见 UserSourceLDAP
+	CalendarToken string    `json:"-" sql:"index:u_calendar_token"` // 日历订阅地址中的 token
+	TotpSecret    string    `json:"-"`                              // 两步验证的 TOTP 密钥
+	TotpEnabled   bool      `json:"totpEnabled"`                    // 是否已启用两步验证
+	Ctime         time.Time `json:"ctime,omitempty"`                // 创建时间
 }
 
 // 用户表对应的表名称和字段名称
 const (
-	UserTableName   = "users"
-	UserNameCol     = "name"
-	UserPasswordCol = "password"
-	UserDisNameCol  = "display_name"
-	UserEmailCol    = "email"
-	UserPhoneCol    = "phone"
-	UserCompanyCol  = "company"
-	WhereUserName   = "name=?"
+	UserTableName          = "users"
+	UserNameCol            = "name"
+	UserPasswordCol        = "password"
+	UserDisNameCol         = "display_name"
+	UserEmailCol           = "email"
+	UserPhoneCol           = "phone"
+	UserEmailVerifiedCol   = "email_verified"
+	UserPhoneVerifiedCol   = "phone_verified"
+	UserCompanyCol         = "company"
+	UserRoleCol            = "role"
+	UserDisabledCol        = "disabled"
+	UserSourceCol          = "source"
+	UserCalendarTokenCol   = "calendar_token"
+	UserTotpSecretCol      = "totp_secret"
+	UserTotpEnabledCol     = "totp_enabled"
+	WhereUserName          = "name=?"
+	WhereUserCalendarToken = "calendar_token=?"
+	WhereUserVerifiedEmail = "email=? and email_verified=?"
+	WhereUserVerifiedPhone = "phone=? and phone_verified=?"
+	WhereUserPassword      = "id=? and password=?"
+	WhereUserIds           = "id in ?"
+	WhereUserNotRole       = "role<>?"
 )
 
 //*****************************************用户创建会议室*********************************************************/
@@ -52,6 +75,7 @@ const (
 type RoomInfo struct {
 	Id                int64      `json:"id,omitempty"`
 	Uid               int64      `json:"uid,omitempty" sql:"index:ri_uid"`      // 房间uid
+	OrgId             int64      `json:"orgId,omitempty" sql:"index:ri_org_id"` // 所属组织id，0 表示个人房间
 	RoomName          string     `json:"roomName" sql:"index:ri_room_name"`     // 房间名称
 	ParticipantLimits int        `json:"participantLimits"`                     // 房间最高参会人数
 	AllowAnonymous    bool       `json:"allowAnonymous"`                        // 是否允许匿名用户创建会议
@@ -106,17 +130,22 @@ func (config *RoomConfig) Scan(src interface{}) error {
 // 会议室信息，会议室表示正在开会的房间
 type ConferenceInfo struct {
 	Id              int64       `json:"id,omitempty"`
-	Uid             int64       `json:"uid,omitempty" sql:"index:ci_uid"`            // 会议uid
-	RoomName        string      `json:"roomName,omitempty" sql:"index:ci_room_name"` // 房间名称
-	Participants    int         `json:"participants,omitempty"`                      // 当前人数
-	MaxParticipants int         `json:"maxParticipants,omitempty"`                   // 最高人数
-	IsRecording     bool        `json:"isRecording,omitempty"`                       // 是否正在录制，直播也是录制
-	Streaming       string      `json:"streaming,omitempty"`                         // 直播地址，录制则需清空
-	ApiEnabled      bool        `json:"apiEnabled,omitempty"`                        // 是否是使用API接入的会议室
-	LockPassword    string      `json:"lockPassword,omitempty"`                      // 进入密码
-	Locked          bool        `json:"locked,omitempty"`                            // 是否锁定
-	Ctime           time.Time   `json:"ctime,omitempty" sql:"index:ci_ctime"`        // 开始时间
-	Etime           db.NullTime `json:"etime,omitempty" sql:"index:ci_etime"`        // 结束时间
+	Uid             int64       `json:"uid,omitempty" sql:"index:ci_uid"`              // 会议uid
+	OrgId           int64       `json:"orgId,omitempty" sql:"index:ci_org_id"`         // 所属组织id
+	RoomName        string      `json:"roomName,omitempty" sql:"index:ci_room_name"`   // 房间名称
+	Participants    int         `json:"participants,omitempty"`                        // 当前人数
+	MaxParticipants int         `json:"maxParticipants,omitempty"`                     // 最高人数
+	IsRecording     bool        `json:"isRecording,omitempty"`                         // 是否正在录制，直播也是录制
+	Streaming       string      `json:"streaming,omitempty"`                           // 直播地址，录制则需清空
+	ApiEnabled      bool        `json:"apiEnabled,omitempty"`                          // 是否是使用API接入的会议室
+	LockPassword    string      `json:"lockPassword,omitempty"`                        // 进入密码
+	Locked          bool        `json:"locked,omitempty"`                              // 是否锁定
+	Ctime           time.Time   `json:"ctime,omitempty" sql:"index:ci_ctime"`          // 开始时间
+	Etime           db.NullTime `json:"etime,omitempty" sql:"index:ci_etime"`          // 结束时间
+	Htime           db.NullTime `json:"htime,omitempty"`                               // 最近一次确认会议存活的时间
+	CloseReason     string      `json:"closeReason,omitempty"`                         // 结束原因，见 CloseReasonDestroyed 等
+	MeetingId       int64       `json:"meetingId,omitempty" sql:"index:ci_meeting_id"` // 对应的预约会议id，0 表示临时会议
+	OccurrenceStart db.NullTime `json:"occurrenceStart,omitempty"`                     // 对应的预约会议日程开始时间
 }
 
 // 房间表对应的表名称和字段名称
@@ -130,16 +159,28 @@ const (
 	ConferenceIsRecordCol   = "is_recording"
 	ConferenceStreamingCol  = "streaming"
 	ConferenceLockPassCol   = "lock_password"
+	ConferenceHtimeCol      = "htime"
+	ConferenceCloseCol      = "close_reason"
+	ConferenceMeetingIdCol  = "meeting_id"
+	ConferenceOccurrenceCol = "occurrence_start"
 
 	WhereIdAndMaxParti = "id=? and max_participants<?"
 )
 
+// 会议结束原因
+const (
+	CloseReasonDestroyed = "destroyed"         // 媒体服务器通知会议结束
+	CloseReasonOrphaned  = "orphaned"          // 媒体服务器上已不存在该会议
+	CloseReasonHeartbeat = "heartbeat-timeout" // 无法连接媒体服务器，且长时间没有收到会议事件
+)
+
 //*****************************************会议回看定义*********************************************************/
 // 会议回看信息
 type RecordInfo struct {
 	Id           int64     `json:"id,omitempty"`
 	ConferenceId int64     `json:"conferenceId,omitempty"` // 会议室id
 	Uid          int64     `json:"uid,omitempty"`          // 会议室用户id
+	OrgId        int64     `json:"orgId,omitempty"`        // 所属组织id
 	RoomName     string    `json:"roomName,omitempty"`     // 会议室名称
 	Duration     int64     `json:"duration,omitempty"`     // 录制时长
 	Size         int64     `json:"size,omitempty"`         // 文件大小
@@ -158,5 +199,423 @@ const (
 	RecordDownUrlCol      = "download_url"
 	RecordStreamUrlCol    = "streaming_url"
 
-	WhereRecordConfIDAndStream = "conference_id=? and streaming_url=? and duration=0"
+	WhereRecordConfIDAndStream  = "conference_id=? and streaming_url=? and duration=0"
+	WhereRecordConfIDAndDownUrl = "conference_id=? and download_url=?"
+)
+
+//*****************************************参会者记录*********************************************************/
+// 参会者信息，记录每位参会者的进出时间
+type ParticipantInfo struct {
+	Id           int64       `json:"id,omitempty"`
+	ConferenceId int64       `json:"conferenceId,omitempty" sql:"index:pi_conference_id"` // 会议室id
+	Uid          int64       `json:"uid,omitempty" sql:"index:pi_uid"`                    // 会议室用户id
+	RoomName     string      `json:"roomName,omitempty"`                                  // 房间名称
+	Jid          string      `json:"jid,omitempty" sql:"index:pi_jid"`                    // 参会者ID
+	Nick         string      `json:"nick,omitempty"`                                      // 参会者昵称
+	Duration     int64       `json:"duration"`                                            // 参会时长（秒）
+	Ctime        time.Time   `json:"ctime,omitempty"`                                     // 加入时间
+	Etime        db.NullTime `json:"etime,omitempty"`                                     // 离开时间
+}
+
+// 参会者表对应的表名称和字段名称
+const (
+	ParticipantTableName       = "participant"
+	ParticipantConferenceIdCol = "conference_id"
+	ParticipantRoomNameCol     = "room_name"
+	ParticipantJidCol          = "jid"
+	ParticipantNickCol         = "nick"
+	ParticipantDurationCol     = "duration"
+	ParticipantEtimeCol        = "etime"
+
+	WhereParticipantOnline     = "conference_id=? and jid=? and etime is null"
+	WhereConferenceParticipant = "conference_id=? and etime is null"
+)
+
+//*****************************************会议事件记录*********************************************************/
+// 已处理的会议事件，用于丢弃媒体服务器重试投递的重复事件
+type ConferenceEvent struct {
+	Id           int64     `json:"id,omitempty"`
+	EventId      string    `json:"eventId,omitempty" sql:"index:ce_event_id,unique"`    // 事件ID，由媒体服务器生成
+	ConferenceId int64     `json:"conferenceId,omitempty" sql:"index:ce_conference_id"` // 会议室id，创建会议事件为新建的会议id
+	Action       string    `json:"action,omitempty"`                                    // 事件名
+	Seq          int64     `json:"seq,omitempty"`                                       // 会议内的事件序号
+	SeqKey       string    `json:"seqKey,omitempty"`                                    // 事件改变的状态，同一状态的事件按序号处理
+	Ctime        time.Time `json:"ctime,omitempty"`                                     // 处理时间
+}
+
+// 会议事件表对应的表名称和字段名称
+const (
+	ConferenceEventTableName = "conference_event"
+	ConferenceEventIdCol     = "event_id"
+	ConferenceEventConfIdCol = "conference_id"
+	ConferenceEventActionCol = "action"
+	ConferenceEventSeqCol    = "seq"
+	ConferenceEventSeqKeyCol = "seq_key"
+
+	WhereConferenceEventId    = "event_id=?"
+	WhereConferenceEventNewer = "conference_id=? and seq_key=? and seq>?"
+)
+
+//*****************************************登录会话*********************************************************/
+// 登录会话信息，会话是否有效以 Store 中的记录为准，数据库只用于展示
+type SessionInfo struct {
+	Id           int64       `json:"id,omitempty"`
+	Sid          string      `json:"sid,omitempty" sql:"index:si_sid,unique"` // 会话 ID
+	Uid          int64       `json:"uid,omitempty" sql:"index:si_uid"`        // 用户 ID
+	Impersonator int64       `json:"impersonator,omitempty"`                  // 模拟登录的管理员 ID
+	Ip           string      `json:"ip"`                                      // 登录 IP
+	UserAgent    string      `json:"userAgent" sql:"length:512"`              // 浏览器信息
+	Current      bool        `json:"current" db:"-"`                          // 是否为当前请求所在的会话
+	Ctime        time.Time   `json:"ctime,omitempty"`                         // 登录时间
+	Atime        time.Time   `json:"atime,omitempty"`                         // 最近刷新时间
+	Etime        db.NullTime `json:"etime,omitempty"`                         // 注销时间
+}
+
+// 会话表对应的表名称和字段名称
+const (
+	SessionTableName       = "user_session"
+	SessionSidCol          = "sid"
+	SessionImpersonatorCol = "impersonator"
+	SessionIpCol           = "ip"
+	SessionUserAgentCol    = "user_agent"
+	SessionAtimeCol        = "atime"
+	SessionEtimeCol        = "etime"
+
+	WhereSessionSid       = "sid=?"
+	WhereSessionOnline    = "sid=? and etime is null"
+	WhereSessionSidAndUid = "sid=? and uid=?"
+	WhereSessionActive    = "uid=? and etime is null and atime>=?"
+)
+
+//*****************************************组织*********************************************************/
+// 组织，组织内的成员共享组织的房间和录像
+type Organization struct {
+	Id                int64     `json:"id,omitempty"`
+	Uid               int64     `json:"uid,omitempty" sql:"index:org_uid"` // 创建者uid
+	Name              string    `json:"name" sql:"index:org_name,unique"`  // 组织名称
+	RoomLimits        int       `json:"roomLimits"`                        // 房间数量上限，0 表示不限
+	ParticipantLimits int       `json:"participantLimits"`                 // 同时参会人数上限，0 表示不限
+	RequireTotp       bool      `json:"requireTotp"`                       // 是否要求所有成员启用两步验证
+	Ctime             time.Time `json:"ctime,omitempty"`                   // 创建时间
+}
+
+// 组织表对应的表名称和字段名称
+const (
+	OrgTableName      = "organization"
+	OrgNameCol        = "name"
+	OrgRoomLimitsCol  = "room_limits"
+	OrgPartLimitsCol  = "participant_limits"
+	OrgRequireTotpCol = "require_totp"
+	WhereOrgName      = "name=?"
+)
+
+// 组织成员
+type OrgMember struct {
+	Id    int64     `json:"id,omitempty"`
+	OrgId int64     `json:"orgId,omitempty" sql:"index:om_org_uid,unique"` // 组织id
+	Uid   int64     `json:"uid,omitempty" sql:"index:om_org_uid,unique"`   // 成员uid
+	Role  string    `json:"role"`                                          // 组织内角色，见 OrgRoleAdmin
+	Ctime time.Time `json:"ctime,omitempty"`                               // 加入时间
+}
+
+// 组织成员表对应的表名称和字段名称
+const (
+	OrgMemberTableName = "org_member"
+	OrgMemberOrgIdCol  = "org_id"
+	OrgMemberRoleCol   = "role"
+
+	WhereOrgMember = "org_id=? and uid=?"
+)
+
+//*****************************************外部身份*********************************************************/
+// 单点登录的外部身份，通过 issuer 和 subject 找到对应的用户
+type UserIdentity struct {
+	Id      int64     `json:"id,omitempty"`
+	Uid     int64     `json:"uid,omitempty" sql:"index:ui_uid"`             // 用户uid
+	Issuer  string    `json:"issuer" sql:"index:ui_issuer_subject,unique"`  // 身份提供方
+	Subject string    `json:"subject" sql:"index:ui_issuer_subject,unique"` // 身份提供方中的用户标识
+	Email   string    `json:"email"`                                        // 关联时的邮箱
+	Ctime   time.Time `json:"ctime,omitempty"`                              // 关联时间
+}
+
+// 外部身份表对应的表名称和字段名称
+const (
+	UserIdentityTableName  = "user_identity"
+	UserIdentityIssuerCol  = "issuer"
+	UserIdentitySubjectCol = "subject"
+	UserIdentityEmailCol   = "email"
+)
+
+//*****************************************两步验证*********************************************************/
+// 两步验证的恢复码，无法使用身份验证器时代替动态密码登录，每个只能使用一次
+type RecoveryCode struct {
+	Id       int64       `json:"id,omitempty"`
+	Uid      int64       `json:"uid,omitempty" sql:"index:rc_uid"` // 用户uid
+	CodeHash string      `json:"-"`                                // 恢复码哈希
+	UsedTime db.NullTime `json:"usedTime"`                         // 使用时间，为空表示未使用
+	Ctime    time.Time   `json:"ctime,omitempty"`                  // 创建时间
+}
+
+// 恢复码表对应的表名称和字段名称
+const (
+	RecoveryCodeTableName = "recovery_code"
+	RecoveryCodeHashCol   = "code_hash"
+	RecoveryCodeUsedCol   = "used_time"
+
+	WhereRecoveryCodeUnused = "uid=? and code_hash=? and used_time is null"
+)
+
+//*****************************************入会 token*********************************************************/
+// 签发的入会 token 记录，用于审计，不保存 token 本身
+type RoomToken struct {
+	Id        int64     `json:"id,omitempty"`
+	Uid       int64     `json:"uid,omitempty" sql:"index:rt_uid"`        // 申请 token 的用户uid
+	RoomId    int64     `json:"roomId,omitempty" sql:"index:rt_room_id"` // 房间id
+	RoomName  string    `json:"roomName"`                                // 房间名称
+	Jti       string    `json:"jti"`                                     // token ID，转发到 API 服务签发时为空
+	UserId    string    `json:"userId"`                                  // token 中的参会者ID
+	UserName  string    `json:"userName"`                                // token 中的参会者名称
+	Moderator bool      `json:"moderator"`                               // 是否为主持人
+	Anonymous bool      `json:"anonymous"`                               // 是否为匿名参会者
+	Proxy     bool      `json:"proxy"`                                   // 是否转发到 API 服务签发
+	ExpiresAt time.Time `json:"expiresAt"`                               // 过期时间
+	Ip        string    `json:"ip"`                                      // 申请 IP
+	Ctime     time.Time `json:"ctime,omitempty" sql:"index:rt_ctime"`    // 签发时间
+}
+
+// 入会 token 表对应的表名称和字段名称
+const (
+	RoomTokenTableName    = "room_token"
+	RoomTokenRoomIdCol    = "room_id"
+	RoomTokenRoomNameCol  = "room_name"
+	RoomTokenJtiCol       = "jti"
+	RoomTokenUserIdCol    = "user_id"
+	RoomTokenUserNameCol  = "user_name"
+	RoomTokenModeratorCol = "moderator"
+	RoomTokenAnonymousCol = "anonymous"
+	RoomTokenProxyCol     = "proxy"
+	RoomTokenExpiresAtCol = "expires_at"
+	RoomTokenIpCol        = "ip"
+)
+
+//*****************************************历史密码*********************************************************/
+// 用户使用过的密码哈希，修改密码时避免重复使用最近的密码
+type PasswordHistory struct {
+	Id    int64     `json:"id,omitempty"`
+	Uid   int64     `json:"uid,omitempty" sql:"index:ph_uid"` // 用户uid
+	Hash  string    `json:"-"`                                // 密码哈希
+	Ctime time.Time `json:"ctime,omitempty"`                  // 停止使用的时间
+}
+
+// 历史密码表对应的表名称和字段名称
+const (
+	PasswordHistoryTableName = "password_history"
+	PasswordHistoryHashCol   = "hash"
 )
+
+//*****************************************API Key*********************************************************/
+// 内部服务使用的 API Key，只保存哈希值
+type APIKey struct {
+	Id        int64       `json:"id,omitempty"`
+	Uid       int64       `json:"uid,omitempty" sql:"index:ak_uid"`    // 创建者uid，使用 API Key 访问时视为该用户
+	Name      string      `json:"name"`                                // 名称，如调用方服务名
+	Prefix    string      `json:"prefix" sql:"index:ak_prefix,unique"` // 明文前缀，用于查找和展示
+	KeyHash   string      `json:"-"`                                   // 密钥哈希
+	Scopes    StringList  `json:"scopes"`                              // 授权范围，见 ScopeConferenceAction 等
+	Revoked   bool        `json:"revoked"`                             // 是否已吊销
+	LastUsed  db.NullTime `json:"lastUsed"`                            // 最近使用时间
+	ExpiresAt db.NullTime `json:"expiresAt"`                           // 过期时间，为空表示不过期
+	Ctime     time.Time   `json:"ctime,omitempty"`                     // 创建时间
+}
+
+// API Key 表对应的表名称和字段名称
+const (
+	APIKeyTableName    = "api_key"
+	APIKeyNameCol      = "name"
+	APIKeyPrefixCol    = "prefix"
+	APIKeyHashCol      = "key_hash"
+	APIKeyScopesCol    = "scopes"
+	APIKeyRevokedCol   = "revoked"
+	APIKeyLastUsedCol  = "last_used"
+	APIKeyExpiresAtCol = "expires_at"
+
+	WhereAPIKeyPrefix = "prefix=?"
+)
+
+//*****************************************Webhook*********************************************************/
+// Webhook 订阅，会议事件推送到用户或组织的业务系统
+type Webhook struct {
+	Id      int64      `json:"id,omitempty"`
+	Uid     int64      `json:"uid,omitempty" sql:"index:wh_uid"`      // 创建者uid
+	OrgId   int64      `json:"orgId,omitempty" sql:"index:wh_org_id"` // 所属组织id，不为 0 时推送组织内所有房间的事件
+	Url     string     `json:"url" sql:"length:512"`                  // 接收地址
+	Secret  string     `json:"-"`                                     // 签名密钥
+	Events  StringList `json:"events"`                                // 订阅的事件，为空表示全部，见 WebhookEventConferenceStarted 等
+	Enabled bool       `json:"enabled"`                               // 是否启用
+	Ctime   time.Time  `json:"ctime,omitempty"`                       // 创建时间
+}
+
+// Webhook 表对应的表名称和字段名称
+const (
+	WebhookTableName  = "webhook"
+	WebhookUrlCol     = "url"
+	WebhookSecretCol  = "secret"
+	WebhookEventsCol  = "events"
+	WebhookEnabledCol = "enabled"
+)
+
+// Webhook 推送记录
+type WebhookDelivery struct {
+	Id           int64       `json:"id,omitempty"`
+	WebhookId    int64       `json:"webhookId,omitempty" sql:"index:wd_webhook_id"` // Webhook id
+	Event        string      `json:"event,omitempty"`                               // 事件名
+	Payload      string      `json:"payload,omitempty" sql:"type:text"`             // 推送的 JSON 内容
+	Status       string      `json:"status,omitempty" sql:"index:wd_status"`        // 推送状态，见 DeliveryPending 等
+	Attempts     int         `json:"attempts"`                                      // 已推送次数
+	ResponseCode int         `json:"responseCode,omitempty"`                        // 最近一次推送的 HTTP 状态码
+	Error        string      `json:"error,omitempty" sql:"length:512"`              // 最近一次推送的错误信息
+	NextTime     db.NullTime `json:"nextTime,omitempty" sql:"index:wd_next_time"`   // 下次推送时间
+	Ctime        time.Time   `json:"ctime,omitempty"`                               // 创建时间
+	Utime        db.NullTime `json:"utime,omitempty"`                               // 最近一次推送时间
+}
+
+// Webhook 推送记录表对应的表名称和字段名称
+const (
+	WebhookDeliveryTableName = "webhook_delivery"
+	DeliveryWebhookIdCol     = "webhook_id"
+	DeliveryEventCol         = "event"
+	DeliveryPayloadCol       = "payload"
+	DeliveryStatusCol        = "status"
+	DeliveryAttemptsCol      = "attempts"
+	DeliveryRespCodeCol      = "response_code"
+	DeliveryErrorCol         = "error"
+	DeliveryNextTimeCol      = "next_time"
+	DeliveryUtimeCol         = "utime"
+
+	WhereDeliveryDue   = "status=? and next_time<=?"
+	WhereDeliveryClaim = "id=? and attempts=? and status=?"
+)
+
+//*****************************************预约会议*********************************************************/
+// 预约会议，在指定房间按时间举行，Recurrence 不为空时为重复会议
+type Meeting struct {
+	Id          int64      `json:"id,omitempty"`
+	Uid         int64      `json:"uid,omitempty" sql:"index:mt_uid"`      // 创建者uid
+	OrgId       int64      `json:"orgId,omitempty" sql:"index:mt_org_id"` // 所属组织id，与房间一致
+	RoomId      int64      `json:"roomId" sql:"index:mt_room_id"`         // 房间id
+	RoomName    string     `json:"roomName"`                              // 房间名称
+	Title       string     `json:"title"`                                 // 会议主题
+	Description string     `json:"description" sql:"type:text"`           // 会议说明
+	Start       time.Time  `json:"start"`                                 // 首次会议开始时间
+	Duration    int        `json:"duration"`                              // 会议时长（分钟）
+	Timezone    string     `json:"timezone"`                              // 时区，如 Asia/Shanghai，重复规则按该时区展开
+	Recurrence  string     `json:"recurrence"`                            // RFC 5545 重复规则，如 FREQ=WEEKLY;BYDAY=MO
+	Attendees   StringList `json:"attendees"`                             // 参会者邮箱，创建、修改和取消时发送邀请邮件
+	Sequence    int        `json:"sequence"`                              // 修改次数，日历客户端据此更新日程
+	Cancelled   bool       `json:"cancelled"`                             // 是否已取消
+	Ctime       time.Time  `json:"ctime,omitempty"`                       // 创建时间
+	Utime       time.Time  `json:"utime,omitempty"`                       // 修改时间
+}
+
+// 预约会议表对应的表名称和字段名称
+const (
+	MeetingTableName      = "meeting"
+	MeetingRoomIdCol      = "room_id"
+	MeetingRoomNameCol    = "room_name"
+	MeetingTitleCol       = "title"
+	MeetingDescriptionCol = "description"
+	MeetingStartCol       = "start"
+	MeetingDurationCol    = "duration"
+	MeetingTimezoneCol    = "timezone"
+	MeetingRecurrenceCol  = "recurrence"
+	MeetingAttendeesCol   = "attendees"
+	MeetingSequenceCol    = "sequence"
+	MeetingCancelledCol   = "cancelled"
+	MeetingUtimeCol       = "utime"
+
+	WhereMeetingRoom = "room_id=? and cancelled=?"
+)
+
+// 重复会议中被取消的一次日程
+type MeetingException struct {
+	Id        int64     `json:"id,omitempty"`
+	MeetingId int64     `json:"meetingId,omitempty" sql:"index:me_meeting_id"` // 预约会议id
+	Start     time.Time `json:"start"`                                         // 被取消的日程原定开始时间
+	Ctime     time.Time `json:"ctime,omitempty"`                               // 取消时间
+}
+
+// 预约会议例外表对应的表名称和字段名称
+const (
+	MeetingExceptionTableName  = "meeting_exception"
+	MeetingExceptionMeetingCol = "meeting_id"
+	MeetingExceptionStartCol   = "start"
+)
+
+//*****************************************邮件发件箱*********************************************************/
+// 待发送的邮件，由 RunMailer 发送，失败时重试
+type MailOutbox struct {
+	Id         int64       `json:"id,omitempty"`
+	Recipients StringList  `json:"recipients"`                                  // 收件人邮箱
+	Template   string      `json:"template,omitempty"`                          // 邮件模板，见 MailTemplateInvitation 等
+	Subject    string      `json:"subject,omitempty" sql:"length:512"`          // 邮件主题
+	Message    string      `json:"-" sql:"type:text"`                           // 完整的 MIME 邮件内容
+	Status     string      `json:"status,omitempty" sql:"index:mo_status"`      // 发送状态，见 DeliveryPending 等
+	Attempts   int         `json:"attempts"`                                    // 已发送次数
+	Error      string      `json:"error,omitempty" sql:"length:512"`            // 最近一次发送的错误信息
+	NextTime   db.NullTime `json:"nextTime,omitempty" sql:"index:mo_next_time"` // 下次发送时间
+	Ctime      time.Time   `json:"ctime,omitempty"`                             // 创建时间
+	Utime      db.NullTime `json:"utime,omitempty"`                             // 最近一次发送时间
+}
+
+// 发件箱表对应的表名称和字段名称，发送状态和查询条件与 Webhook 推送记录相同
+const (
+	MailOutboxTableName = "mail_outbox"
+	MailRecipientsCol   = "recipients"
+	MailTemplateCol     = "template"
+	MailSubjectCol      = "subject"
+	MailMessageCol      = "message"
+	MailStatusCol       = "status"
+	MailAttemptsCol     = "attempts"
+	MailErrorCol        = "error"
+	MailNextTimeCol     = "next_time"
+	MailUtimeCol        = "utime"
+)
+
+// 字符串列表，以 JSON 格式保存
+type StringList []string
+
+func (list StringList) Value() (driver.Value, error) {
+	if list == nil {
+		list = StringList{}
+	}
+	data, _ := json.Marshal(list)
+
+	return string(data), nil
+}
+
+func (list *StringList) Scan(src interface{}) error {
+	var source []byte
+	switch src.(type) {
+	case string:
+		source = []byte(src.(string))
+	case []byte:
+		source = src.([]byte)
+	case nil:
+		*list = nil
+		return nil
+	default:
+		return errors.New("Incompatible type for StringList")
+	}
+
+	return json.Unmarshal(source, list)
+}
+
+// Contains 是否包含 s
+func (list StringList) Contains(s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/xid"
+	"go.uber.org/zap"
+)
+
+const (
+	RefreshCookieName = CookieName + "_refresh"
+	TokenClaimsKey    = "claims" // gin.Context 中保存 *TokenClaims 的键
+
+	storeKeyPrefix        = "rtcadmin:"
+	sessionKeyPrefix      = storeKeyPrefix + "session:"
+	revokedTokenKeyPrefix = storeKeyPrefix + "revoked:"
+
+	// refreshReuseGrace 刷新后短时间内上一个刷新 token 再次出现视为并发刷新，不吊销会话
+	refreshReuseGrace = 10 * time.Second
+	// refreshRetiredMax 会话保存的已失效刷新 token 哈希的数量
+	refreshRetiredMax = 32
+)
+
+var (
+	ErrBadToken       = errors.New("bad token")
+	ErrSessionRevoked = errors.New("会话已失效，请重新登录")
+)
+
+// TokenClaims 访问 token 中的用户和会话信息
+type TokenClaims struct {
+	Uid       int64  `json:"uid"`
+	Jti       string `json:"jti"` // token 唯一 ID，用于吊销
+	Sid       string `json:"sid"` // 会话 ID，刷新 token 时不变
+	ExpiresAt int64  `json:"exp"`
+
+	Impersonator int64 `json:"imp,omitempty"` // 模拟登录时为操作员的用户 ID
+}
+
+// TokenPair 登录或刷新后下发的 token
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"` // 访问 token 有效期（秒）
+}
+
+// sessionRecord 保存在 Store 中的会话，刷新 token 只保存哈希值
+type sessionRecord struct {
+	Uid         int64  `json:"uid"`
+	RefreshHash string `json:"refreshHash"`
+	// 已失效的刷新 token 的哈希，最近的在前，再次出现时视为被盗用
+	RetiredRefreshHashes []string `json:"retired,omitempty"`
+	RefreshedAt          int64    `json:"rat,omitempty"` // 上次刷新的时间
+	Jti                  string   `json:"jti"`           // 当前访问 token 的 ID
+	ExpiresAt            int64    `json:"exp"`           // 当前访问 token 的过期时间
+
+	Impersonator int64 `json:"imp,omitempty"`
+}
+
+// RequestToken 从 cookie 或 Authorization 头中读取访问 token，cookie 优先
+func RequestToken(c *gin.Context) string {
+	tokenString := ""
+	if authString := c.GetHeader("Authorization"); len(authString) > 0 {
+		tokenString = strings.TrimPrefix(authString, "Bearer")
+		tokenString = strings.TrimSpace(tokenString)
+	}
+	if cookie, err := c.Cookie(CookieName); err == nil {
+		tokenString = cookie
+	}
+	return tokenString
+}
+
+func parseTokenClaims(claims jwt.MapClaims) (*TokenClaims, error) {
+	aud, _ := claims["aud"].(string)
+	uid, _ := strconv.ParseInt(aud, 10, 64)
+	if uid <= 0 {
+		return nil, ErrBadToken
+	}
+	tokenClaims := &TokenClaims{Uid: uid}
+	tokenClaims.Jti, _ = claims["jti"].(string)
+	tokenClaims.Sid, _ = claims["sid"].(string)
+	if imp, ok := claims["imp"].(string); ok {
+		tokenClaims.Impersonator, _ = strconv.ParseInt(imp, 10, 64)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		tokenClaims.ExpiresAt = int64(exp)
+	}
+	return tokenClaims, nil
+}
+
+// CreateSession 登录成功后创建会话，返回访问 token 和刷新 token
+func (app App) CreateSession(userID int64, ip, userAgent string) (*TokenPair, error) {
+	return app.ImpersonateSession(0, userID, ip, userAgent)
+}
+
+// ImpersonateSession 管理员以 userID 的身份创建会话，operatorID 为 0 时即普通登录
+func (app App) ImpersonateSession(operatorID, userID int64, ip, userAgent string) (*TokenPair, error) {
+	now := time.Now()
+	session := SessionInfo{
+		Sid:          xid.New().String(),
+		Uid:          userID,
+		Impersonator: operatorID,
+		Ip:           ip,
+		UserAgent:    userAgent,
+		Ctime:        now,
+		Atime:        now,
+	}
+	_, err := app.db.InsertInto(SessionTableName).
+		Columns(SessionSidCol, CommonUidCol, SessionImpersonatorCol, SessionIpCol, SessionUserAgentCol,
+			CommonCtimeCol, SessionAtimeCol).
+		Record(&session).Exec()
+	if err != nil {
+		return nil, err
+	}
+	return app.issueSession(sessionRecord{Uid: userID, Impersonator: operatorID}, session.Sid, "")
+}
+
+// RefreshSession 使用刷新 token 换取新的 token，旧的刷新 token 立即失效。
+// 已失效的刷新 token 再次出现时视为被盗用，整个会话被吊销；
+// 刚刷新后上一个刷新 token 再次出现视为并发刷新，与其他不匹配的 token 一样只返回 ErrBadToken。
+func (app App) RefreshSession(refreshToken string) (*TokenPair, error) {
+	parts := strings.SplitN(refreshToken, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrBadToken
+	}
+	sid := parts[0]
+
+	record, data, err := app.loadSession(sid)
+	if err != nil {
+		return nil, err
+	}
+	hash := []byte(hashToken(parts[1]))
+	if !hmac.Equal([]byte(record.RefreshHash), hash) {
+		for i, retired := range record.RetiredRefreshHashes {
+			if !hmac.Equal([]byte(retired), hash) {
+				continue
+			}
+			if i == 0 && time.Since(time.Unix(record.RefreshedAt, 0)) <= refreshReuseGrace {
+				break
+			}
+			logger.Warn("refresh token reused, revoke session.", zap.String("sid", sid), zap.Int64("uid", record.Uid))
+			app.RevokeSession(sid)
+			return nil, ErrSessionRevoked
+		}
+		return nil, ErrBadToken
+	}
+
+	oldJti, oldExpiresAt := record.Jti, record.ExpiresAt
+	record.RetiredRefreshHashes = append([]string{record.RefreshHash}, record.RetiredRefreshHashes...)
+	if len(record.RetiredRefreshHashes) > refreshRetiredMax {
+		record.RetiredRefreshHashes = record.RetiredRefreshHashes[:refreshRetiredMax]
+	}
+	record.RefreshedAt = time.Now().Unix()
+	tokens, err := app.issueSession(*record, sid, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// 旧的访问 token 随之失效
+	if err = app.RevokeToken(oldJti, oldExpiresAt); err != nil {
+		return nil, err
+	}
+
+	app.db.Update(SessionTableName).Set(SessionAtimeCol, time.Now()).Where(WhereSessionSid, sid).Exec()
+
+	return tokens, nil
+}
+
+// RevokeRefreshSession 吊销刷新 token 所属的会话，用于访问 token 已过期时退出登录。
+// 刷新 token 必须是当前有效的，避免他人伪造 sid 吊销会话。
+func (app App) RevokeRefreshSession(refreshToken string) error {
+	parts := strings.SplitN(refreshToken, ".", 2)
+	if len(parts) != 2 {
+		return ErrBadToken
+	}
+	record, _, err := app.loadSession(parts[0])
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(record.RefreshHash), []byte(hashToken(parts[1]))) {
+		return ErrBadToken
+	}
+	return app.RevokeSession(parts[0])
+}
+
+// ListSessions 用户未过期的登录会话，按登录时间倒序
+func (app App) ListSessions(userID int64) ([]SessionInfo, error) {
+	since := time.Now().Add(-time.Duration(app.config.Token.RefreshTokenTTL) * time.Second)
+	sessions := []SessionInfo{}
+	_, err := app.db.Select(SqlStar).From(SessionTableName).
+		Where(WhereSessionActive, userID, since).
+		OrderDesc(CommonCtimeCol).Load(&sessions)
+	return sessions, err
+}
+
+// RevokeUserSessions 吊销用户的所有会话，exceptSid 不为空时保留该会话
+func (app App) RevokeUserSessions(userID int64, exceptSid string) error {
+	sessions, err := app.ListSessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.Sid == exceptSid {
+			continue
+		}
+		if err = app.RevokeSession(session.Sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeSession 吊销会话，当前访问 token 和刷新 token 都不再可用
+func (app App) RevokeSession(sid string) error {
+	_, err := app.db.Update(SessionTableName).Set(SessionEtimeCol, time.Now()).
+		Where(WhereSessionOnline, sid).Exec()
+	if err != nil {
+		return err
+	}
+
+	record, _, err := app.loadSession(sid)
+	if err == ErrSessionRevoked {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = app.RevokeToken(record.Jti, record.ExpiresAt); err != nil {
+		return err
+	}
+	return app.store.Del(sessionKeyPrefix + sid)
+}
+
+// RevokeToken 将访问 token 加入吊销列表，保存到 token 过期为止
+func (app App) RevokeToken(jti string, expiresAt int64) error {
+	ttl := time.Until(time.Unix(expiresAt, 0))
+	if len(jti) == 0 || ttl <= 0 {
+		return nil
+	}
+	return app.store.Set(revokedTokenKeyPrefix+jti, "1", ttl)
+}
+
+// IsTokenRevoked 访问 token 是否已被吊销，存储不可用时按已吊销处理
+func (app App) IsTokenRevoked(jti string) bool {
+	_, err := app.store.Get(revokedTokenKeyPrefix + jti)
+	if err == ErrStoreNil {
+		return false
+	}
+	if err != nil {
+		logger.Error("check revoked token failed.", zap.String("jti", jti), zap.Error(err))
+	}
+	return true
+}
+
+// issueSession 签发新的 token 并保存会话。previous 不为空时为刷新，
+// 只有会话仍是读取时的值才写入，并发刷新中只有一个成功，其余返回 ErrBadToken。
+func (app App) issueSession(record sessionRecord, sid string, previous string) (*TokenPair, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, claims := app.CreateToken(TokenClaims{
+		Uid:          record.Uid,
+		Sid:          sid,
+		Impersonator: record.Impersonator,
+	})
+	record.RefreshHash = hashToken(secret)
+	record.Jti = claims.Jti
+	record.ExpiresAt = claims.ExpiresAt
+	data, _ := json.Marshal(record)
+	ttl := time.Duration(app.config.Token.RefreshTokenTTL) * time.Second
+	if len(previous) == 0 {
+		err = app.store.Set(sessionKeyPrefix+sid, string(data), ttl)
+	} else {
+		var swapped bool
+		swapped, err = app.store.CompareAndSwap(sessionKeyPrefix+sid, previous, string(data), ttl)
+		if err == nil && !swapped {
+			err = ErrBadToken
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: sid + "." + secret,
+		ExpiresIn:    app.config.Token.AccessTokenTTL,
+	}, nil
+}
+
+// loadSession 读取会话，同时返回原始值用于比较写入
+func (app App) loadSession(sid string) (*sessionRecord, string, error) {
+	data, err := app.store.Get(sessionKeyPrefix + sid)
+	if err == ErrStoreNil {
+		return nil, "", ErrSessionRevoked
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	record := &sessionRecord{}
+	if err = json.Unmarshal([]byte(data), record); err != nil {
+		return nil, "", err
+	}
+	return record, data, nil
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
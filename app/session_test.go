@@ -0,0 +1,187 @@
+package app
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/db"
+)
+
+func newTestApp() *App {
+	session := db.NewSQLDB(db.Config{Driver: "sqlite3", DSN: ":memory:"}, false)
+	// 内存数据库每个连接都是独立的
+	session.SetMaxOpenConns(1)
+	InitSqlDB(session)
+
+	return &App{
+		config: AppConfig{
+			Secret: "test",
+			Token: TokenConfig{
+				AccessTokenTTL:  60,
+				RefreshTokenTTL: 600,
+			},
+		},
+		store:  NewMemoryStore(),
+		broker: NewMemoryBroker(),
+		db:     session,
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	app := newTestApp()
+
+	tokens, err := app.CreateSession(1, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	claims, err := app.ParseToken(tokens.AccessToken)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, claims.Uid)
+	require.False(t, app.IsTokenRevoked(claims.Jti))
+
+	refreshed, err := app.RefreshSession(tokens.RefreshToken)
+	require.NoError(t, err)
+	require.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+
+	// 刷新后旧的访问 token 被吊销，会话 ID 不变
+	require.True(t, app.IsTokenRevoked(claims.Jti))
+	newClaims, err := app.ParseToken(refreshed.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, claims.Sid, newClaims.Sid)
+	require.False(t, app.IsTokenRevoked(newClaims.Jti))
+
+	// 伪造的刷新 token 不影响会话
+	sid := strings.SplitN(refreshed.RefreshToken, ".", 2)[0]
+	_, err = app.RefreshSession(sid + ".garbage")
+	require.Equal(t, ErrBadToken, err)
+	require.False(t, app.IsTokenRevoked(newClaims.Jti))
+
+	// 刚刷新后旧的刷新 token 再次出现视为并发刷新
+	_, err = app.RefreshSession(tokens.RefreshToken)
+	require.Equal(t, ErrBadToken, err)
+	require.False(t, app.IsTokenRevoked(newClaims.Jti))
+
+	// 之后旧的刷新 token 重复使用，整个会话被吊销
+	record, _, err := app.loadSession(sid)
+	require.NoError(t, err)
+	record.RefreshedAt -= int64(refreshReuseGrace/time.Second) + 1
+	data, _ := json.Marshal(record)
+	require.NoError(t, app.store.Set(sessionKeyPrefix+sid, string(data), time.Minute))
+	_, err = app.RefreshSession(tokens.RefreshToken)
+	require.Equal(t, ErrSessionRevoked, err)
+	require.True(t, app.IsTokenRevoked(newClaims.Jti))
+
+	_, err = app.RefreshSession(refreshed.RefreshToken)
+	require.Equal(t, ErrSessionRevoked, err)
+}
+
+func TestRefreshTokenReuseAfterRotations(t *testing.T) {
+	app := newTestApp()
+
+	tokens, err := app.CreateSession(1, "127.0.0.1", "test")
+	require.NoError(t, err)
+	stolen := tokens.RefreshToken
+	for i := 0; i < 3; i++ {
+		tokens, err = app.RefreshSession(tokens.RefreshToken)
+		require.NoError(t, err)
+	}
+	claims, err := app.ParseToken(tokens.AccessToken)
+	require.NoError(t, err)
+
+	// 多次刷新之前的刷新 token 再次出现同样吊销会话
+	_, err = app.RefreshSession(stolen)
+	require.Equal(t, ErrSessionRevoked, err)
+	require.True(t, app.IsTokenRevoked(claims.Jti))
+	_, err = app.RefreshSession(tokens.RefreshToken)
+	require.Equal(t, ErrSessionRevoked, err)
+}
+
+func TestConcurrentSessionRefresh(t *testing.T) {
+	app := newTestApp()
+
+	tokens, err := app.CreateSession(1, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	// 同一个刷新 token 并发使用时只有一个成功，其余返回 ErrBadToken，会话不被吊销
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = app.RefreshSession(tokens.RefreshToken)
+		}(i)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else {
+			require.Equal(t, ErrBadToken, err)
+		}
+	}
+	require.Equal(t, 1, succeeded)
+}
+
+func TestRevokeRefreshSession(t *testing.T) {
+	app := newTestApp()
+
+	tokens, err := app.CreateSession(1, "127.0.0.1", "test")
+	require.NoError(t, err)
+	claims, err := app.ParseToken(tokens.AccessToken)
+	require.NoError(t, err)
+
+	require.Equal(t, ErrBadToken, app.RevokeRefreshSession(claims.Sid+".garbage"))
+	require.False(t, app.IsTokenRevoked(claims.Jti))
+
+	require.NoError(t, app.RevokeRefreshSession(tokens.RefreshToken))
+	require.True(t, app.IsTokenRevoked(claims.Jti))
+	_, err = app.RefreshSession(tokens.RefreshToken)
+	require.Equal(t, ErrSessionRevoked, err)
+}
+
+func TestRevokeSession(t *testing.T) {
+	app := newTestApp()
+
+	tokens, err := app.CreateSession(1, "127.0.0.1", "test")
+	require.NoError(t, err)
+	claims, err := app.ParseToken(tokens.AccessToken)
+	require.NoError(t, err)
+
+	require.NoError(t, app.RevokeSession(claims.Sid))
+	require.True(t, app.IsTokenRevoked(claims.Jti))
+
+	_, err = app.RefreshSession(tokens.RefreshToken)
+	require.Equal(t, ErrSessionRevoked, err)
+
+	// 重复吊销不报错
+	require.NoError(t, app.RevokeSession(claims.Sid))
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	app := newTestApp()
+
+	var sids []string
+	for i := 0; i < 3; i++ {
+		tokens, err := app.CreateSession(2, "127.0.0.1", "test")
+		require.NoError(t, err)
+		claims, err := app.ParseToken(tokens.AccessToken)
+		require.NoError(t, err)
+		sids = append(sids, claims.Sid)
+	}
+
+	sessions, err := app.ListSessions(2)
+	require.NoError(t, err)
+	require.Len(t, sessions, 3)
+
+	require.NoError(t, app.RevokeUserSessions(2, sids[0]))
+
+	sessions, err = app.ListSessions(2)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, sids[0], sessions[0].Sid)
+}
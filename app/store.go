@@ -0,0 +1,206 @@
+package app
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrStoreNil 键不存在或已过期
+var ErrStoreNil = errors.New("store: key not found")
+
+// Store 带过期时间的键值存储，配置了 Redis 时使用 Redis，否则使用进程内存
+type Store interface {
+	Get(key string) (string, error)
+	Set(key string, value string, ttl time.Duration) error
+	// SetNX 键不存在时才写入，返回是否写入成功
+	SetNX(key string, value string, ttl time.Duration) (bool, error)
+	// CompareAndSwap 键的当前值等于 old 时才写入 value，返回是否写入成功
+	CompareAndSwap(key string, old string, value string, ttl time.Duration) (bool, error)
+	Del(keys ...string) error
+	// Incr 计数加一，首次创建时设置过期时间
+	Incr(key string, ttl time.Duration) (int64, error)
+}
+
+func newStore(redisCli redis.UniversalClient) Store {
+	if redisCli != nil {
+		return &redisStore{cli: redisCli}
+	}
+	return NewMemoryStore()
+}
+
+type redisStore struct {
+	cli redis.UniversalClient
+}
+
+func (s *redisStore) Get(key string) (string, error) {
+	val, err := s.cli.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrStoreNil
+	}
+	return val, err
+}
+
+func (s *redisStore) Set(key string, value string, ttl time.Duration) error {
+	return s.cli.Set(key, value, ttl).Err()
+}
+
+func (s *redisStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	return s.cli.SetNX(key, value, ttl).Result()
+}
+
+// compareAndSwapScript 比较和写入在 Redis 中原子执行
+var compareAndSwapScript = redis.NewScript(`
+if redis.call('get', KEYS[1]) == ARGV[1] then
+	redis.call('set', KEYS[1], ARGV[2], 'px', ARGV[3])
+	return 1
+end
+return 0`)
+
+func (s *redisStore) CompareAndSwap(key string, old string, value string, ttl time.Duration) (bool, error) {
+	val, err := compareAndSwapScript.Run(s.cli, []string{key}, old, value, ttl.Milliseconds()).Int()
+	return val == 1, err
+}
+
+func (s *redisStore) Del(keys ...string) error {
+	return s.cli.Del(keys...).Err()
+}
+
+func (s *redisStore) Incr(key string, ttl time.Duration) (int64, error) {
+	val, err := s.cli.Incr(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if val == 1 {
+		err = s.cli.Expire(key, ttl).Err()
+	}
+	return val, err
+}
+
+type memoryItem struct {
+	value    string
+	expireAt time.Time
+}
+
+func (item memoryItem) expired(now time.Time) bool {
+	return !item.expireAt.IsZero() && now.After(item.expireAt)
+}
+
+// MemoryStore 进程内存存储，未配置 Redis 时使用，多实例部署时数据不共享
+type MemoryStore struct {
+	mu      sync.Mutex
+	items   map[string]memoryItem
+	sweptAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: make(map[string]memoryItem),
+	}
+}
+
+func (s *MemoryStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.load(key)
+	if !ok {
+		return "", ErrStoreNil
+	}
+	return item.value, nil
+}
+
+func (s *MemoryStore) Set(key string, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store(key, value, ttl)
+	return nil
+}
+
+func (s *MemoryStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.load(key); ok {
+		return false, nil
+	}
+	s.store(key, value, ttl)
+	return true, nil
+}
+
+func (s *MemoryStore) CompareAndSwap(key string, old string, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, ok := s.load(key); !ok || item.value != old {
+		return false, nil
+	}
+	s.store(key, value, ttl)
+	return true, nil
+}
+
+func (s *MemoryStore) Del(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.items, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.load(key)
+	if !ok {
+		s.store(key, "1", ttl)
+		return 1, nil
+	}
+	val, err := strconv.ParseInt(item.value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	val++
+	item.value = strconv.FormatInt(val, 10)
+	s.items[key] = item
+	return val, nil
+}
+
+func (s *MemoryStore) load(key string) (memoryItem, bool) {
+	now := time.Now()
+	s.sweep(now)
+
+	item, ok := s.items[key]
+	if ok && item.expired(now) {
+		delete(s.items, key)
+		return item, false
+	}
+	return item, ok
+}
+
+func (s *MemoryStore) store(key string, value string, ttl time.Duration) {
+	item := memoryItem{value: value}
+	if ttl > 0 {
+		item.expireAt = time.Now().Add(ttl)
+	}
+	s.items[key] = item
+}
+
+// sweep 每分钟最多清理一次过期的键
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.sweptAt) < time.Minute {
+		return
+	}
+	s.sweptAt = now
+	for key, item := range s.items {
+		if item.expired(now) {
+			delete(s.items, key)
+		}
+	}
+}
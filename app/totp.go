@@ -0,0 +1,422 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+	"jhmeeting.com/adminserver/util"
+)
+
+const (
+	totpIssuer = "jhmeeting"
+	// 允许的时间误差（时间步）
+	totpSkew = 1
+	// 生成密钥后需要在该时间内完成绑定
+	totpPendingTTL = 10 * time.Minute
+
+	// 两步登录中第一步返回的 challenge 有效期
+	LoginChallengeTTL = 5 * time.Minute
+	// 同一 challenge 允许的错误次数
+	loginChallengeMaxFailures = 5
+	// 已登录用户校验动态验证码的错误计数时间窗口，错误次数上限与 challenge 相同
+	totpFailWindow = 15 * time.Minute
+
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+
+	totpPendingKeyPrefix   = storeKeyPrefix + "totp-pending:"
+	totpUsedKeyPrefix      = storeKeyPrefix + "totp-used:"
+	challengeKeyPrefix     = storeKeyPrefix + "challenge:"
+	challengeFailKeyPrefix = storeKeyPrefix + "challenge-fail:"
+	totpFailKeyPrefix      = storeKeyPrefix + "totp-fail:"
+)
+
+var (
+	ErrInvalidTotp     = errors.New("动态验证码错误")
+	ErrTotpEnabled     = errors.New("已启用两步验证")
+	ErrTotpNotEnabled  = errors.New("未启用两步验证")
+	ErrTotpRequired    = errors.New("所在组织要求启用两步验证，不能关闭")
+	ErrBadChallenge    = errors.New("登录已过期，请重新登录")
+	ErrTotpNotPrepared = errors.New("请先生成两步验证密钥")
+	ErrTotpLocked      = errors.New("动态验证码错误次数过多，请稍后再试")
+)
+
+// recoveryAlphabet 恢复码字符，去掉了容易混淆的字符
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// TotpSetup 绑定身份验证器时使用的密钥和 otpauth:// 地址
+type TotpSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// LoginChallenge 启用了两步验证的用户登录第一步返回的 challenge，
+// 第二步使用它和动态验证码换取 token。Enroll 为 true 表示用户尚未绑定，需要先生成密钥。
+type LoginChallenge struct {
+	Challenge string `json:"challenge"`
+	Enroll    bool   `json:"enroll"`
+	ExpiresIn int    `json:"expiresIn"` // 有效期（秒）
+}
+
+type challengeRecord struct {
+	Uid    int64  `json:"uid"`
+	Name   string `json:"name"` // 第一步登录使用的账号名，动态验证码错误时计入该账号的登录失败次数
+	Enroll bool   `json:"enroll"`
+}
+
+// TotpRequired 用户所在的组织是否要求启用两步验证
+func (app App) TotpRequired(ctx context.Context, uid int64) (bool, error) {
+	count, err := app.db.Select("count(*)").From(dbr.I(OrgMemberTableName).As("m")).
+		Join(dbr.I(OrgTableName).As("o"), "o.id=m.org_id").
+		Where("m.uid=? and o.require_totp=?", uid, true).ReturnInt64()
+	return count > 0, err
+}
+
+// SetupTotp 生成新的密钥，调用 EnableTotp 校验动态验证码后才会生效
+func (app App) SetupTotp(ctx context.Context, uid int64) (*TotpSetup, error) {
+	user, err := app.loadUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if user.TotpEnabled {
+		return nil, ErrTotpEnabled
+	}
+	secret, err := util.NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err = app.store.Set(totpPendingKeyPrefix+strconv.FormatInt(uid, 10), secret, totpPendingTTL); err != nil {
+		return nil, err
+	}
+	return &TotpSetup{
+		Secret: secret,
+		URI:    util.TOTPProvisioningURI(totpIssuer, user.Name, secret),
+	}, nil
+}
+
+// EnableTotp 使用 SetupTotp 生成的密钥校验动态验证码，通过后启用两步验证并返回恢复码
+func (app App) EnableTotp(ctx context.Context, uid int64, code string) ([]string, error) {
+	key := totpPendingKeyPrefix + strconv.FormatInt(uid, 10)
+	secret, err := app.store.Get(key)
+	if err == ErrStoreNil {
+		return nil, ErrTotpNotPrepared
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = app.checkTotp(uid, secret, code); err != nil {
+		return nil, err
+	}
+
+	tx, err := app.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	result, err := tx.Update(UserTableName).
+		Set(UserTotpSecretCol, secret).
+		Set(UserTotpEnabledCol, true).
+		Where(WhereCommonId, uid).Where(dbr.Eq(UserTotpEnabledCol, false)).
+		ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, ErrTotpEnabled
+	}
+	codes, err := app.resetRecoveryCodes(ctx, tx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	app.store.Del(key)
+	logger.Info("totp enabled.", zap.Int64("uid", uid))
+	return codes, nil
+}
+
+// DisableTotp 校验动态验证码或恢复码后关闭两步验证，组织要求启用时不能关闭
+func (app App) DisableTotp(ctx context.Context, uid int64, code string) error {
+	user, err := app.loadUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if !user.TotpEnabled {
+		return ErrTotpNotEnabled
+	}
+	if required, err := app.TotpRequired(ctx, uid); err != nil || required {
+		if err != nil {
+			return err
+		}
+		return ErrTotpRequired
+	}
+	err = app.limitTotpFailures(uid, func() error {
+		return app.VerifyTotp(ctx, user, code)
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	_, err = tx.Update(UserTableName).
+		Set(UserTotpSecretCol, "").
+		Set(UserTotpEnabledCol, false).
+		Where(WhereCommonId, uid).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.DeleteFrom(RecoveryCodeTableName).Where(dbr.Eq(CommonUidCol, uid)).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	logger.Info("totp disabled.", zap.Int64("uid", uid))
+	return nil
+}
+
+// RegenerateRecoveryCodes 校验动态验证码后重新生成恢复码，旧的恢复码全部失效
+func (app App) RegenerateRecoveryCodes(ctx context.Context, uid int64, code string) ([]string, error) {
+	user, err := app.loadUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TotpEnabled {
+		return nil, ErrTotpNotEnabled
+	}
+	err = app.limitTotpFailures(uid, func() error {
+		return app.checkTotp(uid, user.TotpSecret, code)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return app.resetRecoveryCodes(ctx, app.db, uid)
+}
+
+// limitTotpFailures 已登录用户校验动态验证码时按用户累计错误次数，
+// 达到上限后在时间窗口内拒绝校验，避免访问 token 泄露后被暴力破解关闭两步验证
+func (app App) limitTotpFailures(uid int64, verify func() error) error {
+	key := totpFailKeyPrefix + strconv.FormatInt(uid, 10)
+	if value, err := app.store.Get(key); err == nil {
+		if failures, _ := strconv.Atoi(value); failures >= loginChallengeMaxFailures {
+			return ErrTotpLocked
+		}
+	} else if err != ErrStoreNil {
+		return err
+	}
+
+	err := verify()
+	if err == ErrInvalidTotp {
+		failures, incrErr := app.store.Incr(key, totpFailWindow)
+		if incrErr != nil {
+			return incrErr
+		}
+		logger.Warn("totp failed.", zap.Int64("uid", uid), zap.Int64("failures", failures))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return app.store.Del(key)
+}
+
+// VerifyTotp 校验动态验证码，也可以使用一个未使用过的恢复码
+func (app App) VerifyTotp(ctx context.Context, user *User, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == util.TOTPDigits {
+		return app.checkTotp(user.Id, user.TotpSecret, code)
+	}
+
+	result, err := app.db.Update(RecoveryCodeTableName).
+		Set(RecoveryCodeUsedCol, time.Now()).
+		Where(WhereRecoveryCodeUnused, user.Id, hashToken(normalizeRecoveryCode(code))).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidTotp
+	}
+	logger.Info("recovery code used.", zap.Int64("uid", user.Id))
+	return nil
+}
+
+// checkTotp 校验动态验证码，同一个时间步的验证码只能使用一次
+func (app App) checkTotp(uid int64, secret, code string) error {
+	counter, ok := util.CheckTOTP(secret, strings.TrimSpace(code), time.Now(), totpSkew)
+	if !ok {
+		return ErrInvalidTotp
+	}
+	key := totpUsedKeyPrefix + strconv.FormatInt(uid, 10) + ":" + strconv.FormatInt(counter, 10)
+	ttl := time.Duration((2*totpSkew+1)*util.TOTPPeriod) * time.Second
+	ok, err := app.store.SetNX(key, "1", ttl)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidTotp
+	}
+	return nil
+}
+
+// resetRecoveryCodes 删除旧的恢复码并生成新的，数据库中只保存哈希值
+func (app App) resetRecoveryCodes(ctx context.Context, runner dbr.SessionRunner, uid int64) ([]string, error) {
+	_, err := runner.DeleteFrom(RecoveryCodeTableName).Where(dbr.Eq(CommonUidCol, uid)).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	codes := make([]string, 0, recoveryCodeCount)
+	stmt := runner.InsertInto(RecoveryCodeTableName).Columns(CommonUidCol, RecoveryCodeHashCol, CommonCtimeCol)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		stmt.Record(&RecoveryCode{Uid: uid, CodeHash: hashToken(normalizeRecoveryCode(code)), Ctime: now})
+	}
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// newRecoveryCode 生成形如 abcde-fghjk 的恢复码
+func newRecoveryCode() (string, error) {
+	max := big.NewInt(int64(len(recoveryAlphabet)))
+	code := make([]byte, 0, recoveryCodeLength+1)
+	for i := 0; i < recoveryCodeLength; i++ {
+		if i == recoveryCodeLength/2 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, recoveryAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+// CreateLoginChallenge 密码校验通过后生成 challenge，name 为登录使用的账号名，
+// enroll 表示用户需要先绑定身份验证器
+func (app App) CreateLoginChallenge(uid int64, name string, enroll bool) (*LoginChallenge, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(challengeRecord{Uid: uid, Name: name, Enroll: enroll})
+	if err = app.store.Set(challengeKeyPrefix+hashToken(token), string(data), LoginChallengeTTL); err != nil {
+		return nil, err
+	}
+	return &LoginChallenge{
+		Challenge: token,
+		Enroll:    enroll,
+		ExpiresIn: int(LoginChallengeTTL / time.Second),
+	}, nil
+}
+
+func (app App) loadChallenge(token string) (*challengeRecord, error) {
+	data, err := app.store.Get(challengeKeyPrefix + hashToken(token))
+	if err == ErrStoreNil {
+		return nil, ErrBadChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &challengeRecord{}
+	if err = json.Unmarshal([]byte(data), record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ChallengeTotpSetup 登录时尚未绑定身份验证器的用户使用 challenge 生成密钥
+func (app App) ChallengeTotpSetup(ctx context.Context, token string) (*TotpSetup, error) {
+	record, err := app.loadChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	if !record.Enroll {
+		return nil, ErrTotpEnabled
+	}
+	return app.SetupTotp(ctx, record.Uid)
+}
+
+// CompleteLoginChallenge 登录第二步，校验动态验证码后创建会话。
+// 需要绑定身份验证器时同时启用两步验证，并返回恢复码。
+// 动态验证码错误与密码错误一样计入账号和 IP 的登录失败次数，避免反复生成 challenge 暴力破解。
+func (app App) CompleteLoginChallenge(ctx context.Context, token, code, ip, userAgent string) (*TokenPair, []string, error) {
+	record, err := app.loadChallenge(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = app.CheckLoginAllowed(record.Name, ip); err != nil {
+		return nil, nil, err
+	}
+	key := hashToken(token)
+
+	var codes []string
+	if record.Enroll {
+		codes, err = app.EnableTotp(ctx, record.Uid, code)
+	} else {
+		var user *User
+		if user, err = app.loadUser(ctx, record.Uid); err == nil {
+			err = app.VerifyTotp(ctx, user, code)
+		}
+	}
+	if err == ErrInvalidTotp {
+		failures, incrErr := app.store.Incr(challengeFailKeyPrefix+key, LoginChallengeTTL)
+		if incrErr == nil && failures >= loginChallengeMaxFailures {
+			app.store.Del(challengeKeyPrefix+key, challengeFailKeyPrefix+key)
+		}
+		logger.Info("login totp failed.", zap.Int64("uid", record.Uid), zap.String("ip", ip))
+		if failErr := app.RecordLoginFailure(record.Name, ip, err.Error()); failErr != nil {
+			return nil, nil, failErr
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = app.store.Del(challengeKeyPrefix+key, challengeFailKeyPrefix+key); err != nil {
+		return nil, nil, err
+	}
+	if err = app.RecordLoginSuccess(record.Name); err != nil {
+		return nil, nil, err
+	}
+	tokens, err := app.CreateSession(record.Uid, ip, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, codes, nil
+}
+
+// RecoveryCodesLeft 剩余未使用的恢复码数量
+func (app App) RecoveryCodesLeft(ctx context.Context, uid int64) (int64, error) {
+	return app.db.Select("count(*)").From(RecoveryCodeTableName).
+		Where(dbr.Eq(CommonUidCol, uid)).Where(dbr.Eq(RecoveryCodeUsedCol, nil)).
+		ReturnInt64()
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/util"
+)
+
+func TestTotpLogin(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, CommonCtimeCol).
+		Values("alice", "", time.Now()).Exec()
+	require.NoError(t, err)
+
+	// 绑定身份验证器
+	_, err = app.EnableTotp(ctx, 1, "123456")
+	require.Equal(t, ErrTotpNotPrepared, err)
+	setup, err := app.SetupTotp(ctx, 1)
+	require.NoError(t, err)
+	require.Contains(t, setup.URI, "otpauth://totp/jhmeeting:alice?")
+	_, err = app.EnableTotp(ctx, 1, "000000x")
+	require.Equal(t, ErrInvalidTotp, err)
+	code, _ := util.TOTPCode(setup.Secret, time.Now())
+	codes, err := app.EnableTotp(ctx, 1, code)
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodeCount)
+	_, err = app.SetupTotp(ctx, 1)
+	require.Equal(t, ErrTotpEnabled, err)
+
+	// 同一个动态验证码不能重复使用
+	challenge, err := app.CreateLoginChallenge(1, "alice", false)
+	require.NoError(t, err)
+	_, _, err = app.CompleteLoginChallenge(ctx, challenge.Challenge, code, "127.0.0.1", "test")
+	require.Equal(t, ErrInvalidTotp, err)
+
+	// 恢复码只能使用一次，challenge 使用后失效
+	tokens, _, err := app.CompleteLoginChallenge(ctx, challenge.Challenge, codes[0], "127.0.0.1", "test")
+	require.NoError(t, err)
+	require.NotEmpty(t, tokens.AccessToken)
+	_, _, err = app.CompleteLoginChallenge(ctx, challenge.Challenge, codes[1], "127.0.0.1", "test")
+	require.Equal(t, ErrBadChallenge, err)
+	challenge, _ = app.CreateLoginChallenge(1, "alice", false)
+	_, _, err = app.CompleteLoginChallenge(ctx, challenge.Challenge, codes[0], "127.0.0.1", "test")
+	require.Equal(t, ErrInvalidTotp, err)
+	left, err := app.RecoveryCodesLeft(ctx, 1)
+	require.NoError(t, err)
+	require.EqualValues(t, recoveryCodeCount-1, left)
+
+	// 错误次数过多后 challenge 作废
+	for i := 1; i < loginChallengeMaxFailures; i++ {
+		_, _, err = app.CompleteLoginChallenge(ctx, challenge.Challenge, "wrong", "127.0.0.1", "test")
+		require.Equal(t, ErrInvalidTotp, err)
+	}
+	_, _, err = app.CompleteLoginChallenge(ctx, challenge.Challenge, codes[1], "127.0.0.1", "test")
+	require.Equal(t, ErrBadChallenge, err)
+
+	// 动态验证码错误计入账号的登录失败次数，重新生成 challenge 也不能继续尝试
+	challenge, _ = app.CreateLoginChallenge(1, "alice", false)
+	_, _, err = app.CompleteLoginChallenge(ctx, challenge.Challenge, codes[1], "127.0.0.1", "test")
+	require.Equal(t, ErrAccountLocked, err)
+	require.Equal(t, ErrAccountLocked, app.CheckLoginAllowed("alice", "127.0.0.2"))
+
+	// 已登录后关闭两步验证、重新生成恢复码同样限制错误次数，按用户累计
+	for i := 0; i < loginChallengeMaxFailures; i++ {
+		_, err = app.RegenerateRecoveryCodes(ctx, 1, "00000x")
+		require.Equal(t, ErrInvalidTotp, err)
+	}
+	_, err = app.RegenerateRecoveryCodes(ctx, 1, "00000x")
+	require.Equal(t, ErrTotpLocked, err)
+	require.Equal(t, ErrTotpLocked, app.DisableTotp(ctx, 1, codes[1]))
+	user, err := app.loadUser(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, user.TotpEnabled)
+}
+
+func TestTotpRequiredByOrg(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, CommonCtimeCol).
+		Values("bob", "", time.Now()).Exec()
+	require.NoError(t, err)
+	_, err = app.db.InsertInto(OrgTableName).
+		Columns(CommonUidCol, OrgNameCol, OrgRequireTotpCol, CommonCtimeCol).
+		Values(1, "org", true, time.Now()).Exec()
+	require.NoError(t, err)
+
+	required, err := app.TotpRequired(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, required)
+	_, err = app.db.InsertInto(OrgMemberTableName).
+		Columns(OrgMemberOrgIdCol, CommonUidCol, OrgMemberRoleCol, CommonCtimeCol).
+		Values(1, 1, OrgRoleMember, time.Now()).Exec()
+	require.NoError(t, err)
+	required, err = app.TotpRequired(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, required)
+
+	// 未绑定的用户在登录过程中完成绑定
+	challenge, err := app.CreateLoginChallenge(1, "bob", true)
+	require.NoError(t, err)
+	setup, err := app.ChallengeTotpSetup(ctx, challenge.Challenge)
+	require.NoError(t, err)
+	code, _ := util.TOTPCode(setup.Secret, time.Now())
+	tokens, codes, err := app.CompleteLoginChallenge(ctx, challenge.Challenge, code, "127.0.0.1", "test")
+	require.NoError(t, err)
+	require.NotEmpty(t, tokens.AccessToken)
+	require.Len(t, codes, recoveryCodeCount)
+
+	// 组织要求时不能关闭
+	require.Equal(t, ErrTotpRequired, app.DisableTotp(ctx, 1, codes[0]))
+	_, err = app.db.Update(OrgTableName).Set(OrgRequireTotpCol, false).Exec()
+	require.NoError(t, err)
+	require.NoError(t, app.DisableTotp(ctx, 1, codes[0]))
+	user, err := app.loadUser(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, user.TotpEnabled)
+	require.Empty(t, user.TotpSecret)
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	verifyCodeTTL = 15 * time.Minute
+	// 同一用户每小时最多请求的验证码次数
+	verifyUserLimit  = 10
+	verifyRateWindow = time.Hour
+	// 同一用户同一渠道两次请求验证码的最小间隔
+	verifyCooldown = time.Minute
+	// 注册时同一 IP 每小时最多发送的验证码次数
+	signupIPLimit = 10
+)
+
+var (
+	ErrNoContact       = errors.New("未设置邮箱或手机号码")
+	ErrAlreadyVerified = errors.New("已验证，无需重复验证")
+	ErrNotVerified     = errors.New("请先验证邮箱或手机号码")
+)
+
+// VerifyConfig 邮箱和手机号码验证
+type VerifyConfig struct {
+	RequireForRoom bool `json:"requireForRoom,omitempty"` // 只有已验证邮箱或手机号码的用户可以创建会议室
+}
+
+// Verified 邮箱或手机号码是否至少有一个已验证
+func (user User) Verified() bool {
+	return user.EmailVerified || user.PhoneVerified
+}
+
+// verifyTarget 渠道对应的验证码用途、联系方式、是否已验证和数据库字段
+func verifyTarget(user *User, channel string) (purpose, to string, verified bool, col string, err error) {
+	switch channel {
+	case ChannelEmail:
+		return CodePurposeVerifyEmail, user.Email, user.EmailVerified, UserEmailVerifiedCol, nil
+	case ChannelSMS:
+		return CodePurposeVerifyPhone, user.Phone, user.PhoneVerified, UserPhoneVerifiedCol, nil
+	}
+	return "", "", false, "", ErrNoCodeChannel
+}
+
+// verifySubject 验证码绑定用户和联系方式，修改邮箱或手机号码后旧验证码失效
+func verifySubject(uid int64, to string) string {
+	return strconv.FormatInt(uid, 10) + ":" + to
+}
+
+func (app App) loadUser(ctx context.Context, uid int64) (*User, error) {
+	user := &User{}
+	err := app.db.Select(SqlStar).From(UserTableName).
+		Where(WhereCommonId, uid).LoadOneContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SendVerifyCode 向用户的邮箱或手机号码发送验证码
+func (app App) SendVerifyCode(ctx context.Context, uid int64, channel string) error {
+	user, err := app.loadUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	purpose, to, verified, _, err := verifyTarget(user, channel)
+	if err != nil {
+		return err
+	}
+	if len(to) == 0 {
+		return ErrNoContact
+	}
+	if verified {
+		return ErrAlreadyVerified
+	}
+
+	subject := strconv.FormatInt(uid, 10)
+	if ok, err := app.allowRate("verify-user:"+subject, verifyUserLimit, verifyRateWindow); err != nil || !ok {
+		return rateError(err)
+	}
+	if ok, err := app.store.SetNX(rateKeyPrefix+"verify-cooldown:"+channel+":"+subject, "1", verifyCooldown); err != nil || !ok {
+		return rateError(err)
+	}
+	code, err := app.issueCode(purpose, verifySubject(uid, to), verifyCodeTTL)
+	if err != nil {
+		return err
+	}
+	return app.CodeSender().SendCode(ctx, channel, to, purpose, code, verifyCodeTTL)
+}
+
+// SendSignupCode 注册后向填写的邮箱或手机号码发送验证码。
+// 注册无需登录，按 IP 限制发送次数，避免被用来批量发送短信和邮件。
+func (app App) SendSignupCode(ctx context.Context, uid int64, channel, ip string) error {
+	if ok, err := app.allowRate("signup-ip:"+ip, signupIPLimit, verifyRateWindow); err != nil || !ok {
+		return rateError(err)
+	}
+	return app.SendVerifyCode(ctx, uid, channel)
+}
+
+// ConfirmVerifyCode 校验验证码，通过后将邮箱或手机号码标记为已验证
+func (app App) ConfirmVerifyCode(ctx context.Context, uid int64, channel, code string) error {
+	user, err := app.loadUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	purpose, to, _, col, err := verifyTarget(user, channel)
+	if err != nil {
+		return err
+	}
+	if len(to) == 0 {
+		return ErrInvalidCode
+	}
+	if err = app.checkCode(purpose, verifySubject(uid, to), code); err != nil {
+		return err
+	}
+
+	// 只在联系方式仍是验证码发送时的地址时标记，避免验证期间修改为他人的地址
+	contactCol := UserEmailCol
+	if channel == ChannelSMS {
+		contactCol = UserPhoneCol
+	}
+	result, err := app.db.Update(UserTableName).Set(col, true).
+		Where(WhereCommonId, uid).Where(dbr.Eq(contactCol, to)).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidCode
+	}
+	logger.Info("contact verified.", zap.Int64("uid", uid), zap.String("channel", channel))
+	return nil
+}
+
+// CheckRoomCreator 开启 RequireForRoom 时，未验证的用户不能创建会议室
+func (app App) CheckRoomCreator(ctx context.Context, uid int64) error {
+	if !app.config.Verify.RequireForRoom {
+		return nil
+	}
+	user, err := app.loadUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if !user.Verified() {
+		return ErrNotVerified
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyContact(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+	sender := &fakeCodeSender{}
+	app.SetCodeSender(sender)
+	app.config.Verify.RequireForRoom = true
+
+	_, err := app.db.InsertInto(UserTableName).
+		Columns(UserNameCol, UserPasswordCol, UserEmailCol, UserPhoneCol, CommonCtimeCol).
+		Values("alice", "", "alice@example.com", "", time.Now()).Exec()
+	require.NoError(t, err)
+
+	require.Equal(t, ErrNotVerified, app.CheckRoomCreator(ctx, 1))
+	require.Equal(t, ErrNoContact, app.SendVerifyCode(ctx, 1, ChannelSMS))
+	require.Equal(t, ErrNoCodeChannel, app.SendVerifyCode(ctx, 1, "fax"))
+
+	require.NoError(t, app.SendVerifyCode(ctx, 1, ChannelEmail))
+	require.Len(t, sender.sent, 1)
+	require.Equal(t, fakeCode{ChannelEmail, "alice@example.com", CodePurposeVerifyEmail, sender.sent[0].code}, sender.sent[0])
+	require.Equal(t, ErrRateLimited, app.SendVerifyCode(ctx, 1, ChannelEmail))
+
+	// 重置密码的验证码不能用于验证邮箱
+	require.Equal(t, ErrInvalidCode, app.checkCode(CodePurposeResetPassword, "1", sender.sent[0].code))
+	require.Equal(t, ErrInvalidCode, app.ConfirmVerifyCode(ctx, 1, ChannelEmail, "wrong"))
+	require.NoError(t, app.ConfirmVerifyCode(ctx, 1, ChannelEmail, sender.sent[0].code))
+	require.Equal(t, ErrInvalidCode, app.ConfirmVerifyCode(ctx, 1, ChannelEmail, sender.sent[0].code))
+
+	user, err := app.loadUser(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, user.EmailVerified)
+	require.False(t, user.PhoneVerified)
+	require.NoError(t, app.CheckRoomCreator(ctx, 1))
+	require.Equal(t, ErrAlreadyVerified, app.SendVerifyCode(ctx, 1, ChannelEmail))
+
+	// 验证码绑定发送时的手机号码，修改手机号码后失效
+	_, err = app.db.Update(UserTableName).Set(UserPhoneCol, "13800000000").Where(WhereCommonId, 1).Exec()
+	require.NoError(t, err)
+	require.NoError(t, app.SendVerifyCode(ctx, 1, ChannelSMS))
+	require.Len(t, sender.sent, 2)
+	require.Equal(t, "13800000000", sender.sent[1].to)
+	_, err = app.db.Update(UserTableName).Set(UserPhoneCol, "13900000000").Where(WhereCommonId, 1).Exec()
+	require.NoError(t, err)
+	require.Equal(t, ErrInvalidCode, app.ConfirmVerifyCode(ctx, 1, ChannelSMS, sender.sent[1].code))
+}
+
+func TestSignupCodeRate(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+	sender := &fakeCodeSender{}
+	app.SetCodeSender(sender)
+
+	for i := 0; i <= signupIPLimit; i++ {
+		_, err := app.db.InsertInto(UserTableName).
+			Columns(UserNameCol, UserPasswordCol, UserEmailCol, UserPhoneCol, CommonCtimeCol).
+			Values("user"+strconv.Itoa(i), "", "user"+strconv.Itoa(i)+"@example.com", "", time.Now()).Exec()
+		require.NoError(t, err)
+	}
+
+	// 同一 IP 注册的不同用户共用发送次数
+	for i := 1; i <= signupIPLimit; i++ {
+		require.NoError(t, app.SendSignupCode(ctx, int64(i), ChannelEmail, "10.0.0.1"))
+	}
+	require.Equal(t, ErrRateLimited, app.SendSignupCode(ctx, signupIPLimit+1, ChannelEmail, "10.0.0.1"))
+	require.Len(t, sender.sent, signupIPLimit)
+	require.NoError(t, app.SendSignupCode(ctx, signupIPLimit+1, ChannelEmail, "10.0.0.2"))
+}
@@ -0,0 +1,370 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+	"jhmeeting.com/adminserver/db"
+)
+
+// Webhook 事件
+const (
+	WebhookEventConferenceStarted = "conference.started" // 会议开始
+	WebhookEventConferenceEnded   = "conference.ended"   // 会议结束
+	WebhookEventParticipantJoined = "participant.joined" // 参会者加入
+	WebhookEventParticipantLeft   = "participant.left"   // 参会者离开
+	WebhookEventRecordingFinished = "recording.finished" // 录制完成
+)
+
+var WebhookEvents = StringList{
+	WebhookEventConferenceStarted,
+	WebhookEventConferenceEnded,
+	WebhookEventParticipantJoined,
+	WebhookEventParticipantLeft,
+	WebhookEventRecordingFinished,
+}
+
+// 推送状态
+const (
+	DeliveryPending = "pending" // 等待推送或重试
+	DeliverySuccess = "success" // 推送成功
+	DeliveryFailed  = "failed"  // 超过重试次数
+)
+
+// 推送请求头，签名方式与媒体服务器事件回调相同，见 SignCallback
+const (
+	WebhookEventHeader    = "X-Webhook-Event"
+	WebhookDeliveryHeader = "X-Webhook-Delivery"
+)
+
+const (
+	webhookMaxAttempts  = 8
+	webhookRetryBase    = 10 * time.Second
+	webhookRetryMax     = time.Hour
+	webhookPollInterval = 3 * time.Second
+	webhookBatchSize    = 100
+	webhookTimeout      = 10 * time.Second
+	// webhookLease 领取推送后推迟 next_time，推送期间其他实例不会再次领取，实例退出后到期重试
+	webhookLease = 2 * webhookTimeout
+)
+
+var ErrWebhookAddress = errors.New("webhook address is not allowed")
+
+// WebhookConfig Webhook 推送
+type WebhookConfig struct {
+	AllowPrivateNetwork bool `json:"allowPrivateNetwork,omitempty"` // 允许推送到内网、本机地址
+}
+
+var (
+	// webhookClient 连接时检查解析后的地址，拒绝内网、本机地址，包括重定向和 DNS 变化
+	webhookClient = &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: webhookTimeout,
+				Control: func(network, address string, c syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+						return ErrWebhookAddress
+					}
+					return nil
+				},
+			}).DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+	}
+	privateWebhookClient = &http.Client{
+		Timeout: webhookTimeout,
+	}
+)
+
+// 不允许推送的地址：本机、内网、链路本地、运营商 NAT 等
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isPublicIP 是否为公网地址，IPv4 映射的 IPv6 地址按 IPv4 判断
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// WebhookPayload 推送的 JSON 内容
+type WebhookPayload struct {
+	Event string      `json:"event"`
+	Time  int64       `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// EnqueueWebhook 为订阅了事件的 Webhook 创建推送记录，由 RunWebhooks 推送。
+// runner 可以是事件处理的事务，事务回滚时不会推送。
+func (app App) EnqueueWebhook(ctx context.Context, runner dbr.SessionRunner, userID, orgID int64, event string, data interface{}) error {
+	// 个人的 Webhook 只接收个人房间的事件，组织的 Webhook 接收组织内所有房间的事件
+	scope := dbr.And(dbr.Eq(CommonUidCol, userID), dbr.Eq(CommonOrgIdCol, 0))
+	if orgID > 0 {
+		scope = dbr.Or(scope, dbr.Eq(CommonOrgIdCol, orgID))
+	}
+	webhooks := []Webhook{}
+	_, err := runner.Select(SqlStar).From(WebhookTableName).
+		Where(scope).
+		Where(dbr.Eq(WebhookEnabledCol, true)).
+		LoadContext(ctx, &webhooks)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		Event: event,
+		Time:  time.Now().Unix(),
+		Data:  data,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, webhook := range webhooks {
+		if len(webhook.Events) > 0 && !webhook.Events.Contains(event) {
+			continue
+		}
+		delivery := WebhookDelivery{
+			WebhookId: webhook.Id,
+			Event:     event,
+			Payload:   string(payload),
+			Status:    DeliveryPending,
+			NextTime:  db.NewNullTime(now),
+			Ctime:     now,
+		}
+		if err = insertDelivery(ctx, runner, &delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RedeliverWebhook 重新推送，复制原推送记录的内容，原记录保留
+func (app App) RedeliverWebhook(ctx context.Context, deliveryID int64) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	err := app.db.Select(SqlStar).From(WebhookDeliveryTableName).
+		Where(WhereCommonId, deliveryID).LoadOneContext(ctx, delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	redelivery := &WebhookDelivery{
+		WebhookId: delivery.WebhookId,
+		Event:     delivery.Event,
+		Payload:   delivery.Payload,
+		Status:    DeliveryPending,
+		NextTime:  db.NewNullTime(now),
+		Ctime:     now,
+	}
+	if err = insertDelivery(ctx, app.db, redelivery); err != nil {
+		return nil, err
+	}
+	return redelivery, nil
+}
+
+func insertDelivery(ctx context.Context, runner dbr.SessionRunner, delivery *WebhookDelivery) error {
+	_, err := runner.InsertInto(WebhookDeliveryTableName).
+		Columns(DeliveryWebhookIdCol, DeliveryEventCol, DeliveryPayloadCol, DeliveryStatusCol,
+			DeliveryNextTimeCol, CommonCtimeCol).
+		Record(delivery).ExecContext(ctx)
+	return err
+}
+
+// RunWebhooks 定时推送到期的 Webhook，直到 stop 关闭
+func (app App) RunWebhooks(stop <-chan struct{}) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := app.DeliverWebhooks(context.Background()); err != nil {
+				logger.Error("deliver webhooks failed.", zap.Error(err))
+			}
+		}
+	}
+}
+
+// DeliverWebhooks 推送一批到期的记录，返回推送的数量
+func (app App) DeliverWebhooks(ctx context.Context) (int, error) {
+	deliveries := []WebhookDelivery{}
+	_, err := app.db.Select(SqlStar).From(WebhookDeliveryTableName).
+		Where(WhereDeliveryDue, DeliveryPending, time.Now()).
+		OrderAsc(CommonIdCol).
+		Limit(webhookBatchSize).
+		LoadContext(ctx, &deliveries)
+	if err != nil {
+		return 0, err
+	}
+
+	webhooks := make(map[int64]*Webhook)
+	count := 0
+	for _, delivery := range deliveries {
+		// 多个实例同时推送时，只有更新成功的实例负责本次推送
+		result, err := app.db.Update(WebhookDeliveryTableName).
+			Set(DeliveryAttemptsCol, delivery.Attempts+1).
+			Set(DeliveryNextTimeCol, time.Now().Add(webhookLease)).
+			Where(WhereDeliveryClaim, delivery.Id, delivery.Attempts, DeliveryPending).
+			ExecContext(ctx)
+		if err != nil {
+			return count, err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			continue
+		}
+		delivery.Attempts++
+
+		webhook, ok := webhooks[delivery.WebhookId]
+		if !ok {
+			webhook = &Webhook{}
+			err = app.db.Select(SqlStar).From(WebhookTableName).
+				Where(WhereCommonId, delivery.WebhookId).LoadOneContext(ctx, webhook)
+			if err != nil {
+				webhook = nil
+			}
+			webhooks[delivery.WebhookId] = webhook
+		}
+
+		var code int
+		if webhook == nil || !webhook.Enabled {
+			err = errors.New("webhook is deleted or disabled")
+			delivery.Attempts = webhookMaxAttempts
+		} else {
+			code, err = sendWebhook(ctx, app.webhookClient(), webhook, &delivery)
+		}
+		if err = app.finishDelivery(ctx, &delivery, code, err); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// webhookClient 未允许内网地址时，只推送到公网地址
+func (app App) webhookClient() *http.Client {
+	if app.config.Webhook.AllowPrivateNetwork {
+		return privateWebhookClient
+	}
+	return webhookClient
+}
+
+// sendWebhook 发送推送，返回 HTTP 状态码，非 2xx 视为失败
+func sendWebhook(ctx context.Context, client *http.Client, webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	timestamp := time.Now().Unix()
+	nonce := fmt.Sprintf("%d-%d", delivery.Id, delivery.Attempts)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set(CallbackTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(CallbackNonceHeader, nonce)
+	req.Header.Set(CallbackSignatureHeader, SignCallback(webhook.Secret, timestamp, nonce, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// finishDelivery 记录推送结果，失败时按指数退避安排重试
+func (app App) finishDelivery(ctx context.Context, delivery *WebhookDelivery, code int, sendErr error) error {
+	now := time.Now()
+	stmt := app.db.Update(WebhookDeliveryTableName).
+		Set(DeliveryRespCodeCol, code).
+		Set(DeliveryUtimeCol, now)
+
+	switch {
+	case sendErr == nil:
+		stmt.Set(DeliveryStatusCol, DeliverySuccess).
+			Set(DeliveryErrorCol, "").
+			Set(DeliveryNextTimeCol, nil)
+
+	case delivery.Attempts >= webhookMaxAttempts:
+		logger.Warn("webhook delivery failed.", zap.Int64("id", delivery.Id), zap.Int64("webhookId", delivery.WebhookId),
+			zap.Int("attempts", delivery.Attempts), zap.Error(sendErr))
+		stmt.Set(DeliveryStatusCol, DeliveryFailed).
+			Set(DeliveryErrorCol, truncate(sendErr.Error(), 512)).
+			Set(DeliveryNextTimeCol, nil)
+
+	default:
+		stmt.Set(DeliveryErrorCol, truncate(sendErr.Error(), 512)).
+			Set(DeliveryNextTimeCol, now.Add(webhookBackoff(delivery.Attempts)))
+	}
+
+	_, err := stmt.Where(WhereCommonId, delivery.Id).ExecContext(ctx)
+	return err
+}
+
+// webhookBackoff 第 attempts 次推送失败后的重试间隔
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookRetryBase
+	for i := 1; i < attempts && backoff < webhookRetryMax; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookRetryMax {
+		backoff = webhookRetryMax
+	}
+	return backoff
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
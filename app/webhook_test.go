@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	app := newTestApp()
+	app.config.Webhook.AllowPrivateNetwork = true
+	ctx := context.Background()
+
+	received := []WebhookPayload{}
+	fail := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get(CallbackTimestampHeader), 10, 64)
+		signature := SignCallback("whsecret", ts, r.Header.Get(CallbackNonceHeader), body)
+		require.Equal(t, signature, r.Header.Get(CallbackSignatureHeader))
+
+		// 推送期间其他实例不会再次领取
+		count, err := app.DeliverWebhooks(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 0, count)
+
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		payload := WebhookPayload{}
+		require.NoError(t, json.Unmarshal(body, &payload))
+		require.Equal(t, payload.Event, r.Header.Get(WebhookEventHeader))
+		received = append(received, payload)
+	}))
+	defer receiver.Close()
+
+	_, err := app.db.InsertInto(WebhookTableName).
+		Columns(CommonUidCol, WebhookUrlCol, WebhookSecretCol, WebhookEventsCol, WebhookEnabledCol, CommonCtimeCol).
+		Record(&Webhook{
+			Uid:     1,
+			Url:     receiver.URL,
+			Secret:  "whsecret",
+			Events:  StringList{WebhookEventConferenceEnded},
+			Enabled: true,
+			Ctime:   time.Now(),
+		}).ExecContext(ctx)
+	require.NoError(t, err)
+
+	// 未订阅的事件和其他用户的事件不推送
+	require.NoError(t, app.EnqueueWebhook(ctx, app.db, 1, 0, WebhookEventParticipantJoined, nil))
+	require.NoError(t, app.EnqueueWebhook(ctx, app.db, 2, 0, WebhookEventConferenceEnded, nil))
+	require.NoError(t, app.EnqueueWebhook(ctx, app.db, 1, 0, WebhookEventConferenceEnded, map[string]int{"id": 1}))
+
+	count, err := app.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	delivery := WebhookDelivery{}
+	require.NoError(t, app.db.Select(SqlStar).From(WebhookDeliveryTableName).LoadOneContext(ctx, &delivery))
+	require.Equal(t, DeliveryPending, delivery.Status)
+	require.Equal(t, 1, delivery.Attempts)
+	require.Equal(t, http.StatusInternalServerError, delivery.ResponseCode)
+	require.True(t, delivery.NextTime.Time.After(time.Now()))
+
+	// 未到重试时间
+	count, err = app.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	fail = false
+	_, err = app.db.Update(WebhookDeliveryTableName).Set(DeliveryNextTimeCol, time.Now()).ExecContext(ctx)
+	require.NoError(t, err)
+	count, err = app.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.Len(t, received, 1)
+	require.Equal(t, WebhookEventConferenceEnded, received[0].Event)
+
+	require.NoError(t, app.db.Select(SqlStar).From(WebhookDeliveryTableName).
+		Where(WhereCommonId, delivery.Id).LoadOneContext(ctx, &delivery))
+	require.Equal(t, DeliverySuccess, delivery.Status)
+	require.Equal(t, 2, delivery.Attempts)
+
+	redelivery, err := app.RedeliverWebhook(ctx, delivery.Id)
+	require.NoError(t, err)
+	require.NotEqual(t, delivery.Id, redelivery.Id)
+	count, err = app.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.Len(t, received, 2)
+}
+
+func TestWebhookPrivateAddress(t *testing.T) {
+	app := newTestApp()
+	ctx := context.Background()
+
+	received := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = true
+	}))
+	defer receiver.Close()
+
+	_, err := app.db.InsertInto(WebhookTableName).
+		Columns(CommonUidCol, WebhookUrlCol, WebhookSecretCol, WebhookEventsCol, WebhookEnabledCol, CommonCtimeCol).
+		Record(&Webhook{
+			Uid:     1,
+			Url:     receiver.URL,
+			Secret:  "whsecret",
+			Events:  StringList{WebhookEventConferenceEnded},
+			Enabled: true,
+			Ctime:   time.Now(),
+		}).ExecContext(ctx)
+	require.NoError(t, err)
+	require.NoError(t, app.EnqueueWebhook(ctx, app.db, 1, 0, WebhookEventConferenceEnded, nil))
+
+	count, err := app.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.False(t, received)
+
+	delivery := WebhookDelivery{}
+	require.NoError(t, app.db.Select(SqlStar).From(WebhookDeliveryTableName).LoadOneContext(ctx, &delivery))
+	require.Equal(t, DeliveryPending, delivery.Status)
+	require.Contains(t, delivery.Error, ErrWebhookAddress.Error())
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.20.0.1", "192.168.1.1", "169.254.169.254",
+		"0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+		require.False(t, isPublicIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"8.8.8.8", "203.0.113.1", "2001:4860:4860::8888"} {
+		require.True(t, isPublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	require.Equal(t, 10*time.Second, webhookBackoff(1))
+	require.Equal(t, 20*time.Second, webhookBackoff(2))
+	require.Equal(t, 80*time.Second, webhookBackoff(4))
+	require.Equal(t, time.Hour, webhookBackoff(20))
+}
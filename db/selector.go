@@ -43,9 +43,10 @@ type Condition struct {
 }
 
 const (
-	CmpEq  = "eq"
-	CmpGte = "gte"
-	CmpLte = "lte"
+	CmpEq   = "eq"
+	CmpGte  = "gte"
+	CmpLte  = "lte"
+	CmpLike = "like"
 )
 
 func (c Condition) Build() dbr.Builder {
@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"jhmeeting.com/adminserver/app"
 	"jhmeeting.com/adminserver/routes"
+	"jhmeeting.com/adminserver/server"
 )
 
 func main() {
@@ -15,14 +16,21 @@ func main() {
 	https := gin.Default()
 	app := app.NewApp()
 
+	// 会议事件的处理器只注册一次，路由和清理任务共用
+	conferenceServer := server.NewConferenceServer(app)
+
+	go app.RunWebhooks(nil)
+	go app.RunMailer(nil)
+	go server.NewReaper(conferenceServer).Run(nil)
+
 	if app.Config().HttpsPort > 0 {
 		httpsPort := fmt.Sprintf(":%d", app.Config().HttpsPort)
 		https.Use(TlsHandler(httpsPort))
-		routes.Setup(https, app)
+		routes.Setup(https, app, conferenceServer)
 		go https.RunTLS(httpsPort, app.Config().CertPath, app.Config().KeyPath)
 	}
 
-	routes.Setup(r, app)
+	routes.Setup(r, app, conferenceServer)
 
 	r.Run(fmt.Sprintf(":%d", app.Config().Port))
 }
@@ -1,18 +1,22 @@
 package routes
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/util"
 )
 
+var logger = util.GetLogger()
+
 // timeout middleware wraps the request context with a timeout
 func timeoutMiddleware(timeout time.Duration) func(c *gin.Context) {
 	return func(c *gin.Context) {
@@ -30,6 +34,16 @@ func timeoutMiddleware(timeout time.Duration) func(c *gin.Context) {
 	}
 }
 
+// 客户端 IP。gin 直接使用 X-Forwarded-For 中客户端填写的值，这里按可信代理改写为实际的客户端 IP，
+// c.ClientIP() 用于登录锁定、发送限流和审计。
+func clientIPMiddleware(gapp *app.App) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.Request.Header.Set("X-Forwarded-For", gapp.ForwardedClientIP(c.Request))
+		c.Request.Header.Del("X-Real-Ip")
+		c.Next()
+	}
+}
+
 // 格式化错误JSON输出，{"error": "msg"}
 func errorMiddleware(c *gin.Context) {
 	c.Next()
@@ -46,35 +60,114 @@ func errorMiddleware(c *gin.Context) {
 	}
 }
 
-// cookie授权
-func authMiddleware(gapp *app.App) func(c *gin.Context) {
+// cookie授权。scopes 为路由允许的 API Key 授权范围，为空时不接受 API Key
+func authMiddleware(gapp *app.App, scopes ...string) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		tokenString := ""
-		if authString := c.GetHeader("Authorization"); len(authString) > 0 {
-			tokenString = strings.TrimPrefix(authString, "Bearer")
-			tokenString = strings.TrimSpace(tokenString)
-		}
-		if cookie, err := c.Cookie(app.CookieName); err == nil {
-			tokenString = cookie
-		}
+		tokenString := app.RequestToken(c)
 		if len(tokenString) == 0 {
 			c.AbortWithError(http.StatusNonAuthoritativeInfo, errors.New("not authrized"))
 			return
 		}
 		// from other internal server
-		if tokenString == gapp.Config().Secret {
+		if app.IsAPIKey(tokenString) {
+			apiKeyAuth(c, gapp, tokenString, scopes)
 			return
 		}
-		userID, err := gapp.ParseToken(tokenString)
+		claims, err := gapp.ParseToken(tokenString)
 		if err != nil {
 			c.AbortWithError(http.StatusNonAuthoritativeInfo, err)
 			return
 		}
-		uid, _ := strconv.ParseInt(userID, 10, 64)
-		if uid <= 0 {
-			c.AbortWithError(http.StatusNonAuthoritativeInfo, errors.New("bad token"))
+		if gapp.IsTokenRevoked(claims.Jti) {
+			c.AbortWithError(http.StatusNonAuthoritativeInfo, app.ErrSessionRevoked)
+			return
+		}
+		c.Set("uid", claims.Uid)
+		c.Set(app.TokenClaimsKey, claims)
+	}
+}
+
+// API Key 授权，key 需拥有路由允许的任一授权范围
+func apiKeyAuth(c *gin.Context, gapp *app.App, key string, scopes []string) {
+	apiKey, err := gapp.VerifyAPIKey(c, key)
+	if err != nil {
+		c.AbortWithError(http.StatusNonAuthoritativeInfo, err)
+		return
+	}
+	for _, scope := range scopes {
+		if apiKey.Scopes.Contains(scope) {
+			c.Set("uid", apiKey.Uid)
+			c.Set(app.APIKeyContextKey, apiKey)
+			return
+		}
+	}
+	c.AbortWithError(http.StatusForbidden, errors.New("没有权限"))
+}
+
+// 角色权限校验，需在 authMiddleware 之后使用
+func permissionMiddleware(gapp *app.App, permission string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		// 模拟登录的会话不能使用管理功能
+		if claims, ok := c.Get(app.TokenClaimsKey); ok && claims.(*app.TokenClaims).Impersonator > 0 {
+			c.AbortWithError(http.StatusForbidden, errors.New("没有权限"))
+			return
+		}
+
+		user := app.User{}
+		err := gapp.DB().Select(app.UserRoleCol, app.UserDisabledCol).From(app.UserTableName).
+			Where(app.WhereCommonId, c.GetInt64(app.UserID)).LoadOneContext(c, &user)
+		if err != nil || user.Disabled || !app.HasPermission(user.Role, permission) {
+			c.AbortWithError(http.StatusForbidden, errors.New("没有权限"))
+			return
+		}
+		c.Set(app.UserRole, user.Role)
+	}
+}
+
+// 媒体服务器事件上报授权：配置了 callback.secret 时必须带有效的回调签名，
+// 未配置时需要 conference:action 授权范围的 API Key。
+// 不接受用户的访问 token，避免普通用户伪造会议事件。
+func actionAuthMiddleware(gapp *app.App) func(c *gin.Context) {
+	if gapp.CallbackEnabled() {
+		// 启用签名后不再接受没有签名的 API Key，避免泄露的 key 伪造或重放事件
+		return callbackMiddleware(gapp)
+	}
+	logger.Warn("callback.secret is not set, conference actions are authorized by api key.")
+	return func(c *gin.Context) {
+		tokenString := app.RequestToken(c)
+		if len(tokenString) == 0 {
+			c.AbortWithError(http.StatusNonAuthoritativeInfo, errors.New("not authrized"))
+			return
+		}
+		if !app.IsAPIKey(tokenString) {
+			c.AbortWithError(http.StatusForbidden, errors.New("没有权限"))
+			return
+		}
+		apiKeyAuth(c, gapp, tokenString, []string{app.ScopeConferenceAction})
+	}
+}
+
+// 媒体服务器事件回调签名校验，拒绝伪造、过期和重复投递的请求
+func callbackMiddleware(gapp *app.App) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		err = gapp.VerifyCallback(
+			c.GetHeader(app.CallbackTimestampHeader),
+			c.GetHeader(app.CallbackNonceHeader),
+			c.GetHeader(app.CallbackSignatureHeader),
+			body,
+		)
+		if err != nil {
+			logger.Warn("reject callback.", zap.String("ip", c.ClientIP()),
+				zap.String("nonce", c.GetHeader(app.CallbackNonceHeader)), zap.Error(err))
+			c.AbortWithError(http.StatusUnauthorized, err)
 			return
 		}
-		c.Set("uid", uid)
 	}
 }
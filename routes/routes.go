@@ -8,15 +8,23 @@ import (
 
 	"github.com/dchest/captcha"
 	"github.com/gin-gonic/gin"
-	"jhmeeting.com/adminserver/app"
+	gapp "jhmeeting.com/adminserver/app"
 	"jhmeeting.com/adminserver/server"
 )
 
-func Setup(r *gin.Engine, app *app.App) {
+// Setup 注册路由。conferenceServer 由调用方创建，http 和 https 以及后台任务共用，
+// 订阅的会议事件处理器对所有入口生效。
+func Setup(r *gin.Engine, app *gapp.App, conferenceServer *server.ConferenceServer) {
 	gin.SetMode(gin.DebugMode)
 
+	r.Use(clientIPMiddleware(app))
+
 	r.Use(static.Serve("/admin", static.LocalFile("./www", true)))
 
+	// 访问 token 的公钥，反向代理只转发 /admin 时可以使用 /admin/.well-known/jwks.json
+	jwks := server.NewPassportServer(app).JWKS
+	r.GET("/.well-known/jwks.json", jwks)
+
 	admin := r.Group("/admin")
 	admin.Use(errorMiddleware, timeoutMiddleware(5*time.Second))
 	{
@@ -24,48 +32,148 @@ func Setup(r *gin.Engine, app *app.App) {
 		admin.POST("/captcha-id", handleCaptchaId)
 		admin.GET("/captcha-id", handleCaptchaId)
 		admin.GET("/captcha/:id", gin.WrapH(captcha.Server(captcha.StdWidth, captcha.StdHeight)))
+		admin.GET("/.well-known/jwks.json", jwks)
 
 		passport := admin.Group("/passport")
 		{
 			server := server.NewPassportServer(app)
 			passport.POST("/signup", server.Signup)
 			passport.POST("/login", server.Login)
+			passport.POST("/login/totp", server.LoginTotp)
+			passport.POST("/login/totp/setup", server.LoginTotpSetup)
+			passport.GET("/oidc/login", server.OIDCLogin)
+			passport.GET("/oidc/callback", server.OIDCCallback)
+			passport.POST("/refresh", server.Refresh)
 			passport.POST("/logout", server.Logout)
+			passport.POST("/reset/request", server.ResetRequest)
+			passport.POST("/reset/confirm", server.ResetConfirm)
 			passport.POST("/info", authMiddleware(app), server.Info)
 			passport.POST("/modify", authMiddleware(app), server.Modify)
+			passport.POST("/verify/send", authMiddleware(app), server.VerifySend)
+			passport.POST("/verify/confirm", authMiddleware(app), server.VerifyConfirm)
+			passport.POST("/totp", authMiddleware(app), server.TotpStatus)
+			passport.POST("/totp/setup", authMiddleware(app), server.TotpSetup)
+			passport.POST("/totp/enable", authMiddleware(app), server.TotpEnable)
+			passport.POST("/totp/disable", authMiddleware(app), server.TotpDisable)
+			passport.POST("/totp/recovery", authMiddleware(app), server.TotpRecovery)
+			passport.POST("/sessions", authMiddleware(app), server.SessionList)
+			passport.POST("/sessions/revoke", authMiddleware(app), server.SessionRevoke)
+			passport.POST("/sessions/revoke-others", authMiddleware(app), server.SessionRevokeOthers)
 		}
 
-		roomGroup := admin.Group("/room", authMiddleware(app))
+		// 内部服务可使用对应授权范围的 API Key 访问
+		auth := authMiddleware(app)
+		roomRead := authMiddleware(app, gapp.ScopeRoomRead)
+		conferenceRead := authMiddleware(app, gapp.ScopeConferenceRead)
+		recordRead := authMiddleware(app, gapp.ScopeRecordRead)
+
+		roomGroup := admin.Group("/room")
 		{
 			roomServer := server.NewRoomServer(app)
-			roomGroup.POST("/info", roomServer.Info)
-			roomGroup.POST("/list", roomServer.List)
-			roomGroup.POST("/create", roomServer.Create)
-			roomGroup.POST("/modify", roomServer.Modify)
-			roomGroup.POST("/delete", roomServer.Delete)
-			roomGroup.POST("/token", roomServer.Token)
+			roomGroup.POST("/info", roomRead, roomServer.Info)
+			roomGroup.POST("/list", roomRead, roomServer.List)
+			roomGroup.POST("/create", auth, roomServer.Create)
+			roomGroup.POST("/modify", auth, roomServer.Modify)
+			roomGroup.POST("/delete", auth, roomServer.Delete)
+			roomGroup.POST("/token", auth, roomServer.Token)
 		}
 
-		conferenceGroup := admin.Group("/conference", authMiddleware(app))
+		conferenceGroup := admin.Group("/conference")
 		{
-			conferenceServer := server.NewConferenceServer(app)
-			conferenceGroup.POST("/info", conferenceServer.Info)
-			conferenceGroup.POST("/runing", conferenceServer.Runing)
-			conferenceGroup.POST("/dispose", conferenceServer.Dispose)
-			conferenceGroup.POST("/lock", conferenceServer.Lock)
-			conferenceGroup.POST("/unlock", conferenceServer.Unlock)
-			conferenceGroup.POST("/history", conferenceServer.History)
-			conferenceGroup.POST("/action", conferenceServer.Action)
+			conferenceGroup.POST("/info", conferenceRead, conferenceServer.Info)
+			conferenceGroup.POST("/runing", conferenceRead, conferenceServer.Runing)
+			conferenceGroup.POST("/dispose", auth, conferenceServer.Dispose)
+			conferenceGroup.POST("/lock", auth, conferenceServer.Lock)
+			conferenceGroup.POST("/unlock", auth, conferenceServer.Unlock)
+			conferenceGroup.POST("/history", conferenceRead, conferenceServer.History)
+			conferenceGroup.POST("/participants", conferenceRead, conferenceServer.Participants)
+			conferenceGroup.POST("/action", actionAuthMiddleware(app), conferenceServer.Action)
 		}
 
-		recordGroup := admin.Group("/record", authMiddleware(app))
+		recordGroup := admin.Group("/record")
 		{
 			recordServer := server.NewRecordServer(app)
-			recordGroup.POST("/info", recordServer.Info)
-			recordGroup.POST("/list", recordServer.List)
-			recordGroup.POST("/delete", recordServer.Delete)
+			recordGroup.POST("/info", recordRead, recordServer.Info)
+			recordGroup.POST("/list", recordRead, recordServer.List)
+			recordGroup.POST("/delete", auth, recordServer.Delete)
+		}
+
+		meetingGroup := admin.Group("/meeting", auth)
+		{
+			meetingServer := server.NewMeetingServer(app)
+			meetingGroup.POST("/create", meetingServer.Create)
+			meetingGroup.POST("/list", meetingServer.List)
+			meetingGroup.POST("/info", meetingServer.Info)
+			meetingGroup.POST("/occurrences", meetingServer.Occurrences)
+			meetingGroup.POST("/modify", meetingServer.Modify)
+			meetingGroup.POST("/cancel", meetingServer.Cancel)
+			meetingGroup.POST("/cancel-occurrence", meetingServer.CancelOccurrence)
+			meetingGroup.GET("/ics", meetingServer.ICS)
+			meetingGroup.POST("/calendar", meetingServer.CalendarFeed)
+		}
+
+		// 日历订阅由日历客户端拉取，地址中的 token 即为授权
+		admin.GET("/calendar/:file", server.NewMeetingServer(app).Calendar)
+
+		orgGroup := admin.Group("/org", authMiddleware(app))
+		{
+			orgServer := server.NewOrgServer(app)
+			orgGroup.POST("/create", permissionMiddleware(app, gapp.PermOrgCreate), orgServer.Create)
+			orgGroup.POST("/list", orgServer.List)
+			orgGroup.POST("/info", orgServer.Info)
+			orgGroup.POST("/modify", orgServer.Modify)
+			orgGroup.POST("/security", orgServer.Security)
+			orgGroup.POST("/delete", orgServer.Delete)
+			orgGroup.POST("/member/list", orgServer.MemberList)
+			orgGroup.POST("/member/add", orgServer.MemberAdd)
+			orgGroup.POST("/member/remove", orgServer.MemberRemove)
+			orgGroup.POST("/member/role", orgServer.MemberRole)
+		}
+
+		webhookGroup := admin.Group("/webhook", auth)
+		{
+			webhookServer := server.NewWebhookServer(app)
+			webhookGroup.POST("/create", webhookServer.Create)
+			webhookGroup.POST("/list", webhookServer.List)
+			webhookGroup.POST("/modify", webhookServer.Modify)
+			webhookGroup.POST("/delete", webhookServer.Delete)
+			webhookGroup.POST("/deliveries", webhookServer.Deliveries)
+			webhookGroup.POST("/redeliver", webhookServer.Redeliver)
+		}
+
+		manageGroup := admin.Group("/manage", authMiddleware(app))
+		{
+			manageServer := server.NewManageServer(app)
+			userManage := permissionMiddleware(app, gapp.PermUserManage)
+			manageGroup.POST("/user/list", userManage, manageServer.UserList)
+			manageGroup.POST("/user/disable", userManage, manageServer.UserDisable)
+			manageGroup.POST("/user/enable", userManage, manageServer.UserEnable)
+			manageGroup.POST("/user/unlock", userManage, manageServer.UserUnlock)
+			manageGroup.POST("/user/role", userManage, manageServer.UserRole)
+			manageGroup.POST("/user/impersonate", userManage, manageServer.UserImpersonate)
+			manageGroup.POST("/room/list", permissionMiddleware(app, gapp.PermRoomViewAll), manageServer.RoomList)
+			manageGroup.POST("/conference/runing", permissionMiddleware(app, gapp.PermConferenceViewAll), manageServer.ConferenceRuning)
+			manageGroup.POST("/record/list", permissionMiddleware(app, gapp.PermRecordViewAll), manageServer.RecordList)
+			manageGroup.POST("/org/list", permissionMiddleware(app, gapp.PermOrgManage), manageServer.OrgList)
+			manageGroup.POST("/org/quota", permissionMiddleware(app, gapp.PermOrgManage), manageServer.OrgQuota)
+			apiKeyManage := permissionMiddleware(app, gapp.PermAPIKeyManage)
+			manageGroup.POST("/apikey/create", apiKeyManage, manageServer.APIKeyCreate)
+			manageGroup.POST("/apikey/list", apiKeyManage, manageServer.APIKeyList)
+			manageGroup.POST("/apikey/revoke", apiKeyManage, manageServer.APIKeyRevoke)
 		}
 	}
+
+	// 报表导出耗时较长，不使用 admin 的请求超时
+	export := r.Group("/admin", errorMiddleware, timeoutMiddleware(10*time.Minute), authMiddleware(app))
+	{
+		export.POST("/conference/export", conferenceServer.Export)
+	}
+
+	// 实时推送为长连接，不设置请求超时
+	stream := r.Group("/admin", errorMiddleware, authMiddleware(app))
+	{
+		stream.GET("/conference/stream", conferenceServer.Stream)
+	}
 }
 
 func handleCaptchaId(c *gin.Context) {
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// ActionHandler 会议室事件处理器
+type ActionHandler interface {
+	Handle(ctx context.Context, req ActionRequest) (interface{}, error)
+}
+
+// ActionHandlerFunc 函数形式的事件处理器
+type ActionHandlerFunc func(ctx context.Context, req ActionRequest) (interface{}, error)
+
+func (f ActionHandlerFunc) Handle(ctx context.Context, req ActionRequest) (interface{}, error) {
+	return f(ctx, req)
+}
+
+// ActionRegistry 会议室事件的处理器注册表，同一事件可注册多个处理器
+type ActionRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string][]ActionHandler
+}
+
+func NewActionRegistry() *ActionRegistry {
+	return &ActionRegistry{
+		handlers: make(map[string][]ActionHandler),
+	}
+}
+
+// Register 注册事件处理器，按注册顺序调用
+func (r *ActionRegistry) Register(action string, handler ActionHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[action] = append(r.handlers[action], handler)
+}
+
+// Has 事件是否有处理器
+func (r *ActionRegistry) Has(action string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.handlers[action]) > 0
+}
+
+// Dispatch 依次调用事件的处理器，任一处理器出错即停止。
+// 返回第一个不为 nil 的处理结果。
+func (r *ActionRegistry) Dispatch(ctx context.Context, req ActionRequest) (result interface{}, err error) {
+	r.mu.RLock()
+	handlers := r.handlers[req.Action]
+	r.mu.RUnlock()
+
+	if len(handlers) == 0 {
+		return nil, newHTTPError(http.StatusBadRequest, errors.New("unknown action: "+req.Action))
+	}
+	for _, handler := range handlers {
+		resp, err := handler.Handle(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = resp
+		}
+	}
+	return
+}
+
+type actionTxKey struct{}
+
+// actionTx 状态事件的事务，以及提交后需要执行的函数
+type actionTx struct {
+	*dbr.Tx
+	afterCommit []func()
+}
+
+// withActionTx 状态事件的处理器共用同一个事务
+func withActionTx(ctx context.Context, tx *actionTx) context.Context {
+	return context.WithValue(ctx, actionTxKey{}, tx)
+}
+
+// commit 提交事务，并执行 AfterCommit 注册的函数
+func (tx *actionTx) commit() error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, fn := range tx.afterCommit {
+		fn()
+	}
+	return nil
+}
+
+// ActionRunner 事件处理器使用的数据库连接，状态事件在事务内处理时返回该事务
+func ActionRunner(ctx context.Context, session *dbr.Session) dbr.SessionRunner {
+	if tx, ok := ctx.Value(actionTxKey{}).(*actionTx); ok {
+		return tx.Tx
+	}
+	return session
+}
+
+// AfterCommit 事件的事务提交后执行 fn，用于通知等不能回滚的操作。不在事务内时立即执行。
+func AfterCommit(ctx context.Context, fn func()) {
+	if tx, ok := ctx.Value(actionTxKey{}).(*actionTx); ok {
+		tx.afterCommit = append(tx.afterCommit, fn)
+		return
+	}
+	fn()
+}
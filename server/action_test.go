@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestActionRegistry(t *testing.T) {
+	registry := NewActionRegistry()
+	ctx := context.Background()
+
+	calls := []string{}
+	registry.Register(MUC_ROOM_RECORDING_STOP, ActionHandlerFunc(func(ctx context.Context, req ActionRequest) (interface{}, error) {
+		calls = append(calls, "record")
+		return nil, nil
+	}))
+	registry.Register(MUC_ROOM_RECORDING_STOP, ActionHandlerFunc(func(ctx context.Context, req ActionRequest) (interface{}, error) {
+		calls = append(calls, "stats")
+		return "ok", nil
+	}))
+	registry.Register(MUC_ROOM_RECORDING_STOP, ActionHandlerFunc(func(ctx context.Context, req ActionRequest) (interface{}, error) {
+		calls = append(calls, "webhook")
+		return "ignored", nil
+	}))
+
+	result, err := registry.Dispatch(ctx, ActionRequest{Action: MUC_ROOM_RECORDING_STOP})
+	require.NoError(t, err)
+	require.Equal(t, "ok", result)
+	require.Equal(t, []string{"record", "stats", "webhook"}, calls)
+
+	// 处理器出错时不再调用后续处理器
+	registry.Register(MUC_ROOM_DESTROYED, ActionHandlerFunc(func(ctx context.Context, req ActionRequest) (interface{}, error) {
+		return nil, errors.New("failed")
+	}))
+	registry.Register(MUC_ROOM_DESTROYED, ActionHandlerFunc(func(ctx context.Context, req ActionRequest) (interface{}, error) {
+		t.Fatal("should not be called")
+		return nil, nil
+	}))
+	_, err = registry.Dispatch(ctx, ActionRequest{Action: MUC_ROOM_DESTROYED})
+	require.EqualError(t, err, "failed")
+
+	require.False(t, registry.Has("unknown"))
+	_, err = registry.Dispatch(ctx, ActionRequest{Action: "unknown"})
+	require.Equal(t, http.StatusBadRequest, errorStatus(err))
+}
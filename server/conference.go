@@ -1,8 +1,11 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -16,12 +19,16 @@ import (
 // ConferenceServer 会议室服务
 type ConferenceServer struct {
 	*app.App
+	actions *ActionRegistry
 }
 
 func NewConferenceServer(app *app.App) *ConferenceServer {
-	return &ConferenceServer{
-		App: app,
+	s := &ConferenceServer{
+		App:     app,
+		actions: NewActionRegistry(),
 	}
+	s.registerActions()
+	return s
 }
 
 // Info 获取会议室信息
@@ -32,9 +39,13 @@ func (s ConferenceServer) Info(c *gin.Context) {
 	if c.BindJSON(&param) != nil {
 		return
 	}
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
 	info := app.ConferenceInfo{}
 	err := s.DB().Select(app.SqlStar).From(app.ConferenceTableName).
-		Where(app.WhereCommonIdAndUid, param.ID, c.GetInt64(app.UserID)).LoadOneContext(c, &info)
+		Where(app.WhereCommonId, param.ID).Where(scope).LoadOneContext(c, &info)
 	if err != nil {
 		c.AbortWithError(http.StatusNotFound, err)
 		return
@@ -44,9 +55,13 @@ func (s ConferenceServer) Info(c *gin.Context) {
 
 // Runing 获取正在进行的会议室列表
 func (s ConferenceServer) Runing(c *gin.Context) {
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
 	items := []app.ConferenceInfo{}
 	result, err := db.NewSelector(s.DB()).From(app.ConferenceTableName).Where(
-		dbr.Eq(app.CommonUidCol, c.GetInt64(app.UserID)),
+		scope,
 		dbr.Eq(app.ConferenceEtimeCol, nil),
 	).LoadPage(&items)
 	if err != nil {
@@ -74,11 +89,7 @@ func (s ConferenceServer) Unlock(c *gin.Context) {
 //History 会议室历史记录
 func (s ConferenceServer) History(c *gin.Context) {
 	var param struct {
-		RoomName string `json:"roomName,omitempty"`
-		Range    struct {
-			StartTime db.NullTime `json:"startTime,omitempty"`
-			EndTime   db.NullTime `json:"endTime,omitempty"`
-		} `json:"range,omitempty"`
+		historyFilter
 		Page    uint64 `json:"page,omitempty"`
 		PerPage uint64 `json:"perPage,omitempty"`
 	}
@@ -87,43 +98,192 @@ func (s ConferenceServer) History(c *gin.Context) {
 		return
 	}
 
-	selector := db.NewSelector(s.DB())
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
 
-	selector.Conditions = append(selector.Conditions, db.Condition{
-		Col: app.CommonUidCol,
-		Cmp: db.CmpEq,
-		Val: c.GetInt64(app.UserID),
-	})
+	selector := db.NewSelector(s.DB()).Where(scope)
+	selector.Conditions = param.conditions()
+	selector.Orders = []db.Order{
+		{Col: "id"},
+	}
 
-	if len(param.RoomName) > 0 {
-		selector.Conditions = append(selector.Conditions, db.Condition{
+	confereces := []app.ConferenceInfo{}
+	result, err := selector.From(app.ConferenceTableName).Paginate(param.Page, param.PerPage).LoadPage(&confereces)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// historyFilter 会议历史记录的查询条件
+type historyFilter struct {
+	RoomName string `json:"roomName,omitempty"`
+	Range    struct {
+		StartTime db.NullTime `json:"startTime,omitempty"`
+		EndTime   db.NullTime `json:"endTime,omitempty"`
+	} `json:"range,omitempty"`
+}
+
+func (f historyFilter) conditions() []db.Condition {
+	conditions := []db.Condition{}
+
+	if len(f.RoomName) > 0 {
+		conditions = append(conditions, db.Condition{
 			Col: app.RoomNameCol,
 			Cmp: db.CmpEq,
-			Val: param.RoomName,
+			Val: f.RoomName,
 		})
 	}
 
-	if param.Range.StartTime.Valid {
-		selector.Conditions = append(selector.Conditions, db.Condition{
+	if f.Range.StartTime.Valid {
+		conditions = append(conditions, db.Condition{
 			Col: app.CommonCtimeCol,
 			Cmp: db.CmpGte,
-			Val: param.Range.StartTime,
+			Val: f.Range.StartTime,
 		})
 	}
-	if param.Range.EndTime.Valid {
-		selector.Conditions = append(selector.Conditions, db.Condition{
+	if f.Range.EndTime.Valid {
+		conditions = append(conditions, db.Condition{
 			Col: app.CommonCtimeCol,
 			Cmp: db.CmpLte,
-			Val: param.Range.EndTime,
+			Val: f.Range.EndTime,
 		})
 	}
 
-	selector.Orders = []db.Order{
-		{Col: "id"},
+	return conditions
+}
+
+// Export 导出参会报表，指定会议 id 时只导出该会议，否则按历史记录的条件导出
+func (s ConferenceServer) Export(c *gin.Context) {
+	var param struct {
+		historyFilter
+		ID     int64  `json:"id,omitempty"`
+		Format string `json:"format,omitempty"` // csv 或 xlsx，默认 csv
+	}
+	if c.BindJSON(&param) != nil {
+		return
 	}
 
-	confereces := []app.ConferenceInfo{}
-	result, err := selector.From(app.ConferenceTableName).Paginate(param.Page, param.PerPage).LoadPage(&confereces)
+	uid := c.GetInt64(app.UserID)
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
+	conditions := param.conditions()
+	if param.ID > 0 {
+		conditions = append(conditions, db.Condition{
+			Col: app.CommonIdCol,
+			Cmp: db.CmpEq,
+			Val: param.ID,
+		})
+	}
+
+	format := strings.ToLower(param.Format)
+	if len(format) == 0 {
+		format = reportFormatCSV
+	}
+	if format != reportFormatCSV && format != reportFormatXLSX {
+		c.AbortWithError(http.StatusBadRequest, errors.New("不支持的导出格式"))
+		return
+	}
+
+	filename := fmt.Sprintf("attendance-%s.%s", time.Now().Format("20060102150405"), format)
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Header("Content-Type", reportContentTypes[format])
+	c.Status(http.StatusOK)
+
+	writer, err := newReportWriter(c.Writer, format)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err = s.writeAttendanceReport(c, writer, scope, conditions); err != nil {
+		// 响应已经开始输出，只能记录日志
+		logger.Error("export attendance report failed.", zap.Int64("uid", uid), zap.Error(err))
+	}
+	if err = writer.Close(); err != nil {
+		logger.Error("close attendance report failed.", zap.Int64("uid", uid), zap.Error(err))
+	}
+}
+
+// writeAttendanceReport 按 id 分批读取会议及其参会者，逐行写入报表
+func (s ConferenceServer) writeAttendanceReport(ctx context.Context, writer reportWriter, scope dbr.Builder, conditions []db.Condition) error {
+	if err := writer.Write(attendanceReportHeader); err != nil {
+		return err
+	}
+
+	var lastId int64
+	for {
+		stmt := s.DB().Select(app.SqlStar).From(app.ConferenceTableName).
+			Where(scope).
+			Where(dbr.Gt(app.CommonIdCol, lastId)).
+			OrderAsc(app.CommonIdCol).
+			Limit(reportBatchSize)
+		for _, condition := range conditions {
+			if builder := condition.Build(); builder != nil {
+				stmt.Where(builder)
+			}
+		}
+
+		conferences := []app.ConferenceInfo{}
+		if _, err := stmt.LoadContext(ctx, &conferences); err != nil {
+			return err
+		}
+
+		for _, conference := range conferences {
+			participants := []app.ParticipantInfo{}
+			_, err := s.DB().Select(app.SqlStar).From(app.ParticipantTableName).
+				Where(dbr.Eq(app.ParticipantConferenceIdCol, conference.Id)).
+				OrderAsc(app.CommonIdCol).LoadContext(ctx, &participants)
+			if err != nil {
+				return err
+			}
+			for _, record := range attendanceRecords(conference, participants) {
+				if err = writer.Write(record); err != nil {
+					return err
+				}
+			}
+			lastId = conference.Id
+		}
+
+		if len(conferences) < reportBatchSize {
+			return nil
+		}
+	}
+}
+
+// Participants 会议参会者列表
+func (s ConferenceServer) Participants(c *gin.Context) {
+	var param struct {
+		ConferenceId int64 `json:"conferenceId,omitempty"`
+		db.Pagination
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
+	count, err := s.DB().Select("count(*)").From(app.ConferenceTableName).
+		Where(app.WhereCommonId, param.ConferenceId).Where(scope).ReturnInt64()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if count == 0 {
+		c.AbortWithError(http.StatusNotFound, errors.New("会议不存在"))
+		return
+	}
+
+	participants := []app.ParticipantInfo{}
+	result, err := db.NewSelector(s.DB()).From(app.ParticipantTableName).Where(
+		dbr.Eq(app.ParticipantConferenceIdCol, param.ConferenceId),
+	).Paginate(param.Page, param.PerPage).OrderAsc(app.CommonIdCol).LoadPage(&participants)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -142,105 +302,518 @@ func (s ConferenceServer) Action(c *gin.Context) {
 		c.AbortWithError(http.StatusBadRequest, errors.New("room is invalid"))
 		return
 	}
+	if !s.actions.Has(req.Action) {
+		logger.Warn("unknown action.", zap.String("roomName", req.Room), zap.String("action", req.Action))
+		c.AbortWithError(http.StatusBadRequest, errors.New("unknown action: "+req.Action))
+		return
+	}
 
-	switch req.Action {
-	case MUC_ROOM_INFO:
-		logger.Info("get room.", zap.String("roomName", req.Room))
-		var roomInfo app.RoomInfo
-		err := s.DB().Select(app.SqlStar).From(app.RoomTableName).Where(app.WhereRoomName, req.Room).LoadOne(&roomInfo)
+	var result interface{}
+	var err error
+	if queryActions[req.Action] {
+		result, err = s.actions.Dispatch(c, req)
+	} else {
+		result, err = s.applyEvent(c, req)
+	}
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	if result != nil {
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// Subscribe 订阅会议室事件，状态事件的处理器在事件的事务内调用，可通过 ActionRunner 获取该事务
+func (s ConferenceServer) Subscribe(action string, handler ActionHandler) {
+	s.actions.Register(action, handler)
+}
+
+// 只查询、不改变会议状态的事件，不需要去重和事务
+var queryActions = map[string]bool{
+	MUC_ROOM_INFO:         true,
+	MUC_ROOM_CREATED:      true,
+	MUC_OCCUPANT_PRE_JOIN: true,
+}
+
+func (s ConferenceServer) registerActions() {
+	s.Subscribe(MUC_ROOM_INFO, ActionHandlerFunc(s.roomInfo))
+	s.Subscribe(MUC_ROOM_PRE_CREATE, ActionHandlerFunc(s.createConference))
+	s.Subscribe(MUC_ROOM_CREATED, ActionHandlerFunc(s.roomCreated))
+	s.Subscribe(MUC_OCCUPANT_PRE_JOIN, ActionHandlerFunc(s.preJoin))
+	s.Subscribe(MUC_OCCUPANT_JOINED, ActionHandlerFunc(s.occupantJoined))
+	s.Subscribe(MUC_OCCUPANT_LEFT, ActionHandlerFunc(s.occupantLeft))
+	s.Subscribe(MUC_ROOM_DESTROYED, ActionHandlerFunc(s.roomDestroyed))
+	s.Subscribe(MUC_ROOM_SECRET, ActionHandlerFunc(s.roomSecret))
+	s.Subscribe(MUC_ROOM_RECORDING_START, ActionHandlerFunc(s.recordingStart))
+	s.Subscribe(MUC_ROOM_RECORDING_STOP, ActionHandlerFunc(s.recordingStop))
+	s.registerWebhooks()
+	s.registerStream()
+	s.registerNotifications()
+}
+
+// applyEvent 在一个事务内处理改变会议状态的事件，并记录已处理的事件。
+// 按事件 ID 去重，重复投递的事件直接返回；会议结束后到达的事件，
+// 以及同一状态（见 eventSeqKey）已处理过更大序号的乱序事件，只记录不处理。
+func (s ConferenceServer) applyEvent(ctx context.Context, req ActionRequest) (interface{}, error) {
+	dbTx, err := s.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer dbTx.RollbackUnlessCommitted()
+	tx := &actionTx{Tx: dbTx}
+
+	if len(req.EventId) > 0 {
+		event := app.ConferenceEvent{}
+		err = tx.Select(app.SqlStar).From(app.ConferenceEventTableName).
+			Where(app.WhereConferenceEventId, req.EventId).LoadOneContext(ctx, &event)
+		if err == nil {
+			logger.Info("duplicate event.", zap.String("roomName", req.Room), zap.String("action", req.Action),
+				zap.String("eventId", req.EventId))
+			return s.duplicateEventResult(ctx, tx, event)
+		}
+		if err != dbr.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	var result interface{}
+	if req.Action == MUC_ROOM_PRE_CREATE {
+		if result, err = s.actions.Dispatch(withActionTx(ctx, tx), req); err != nil {
+			return nil, err
+		}
+		if conference, ok := result.(*app.ConferenceInfo); ok {
+			req.ConferenceId = conference.Id
+		}
+	} else {
+		conference := app.ConferenceInfo{}
+		err = tx.Select(app.SqlStar).From(app.ConferenceTableName).
+			Where(app.WhereCommonId, req.ConferenceId).LoadOneContext(ctx, &conference)
+		if err != nil && err != dbr.ErrNotFound {
+			return nil, err
+		}
+		stale, err := newerEventProcessed(tx, req)
 		if err != nil {
-			c.AbortWithError(http.StatusNotFound, err)
-			return
-		}
-		c.JSON(http.StatusOK, roomInfo)
-
-	case MUC_ROOM_PRE_CREATE:
-		logger.Info("create room.", zap.String("roomName", req.Room))
-		uid, _ := s.DB().Select(app.CommonUidCol).From(app.RoomTableName).Where(app.WhereRoomName, req.Room).ReturnInt64()
-		if uid == 0 {
-			c.AbortWithError(http.StatusNotFound, errors.New("房间不存在"))
-			return
-		}
-		confereceInfo := app.ConferenceInfo{
-			Uid:        uid,
-			RoomName:   req.Room,
-			ApiEnabled: req.ApiEnabled,
-			Ctime:      time.Now(),
-		}
-		_, err := s.DB().InsertInto(app.ConferenceTableName).
-			Columns(app.CommonUidCol, app.ConferenceRoomNameCol, app.ConferenceApiEnabledCol, app.CommonCtimeCol).
-			Record(&confereceInfo).ExecContext(c)
+			return nil, err
+		}
+		reason := ignoreReason(conference, req, stale)
+		if len(reason) > 0 {
+			logger.Info("ignore event.", zap.String("roomName", req.Room), zap.String("action", req.Action),
+				zap.Int64("seq", req.Seq), zap.String("reason", reason))
+		} else if result, err = s.actions.Dispatch(withActionTx(ctx, tx), req); err != nil {
+			return nil, err
+		}
+		// 收到会议事件视为会议存活
+		if conference.Id > 0 && len(reason) == 0 && req.Action != MUC_ROOM_DESTROYED {
+			_, err = tx.Update(app.ConferenceTableName).Set(app.ConferenceHtimeCol, time.Now()).
+				Where(app.WhereCommonId, conference.Id).ExecContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(req.EventId) > 0 {
+		event := app.ConferenceEvent{
+			EventId:      req.EventId,
+			ConferenceId: req.ConferenceId,
+			Action:       req.Action,
+			Seq:          req.Seq,
+			SeqKey:       eventSeqKey(req),
+			Ctime:        time.Now(),
+		}
+		_, err = tx.InsertInto(app.ConferenceEventTableName).
+			Columns(app.ConferenceEventIdCol, app.ConferenceEventConfIdCol, app.ConferenceEventActionCol,
+				app.ConferenceEventSeqCol, app.ConferenceEventSeqKeyCol, app.CommonCtimeCol).
+			Record(&event).ExecContext(ctx)
 		if err != nil {
-			c.AbortWithError(http.StatusNotFound, errors.New("房间不存在"))
-			return
+			return nil, err
 		}
-		c.JSON(http.StatusOK, confereceInfo)
+	}
+
+	return result, tx.commit()
+}
+
+// ignoreReason 事件不需要处理的原因，为空表示需要处理，stale 表示同一状态已处理过更大序号的事件。
+// 录像文件可能在会议结束后才上传完成，录制结束事件总是需要处理。
+func ignoreReason(conference app.ConferenceInfo, req ActionRequest, stale bool) string {
+	switch {
+	case req.Action == MUC_ROOM_RECORDING_STOP:
+		return ""
+	case conference.Id == 0:
+		return "conference not found"
+	case conference.Etime.Valid:
+		return "conference destroyed"
+	case stale:
+		return "out of order"
+	}
+	return ""
+}
+
+// eventSeqKey 事件改变的状态，序号只在同一状态的事件之间比较：
+// 锁定和录制按会议，加入和离开按参会者，其他事件不按序号丢弃。
+func eventSeqKey(req ActionRequest) string {
+	switch req.Action {
+	case MUC_ROOM_SECRET:
+		return "lock"
+	case MUC_ROOM_RECORDING_START, MUC_ROOM_RECORDING_STOP:
+		return "recording"
+	case MUC_OCCUPANT_JOINED, MUC_OCCUPANT_LEFT:
+		return "jid:" + req.Jid
+	}
+	return ""
+}
+
+// newerEventProcessed 同一会议的同一状态是否已处理过序号更大的事件
+func newerEventProcessed(runner dbr.SessionRunner, req ActionRequest) (bool, error) {
+	seqKey := eventSeqKey(req)
+	if req.Seq <= 0 || req.ConferenceId == 0 || len(seqKey) == 0 {
+		return false, nil
+	}
+	count, err := runner.Select("count(*)").From(app.ConferenceEventTableName).
+		Where(app.WhereConferenceEventNewer, req.ConferenceId, seqKey, req.Seq).ReturnInt64()
+	return count > 0, err
+}
+
+// duplicateEventResult 重复事件的返回值，创建会议事件返回已创建的会议
+func (s ConferenceServer) duplicateEventResult(ctx context.Context, runner dbr.SessionRunner, event app.ConferenceEvent) (interface{}, error) {
+	if event.Action != MUC_ROOM_PRE_CREATE {
+		return nil, nil
+	}
+	conference := app.ConferenceInfo{}
+	err := runner.Select(app.SqlStar).From(app.ConferenceTableName).
+		Where(app.WhereCommonId, event.ConferenceId).LoadOneContext(ctx, &conference)
+	if err != nil {
+		return nil, err
+	}
+	return conference, nil
+}
+
+// actionConference 事件所属的会议，会议不存在时返回 nil。
+// 在会议状态更新之后调用，创建会议事件的会议 id 由前面的处理器生成，按房间名查找。
+func actionConference(ctx context.Context, runner dbr.SessionRunner, req ActionRequest) (*app.ConferenceInfo, error) {
+	conference := &app.ConferenceInfo{}
+	stmt := runner.Select(app.SqlStar).From(app.ConferenceTableName)
+	if req.Action == MUC_ROOM_PRE_CREATE {
+		stmt.Where(app.WhereRoomName, req.Room).Where(dbr.Eq(app.ConferenceEtimeCol, nil)).
+			OrderDesc(app.CommonIdCol).Limit(1)
+	} else {
+		stmt.Where(app.WhereCommonId, req.ConferenceId)
+	}
+	if err := stmt.LoadOneContext(ctx, conference); err != nil {
+		if err == dbr.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	conference.LockPassword = ""
+	return conference, nil
+}
+
+// roomInfo 获取房间信息
+func (s ConferenceServer) roomInfo(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("get room.", zap.String("roomName", req.Room))
+	var roomInfo app.RoomInfo
+	err := s.DB().Select(app.SqlStar).From(app.RoomTableName).Where(app.WhereRoomName, req.Room).LoadOneContext(ctx, &roomInfo)
+	if err != nil {
+		return nil, newHTTPError(http.StatusNotFound, err)
+	}
+	return roomInfo, nil
+}
 
-	case MUC_ROOM_CREATED:
-		logger.Info("created room.", zap.String("roomName", req.Room))
+func (s ConferenceServer) roomCreated(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("created room.", zap.String("roomName", req.Room))
+	return nil, nil
+}
+
+// preJoin 检查房间和组织的参会人数上限
+func (s ConferenceServer) preJoin(ctx context.Context, req ActionRequest) (interface{}, error) {
+	participantLimits, _ := s.DB().Select(app.RoomPartLimitsCol).From(app.RoomTableName).Where(app.WhereRoomName, req.Room).ReturnInt64()
+	logger.Info("pre join room.", zap.String("roomName", req.Room), zap.Int("reqLimits", req.Participants), zap.Int64("sqlLimits", participantLimits))
+	if participantLimits > 0 && req.Participants >= int(participantLimits) {
+		return nil, newHTTPError(http.StatusServiceUnavailable, errors.New("会议室人数已达上限"))
+	}
+	full, err := s.orgParticipantsFull(ctx, req.Room)
+	if err != nil {
+		return nil, err
+	}
+	if full {
+		return nil, newHTTPError(http.StatusServiceUnavailable, errors.New("组织参会人数已达上限"))
+	}
+	return nil, nil
+}
 
-	case MUC_OCCUPANT_PRE_JOIN:
-		participantLimits, _ := s.DB().Select(app.RoomPartLimitsCol).From(app.RoomTableName).Where(app.WhereRoomName, req.Room).ReturnInt64()
-		logger.Info("pre join room.", zap.String("roomName", req.Room), zap.Int("reqLimits", req.Participants), zap.Int64("sqlLimits", participantLimits))
-		if participantLimits > 0 && req.Participants >= int(participantLimits) {
-			c.AbortWithError(http.StatusServiceUnavailable, errors.New("会议室人数已达上限"))
-			return
+// matchMeeting 在保存点内匹配预约日程。PostgreSQL 中语句失败会使整个事务失效，
+// 失败时回滚到保存点，避免影响事件的事务。
+func (s ConferenceServer) matchMeeting(ctx context.Context, runner dbr.SessionRunner, roomID int64, t time.Time) (*app.Meeting, time.Time, error) {
+	tx, ok := runner.(*dbr.Tx)
+	if !ok {
+		return s.MatchMeetingOccurrence(ctx, runner, roomID, t)
+	}
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT match_meeting"); err != nil {
+		return nil, time.Time{}, err
+	}
+	meeting, start, err := s.MatchMeetingOccurrence(ctx, tx, roomID, t)
+	if err != nil {
+		if _, rollbackErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT match_meeting"); rollbackErr != nil {
+			logger.Error("rollback to savepoint failed.", zap.Error(rollbackErr))
 		}
+		return nil, time.Time{}, err
+	}
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT match_meeting")
+	return meeting, start, err
+}
+
+// createConference 房间创建会议
+func (s ConferenceServer) createConference(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("create room.", zap.String("roomName", req.Room))
+	runner := ActionRunner(ctx, s.DB())
+
+	var roomInfo app.RoomInfo
+	err := runner.Select(app.SqlStar).From(app.RoomTableName).Where(app.WhereRoomName, req.Room).LoadOneContext(ctx, &roomInfo)
+	if err != nil || roomInfo.Uid == 0 {
+		return nil, newHTTPError(http.StatusNotFound, errors.New("房间不存在"))
+	}
+	confereceInfo := &app.ConferenceInfo{
+		Uid:        roomInfo.Uid,
+		OrgId:      roomInfo.OrgId,
+		RoomName:   req.Room,
+		ApiEnabled: req.ApiEnabled,
+		Ctime:      time.Now(),
+		Htime:      db.NewNullTime(time.Now()),
+	}
 
-	case MUC_OCCUPANT_JOINED:
-		logger.Info("joined room.", zap.String("roomName", req.Room))
-		s.DB().Update(app.ConferenceTableName).Set(app.ConferencePartiCol, req.Participants).Where(app.WhereCommonId, req.ConferenceId).ExecContext(c)
-		s.DB().Update(app.ConferenceTableName).Set(app.ConferenceMaxPartiCol, req.Participants).
-			Where(app.WhereIdAndMaxParti, req.ConferenceId, req.Participants).ExecContext(c)
-		// TODO: 数据库记录参会者
+	// 关联本次会议对应的预约日程，匹配失败不影响开会
+	meeting, start, err := s.matchMeeting(ctx, runner, roomInfo.Id, confereceInfo.Ctime)
+	if err != nil {
+		logger.Warn("match meeting failed.", zap.String("roomName", req.Room), zap.Error(err))
+	} else if meeting != nil {
+		confereceInfo.MeetingId = meeting.Id
+		confereceInfo.OccurrenceStart = db.NewNullTime(start)
+	}
 
-	case MUC_OCCUPANT_LEFT:
-		logger.Info("left room.", zap.String("roomName", req.Room))
-		s.DB().Update(app.ConferenceTableName).Set(app.ConferencePartiCol, req.Participants).Where(app.WhereCommonId, req.ConferenceId).ExecContext(c)
-		// TODO: 数据库更新参会者
+	_, err = runner.InsertInto(app.ConferenceTableName).
+		Columns(app.CommonUidCol, app.CommonOrgIdCol, app.ConferenceRoomNameCol, app.ConferenceApiEnabledCol,
+			app.CommonCtimeCol, app.ConferenceHtimeCol,
+			app.ConferenceMeetingIdCol, app.ConferenceOccurrenceCol).
+		Record(confereceInfo).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return confereceInfo, nil
+}
 
-	case MUC_ROOM_DESTROYED:
-		logger.Info("destory room.", zap.String("roomName", req.Room))
-		s.DB().Update(app.ConferenceTableName).
-			Set(app.ConferenceEtimeCol, time.Now()).
-			Set(app.ConferenceIsRecordCol, false).
-			Where(app.WhereCommonId, req.ConferenceId).ExecContext(c)
+// occupantJoined 更新会议人数，记录参会者加入
+func (s ConferenceServer) occupantJoined(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("joined room.", zap.String("roomName", req.Room))
+	runner := ActionRunner(ctx, s.DB())
 
-	case MUC_ROOM_SECRET:
-		logger.Info("secret room, need password.", zap.String("roomName", req.Room))
-		s.DB().Update(app.ConferenceTableName).Set(app.ConferenceLockPassCol, req.Secret).Where(app.WhereCommonId, req.ConferenceId).ExecContext(c)
-
-	case MUC_ROOM_RECORDING_START:
-		logger.Info("start recording room.", zap.String("roomName", req.Room))
-		if recording := req.Recording; recording != nil {
-			s.DB().Update(app.ConferenceTableName).
-				Set(app.ConferenceIsRecordCol, true).
-				Set(app.ConferenceStreamingCol, recording.Streaming).
-				Where(app.WhereCommonId, req.ConferenceId).ExecContext(c)
-		}
-
-	case MUC_ROOM_RECORDING_STOP:
-		logger.Info("stop recording room.", zap.String("roomName", req.Room))
-		if recording := req.Recording; recording != nil {
-			s.DB().Update(app.ConferenceTableName).
-				Set(app.ConferenceIsRecordCol, false).
-				Where(app.WhereCommonId, req.ConferenceId).ExecContext(c)
-
-			uid, _ := s.DB().Select(app.CommonUidCol).From(app.RoomTableName).Where(app.WhereRoomName, req.Room).ReturnInt64()
-			recordInfo := app.RecordInfo{
-				Uid:          uid,
-				ConferenceId: req.ConferenceId,
-				RoomName:     req.Room,
-				Duration:     recording.Duration,
-				Size:         recording.Size,
-				DownloadUrl:  recording.ObjectKey,
-				StreamingUrl: recording.Streaming,
-				Ctime:        time.Now(),
-			}
-			s.DB().InsertInto(app.RecordTableName).
-				Columns(app.CommonUidCol, app.RecordConferenceIdCol, app.RecordRoomNameCol,
-					app.RecordDurationCol, app.RecordSizeCol, app.RecordDownUrlCol, app.RecordStreamUrlCol, app.CommonCtimeCol).
-				Record(&recordInfo).ExecContext(c)
+	_, err := runner.Update(app.ConferenceTableName).Set(app.ConferencePartiCol, req.Participants).
+		Where(app.WhereCommonId, req.ConferenceId).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = runner.Update(app.ConferenceTableName).Set(app.ConferenceMaxPartiCol, req.Participants).
+		Where(app.WhereIdAndMaxParti, req.ConferenceId, req.Participants).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.joinParticipant(ctx, runner, req)
+}
+
+// occupantLeft 更新会议人数，记录参会者离开
+func (s ConferenceServer) occupantLeft(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("left room.", zap.String("roomName", req.Room))
+	runner := ActionRunner(ctx, s.DB())
+
+	_, err := runner.Update(app.ConferenceTableName).Set(app.ConferencePartiCol, req.Participants).
+		Where(app.WhereCommonId, req.ConferenceId).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.leaveParticipant(ctx, runner, req.ConferenceId, req.Jid, time.Now())
+}
+
+// roomDestroyed 结束会议，未离开的参会者视为离开
+func (s ConferenceServer) roomDestroyed(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("destory room.", zap.String("roomName", req.Room))
+	runner := ActionRunner(ctx, s.DB())
+
+	reason := req.Reason
+	if len(reason) == 0 {
+		reason = app.CloseReasonDestroyed
+	}
+	_, err := runner.Update(app.ConferenceTableName).
+		Set(app.ConferenceEtimeCol, time.Now()).
+		Set(app.ConferenceIsRecordCol, false).
+		Set(app.ConferenceCloseCol, reason).
+		Where(app.WhereCommonId, req.ConferenceId).ExecContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.closeParticipants(ctx, runner, req.ConferenceId, time.Now())
+}
+
+func (s ConferenceServer) roomSecret(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("secret room, need password.", zap.String("roomName", req.Room))
+	_, err := ActionRunner(ctx, s.DB()).Update(app.ConferenceTableName).Set(app.ConferenceLockPassCol, req.Secret).
+		Where(app.WhereCommonId, req.ConferenceId).ExecContext(ctx)
+	return nil, err
+}
+
+func (s ConferenceServer) recordingStart(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("start recording room.", zap.String("roomName", req.Room))
+	recording := req.Recording
+	if recording == nil {
+		return nil, nil
+	}
+	_, err := ActionRunner(ctx, s.DB()).Update(app.ConferenceTableName).
+		Set(app.ConferenceIsRecordCol, true).
+		Set(app.ConferenceStreamingCol, recording.Streaming).
+		Where(app.WhereCommonId, req.ConferenceId).ExecContext(ctx)
+	return nil, err
+}
+
+// recordingStop 结束录制并保存录像，同一会议的同一录像文件只保存一次。
+// 没有录像文件时只更新录制状态。
+func (s ConferenceServer) recordingStop(ctx context.Context, req ActionRequest) (interface{}, error) {
+	logger.Info("stop recording room.", zap.String("roomName", req.Room))
+	runner := ActionRunner(ctx, s.DB())
+
+	// 只更新进行中的会议，乱序到达时不覆盖更新的录制状态
+	stale, err := newerEventProcessed(runner, req)
+	if err != nil {
+		return nil, err
+	}
+	if !stale {
+		_, err = runner.Update(app.ConferenceTableName).Set(app.ConferenceIsRecordCol, false).
+			Where(app.WhereCommonId, req.ConferenceId).
+			Where(dbr.Eq(app.ConferenceEtimeCol, nil)).ExecContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recording := req.Recording
+	if recording == nil {
+		return nil, nil
+	}
+	count, err := runner.Select("count(*)").From(app.RecordTableName).
+		Where(app.WhereRecordConfIDAndDownUrl, req.ConferenceId, recording.ObjectKey).ReturnInt64()
+	if err != nil || count > 0 {
+		return nil, err
+	}
+
+	var roomInfo app.RoomInfo
+	runner.Select(app.SqlStar).From(app.RoomTableName).Where(app.WhereRoomName, req.Room).LoadOneContext(ctx, &roomInfo)
+	recordInfo := app.RecordInfo{
+		Uid:          roomInfo.Uid,
+		OrgId:        roomInfo.OrgId,
+		ConferenceId: req.ConferenceId,
+		RoomName:     req.Room,
+		Duration:     recording.Duration,
+		Size:         recording.Size,
+		DownloadUrl:  recording.ObjectKey,
+		StreamingUrl: recording.Streaming,
+		Ctime:        time.Now(),
+	}
+	_, err = runner.InsertInto(app.RecordTableName).
+		Columns(app.CommonUidCol, app.CommonOrgIdCol, app.RecordConferenceIdCol, app.RecordRoomNameCol,
+			app.RecordDurationCol, app.RecordSizeCol, app.RecordDownUrlCol, app.RecordStreamUrlCol, app.CommonCtimeCol).
+		Record(&recordInfo).ExecContext(ctx)
+	return nil, err
+}
+
+// joinParticipant 记录参会者加入会议
+func (s ConferenceServer) joinParticipant(ctx context.Context, runner dbr.SessionRunner, req ActionRequest) error {
+	conference := app.ConferenceInfo{}
+	err := runner.Select(app.SqlStar).From(app.ConferenceTableName).
+		Where(app.WhereCommonId, req.ConferenceId).LoadOneContext(ctx, &conference)
+	if err != nil {
+		return err
+	}
+
+	participant := app.ParticipantInfo{
+		ConferenceId: conference.Id,
+		Uid:          conference.Uid,
+		RoomName:     conference.RoomName,
+		Jid:          req.Jid,
+		Nick:         req.Nick,
+		Ctime:        time.Now(),
+	}
+	_, err = runner.InsertInto(app.ParticipantTableName).
+		Columns(app.ParticipantConferenceIdCol, app.CommonUidCol, app.ParticipantRoomNameCol,
+			app.ParticipantJidCol, app.ParticipantNickCol, app.CommonCtimeCol).
+		Record(&participant).ExecContext(ctx)
+	return err
+}
+
+// leaveParticipant 记录参会者离开会议，并计算参会时长
+func (s ConferenceServer) leaveParticipant(ctx context.Context, runner dbr.SessionRunner, conferenceId int64, jid string, etime time.Time) error {
+	participants := []app.ParticipantInfo{}
+	_, err := runner.Select(app.SqlStar).From(app.ParticipantTableName).
+		Where(app.WhereParticipantOnline, conferenceId, jid).LoadContext(ctx, &participants)
+	if err != nil {
+		return err
+	}
+	return updateParticipantsEtime(ctx, runner, participants, etime)
+}
+
+// closeParticipants 会议结束时，所有未离开的参会者视为离开
+func (s ConferenceServer) closeParticipants(ctx context.Context, runner dbr.SessionRunner, conferenceId int64, etime time.Time) error {
+	participants := []app.ParticipantInfo{}
+	_, err := runner.Select(app.SqlStar).From(app.ParticipantTableName).
+		Where(app.WhereConferenceParticipant, conferenceId).LoadContext(ctx, &participants)
+	if err != nil {
+		return err
+	}
+	return updateParticipantsEtime(ctx, runner, participants, etime)
+}
+
+func updateParticipantsEtime(ctx context.Context, runner dbr.SessionRunner, participants []app.ParticipantInfo, etime time.Time) error {
+	for _, participant := range participants {
+		duration := int64(etime.Sub(participant.Ctime) / time.Second)
+		if duration < 0 {
+			duration = 0
+		}
+		_, err := runner.Update(app.ParticipantTableName).
+			Set(app.ParticipantEtimeCol, etime).
+			Set(app.ParticipantDurationCol, duration).
+			Where(app.WhereCommonId, participant.Id).ExecContext(ctx)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// orgParticipantsFull 房间所属组织正在进行的会议总人数是否已达上限，房间或组织不存在时不限制
+func (s ConferenceServer) orgParticipantsFull(ctx context.Context, roomName string) (bool, error) {
+	orgID, err := s.DB().Select(app.CommonOrgIdCol).From(app.RoomTableName).
+		Where(app.WhereRoomName, roomName).ReturnInt64()
+	if err == dbr.ErrNotFound {
+		return false, nil
+	}
+	if err != nil || orgID == 0 {
+		return false, err
+	}
+
+	limits, err := s.DB().Select(app.OrgPartLimitsCol).From(app.OrgTableName).
+		Where(app.WhereCommonId, orgID).ReturnInt64()
+	if err == dbr.ErrNotFound {
+		return false, nil
+	}
+	if err != nil || limits <= 0 {
+		return false, err
+	}
+
+	var participants dbr.NullInt64
+	err = s.DB().Select("sum("+app.ConferencePartiCol+")").From(app.ConferenceTableName).
+		Where(dbr.Eq(app.CommonOrgIdCol, orgID)).
+		Where(dbr.Eq(app.ConferenceEtimeCol, nil)).
+		LoadOneContext(ctx, &participants)
+	if err != nil {
+		return false, err
+	}
+	return participants.Int64 >= limits, nil
 }
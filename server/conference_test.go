@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/db"
+)
+
+func newTestApp(t *testing.T, config app.AppConfig) *app.App {
+	session := db.NewSQLDB(db.Config{Driver: "sqlite3", DSN: ":memory:"}, false)
+	// 内存数据库每个连接都是独立的
+	session.SetMaxOpenConns(1)
+	app.InitSqlDB(session)
+	config.Secret = "test"
+	testApp, err := app.New(config, session)
+	require.NoError(t, err)
+	return testApp
+}
+
+func TestApplyEventOutOfOrder(t *testing.T) {
+	testApp := newTestApp(t, app.AppConfig{})
+	s := NewConferenceServer(testApp)
+	ctx := context.Background()
+
+	_, err := testApp.DB().InsertInto(app.RoomTableName).
+		Columns(app.CommonUidCol, app.RoomNameCol, app.RoomConfigCol, app.CommonCtimeCol).
+		Values(1, "team", app.RoomConfig{}, time.Now()).Exec()
+	require.NoError(t, err)
+	result, err := s.applyEvent(ctx, ActionRequest{Action: MUC_ROOM_PRE_CREATE, Room: "team", EventId: "e1", Seq: 1})
+	require.NoError(t, err)
+	conferenceID := result.(*app.ConferenceInfo).Id
+
+	apply := func(action, eventID, jid string, seq int64) {
+		_, err := s.applyEvent(ctx, ActionRequest{Action: action, Room: "team", ConferenceId: conferenceID,
+			EventId: eventID, Seq: seq, Jid: jid, Nick: jid})
+		require.NoError(t, err)
+	}
+	// 不同参会者的事件乱序到达，都需要处理
+	apply(MUC_OCCUPANT_JOINED, "e3", "alice", 3)
+	apply(MUC_OCCUPANT_JOINED, "e2", "bob", 2)
+	// 同一参会者离开后才到达的加入事件被丢弃
+	apply(MUC_OCCUPANT_LEFT, "e5", "alice", 5)
+	apply(MUC_OCCUPANT_JOINED, "e4", "alice", 4)
+	// 重复投递
+	apply(MUC_OCCUPANT_JOINED, "e2", "bob", 2)
+
+	participants := []app.ParticipantInfo{}
+	_, err = testApp.DB().Select(app.SqlStar).From(app.ParticipantTableName).
+		OrderAsc(app.CommonIdCol).Load(&participants)
+	require.NoError(t, err)
+	require.Len(t, participants, 2)
+	require.Equal(t, "alice", participants[0].Jid)
+	require.True(t, participants[0].Etime.Valid)
+	require.Equal(t, "bob", participants[1].Jid)
+	require.False(t, participants[1].Etime.Valid)
+
+	count, err := testApp.DB().Select("count(*)").From(app.ConferenceEventTableName).ReturnInt64()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, count)
+}
+
+func TestStreamChannels(t *testing.T) {
+	testApp := newTestApp(t, app.AppConfig{})
+	s := NewConferenceServer(testApp)
+	ctx := context.Background()
+
+	_, err := testApp.DB().InsertInto(app.RoomTableName).
+		Columns(app.CommonUidCol, app.CommonOrgIdCol, app.RoomNameCol, app.RoomConfigCol, app.CommonCtimeCol).
+		Values(1, 0, "personal", app.RoomConfig{}, time.Now()).
+		Values(1, 1, "team", app.RoomConfig{}, time.Now()).Exec()
+	require.NoError(t, err)
+
+	// 组织管理员同时订阅本人和组织的频道，每个事件只收到一次
+	messages, cancel := testApp.Broker().Subscribe(app.StreamUserChannel(1), app.StreamOrgChannel(1))
+	defer cancel()
+	_, err = s.applyEvent(ctx, ActionRequest{Action: MUC_ROOM_PRE_CREATE, Room: "team", EventId: "e1", Seq: 1})
+	require.NoError(t, err)
+	_, err = s.applyEvent(ctx, ActionRequest{Action: MUC_ROOM_PRE_CREATE, Room: "personal", EventId: "e2", Seq: 1})
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+}
+
+func TestCreateConferenceMatchFailure(t *testing.T) {
+	testApp := newTestApp(t, app.AppConfig{})
+	s := NewConferenceServer(testApp)
+	ctx := context.Background()
+
+	_, err := testApp.DB().InsertInto(app.RoomTableName).
+		Columns(app.CommonUidCol, app.RoomNameCol, app.RoomConfigCol, app.CommonCtimeCol).
+		Values(1, "team", app.RoomConfig{}, time.Now()).Exec()
+	require.NoError(t, err)
+	// 匹配预约日程失败时回滚到保存点，会议照常创建
+	_, err = testApp.DB().Exec("DROP TABLE " + app.MeetingTableName)
+	require.NoError(t, err)
+	result, err := s.applyEvent(ctx, ActionRequest{Action: MUC_ROOM_PRE_CREATE, Room: "team", EventId: "e1", Seq: 1})
+	require.NoError(t, err)
+	require.NotZero(t, result.(*app.ConferenceInfo).Id)
+	require.Zero(t, result.(*app.ConferenceInfo).MeetingId)
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocraft/dbr/v2"
+	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/db"
+)
+
+// ManageServer 管理后台服务，可访问所有租户的数据
+type ManageServer struct {
+	*app.App
+}
+
+func NewManageServer(app *app.App) *ManageServer {
+	return &ManageServer{
+		App: app,
+	}
+}
+
+// UserList 用户列表
+func (s ManageServer) UserList(c *gin.Context) {
+	var param struct {
+		Name    string `json:"name,omitempty"` // 登录名，模糊匹配
+		Role    string `json:"role,omitempty"`
+		Page    uint64 `json:"page,omitempty"`
+		PerPage uint64 `json:"perPage,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	selector := db.NewSelector(s.DB())
+	if len(param.Name) > 0 {
+		selector.Conditions = append(selector.Conditions, db.Condition{
+			Col: app.UserNameCol,
+			Cmp: db.CmpLike,
+			Val: "%" + param.Name + "%",
+		})
+	}
+	if len(param.Role) > 0 {
+		selector.Conditions = append(selector.Conditions, db.Condition{
+			Col: app.UserRoleCol,
+			Cmp: db.CmpEq,
+			Val: param.Role,
+		})
+	}
+
+	users := []*app.User{}
+	result, err := selector.From(app.UserTableName).
+		Paginate(param.Page, param.PerPage).
+		OrderDesc(app.CommonIdCol).
+		LoadPage(&users)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	for _, user := range users {
+		user.Password = ""
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// UserDisable 禁用用户，并退出该用户所有的会话
+func (s ManageServer) UserDisable(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if param.ID == c.GetInt64(app.UserID) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("不能禁用自己"))
+		return
+	}
+
+	_, err := s.DB().Update(app.UserTableName).Set(app.UserDisabledCol, true).
+		Where(app.WhereCommonId, param.ID).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err = s.RevokeUserSessions(param.ID, ""); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("disable user.", zap.Int64("operator", c.GetInt64(app.UserID)), zap.Int64("uid", param.ID))
+}
+
+// UserEnable 启用用户
+func (s ManageServer) UserEnable(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	_, err := s.DB().Update(app.UserTableName).Set(app.UserDisabledCol, false).
+		Where(app.WhereCommonId, param.ID).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("enable user.", zap.Int64("operator", c.GetInt64(app.UserID)), zap.Int64("uid", param.ID))
+}
+
+// UserUnlock 解除因登录失败次数过多导致的账号锁定
+func (s ManageServer) UserUnlock(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	user := app.User{}
+	err := s.DB().Select(app.SqlStar).From(app.UserTableName).
+		Where(app.WhereCommonId, param.ID).LoadOneContext(c, &user)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, errors.New("用户不存在"))
+		return
+	}
+	if err = s.UnlockAccount(user.Name); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("unlock user.", zap.Int64("operator", c.GetInt64(app.UserID)), zap.Int64("uid", param.ID))
+}
+
+// UserRole 设置用户角色
+func (s ManageServer) UserRole(c *gin.Context) {
+	var param struct {
+		ID   int64
+		Role string `json:"role,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if !app.ValidRole(param.Role) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("角色不存在"))
+		return
+	}
+	if param.ID == c.GetInt64(app.UserID) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("不能修改自己的角色"))
+		return
+	}
+
+	_, err := s.DB().Update(app.UserTableName).Set(app.UserRoleCol, param.Role).
+		Where(app.WhereCommonId, param.ID).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("set user role.", zap.Int64("operator", c.GetInt64(app.UserID)),
+		zap.Int64("uid", param.ID), zap.String("role", param.Role))
+}
+
+// UserImpersonate 以指定用户的身份登录，用于排查问题
+func (s ManageServer) UserImpersonate(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	user := app.User{}
+	err := s.DB().Select(app.SqlStar).From(app.UserTableName).
+		Where(app.WhereCommonId, param.ID).LoadOneContext(c, &user)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errors.New("用户不存在"))
+		return
+	}
+	if user.Disabled || user.Role == app.RoleSuperAdmin {
+		c.AbortWithError(http.StatusForbidden, errors.New("不能模拟登录该用户"))
+		return
+	}
+
+	operator := c.GetInt64(app.UserID)
+	tokens, err := s.ImpersonateSession(operator, user.Id, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	logger.Warn("impersonate user.", zap.Int64("operator", operator), zap.Int64("uid", user.Id))
+
+	c.SetCookie(app.CookieName, tokens.AccessToken, 0, "/", "", false, true)
+	c.SetCookie(app.RefreshCookieName, tokens.RefreshToken, s.Config().Token.RefreshTokenTTL, "/admin/passport", "", false, true)
+	c.JSON(http.StatusOK, tokens)
+}
+
+// ConferenceRuning 所有租户正在进行的会议
+func (s ManageServer) ConferenceRuning(c *gin.Context) {
+	var param db.Pagination
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	items := []app.ConferenceInfo{}
+	result, err := db.NewSelector(s.DB()).From(app.ConferenceTableName).
+		Where(dbr.Eq(app.ConferenceEtimeCol, nil)).
+		Paginate(param.Page, param.PerPage).
+		OrderDesc(app.CommonIdCol).
+		LoadPage(&items)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// RoomList 所有租户的房间
+func (s ManageServer) RoomList(c *gin.Context) {
+	rooms := []app.RoomInfo{}
+	if result, ok := s.listAll(c, app.RoomTableName, &rooms); ok {
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// RecordList 所有租户的录像
+func (s ManageServer) RecordList(c *gin.Context) {
+	records := []*app.RecordInfo{}
+	result, ok := s.listAll(c, app.RecordTableName, &records)
+	if !ok {
+		return
+	}
+	for _, record := range records {
+		record.DownloadUrl = s.Config().RecordingURL + record.DownloadUrl
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// OrgList 所有组织
+func (s ManageServer) OrgList(c *gin.Context) {
+	var param struct {
+		Name    string `json:"name,omitempty"` // 组织名称，模糊匹配
+		Page    uint64 `json:"page,omitempty"`
+		PerPage uint64 `json:"perPage,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	selector := db.NewSelector(s.DB())
+	if len(param.Name) > 0 {
+		selector.Conditions = append(selector.Conditions, db.Condition{
+			Col: app.OrgNameCol,
+			Cmp: db.CmpLike,
+			Val: "%" + param.Name + "%",
+		})
+	}
+
+	orgs := []app.Organization{}
+	result, err := selector.From(app.OrgTableName).
+		Paginate(param.Page, param.PerPage).
+		OrderDesc(app.CommonIdCol).
+		LoadPage(&orgs)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// OrgQuota 设置组织的房间数量和参会人数上限
+func (s ManageServer) OrgQuota(c *gin.Context) {
+	org := app.Organization{}
+	if c.BindJSON(&org) != nil {
+		return
+	}
+
+	_, err := s.DB().Update(app.OrgTableName).
+		Set(app.OrgRoomLimitsCol, org.RoomLimits).
+		Set(app.OrgPartLimitsCol, org.ParticipantLimits).
+		Where(app.WhereCommonId, org.Id).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("set org quota.", zap.Int64("operator", c.GetInt64(app.UserID)), zap.Int64("orgId", org.Id),
+		zap.Int("roomLimits", org.RoomLimits), zap.Int("participantLimits", org.ParticipantLimits))
+}
+
+// APIKeyCreate 为内部服务创建 API Key，明文密钥只在创建时返回一次
+func (s ManageServer) APIKeyCreate(c *gin.Context) {
+	var param struct {
+		Uid       int64          `json:"uid,omitempty"` // API Key 所属用户，默认为当前用户
+		Name      string         `json:"name"`
+		Scopes    app.StringList `json:"scopes"`
+		ExpiresIn int64          `json:"expiresIn,omitempty"` // 有效期（秒），为 0 表示不过期
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if len(param.Name) == 0 || len(param.Scopes) == 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("名称和授权范围不能为空"))
+		return
+	}
+	if param.Uid == 0 {
+		param.Uid = c.GetInt64(app.UserID)
+	}
+
+	var expiresAt db.NullTime
+	if param.ExpiresIn > 0 {
+		expiresAt.Time = time.Now().Add(time.Duration(param.ExpiresIn) * time.Second)
+		expiresAt.Valid = true
+	}
+	key, apiKey, err := s.CreateAPIKey(c, param.Uid, param.Name, param.Scopes, expiresAt)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	logger.Info("create api key.", zap.Int64("operator", c.GetInt64(app.UserID)),
+		zap.Int64("id", apiKey.Id), zap.String("name", apiKey.Name), zap.Strings("scopes", apiKey.Scopes))
+
+	c.JSON(http.StatusOK, gin.H{
+		"key":    key,
+		"apiKey": apiKey,
+	})
+}
+
+// APIKeyList API Key 列表
+func (s ManageServer) APIKeyList(c *gin.Context) {
+	var param db.Pagination
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	items := []app.APIKey{}
+	result, err := db.NewSelector(s.DB()).From(app.APIKeyTableName).
+		Paginate(param.Page, param.PerPage).
+		OrderDesc(app.CommonIdCol).
+		LoadPage(&items)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// APIKeyRevoke 吊销 API Key
+func (s ManageServer) APIKeyRevoke(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	if err := s.RevokeAPIKey(c, param.ID); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("revoke api key.", zap.Int64("operator", c.GetInt64(app.UserID)), zap.Int64("id", param.ID))
+}
+
+// listAll 按用户或房间名筛选的分页列表
+func (s ManageServer) listAll(c *gin.Context, table string, items interface{}) (*db.PageResult, bool) {
+	var param struct {
+		Uid      int64  `json:"uid,omitempty"`
+		RoomName string `json:"roomName,omitempty"`
+		Page     uint64 `json:"page,omitempty"`
+		PerPage  uint64 `json:"perPage,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return nil, false
+	}
+
+	selector := db.NewSelector(s.DB())
+	if param.Uid > 0 {
+		selector.Conditions = append(selector.Conditions, db.Condition{
+			Col: app.CommonUidCol,
+			Cmp: db.CmpEq,
+			Val: param.Uid,
+		})
+	}
+	if len(param.RoomName) > 0 {
+		selector.Conditions = append(selector.Conditions, db.Condition{
+			Col: app.RoomNameCol,
+			Cmp: db.CmpEq,
+			Val: param.RoomName,
+		})
+	}
+
+	result, err := selector.From(table).
+		Paginate(param.Page, param.PerPage).
+		OrderDesc(app.CommonIdCol).
+		LoadPage(items)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return result, true
+}
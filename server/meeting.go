@@ -0,0 +1,444 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/db"
+	"jhmeeting.com/adminserver/util"
+)
+
+// 查询日程的最大时间范围
+const meetingMaxRange = 92 * 24 * time.Hour
+
+// MeetingServer 预约会议服务
+type MeetingServer struct {
+	*app.App
+}
+
+func NewMeetingServer(app *app.App) *MeetingServer {
+	return &MeetingServer{
+		App: app,
+	}
+}
+
+// 创建和修改预约会议的参数，修改时不能更换房间
+type meetingParam struct {
+	Id          int64     `json:"id,omitempty"`
+	RoomId      int64     `json:"roomId"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Start       time.Time `json:"start"`
+	Duration    int       `json:"duration"`
+	Timezone    string    `json:"timezone"`
+	Recurrence  string    `json:"recurrence"`
+	Attendees   []string  `json:"attendees"`
+}
+
+func (p meetingParam) meeting() app.Meeting {
+	return app.Meeting{
+		Id:          p.Id,
+		RoomId:      p.RoomId,
+		Title:       strings.TrimSpace(p.Title),
+		Description: p.Description,
+		// 数据库只保存到秒
+		Start:      p.Start.Truncate(time.Second),
+		Duration:   p.Duration,
+		Timezone:   p.Timezone,
+		Recurrence: strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(p.Recurrence)), "RRULE:"),
+		Attendees:  p.Attendees,
+	}
+}
+
+// 预约会议及已取消的日程
+type meetingInfo struct {
+	app.Meeting
+	ExDates []time.Time `json:"exdates"`
+	URL     string      `json:"url"`
+}
+
+// Create 在可访问的房间中创建预约会议
+func (s MeetingServer) Create(c *gin.Context) {
+	var param meetingParam
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	meeting := param.meeting()
+	if err := meeting.Validate(); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
+	room := app.RoomInfo{}
+	err := s.DB().Select(app.SqlStar).From(app.RoomTableName).
+		Where(app.WhereCommonId, param.RoomId).Where(scope).LoadOneContext(c, &room)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errors.New("房间不存在"))
+		return
+	}
+
+	meeting.Uid = c.GetInt64(app.UserID)
+	meeting.OrgId = room.OrgId
+	meeting.RoomName = room.RoomName
+	meeting.Ctime = time.Now()
+	meeting.Utime = meeting.Ctime
+	_, err = s.DB().InsertInto(app.MeetingTableName).
+		Columns(app.CommonUidCol, app.CommonOrgIdCol, app.MeetingRoomIdCol, app.MeetingRoomNameCol, app.MeetingTitleCol,
+			app.MeetingDescriptionCol, app.MeetingStartCol, app.MeetingDurationCol, app.MeetingTimezoneCol,
+			app.MeetingRecurrenceCol, app.MeetingAttendeesCol, app.CommonCtimeCol, app.MeetingUtimeCol).
+		Record(&meeting).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.inviteAttendees(c, meeting.Id)
+	c.JSON(http.StatusOK, gin.H{
+		"id": meeting.Id,
+	})
+}
+
+// List 预约会议列表，默认不包含已取消的会议
+func (s MeetingServer) List(c *gin.Context) {
+	var param struct {
+		Cancelled bool   `json:"cancelled,omitempty"`
+		Page      uint64 `json:"page,omitempty"`
+		PerPage   uint64 `json:"perPage,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
+
+	meetings := []app.Meeting{}
+	result, err := db.NewSelector(s.DB()).From(app.MeetingTableName).
+		Where(scope, dbr.Eq(app.MeetingCancelledCol, param.Cancelled)).
+		Paginate(param.Page, param.PerPage).
+		OrderDesc(app.CommonIdCol).
+		LoadPage(&meetings)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Info 预约会议详情
+func (s MeetingServer) Info(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	meeting, ok := s.loadMeeting(c, param.ID, false)
+	if !ok {
+		return
+	}
+	exdates, err := s.MeetingExDates(c, s.DB(), []int64{meeting.Id})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, meetingInfo{
+		Meeting: *meeting,
+		ExDates: exdates[meeting.Id],
+		URL:     s.RoomURL(meeting.RoomName),
+	})
+}
+
+// Occurrences 时间范围内的日程，默认为之后 30 天
+func (s MeetingServer) Occurrences(c *gin.Context) {
+	var param struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if param.From.IsZero() {
+		param.From = time.Now()
+	}
+	if param.To.IsZero() {
+		param.To = param.From.AddDate(0, 0, 30)
+	}
+	if !param.To.After(param.From) || param.To.Sub(param.From) > meetingMaxRange {
+		c.AbortWithError(http.StatusBadRequest, errors.New("查询时间范围无效，最长 92 天"))
+		return
+	}
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
+
+	meetings := []app.Meeting{}
+	_, err := s.DB().Select(app.SqlStar).From(app.MeetingTableName).
+		Where(scope).
+		Where(dbr.Eq(app.MeetingCancelledCol, false)).
+		Where(dbr.Lt(app.MeetingStartCol, param.To)).
+		LoadContext(c, &meetings)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	occurrences, err := s.ExpandMeetings(c, meetings, param.From, param.To)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, occurrences)
+}
+
+// Modify 修改预约会议，已取消的日程保持不变
+func (s MeetingServer) Modify(c *gin.Context) {
+	var param meetingParam
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	meeting := param.meeting()
+	if err := meeting.Validate(); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	current, ok := s.loadMeeting(c, param.Id, true)
+	if !ok {
+		return
+	}
+	if current.Cancelled {
+		c.AbortWithError(http.StatusBadRequest, errors.New("预约会议已取消"))
+		return
+	}
+
+	_, err := s.DB().Update(app.MeetingTableName).
+		Set(app.MeetingTitleCol, meeting.Title).
+		Set(app.MeetingDescriptionCol, meeting.Description).
+		Set(app.MeetingStartCol, meeting.Start).
+		Set(app.MeetingDurationCol, meeting.Duration).
+		Set(app.MeetingTimezoneCol, meeting.Timezone).
+		Set(app.MeetingRecurrenceCol, meeting.Recurrence).
+		Set(app.MeetingAttendeesCol, meeting.Attendees).
+		IncrBy(app.MeetingSequenceCol, 1).
+		Set(app.MeetingUtimeCol, time.Now()).
+		Where(app.WhereCommonId, param.Id).
+		ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.inviteAttendees(c, param.Id)
+}
+
+// Cancel 取消整个预约会议
+func (s MeetingServer) Cancel(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if _, ok := s.loadMeeting(c, param.ID, true); !ok {
+		return
+	}
+
+	_, err := s.DB().Update(app.MeetingTableName).
+		Set(app.MeetingCancelledCol, true).
+		IncrBy(app.MeetingSequenceCol, 1).
+		Set(app.MeetingUtimeCol, time.Now()).
+		Where(app.WhereCommonId, param.ID).
+		ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.inviteAttendees(c, param.ID)
+}
+
+// CancelOccurrence 取消重复会议中的一次日程，start 为该次日程的开始时间
+func (s MeetingServer) CancelOccurrence(c *gin.Context) {
+	var param struct {
+		ID    int64     `json:"id"`
+		Start time.Time `json:"start"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	meeting, ok := s.loadMeeting(c, param.ID, true)
+	if !ok {
+		return
+	}
+	exdates, err := s.MeetingExDates(c, s.DB(), []int64{meeting.Id})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if meeting.Cancelled || !meeting.HasOccurrence(param.Start, exdates[meeting.Id]) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("日程不存在或已取消"))
+		return
+	}
+
+	tx, err := s.DB().BeginTx(c, nil)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	exception := app.MeetingException{
+		MeetingId: meeting.Id,
+		Start:     param.Start,
+		Ctime:     time.Now(),
+	}
+	_, err = tx.InsertInto(app.MeetingExceptionTableName).
+		Columns(app.MeetingExceptionMeetingCol, app.MeetingExceptionStartCol, app.CommonCtimeCol).
+		Record(&exception).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	_, err = tx.Update(app.MeetingTableName).
+		IncrBy(app.MeetingSequenceCol, 1).
+		Set(app.MeetingUtimeCol, time.Now()).
+		Where(app.WhereCommonId, meeting.Id).
+		ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.inviteAttendees(c, meeting.Id)
+}
+
+// ICS 下载预约会议的 .ics 文件，GET /admin/meeting/ics?id=
+func (s MeetingServer) ICS(c *gin.Context) {
+	id, _ := strconv.ParseInt(c.Query("id"), 10, 64)
+	meeting, ok := s.loadMeeting(c, id, false)
+	if !ok {
+		return
+	}
+	exdates, err := s.MeetingExDates(c, s.DB(), []int64{meeting.Id})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Header("Content-Type", "text/calendar; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="meeting-`+strconv.FormatInt(meeting.Id, 10)+`.ics"`)
+	event := s.MeetingICalEvent(*meeting, exdates[meeting.Id])
+	if err = util.WriteICalendar(c.Writer, meeting.Title, "PUBLISH", []util.ICalEvent{event}); err != nil {
+		logger.Warn("write ics failed.", zap.Int64("meetingId", meeting.Id), zap.Error(err))
+	}
+}
+
+// CalendarFeed 当前用户的日历订阅地址，reset 为 true 时重新生成，旧地址失效
+func (s MeetingServer) CalendarFeed(c *gin.Context) {
+	var param struct {
+		Reset bool `json:"reset,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	token, err := s.CalendarToken(c, c.GetInt64(app.UserID), param.Reset)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	feedURL, err := s.CalendarFeedURL(token)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"url": feedURL,
+	})
+}
+
+// Calendar 日历订阅，地址中的 token 即为授权，GET /admin/calendar/:token.ics
+func (s MeetingServer) Calendar(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("file"), ".ics")
+	uid, err := s.CalendarUser(c, token)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errors.New("订阅地址无效"))
+		return
+	}
+	scope, err := s.OwnerScope(c, uid, false)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// 已取消的会议以 CANCELLED 状态输出，日历客户端据此删除日程
+	meetings := []app.Meeting{}
+	_, err = s.DB().Select(app.SqlStar).From(app.MeetingTableName).
+		Where(scope).OrderAsc(app.CommonIdCol).LoadContext(c, &meetings)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ids := []int64{}
+	for _, meeting := range meetings {
+		ids = append(ids, meeting.Id)
+	}
+	exdates, err := s.MeetingExDates(c, s.DB(), ids)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	events := []util.ICalEvent{}
+	for _, meeting := range meetings {
+		events = append(events, s.MeetingICalEvent(meeting, exdates[meeting.Id]))
+	}
+
+	c.Header("Content-Type", "text/calendar; charset=utf-8")
+	if err = util.WriteICalendar(c.Writer, "预约会议", "PUBLISH", events); err != nil {
+		logger.Warn("write calendar failed.", zap.Int64("uid", uid), zap.Error(err))
+	}
+}
+
+// loadMeeting 加载当前用户可访问的预约会议，manage 为 true 时需要修改权限
+func (s MeetingServer) loadMeeting(c *gin.Context, id int64, manage bool) (*app.Meeting, bool) {
+	scope, ok := ownerScope(c, s.App, manage)
+	if !ok {
+		return nil, false
+	}
+	meeting := &app.Meeting{}
+	err := s.DB().Select(app.SqlStar).From(app.MeetingTableName).
+		Where(app.WhereCommonId, id).Where(scope).LoadOneContext(c, meeting)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errors.New("预约会议不存在"))
+		return nil, false
+	}
+	return meeting, true
+}
+
+// inviteAttendees 按会议的最新状态给参会者发送邀请邮件，由当前用户发送，失败时只记录日志
+func (s MeetingServer) inviteAttendees(c *gin.Context, id int64) {
+	meeting := app.Meeting{}
+	err := s.DB().Select(app.SqlStar).From(app.MeetingTableName).
+		Where(app.WhereCommonId, id).LoadOneContext(c, &meeting)
+	if err != nil {
+		logger.Warn("load meeting failed.", zap.Int64("meetingId", id), zap.Error(err))
+		return
+	}
+	exdates, err := s.MeetingExDates(c, s.DB(), []int64{id})
+	if err == nil {
+		err = s.EnqueueMeetingInvitation(c, s.DB(), c.GetInt64(app.UserID), meeting, exdates[id])
+	}
+	if err != nil {
+		logger.Warn("enqueue meeting invitation failed.", zap.Int64("meetingId", id), zap.Error(err))
+	}
+}
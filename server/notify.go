@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+
+	"jhmeeting.com/adminserver/app"
+)
+
+func (s ConferenceServer) registerNotifications() {
+	s.Subscribe(MUC_ROOM_RECORDING_STOP, ActionHandlerFunc(s.recordingReadyMail))
+}
+
+// recordingReadyMail 录像生成后通知房间所有者，邮件在事件的事务内放入发件箱
+func (s ConferenceServer) recordingReadyMail(ctx context.Context, req ActionRequest) (interface{}, error) {
+	if req.Recording == nil || !s.MailEnabled() {
+		return nil, nil
+	}
+	runner := ActionRunner(ctx, s.DB())
+
+	conference, err := actionConference(ctx, runner, req)
+	if conference == nil {
+		return nil, err
+	}
+	email, err := runner.Select(app.UserEmailCol).From(app.UserTableName).
+		Where(app.WhereCommonId, conference.Uid).ReturnString()
+	if err != nil || len(email) == 0 {
+		return nil, nil
+	}
+
+	data := app.RecordingMailData{
+		RoomName: conference.RoomName,
+		URL:      s.Config().RecordingURL + req.Recording.ObjectKey,
+		Duration: req.Recording.Duration,
+		Size:     req.Recording.Size,
+		Ctime:    conference.Ctime.Local(),
+	}
+	return nil, s.EnqueueMail(ctx, runner, []string{email}, app.MailTemplateRecordingReady, data)
+}
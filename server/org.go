@@ -0,0 +1,406 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocraft/dbr/v2"
+	"jhmeeting.com/adminserver/app"
+)
+
+// OrgServer 组织管理服务
+type OrgServer struct {
+	*app.App
+}
+
+func NewOrgServer(app *app.App) *OrgServer {
+	return &OrgServer{
+		App: app,
+	}
+}
+
+// ownerScope 当前用户可访问的数据范围，出错时中止请求
+func ownerScope(c *gin.Context, gapp *app.App, manage bool) (dbr.Builder, bool) {
+	scope, err := gapp.OwnerScope(c, c.GetInt64(app.UserID), manage)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return scope, true
+}
+
+// 组织及当前用户在组织内的角色
+type orgInfo struct {
+	app.Organization
+	Role string `json:"role"`
+}
+
+// 组织成员及其用户信息
+type orgMemberInfo struct {
+	app.OrgMember
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// Create 创建组织，创建者为组织管理员
+func (s OrgServer) Create(c *gin.Context) {
+	org := app.Organization{}
+	if c.BindJSON(&org) != nil {
+		return
+	}
+	if len(org.Name) == 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("组织名称不能为空"))
+		return
+	}
+
+	count, _ := s.DB().Select("count(*)").From(app.OrgTableName).Where(app.WhereOrgName, org.Name).ReturnInt64()
+	if count > 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("组织名称已存在"))
+		return
+	}
+
+	// 配额只能由超级管理员设置
+	org.Uid = c.GetInt64(app.UserID)
+	org.RoomLimits, org.ParticipantLimits = 0, 0
+	org.Ctime = time.Now()
+
+	tx, err := s.DB().Begin()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	_, err = tx.InsertInto(app.OrgTableName).
+		Columns(app.CommonUidCol, app.OrgNameCol, app.CommonCtimeCol).
+		Record(&org).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	member := app.OrgMember{
+		OrgId: org.Id,
+		Uid:   org.Uid,
+		Role:  app.OrgRoleAdmin,
+		Ctime: org.Ctime,
+	}
+	_, err = tx.InsertInto(app.OrgMemberTableName).
+		Columns(app.OrgMemberOrgIdCol, app.CommonUidCol, app.OrgMemberRoleCol, app.CommonCtimeCol).
+		Record(&member).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id": org.Id,
+	})
+}
+
+// List 当前用户加入的组织
+func (s OrgServer) List(c *gin.Context) {
+	members := []app.OrgMember{}
+	_, err := s.DB().Select(app.SqlStar).From(app.OrgMemberTableName).
+		Where(dbr.Eq(app.CommonUidCol, c.GetInt64(app.UserID))).LoadContext(c, &members)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	items := []orgInfo{}
+	for _, member := range members {
+		org := orgInfo{Role: member.Role}
+		err = s.DB().Select(app.SqlStar).From(app.OrgTableName).
+			Where(app.WhereCommonId, member.OrgId).LoadOneContext(c, &org.Organization)
+		if err == nil {
+			items = append(items, org)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items": items,
+		"count": len(items),
+	})
+}
+
+// Info 组织信息，需要是组织成员
+func (s OrgServer) Info(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	role, ok := s.requireOrgRole(c, param.ID, false)
+	if !ok {
+		return
+	}
+	org := orgInfo{Role: role}
+	err := s.DB().Select(app.SqlStar).From(app.OrgTableName).
+		Where(app.WhereCommonId, param.ID).LoadOneContext(c, &org.Organization)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	c.JSON(http.StatusOK, org)
+}
+
+// Modify 修改组织名称，需要组织管理员权限
+func (s OrgServer) Modify(c *gin.Context) {
+	org := app.Organization{}
+	if c.BindJSON(&org) != nil {
+		return
+	}
+	if _, ok := s.requireOrgRole(c, org.Id, true); !ok {
+		return
+	}
+	if len(org.Name) == 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("组织名称不能为空"))
+		return
+	}
+
+	count, _ := s.DB().Select("count(*)").From(app.OrgTableName).
+		Where(app.WhereOrgName, org.Name).Where(dbr.Neq(app.CommonIdCol, org.Id)).ReturnInt64()
+	if count > 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("组织名称已存在"))
+		return
+	}
+
+	_, err := s.DB().Update(app.OrgTableName).Set(app.OrgNameCol, org.Name).
+		Where(app.WhereCommonId, org.Id).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// Security 修改组织的安全设置，需要组织管理员权限。
+// 要求两步验证后，未启用的成员下次登录时需要先绑定身份验证器。
+func (s OrgServer) Security(c *gin.Context) {
+	var param struct {
+		ID          int64 `json:"id"`
+		RequireTotp bool  `json:"requireTotp"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if _, ok := s.requireOrgRole(c, param.ID, true); !ok {
+		return
+	}
+
+	_, err := s.DB().Update(app.OrgTableName).Set(app.OrgRequireTotpCol, param.RequireTotp).
+		Where(app.WhereCommonId, param.ID).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// Delete 删除组织，组织下还有房间时不能删除
+func (s OrgServer) Delete(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if _, ok := s.requireOrgRole(c, param.ID, true); !ok {
+		return
+	}
+
+	count, _ := s.DB().Select("count(*)").From(app.RoomTableName).
+		Where(dbr.Eq(app.CommonOrgIdCol, param.ID)).ReturnInt64()
+	if count > 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("请先删除组织下的房间"))
+		return
+	}
+
+	tx, err := s.DB().Begin()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	if _, err = tx.DeleteFrom(app.OrgMemberTableName).
+		Where(dbr.Eq(app.OrgMemberOrgIdCol, param.ID)).ExecContext(c); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if _, err = tx.DeleteFrom(app.OrgTableName).
+		Where(app.WhereCommonId, param.ID).ExecContext(c); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// MemberList 组织成员列表，需要是组织成员
+func (s OrgServer) MemberList(c *gin.Context) {
+	var param struct {
+		OrgId int64 `json:"orgId,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if _, ok := s.requireOrgRole(c, param.OrgId, false); !ok {
+		return
+	}
+
+	members := []orgMemberInfo{}
+	_, err := s.DB().Select("m.*", "u.name", "u.display_name").
+		From(dbr.I(app.OrgMemberTableName).As("m")).
+		Join(dbr.I(app.UserTableName).As("u"), "u.id = m.uid").
+		Where("m.org_id = ?", param.OrgId).
+		OrderAsc("m.id").
+		LoadContext(c, &members)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items": members,
+		"count": len(members),
+	})
+}
+
+// MemberAdd 按登录名添加组织成员，需要组织管理员权限
+func (s OrgServer) MemberAdd(c *gin.Context) {
+	var param struct {
+		OrgId int64  `json:"orgId,omitempty"`
+		Name  string `json:"name,omitempty"` // 用户登录名
+		Role  string `json:"role,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if _, ok := s.requireOrgRole(c, param.OrgId, true); !ok {
+		return
+	}
+	if len(param.Role) == 0 {
+		param.Role = app.OrgRoleMember
+	}
+	if !app.ValidOrgRole(param.Role) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("角色不存在"))
+		return
+	}
+
+	uid, _ := s.DB().Select(app.CommonIdCol).From(app.UserTableName).
+		Where(app.WhereUserName, param.Name).ReturnInt64()
+	if uid == 0 {
+		c.AbortWithError(http.StatusNotFound, errors.New("用户不存在"))
+		return
+	}
+	if len(s.OrgRole(c, param.OrgId, uid)) > 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("用户已是组织成员"))
+		return
+	}
+
+	member := app.OrgMember{
+		OrgId: param.OrgId,
+		Uid:   uid,
+		Role:  param.Role,
+		Ctime: time.Now(),
+	}
+	_, err := s.DB().InsertInto(app.OrgMemberTableName).
+		Columns(app.OrgMemberOrgIdCol, app.CommonUidCol, app.OrgMemberRoleCol, app.CommonCtimeCol).
+		Record(&member).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, member)
+}
+
+// MemberRemove 移除组织成员，需要组织管理员权限
+func (s OrgServer) MemberRemove(c *gin.Context) {
+	var param struct {
+		OrgId int64 `json:"orgId,omitempty"`
+		Uid   int64 `json:"uid,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if _, ok := s.requireOrgRole(c, param.OrgId, true); !ok {
+		return
+	}
+	if !s.keepOrgAdmin(c, param.OrgId, param.Uid) {
+		return
+	}
+
+	_, err := s.DB().DeleteFrom(app.OrgMemberTableName).
+		Where(app.WhereOrgMember, param.OrgId, param.Uid).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// MemberRole 设置成员在组织内的角色，需要组织管理员权限
+func (s OrgServer) MemberRole(c *gin.Context) {
+	var param struct {
+		OrgId int64  `json:"orgId,omitempty"`
+		Uid   int64  `json:"uid,omitempty"`
+		Role  string `json:"role,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if _, ok := s.requireOrgRole(c, param.OrgId, true); !ok {
+		return
+	}
+	if !app.ValidOrgRole(param.Role) {
+		c.AbortWithError(http.StatusBadRequest, errors.New("角色不存在"))
+		return
+	}
+	if param.Role != app.OrgRoleAdmin && !s.keepOrgAdmin(c, param.OrgId, param.Uid) {
+		return
+	}
+
+	_, err := s.DB().Update(app.OrgMemberTableName).Set(app.OrgMemberRoleCol, param.Role).
+		Where(app.WhereOrgMember, param.OrgId, param.Uid).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// requireOrgRole 当前用户需要是组织成员，admin 为 true 时需要是组织管理员
+func (s OrgServer) requireOrgRole(c *gin.Context, orgID int64, admin bool) (string, bool) {
+	role := s.OrgRole(c, orgID, c.GetInt64(app.UserID))
+	if len(role) == 0 || (admin && role != app.OrgRoleAdmin) {
+		c.AbortWithError(http.StatusForbidden, errors.New("没有组织的访问权限"))
+		return role, false
+	}
+	return role, true
+}
+
+// keepOrgAdmin 组织至少保留一个管理员
+func (s OrgServer) keepOrgAdmin(c *gin.Context, orgID, uid int64) bool {
+	if s.OrgRole(c, orgID, uid) != app.OrgRoleAdmin {
+		return true
+	}
+	count, err := s.DB().Select("count(*)").From(app.OrgMemberTableName).
+		Where(dbr.Eq(app.OrgMemberOrgIdCol, orgID)).
+		Where(dbr.Eq(app.OrgMemberRoleCol, app.OrgRoleAdmin)).ReturnInt64()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+	if count <= 1 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("组织至少需要一个管理员"))
+		return false
+	}
+	return true
+}
@@ -3,9 +3,13 @@ package server
 import (
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dchest/captcha"
+	"go.uber.org/zap"
 	"jhmeeting.com/adminserver/util"
 
 	"github.com/gin-gonic/gin"
@@ -37,8 +41,12 @@ func (s PassportServer) Signup(c *gin.Context) {
 		return
 	}
 
+	if err := s.CheckPassword(param.Password); err != nil {
+		abortPasswordError(c, err)
+		return
+	}
 	var err error
-	param.Password, err = util.HashPassword(param.Password)
+	param.Password, err = s.PasswordHasher().Hash(param.Password)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -55,21 +63,42 @@ func (s PassportServer) Signup(c *gin.Context) {
 	param.Ctime = time.Now()
 	ctx := c.Request.Context()
 
+	// 超级管理员通过配置 superAdmins 指定，注册的用户都是普通用户
+	param.Role = app.RoleUser
+	param.Disabled = false
+
 	_, err = s.DB().InsertInto(app.UserTableName).
-		Columns(app.UserNameCol, app.UserPasswordCol, app.CommonCtimeCol).
+		Columns(app.UserNameCol, app.UserPasswordCol, app.UserEmailCol, app.UserPhoneCol, app.UserRoleCol, app.CommonCtimeCol).
 		Record(&param.User).ExecContext(ctx)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	token := s.CreateToken(param.Id)
+	// 填写了邮箱或手机号码时发送验证码，发送失败不影响注册，可以稍后重新发送
+	s.sendSignupCode(c, param.Id, app.ChannelEmail, param.Email)
+	s.sendSignupCode(c, param.Id, app.ChannelSMS, param.Phone)
+	tokens, err := s.CreateSession(param.Id, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 	param.Password = ""
-	c.SetCookie(app.CookieName, token, 0, "/", "", true, true)
+	c.SetCookie(app.CookieName, tokens.AccessToken, 0, "/", "", true, true)
+	s.setRefreshCookie(c, tokens.RefreshToken, true)
 	c.JSON(http.StatusOK, gin.H{
 		"id": param.Id,
 	})
 }
 
+func (s PassportServer) sendSignupCode(c *gin.Context, uid int64, channel, to string) {
+	if len(to) == 0 {
+		return
+	}
+	if err := s.SendSignupCode(c, uid, channel, c.ClientIP()); err != nil {
+		logger.Warn("send verify code failed.", zap.Int64("uid", uid), zap.String("channel", channel), zap.Error(err))
+	}
+}
+
 func (s PassportServer) Login(c *gin.Context) {
 	var param struct {
 		app.User
@@ -80,33 +109,248 @@ func (s PassportServer) Login(c *gin.Context) {
 		return
 	}
 
+	ip := c.ClientIP()
+	if err := s.CheckLoginAllowed(param.Name, ip); err != nil {
+		c.AbortWithError(lockoutErrorStatus(err), err)
+		return
+	}
 	if !captcha.VerifyString(param.CaptchaId, param.CaptchaCode) {
+		logger.Info("login captcha failed.", zap.String("name", param.Name), zap.String("ip", ip))
 		c.AbortWithError(http.StatusBadRequest, errors.New("图片验证码错误"))
 		return
 	}
 
-	errMsg := "用户名或密码错误"
-	user := app.User{}
-	err := s.DB().Select(app.SqlStar).From(app.UserTableName).
-		Where(app.WhereUserName, param.Name).LoadOneContext(c, &user)
+	user, err := s.Authenticate(c, param.Name, param.Password)
 	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, errors.New(errMsg))
+		if err := s.RecordLoginFailure(param.Name, ip, err.Error()); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
+	if user.Disabled {
+		logger.Warn("login failed, account disabled.", zap.Int64("uid", user.Id), zap.String("ip", ip))
+		c.AbortWithError(http.StatusForbidden, errors.New("账号已被禁用"))
+		return
+	}
+	// 密码哈希的算法或参数已过时则重新生成，失败不影响登录
+	if err = s.UpgradePasswordHash(c, user, param.Password); err != nil {
+		logger.Warn("upgrade password hash failed.", zap.Int64("uid", user.Id), zap.Error(err))
+	}
 
-	pass := util.CheckPasswordHash(param.Password, user.Password)
+	// 启用了两步验证，或所在组织要求两步验证时，返回 challenge，由 LoginTotp 完成登录
+	required, err := s.TotpRequired(c, user.Id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	// 需要两步验证时，账号的失败计数在完成第二步后再清除
+	if user.TotpEnabled || required {
+		challenge, err := s.CreateLoginChallenge(user.Id, param.Name, !user.TotpEnabled)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, challenge)
+		return
+	}
+	if err = s.RecordLoginSuccess(param.Name); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 
-	if !pass {
-		c.AbortWithError(http.StatusBadRequest, errors.New(errMsg))
+	tokens, err := s.CreateSession(user.Id, ip, c.Request.UserAgent())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	token := s.CreateToken(user.Id)
 	// secure 为 true 则仅允许 ssl 和 https 协议传输 Cookie
-	c.SetCookie(app.CookieName, token, 0, "/", "", false, true)
+	c.SetCookie(app.CookieName, tokens.AccessToken, 0, "/", "", false, true)
+	s.setRefreshCookie(c, tokens.RefreshToken, false)
+	c.JSON(http.StatusOK, tokens)
+}
+
+// LoginTotp 两步登录的第二步，使用 challenge 和动态验证码（或恢复码）换取 token。
+// 需要先绑定身份验证器时，同时返回恢复码。
+func (s PassportServer) LoginTotp(c *gin.Context) {
+	var param struct {
+		Challenge string `json:"challenge,omitempty" binding:"required"`
+		Code      string `json:"code,omitempty" binding:"required"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	tokens, codes, err := s.CompleteLoginChallenge(c, param.Challenge, param.Code, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.AbortWithError(totpErrorStatus(err), err)
+		return
+	}
+	c.SetCookie(app.CookieName, tokens.AccessToken, 0, "/", "", false, true)
+	s.setRefreshCookie(c, tokens.RefreshToken, false)
+	c.JSON(http.StatusOK, struct {
+		*app.TokenPair
+		RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	}{tokens, codes})
+}
+
+// LoginTotpSetup 所在组织要求两步验证但尚未绑定时，登录过程中使用 challenge 生成密钥
+func (s PassportServer) LoginTotpSetup(c *gin.Context) {
+	var param struct {
+		Challenge string `json:"challenge,omitempty" binding:"required"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	setup, err := s.ChallengeTotpSetup(c, param.Challenge)
+	if err != nil {
+		c.AbortWithError(totpErrorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, setup)
+}
+
+// oidcCookiePath state cookie 只在单点登录的路由上发送
+const oidcCookiePath = "/admin/passport/oidc"
+
+// OIDCLogin 跳转到身份提供方登录，redirect 为登录完成后返回的前端页面
+func (s PassportServer) OIDCLogin(c *gin.Context) {
+	authURL, binding, err := s.OIDCAuthURL(c, c.Query("redirect"))
+	if err == app.ErrOIDCDisabled {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusBadGateway, err)
+		return
+	}
+	c.SetCookie(app.OIDCStateCookieName, binding, int(app.OIDCStateTTL/time.Second), oidcCookiePath, "", false, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback 身份提供方登录后的回调，校验通过后写入登录 cookie 并返回前端页面。
+// 需要两步验证时不创建会话，在返回的页面地址中附带 challenge，由 LoginTotp 完成登录。
+func (s PassportServer) OIDCCallback(c *gin.Context) {
+	if errCode := c.Query("error"); len(errCode) > 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New(strings.TrimSpace("单点登录失败："+errCode+" "+c.Query("error_description"))))
+		return
+	}
+
+	// state cookie 只使用一次
+	binding, _ := c.Cookie(app.OIDCStateCookieName)
+	c.SetCookie(app.OIDCStateCookieName, "", -1, oidcCookiePath, "", false, true)
+	user, redirect, err := s.App.OIDCCallback(c, c.Query("code"), c.Query("state"), binding)
+	switch err {
+	case nil:
+	case app.ErrOIDCDisabled:
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	case app.ErrOIDCState, app.ErrOIDCBadToken, app.ErrOIDCNoAccount:
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	default:
+		c.AbortWithError(http.StatusBadGateway, err)
+		return
+	}
+	if user.Disabled {
+		c.AbortWithError(http.StatusForbidden, errors.New("账号已被禁用"))
+		return
+	}
+
+	required, err := s.TotpRequired(c, user.Id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if user.TotpEnabled || required {
+		challenge, err := s.CreateLoginChallenge(user.Id, user.Name, !user.TotpEnabled)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		query := url.Values{}
+		query.Set("challenge", challenge.Challenge)
+		query.Set("enroll", strconv.FormatBool(challenge.Enroll))
+		sep := "?"
+		if strings.Contains(redirect, "?") {
+			sep = "&"
+		}
+		c.Redirect(http.StatusFound, redirect+sep+query.Encode())
+		return
+	}
+
+	tokens, err := s.CreateSession(user.Id, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.SetCookie(app.CookieName, tokens.AccessToken, 0, "/", "", false, true)
+	s.setRefreshCookie(c, tokens.RefreshToken, false)
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// Refresh 使用刷新 token 换取新的访问 token，刷新 token 同时轮换
+func (s PassportServer) Refresh(c *gin.Context) {
+	var param struct {
+		RefreshToken string `json:"refreshToken,omitempty"`
+	}
+	// 浏览器通过 cookie 传递，其他客户端通过 JSON 传递
+	if cookie, err := c.Cookie(app.RefreshCookieName); err == nil {
+		param.RefreshToken = cookie
+	} else if c.BindJSON(&param) != nil {
+		return
+	}
+
+	tokens, err := s.RefreshSession(param.RefreshToken)
+	if err != nil {
+		logger.Info("refresh session failed.", zap.String("ip", c.ClientIP()), zap.Error(err))
+		s.setRefreshCookie(c, "", false)
+		c.AbortWithError(http.StatusNonAuthoritativeInfo, err)
+		return
+	}
+	c.SetCookie(app.CookieName, tokens.AccessToken, 0, "/", "", false, true)
+	s.setRefreshCookie(c, tokens.RefreshToken, false)
+	c.JSON(http.StatusOK, tokens)
 }
 
 func (s PassportServer) Logout(c *gin.Context) {
+	var err error
+	if claims, parseErr := s.ParseToken(app.RequestToken(c)); parseErr == nil {
+		err = s.RevokeSession(claims.Sid)
+	} else {
+		// 访问 token 已过期时通过刷新 token 找到会话，浏览器通过 cookie 传递，其他客户端通过 JSON 传递
+		var param struct {
+			RefreshToken string `json:"refreshToken,omitempty"`
+		}
+		if cookie, cookieErr := c.Cookie(app.RefreshCookieName); cookieErr == nil {
+			param.RefreshToken = cookie
+		} else {
+			c.ShouldBindJSON(&param)
+		}
+		if len(param.RefreshToken) > 0 {
+			err = s.RevokeRefreshSession(param.RefreshToken)
+			if err == app.ErrBadToken || err == app.ErrSessionRevoked {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 	c.SetCookie(app.CookieName, "", -1, "/", "", false, true)
+	s.setRefreshCookie(c, "", false)
+}
+
+// setRefreshCookie 刷新 token 只发送给 passport 接口，token 为空时删除 cookie
+func (s PassportServer) setRefreshCookie(c *gin.Context, token string, secure bool) {
+	maxAge := s.Config().Token.RefreshTokenTTL
+	if len(token) == 0 {
+		maxAge = -1
+	}
+	c.SetCookie(app.RefreshCookieName, token, maxAge, "/admin/passport", "", secure, true)
 }
 
 // 获取账户信息
@@ -143,6 +387,16 @@ func (s PassportServer) Modify(c *gin.Context) {
 		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
+	// 修改邮箱或手机号码后需要重新验证
+	emailVerified := user.EmailVerified && param.Email == user.Email
+	phoneVerified := user.PhoneVerified && param.Phone == user.Phone
+
+	tx, err := s.DB().BeginTx(c, nil)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.RollbackUnlessCommitted()
 
 	if param.Password != "" && param.NewPass != "" {
 		// 检验原密码
@@ -152,33 +406,306 @@ func (s PassportServer) Modify(c *gin.Context) {
 			return
 		}
 
-		// 通过，将新密码变为 hash
-		newPassHash, err := util.HashPassword(param.NewPass)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+		// 按密码规则校验后更新
+		if err = s.SetPassword(c, tx, uid, param.NewPass); err != nil {
+			abortPasswordError(c, err)
 			return
 		}
+	}
 
-		// 更新到数据库中
-		_, err = s.DB().Update(app.UserTableName).
-			Set(app.UserPasswordCol, newPassHash).
-			Set(app.UserDisNameCol, param.DisplayName).
-			Set(app.UserCompanyCol, param.Company).
-			Set(app.UserPhoneCol, param.Phone).
-			Set(app.UserEmailCol, param.Email).
-			Where(app.WhereCommonId, uid).
-			ExecContext(c)
-	} else {
-		_, err = s.DB().Update(app.UserTableName).
-			Set(app.UserDisNameCol, param.DisplayName).
-			Set(app.UserCompanyCol, param.Company).
-			Set(app.UserPhoneCol, param.Phone).
-			Set(app.UserEmailCol, param.Email).
-			Where(app.WhereCommonId, uid).
-			ExecContext(c)
+	_, err = tx.Update(app.UserTableName).
+		Set(app.UserDisNameCol, param.DisplayName).
+		Set(app.UserCompanyCol, param.Company).
+		Set(app.UserPhoneCol, param.Phone).
+		Set(app.UserEmailCol, param.Email).
+		Set(app.UserPhoneVerifiedCol, phoneVerified).
+		Set(app.UserEmailVerifiedCol, emailVerified).
+		Where(app.WhereCommonId, uid).
+		ExecContext(c)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// ResetRequest 忘记密码时发送验证码到账号的邮箱或手机号，account 可以是登录名、邮箱或手机号
+func (s PassportServer) ResetRequest(c *gin.Context) {
+	var param struct {
+		Account string `json:"account,omitempty" binding:"required"`
+		Channel string `json:"channel,omitempty"` // email 或 sms，默认 email
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if len(param.Channel) == 0 {
+		param.Channel = app.ChannelEmail
+	}
+
+	err := s.RequestPasswordReset(c, param.Account, param.Channel, c.ClientIP())
+	if err != nil {
+		c.AbortWithError(codeErrorStatus(err), err)
+		return
+	}
+}
+
+// ResetConfirm 使用验证码设置新密码，成功后所有已登录的会话失效
+func (s PassportServer) ResetConfirm(c *gin.Context) {
+	var param struct {
+		Account  string `json:"account,omitempty" binding:"required"`
+		Code     string `json:"code,omitempty" binding:"required"`
+		Password string `json:"password,omitempty" binding:"required"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
 	}
 
+	err := s.ConfirmPasswordReset(c, param.Account, param.Code, param.Password)
 	if err != nil {
+		logger.Warn("password reset failed.", zap.String("account", param.Account), zap.String("ip", c.ClientIP()),
+			zap.Error(err))
+		if _, ok := err.(*app.PasswordError); ok {
+			abortPasswordError(c, err)
+			return
+		}
+		c.AbortWithError(codeErrorStatus(err), err)
+		return
+	}
+}
+
+// VerifySend 发送邮箱或手机号码验证码
+func (s PassportServer) VerifySend(c *gin.Context) {
+	var param struct {
+		Channel string `json:"channel,omitempty" binding:"required"` // email 或 sms
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	err := s.SendVerifyCode(c, c.GetInt64(app.UserID), param.Channel)
+	if err != nil {
+		c.AbortWithError(codeErrorStatus(err), err)
+		return
+	}
+}
+
+// VerifyConfirm 校验验证码，通过后邮箱或手机号码标记为已验证
+func (s PassportServer) VerifyConfirm(c *gin.Context) {
+	var param struct {
+		Channel string `json:"channel,omitempty" binding:"required"`
+		Code    string `json:"code,omitempty" binding:"required"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	err := s.ConfirmVerifyCode(c, c.GetInt64(app.UserID), param.Channel, param.Code)
+	if err != nil {
+		c.AbortWithError(codeErrorStatus(err), err)
+		return
+	}
+}
+
+// TotpStatus 两步验证状态
+func (s PassportServer) TotpStatus(c *gin.Context) {
+	uid := c.GetInt64(app.UserID)
+	user := app.User{}
+	err := s.DB().Select(app.SqlStar).From(app.UserTableName).
+		Where(app.WhereCommonId, uid).LoadOneContext(c, &user)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	required, err := s.TotpRequired(c, uid)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	left, err := s.RecoveryCodesLeft(c, uid)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":           user.TotpEnabled,
+		"required":          required,
+		"recoveryCodesLeft": left,
+	})
+}
+
+// TotpSetup 生成两步验证密钥，uri 用于生成二维码供身份验证器扫描
+func (s PassportServer) TotpSetup(c *gin.Context) {
+	setup, err := s.SetupTotp(c, c.GetInt64(app.UserID))
+	if err != nil {
+		c.AbortWithError(totpErrorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, setup)
+}
+
+// TotpEnable 校验动态验证码后启用两步验证，返回的恢复码只显示这一次
+func (s PassportServer) TotpEnable(c *gin.Context) {
+	var param struct {
+		Code string `json:"code,omitempty" binding:"required"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	codes, err := s.EnableTotp(c, c.GetInt64(app.UserID), param.Code)
+	if err != nil {
+		c.AbortWithError(totpErrorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"recoveryCodes": codes,
+	})
+}
+
+// TotpDisable 关闭两步验证，需要动态验证码或恢复码
+func (s PassportServer) TotpDisable(c *gin.Context) {
+	var param struct {
+		Code string `json:"code,omitempty" binding:"required"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	err := s.DisableTotp(c, c.GetInt64(app.UserID), param.Code)
+	if err != nil {
+		c.AbortWithError(totpErrorStatus(err), err)
+		return
+	}
+}
+
+// TotpRecovery 重新生成恢复码，旧的恢复码全部失效
+func (s PassportServer) TotpRecovery(c *gin.Context) {
+	var param struct {
+		Code string `json:"code,omitempty" binding:"required"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	codes, err := s.RegenerateRecoveryCodes(c, c.GetInt64(app.UserID), param.Code)
+	if err != nil {
+		c.AbortWithError(totpErrorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"recoveryCodes": codes,
+	})
+}
+
+// lockoutErrorStatus 登录限制相关错误对应的 HTTP 状态码
+func lockoutErrorStatus(err error) int {
+	switch err {
+	case app.ErrAccountLocked, app.ErrTooManyAttempts:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// totpErrorStatus 两步验证相关错误对应的 HTTP 状态码
+func totpErrorStatus(err error) int {
+	switch err {
+	case app.ErrBadChallenge:
+		return http.StatusUnauthorized
+	case app.ErrTotpRequired:
+		return http.StatusForbidden
+	case app.ErrTotpLocked, app.ErrAccountLocked, app.ErrTooManyAttempts:
+		return http.StatusTooManyRequests
+	case app.ErrInvalidTotp, app.ErrTotpEnabled, app.ErrTotpNotEnabled, app.ErrTotpNotPrepared:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// abortPasswordError 密码不符合规则时返回 400 和未满足的规则，便于前端提示，其他错误返回 500
+func abortPasswordError(c *gin.Context, err error) {
+	if err, ok := err.(*app.PasswordError); ok {
+		meta := gin.H{"rule": err.Rule}
+		if err.Param != 0 {
+			meta["param"] = err.Param
+		}
+		c.AbortWithError(http.StatusBadRequest, err).SetMeta(meta)
+		return
+	}
+	c.AbortWithError(http.StatusInternalServerError, err)
+}
+
+// codeErrorStatus 验证码相关错误对应的 HTTP 状态码
+func codeErrorStatus(err error) int {
+	switch err {
+	case app.ErrRateLimited:
+		return http.StatusTooManyRequests
+	case app.ErrInvalidCode, app.ErrNoCodeChannel, app.ErrNoContact, app.ErrAlreadyVerified:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// JWKS 访问 token 的公钥，其他服务可以据此验证 token，不需要共享密钥
+func (s PassportServer) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{
+		"keys": s.Keyring().JWKS(),
+	})
+}
+
+// SessionList 当前用户已登录的会话列表
+func (s PassportServer) SessionList(c *gin.Context) {
+	sessions, err := s.ListSessions(c.GetInt64(app.UserID))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if claims, ok := c.Get(app.TokenClaimsKey); ok {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].Sid == claims.(*app.TokenClaims).Sid
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"items": sessions,
+		"count": len(sessions),
+	})
+}
+
+// SessionRevoke 退出指定的会话
+func (s PassportServer) SessionRevoke(c *gin.Context) {
+	var param struct {
+		Sid string `json:"sid,omitempty" binding:"required"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	count, err := s.DB().Select("count(*)").From(app.SessionTableName).
+		Where(app.WhereSessionSidAndUid, param.Sid, c.GetInt64(app.UserID)).ReturnInt64()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if count == 0 {
+		c.AbortWithError(http.StatusNotFound, errors.New("会话不存在"))
+		return
+	}
+
+	if err = s.RevokeSession(param.Sid); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// SessionRevokeOthers 退出除当前会话外的所有会话
+func (s PassportServer) SessionRevokeOthers(c *gin.Context) {
+	currentSid := ""
+	if claims, ok := c.Get(app.TokenClaimsKey); ok {
+		currentSid = claims.(*app.TokenClaims).Sid
+	}
+	if err := s.RevokeUserSessions(c.GetInt64(app.UserID), currentSid); err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
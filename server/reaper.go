@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"go.uber.org/zap"
+	"jhmeeting.com/adminserver/app"
+)
+
+const (
+	reaperLockKey = "rtcadmin:reaper"
+	// 会议创建后媒体服务器可能还未建好房间，期间不按媒体服务器的房间列表结束会议
+	reaperGracePeriod = 2 * time.Minute
+)
+
+// LiveRoom 媒体服务器上正在进行的会议，见 liveRooms
+type LiveRoom struct {
+	Room         string `json:"room"`
+	Participants int    `json:"participants"`
+	Recording    bool   `json:"recording"`
+}
+
+// Reaper 定时与媒体服务器核对进行中的会议，结束已不存在的会议和录制
+type Reaper struct {
+	conference *ConferenceServer
+}
+
+// NewReaper 结束会议时通过 conference 分发事件，需与处理媒体服务器回调的是同一个实例
+func NewReaper(conference *ConferenceServer) *Reaper {
+	return &Reaper{
+		conference: conference,
+	}
+}
+
+// Run 按配置的间隔核对会议，直到 stop 关闭
+func (r *Reaper) Run(stop <-chan struct{}) {
+	interval := time.Duration(r.conference.Config().Reaper.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// 多个实例时只由一个实例核对
+			ok, err := r.conference.Store().SetNX(reaperLockKey, "1", interval/2)
+			if err != nil || !ok {
+				continue
+			}
+			if err = r.Reconcile(context.Background()); err != nil {
+				logger.Error("reconcile conferences failed.", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Reconcile 核对一次进行中的会议
+func (r *Reaper) Reconcile(ctx context.Context) error {
+	s := r.conference
+	conferences := []app.ConferenceInfo{}
+	_, err := s.DB().Select(app.SqlStar).From(app.ConferenceTableName).
+		Where(dbr.Eq(app.ConferenceEtimeCol, nil)).LoadContext(ctx, &conferences)
+	if err != nil || len(conferences) == 0 {
+		return err
+	}
+
+	rooms, err := r.liveRooms()
+	if err != nil {
+		logger.Warn("list live rooms failed, check heartbeat.", zap.Error(err))
+		return r.reapByHeartbeat(ctx, conferences)
+	}
+
+	now := time.Now()
+	for _, conference := range conferences {
+		room, live := rooms[conference.RoomName]
+		if !live {
+			if now.Sub(conference.Ctime) > reaperGracePeriod {
+				r.close(ctx, conference, app.CloseReasonOrphaned)
+			}
+			continue
+		}
+
+		_, err = s.DB().Update(app.ConferenceTableName).Set(app.ConferenceHtimeCol, now).
+			Where(app.WhereCommonId, conference.Id).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+		if conference.IsRecording && !room.Recording {
+			logger.Warn("stop dangling recording.", zap.Int64("conferenceId", conference.Id),
+				zap.String("roomName", conference.RoomName))
+			r.dispatch(ctx, ActionRequest{
+				Action:       MUC_ROOM_RECORDING_STOP,
+				ConferenceId: conference.Id,
+				Room:         conference.RoomName,
+			})
+		}
+	}
+	return nil
+}
+
+// reapByHeartbeat 无法连接媒体服务器时，结束长时间没有会议事件的会议
+func (r *Reaper) reapByHeartbeat(ctx context.Context, conferences []app.ConferenceInfo) error {
+	timeout := time.Duration(r.conference.Config().Reaper.HeartbeatTimeout) * time.Second
+	if timeout <= 0 {
+		return nil
+	}
+	for _, conference := range conferences {
+		htime := conference.Ctime
+		if conference.Htime.Valid {
+			htime = conference.Htime.Time
+		}
+		if time.Since(htime) > timeout {
+			r.close(ctx, conference, app.CloseReasonHeartbeat)
+		}
+	}
+	return nil
+}
+
+// close 以会议结束事件结束会议，参会者、Webhook 和实时推送与正常结束相同
+func (r *Reaper) close(ctx context.Context, conference app.ConferenceInfo, reason string) {
+	logger.Warn("close stale conference.", zap.Int64("conferenceId", conference.Id),
+		zap.String("roomName", conference.RoomName), zap.String("reason", reason))
+	r.dispatch(ctx, ActionRequest{
+		Action:       MUC_ROOM_DESTROYED,
+		ConferenceId: conference.Id,
+		Room:         conference.RoomName,
+		Reason:       reason,
+	})
+}
+
+func (r *Reaper) dispatch(ctx context.Context, req ActionRequest) {
+	if _, err := r.conference.applyEvent(ctx, req); err != nil {
+		logger.Error("apply reaper event failed.", zap.String("action", req.Action),
+			zap.Int64("conferenceId", req.ConferenceId), zap.Error(err))
+	}
+}
+
+// liveRooms 媒体服务器上正在进行的会议，以房间名为键。
+// 调用 API 服务的 POST /api/conference/rooms，请求体为 {}，使用 api.token 授权，返回：
+//
+//	{"rooms": [{"room": "房间名", "participants": 2, "recording": false}]}
+//
+// 没有会议时 rooms 为空数组。缺少 rooms 字段视为接口不兼容而返回错误，
+// 避免把所有会议当作已不存在而结束，调用方改为按心跳核对。
+func (r *Reaper) liveRooms() (map[string]LiveRoom, error) {
+	data, err := r.conference.SendAPIRequest("/api/conference/rooms", nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Rooms *[]LiveRoom `json:"rooms"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	if result.Rooms == nil {
+		return nil, errors.New("live rooms response has no rooms")
+	}
+
+	rooms := make(map[string]LiveRoom, len(*result.Rooms))
+	for _, room := range *result.Rooms {
+		rooms[room.Room] = room
+	}
+	return rooms, nil
+}
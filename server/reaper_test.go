@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/db"
+)
+
+func TestReaperReconcile(t *testing.T) {
+	response := ""
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/conference/rooms", r.URL.Path)
+		require.Equal(t, "Bearer apitoken", r.Header.Get("Authorization"))
+		if len(response) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	defer api.Close()
+
+	testApp := newTestApp(t, app.AppConfig{
+		API:    app.APIConfig{URL: api.URL, Token: "apitoken"},
+		Reaper: app.ReaperConfig{HeartbeatTimeout: 3600},
+	})
+	reaper := NewReaper(NewConferenceServer(testApp))
+	ctx := context.Background()
+
+	now := time.Now()
+	insert := func(roomName string, ctime, htime time.Time, recording bool) int64 {
+		conference := app.ConferenceInfo{Uid: 1, RoomName: roomName, Ctime: ctime, Htime: db.NewNullTime(htime),
+			IsRecording: recording}
+		_, err := testApp.DB().InsertInto(app.ConferenceTableName).
+			Columns(app.CommonUidCol, app.ConferenceRoomNameCol, app.CommonCtimeCol, app.ConferenceHtimeCol,
+				app.ConferenceIsRecordCol).
+			Record(&conference).Exec()
+		require.NoError(t, err)
+		return conference.Id
+	}
+	load := func(id int64) app.ConferenceInfo {
+		conference := app.ConferenceInfo{}
+		require.NoError(t, testApp.DB().Select(app.SqlStar).From(app.ConferenceTableName).
+			Where(app.WhereCommonId, id).LoadOne(&conference))
+		return conference
+	}
+
+	// 无法获取会议列表或返回中没有 rooms 时按心跳核对，只结束长时间没有事件的会议
+	live := insert("live", now.Add(-time.Hour), now, true)
+	silent := insert("silent", now.Add(-3*time.Hour), now.Add(-2*time.Hour), false)
+	for _, body := range []string{"", `{}`, `{"rooms":null}`} {
+		response = body
+		require.NoError(t, reaper.Reconcile(ctx))
+		require.False(t, load(live).Etime.Valid, body)
+	}
+	require.Equal(t, app.CloseReasonHeartbeat, load(silent).CloseReason)
+
+	// 媒体服务器上已不存在的会议被结束，刚创建的会议保留，已停止的录制被结束
+	gone := insert("gone", now.Add(-time.Hour), now, false)
+	fresh := insert("fresh", now, now, false)
+	response = `{"rooms":[{"room":"live","participants":2,"recording":false}]}`
+	require.NoError(t, reaper.Reconcile(ctx))
+	require.Equal(t, app.CloseReasonOrphaned, load(gone).CloseReason)
+	require.False(t, load(fresh).Etime.Valid)
+	require.False(t, load(live).Etime.Valid)
+	require.False(t, load(live).IsRecording)
+
+	// 没有会议时 rooms 为空数组
+	response = `{"rooms":[]}`
+	require.NoError(t, reaper.Reconcile(ctx))
+	require.Equal(t, app.CloseReasonOrphaned, load(live).CloseReason)
+	require.False(t, load(fresh).Etime.Valid)
+}
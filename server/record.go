@@ -26,11 +26,14 @@ func (s RecordServer) Info(c *gin.Context) {
 		return
 	}
 
-	uid := c.GetInt64(app.UserID)
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
 
 	record := app.RecordInfo{}
 	err := s.DB().Select(app.SqlStar).From(app.RecordTableName).
-		Where(app.WhereCommonIdAndUid, param.ID, uid).LoadOneContext(c, &record)
+		Where(app.WhereCommonId, param.ID).Where(scope).LoadOneContext(c, &record)
 	if err != nil {
 		c.AbortWithError(http.StatusNotFound, err)
 		return
@@ -46,10 +49,13 @@ func (s RecordServer) Delete(c *gin.Context) {
 	if c.BindJSON(&param) != nil {
 		return
 	}
-	uid := c.GetInt64(app.UserID)
+	scope, ok := ownerScope(c, s.App, true)
+	if !ok {
+		return
+	}
 
 	_, err := s.DB().
-		DeleteFrom(app.RecordTableName).Where(app.WhereCommonIdAndUid, param.ID, uid).ExecContext(c)
+		DeleteFrom(app.RecordTableName).Where(app.WhereCommonId, param.ID).Where(scope).ExecContext(c)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -68,13 +74,12 @@ func (s RecordServer) List(c *gin.Context) {
 		return
 	}
 
-	selector := db.NewSelector(s.DB())
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
 
-	selector.Conditions = append(selector.Conditions, db.Condition{
-		Col: app.CommonUidCol,
-		Cmp: db.CmpEq,
-		Val: c.GetInt64(app.UserID),
-	})
+	selector := db.NewSelector(s.DB()).Where(scope)
 
 	if len(param.RoomName) > 0 {
 		selector.Conditions = append(selector.Conditions, db.Condition{
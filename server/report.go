@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/util"
+)
+
+const (
+	reportFormatCSV  = "csv"
+	reportFormatXLSX = "xlsx"
+
+	reportBatchSize  = 100
+	reportTimeFormat = "2006-01-02 15:04:05"
+)
+
+var reportContentTypes = map[string]string{
+	reportFormatCSV:  "text/csv; charset=utf-8",
+	reportFormatXLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// 参会报表表头
+var attendanceReportHeader = []string{
+	"会议ID", "房间名称", "开始时间", "结束时间", "最高人数",
+	"参会者", "参会者ID", "加入时间", "离开时间", "参会时长（秒）",
+}
+
+// reportWriter 报表逐行写入
+type reportWriter interface {
+	Write(record []string) error
+	Close() error
+}
+
+func newReportWriter(w io.Writer, format string) (reportWriter, error) {
+	if format == reportFormatXLSX {
+		return util.NewXlsxWriter(w, "参会报表")
+	}
+	return newCSVReportWriter(w)
+}
+
+type csvReportWriter struct {
+	*csv.Writer
+}
+
+func newCSVReportWriter(w io.Writer) (*csvReportWriter, error) {
+	// 写入 BOM，避免 Excel 打开中文乱码
+	if _, err := w.Write([]byte("\xEF\xBB\xBF")); err != nil {
+		return nil, err
+	}
+	return &csvReportWriter{Writer: csv.NewWriter(w)}, nil
+}
+
+func (w *csvReportWriter) Write(record []string) error {
+	cells := make([]string, len(record))
+	for i, value := range record {
+		cells[i] = reportCell(value)
+	}
+	if err := w.Writer.Write(cells); err != nil {
+		return err
+	}
+	// 逐行刷新，边查询边输出
+	w.Writer.Flush()
+	return w.Writer.Error()
+}
+
+func (w *csvReportWriter) Close() error {
+	w.Writer.Flush()
+	return w.Writer.Error()
+}
+
+// reportCell CSV 单元格以 = + - @ 等开头时加上 '，避免 Excel 当作公式执行。
+// XLSX 使用内联字符串，不会被当作公式，不需要处理。
+func reportCell(value string) string {
+	if len(value) > 0 && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// attendanceRecords 一个会议的报表行，每位参会者一行，没有参会者时输出一行会议信息
+func attendanceRecords(conference app.ConferenceInfo, participants []app.ParticipantInfo) (records [][]string) {
+	etime := ""
+	if conference.Etime.Valid {
+		etime = conference.Etime.Time.Format(reportTimeFormat)
+	}
+	conferenceCols := []string{
+		strconv.FormatInt(conference.Id, 10),
+		conference.RoomName,
+		conference.Ctime.Format(reportTimeFormat),
+		etime,
+		strconv.Itoa(conference.MaxParticipants),
+	}
+
+	if len(participants) == 0 {
+		return [][]string{append(conferenceCols, "", "", "", "", "")}
+	}
+
+	for _, participant := range participants {
+		leaveTime, duration := "", participant.Duration
+		if participant.Etime.Valid {
+			leaveTime = participant.Etime.Time.Format(reportTimeFormat)
+		} else {
+			// 仍在会议中，按当前时间计算时长
+			duration = int64(time.Since(participant.Ctime) / time.Second)
+		}
+
+		record := append([]string{}, conferenceCols...)
+		record = append(record,
+			participant.Nick,
+			participant.Jid,
+			participant.Ctime.Format(reportTimeFormat),
+			leaveTime,
+			strconv.FormatInt(duration, 10),
+		)
+		records = append(records, record)
+	}
+
+	return
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/db"
+)
+
+func TestAttendanceRecords(t *testing.T) {
+	start := time.Date(2020, 6, 1, 10, 0, 0, 0, time.Local)
+	conference := app.ConferenceInfo{Id: 7, RoomName: "=room", MaxParticipants: 2, Ctime: start,
+		Etime: db.NewNullTime(start.Add(time.Hour))}
+
+	records := attendanceRecords(conference, nil)
+	require.Equal(t, [][]string{{"7", "=room", "2020-06-01 10:00:00", "2020-06-01 11:00:00", "2", "", "", "", "", ""}}, records)
+
+	participants := []app.ParticipantInfo{
+		{Nick: "=HYPERLINK(\"http://evil\")", Jid: "@jid", Duration: 60, Ctime: start,
+			Etime: db.NewNullTime(start.Add(time.Minute))},
+		{Nick: "张三", Jid: "+1", Duration: 0, Ctime: time.Now().Add(-time.Minute)},
+	}
+	records = attendanceRecords(conference, participants)
+	require.Len(t, records, 2)
+	require.Equal(t, []string{"=HYPERLINK(\"http://evil\")", "@jid", "2020-06-01 10:00:00", "2020-06-01 10:01:00", "60"},
+		records[0][5:])
+	require.Equal(t, "张三", records[1][5])
+	require.Equal(t, "+1", records[1][6])
+	require.Empty(t, records[1][8])
+	require.NotEqual(t, "0", records[1][9])
+
+	for _, value := range []string{"-1", "\tcmd", "\rcmd"} {
+		require.Equal(t, "'"+value, reportCell(value))
+	}
+	require.Equal(t, "a=b", reportCell("a=b"))
+}
+
+func TestCSVReportWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	writer, err := newReportWriter(&buf, reportFormatCSV)
+	require.NoError(t, err)
+	require.NoError(t, writer.Write(attendanceReportHeader))
+	// 参会者提交的昵称和 ID 不能被当作公式
+	require.NoError(t, writer.Write([]string{"1", "a,b", "=1", "+1", "a=b"}))
+	require.NoError(t, writer.Close())
+
+	data := buf.Bytes()
+	require.Equal(t, []byte("\xEF\xBB\xBF"), data[:3])
+	reader := csv.NewReader(bytes.NewReader(data[3:]))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, attendanceReportHeader, records[0])
+	require.Equal(t, []string{"1", "a,b", "'=1", "'+1", "a=b"}, records[1])
+}
@@ -28,10 +28,13 @@ func (s RoomServer) Info(c *gin.Context) {
 	if c.BindJSON(&param) != nil {
 		return
 	}
-	uid := c.GetInt64(app.UserID)
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
 	room := app.RoomInfo{}
 	err := s.DB().Select(app.SqlStar).From(app.RoomTableName).
-		Where(app.WhereCommonIdAndUid, param.ID, uid).LoadOneContext(c, &room)
+		Where(app.WhereCommonId, param.ID).Where(scope).LoadOneContext(c, &room)
 	if err != nil {
 		c.AbortWithError(http.StatusNotFound, err)
 		return
@@ -48,6 +51,20 @@ func (s RoomServer) Create(c *gin.Context) {
 	roomInfo.Uid = c.GetInt64(app.UserID)
 	roomInfo.Ctime = time.Now()
 
+	if err := s.CheckRoomCreator(c, roomInfo.Uid); err != nil {
+		status := http.StatusInternalServerError
+		if err == app.ErrNotVerified {
+			status = http.StatusForbidden
+		}
+		c.AbortWithError(status, err)
+		return
+	}
+
+	if roomInfo.OrgId > 0 && s.OrgRole(c, roomInfo.OrgId, roomInfo.Uid) != app.OrgRoleAdmin {
+		c.AbortWithError(http.StatusForbidden, errors.New("没有组织的管理权限"))
+		return
+	}
+
 	room := app.RoomInfo{}
 	err := s.DB().Select(app.SqlStar).From(app.RoomTableName).
 		Where(app.WhereRoomName, roomInfo.RoomName).LoadOneContext(c, &room)
@@ -56,13 +73,28 @@ func (s RoomServer) Create(c *gin.Context) {
 		return
 	}
 
-	_, err = s.DB().InsertInto(app.RoomTableName).
-		Columns(app.CommonUidCol, app.RoomPartLimitsCol, app.RoomNameCol, app.RoomAllowAnonymousCol, app.RoomConfigCol, app.CommonCtimeCol).
+	// 组织房间数量的检查和插入在同一事务中，避免并发创建超出上限
+	tx, err := s.DB().BeginTx(c, nil)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	if roomInfo.OrgId > 0 && !s.checkOrgRoomLimits(c, tx, roomInfo.OrgId) {
+		return
+	}
+	_, err = tx.InsertInto(app.RoomTableName).
+		Columns(app.CommonUidCol, app.CommonOrgIdCol, app.RoomPartLimitsCol, app.RoomNameCol, app.RoomAllowAnonymousCol, app.RoomConfigCol, app.CommonCtimeCol).
 		Record(&roomInfo).ExecContext(c)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	if err = tx.Commit(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"id": roomInfo.Id,
 	})
@@ -75,8 +107,11 @@ func (s RoomServer) Delete(c *gin.Context) {
 	if c.BindJSON(&param) != nil {
 		return
 	}
-	uid := c.GetInt64(app.UserID)
-	_, err := s.DB().DeleteFrom(app.RoomTableName).Where(app.WhereCommonIdAndUid, param.ID, uid).ExecContext(c)
+	scope, ok := ownerScope(c, s.App, true)
+	if !ok {
+		return
+	}
+	_, err := s.DB().DeleteFrom(app.RoomTableName).Where(app.WhereCommonId, param.ID).Where(scope).ExecContext(c)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -88,12 +123,15 @@ func (s RoomServer) Modify(c *gin.Context) {
 	if c.BindJSON(&roomInfo) != nil {
 		return
 	}
-	uid := c.GetInt64(app.UserID)
+	scope, ok := ownerScope(c, s.App, true)
+	if !ok {
+		return
+	}
 	_, err := s.DB().Update(app.RoomTableName).
 		Set(app.RoomPartLimitsCol, roomInfo.ParticipantLimits).
 		Set(app.RoomAllowAnonymousCol, roomInfo.AllowAnonymous).
 		Set(app.RoomConfigCol, roomInfo.Config).
-		Where(app.WhereCommonIdAndUid, roomInfo.Id, uid).
+		Where(app.WhereCommonId, roomInfo.Id).Where(scope).
 		ExecContext(c)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
@@ -107,18 +145,109 @@ func (s RoomServer) List(c *gin.Context) {
 		return
 	}
 
-	uid := c.GetInt64(app.UserID)
+	scope, ok := ownerScope(c, s.App, false)
+	if !ok {
+		return
+	}
 	rooms := []app.RoomInfo{}
 
 	result, _ := db.NewSelector(s.DB()).From(app.RoomTableName).
-		Where(dbr.Eq(app.CommonUidCol, uid)).
+		Where(scope).
 		Paginate(param.Page, param.PerPage).
 		OrderDesc(app.CommonIdCol).
 		LoadPage(&rooms)
 	c.JSON(http.StatusOK, result)
 }
 
+// Token 申请房间的入会 token，只能申请本人或所在组织的房间。
+// 配置了 roomToken.appId 和 appSecret 时在本地签发，否则转发到 API 服务签发，两种方式都会记录。
 func (s RoomServer) Token(c *gin.Context) {
-	// JSON Body: see RoomTokenRequest
-	s.APIRoute(c, "/api/conference/token")
+	var param RoomTokenRequest
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	uid := c.GetInt64(app.UserID)
+	room, err := s.RoomForToken(c, uid, param.RoomName, param.Moderator)
+	if err != nil {
+		c.AbortWithError(roomTokenErrorStatus(err), err)
+		return
+	}
+	params := app.RoomTokenParams{
+		Room:      *room,
+		Uid:       uid,
+		ExpiresAt: param.ExpiresAt,
+		Moderator: param.Moderator,
+		Anonymous: param.Anonymous,
+		IP:        c.ClientIP(),
+	}
+	if param.Context != nil {
+		params.User, params.Callee = param.Context.User, param.Context.Callee
+	}
+
+	if s.RoomTokenProxy() {
+		if err = s.ProxyRoomToken(c, params); err != nil {
+			c.AbortWithError(roomTokenErrorStatus(err), err)
+		}
+		return
+	}
+	token, expiresAt, err := s.IssueRoomToken(c, params)
+	if err != nil {
+		c.AbortWithError(roomTokenErrorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":     token,
+		"expiresAt": expiresAt.Unix(),
+	})
+}
+
+// roomTokenErrorStatus 入会 token 相关错误对应的 HTTP 状态码
+func roomTokenErrorStatus(err error) int {
+	switch err {
+	case app.ErrRoomNotFound:
+		return http.StatusNotFound
+	case app.ErrNotRoomModerator, app.ErrAnonymousNotAllowed:
+		return http.StatusForbidden
+	case app.ErrInvalidRoomExpiresAt:
+		return http.StatusBadRequest
+	case app.ErrRoomTokenUpstream:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// checkOrgRoomLimits 组织的房间数量不能超过上限。
+// 先更新组织行加锁，同一组织并发创建房间时依次检查。
+func (s RoomServer) checkOrgRoomLimits(c *gin.Context, tx *dbr.Tx, orgID int64) bool {
+	_, err := tx.Update(app.OrgTableName).
+		Set(app.OrgRoomLimitsCol, dbr.Expr(app.OrgRoomLimitsCol)).
+		Where(app.WhereCommonId, orgID).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+
+	org := app.Organization{}
+	err = tx.Select(app.SqlStar).From(app.OrgTableName).
+		Where(app.WhereCommonId, orgID).LoadOneContext(c, &org)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errors.New("组织不存在"))
+		return false
+	}
+	if org.RoomLimits <= 0 {
+		return true
+	}
+
+	count, err := tx.Select("count(*)").From(app.RoomTableName).
+		Where(dbr.Eq(app.CommonOrgIdCol, orgID)).ReturnInt64()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+	if count >= int64(org.RoomLimits) {
+		c.AbortWithError(http.StatusForbidden, errors.New("组织房间数量已达上限"))
+		return false
+	}
+	return true
 }
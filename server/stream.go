@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"jhmeeting.com/adminserver/app"
+)
+
+// 实时推送的会议状态事件
+const (
+	StreamConferenceCreated   = "conference.created"
+	StreamConferenceLocked    = "conference.locked"
+	StreamConferenceDestroyed = "conference.destroyed"
+	StreamParticipantJoined   = "participant.joined"
+	StreamParticipantLeft     = "participant.left"
+	StreamRecordingStarted    = "recording.started"
+	StreamRecordingStopped    = "recording.stopped"
+)
+
+// 会议室事件对应的实时推送事件
+var streamActions = map[string]string{
+	MUC_ROOM_PRE_CREATE:      StreamConferenceCreated,
+	MUC_ROOM_SECRET:          StreamConferenceLocked,
+	MUC_ROOM_DESTROYED:       StreamConferenceDestroyed,
+	MUC_OCCUPANT_JOINED:      StreamParticipantJoined,
+	MUC_OCCUPANT_LEFT:        StreamParticipantLeft,
+	MUC_ROOM_RECORDING_START: StreamRecordingStarted,
+	MUC_ROOM_RECORDING_STOP:  StreamRecordingStopped,
+}
+
+// 心跳间隔，避免代理关闭空闲连接
+const streamHeartbeat = 25 * time.Second
+
+// streamMessage 实时推送的内容，conference 为事件处理后的会议状态
+type streamMessage struct {
+	Event string `json:"event"`
+	webhookData
+}
+
+func (s ConferenceServer) registerStream() {
+	for action, event := range streamActions {
+		s.Subscribe(action, ActionHandlerFunc(s.streamHandler(event)))
+	}
+}
+
+// streamHandler 事务提交后，推送到会议所属组织或用户的频道
+func (s ConferenceServer) streamHandler(event string) func(ctx context.Context, req ActionRequest) (interface{}, error) {
+	return func(ctx context.Context, req ActionRequest) (interface{}, error) {
+		conference, err := actionConference(ctx, ActionRunner(ctx, s.DB()), req)
+		if conference == nil {
+			return nil, err
+		}
+
+		message, err := json.Marshal(streamMessage{
+			Event: event,
+			webhookData: webhookData{
+				Conference:   *conference,
+				Jid:          req.Jid,
+				Nick:         req.Nick,
+				Participants: req.Participants,
+				Recording:    req.Recording,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// 每个事件只推送到一个频道：组织的会议推送到组织频道，与 OwnerScope 一样按当前成员判断，
+		// 个人会议推送到用户频道。同时推送会使同时订阅两者的创建者收到重复的事件。
+		channel := app.StreamUserChannel(conference.Uid)
+		if conference.OrgId > 0 {
+			channel = app.StreamOrgChannel(conference.OrgId)
+		}
+		AfterCommit(ctx, func() {
+			if err := s.Broker().Publish(channel, message); err != nil {
+				logger.Error("publish stream message failed.", zap.String("channel", channel), zap.Error(err))
+			}
+		})
+		return nil, nil
+	}
+}
+
+// Stream 通过 Server-Sent Events 实时推送当前用户及其所在组织的会议状态变化
+func (s ConferenceServer) Stream(c *gin.Context) {
+	uid := c.GetInt64(app.UserID)
+	orgIds, err := s.UserOrgIds(c, uid, false)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	channels := []string{app.StreamUserChannel(uid)}
+	for _, orgID := range orgIds {
+		channels = append(channels, app.StreamOrgChannel(orgID))
+	}
+
+	messages, cancel := s.Broker().Subscribe(channels...)
+	defer cancel()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case message, ok := <-messages:
+			if !ok {
+				return false
+			}
+			var header struct {
+				Event string `json:"event"`
+			}
+			json.Unmarshal(message, &header)
+			c.SSEvent(header.Event, string(message))
+			return true
+		}
+	})
+}
@@ -1,8 +1,11 @@
 package server
 
 import (
-	"jhmeeting.com/adminserver/util"
+	"net/http"
 	"time"
+
+	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/util"
 )
 
 var logger = util.GetLogger()
@@ -30,6 +33,9 @@ type ActionRequest struct {
 	Participants int            `json:"participants,omitempty"` // 参会人数
 	ApiEnabled   bool           `json:"apiEnabled,omitempty"`   // 是否使用SDK接入
 	Recording    *RecordingFile `json:"recording,omitempty"`    // 录制文件
+	EventId      string         `json:"eventId,omitempty"`      // 事件ID，重试投递时不变，用于去重
+	Seq          int64          `json:"seq,omitempty"`          // 会议内递增的事件序号，用于丢弃乱序事件
+	Reason       string         `json:"reason,omitempty"`       // 会议结束原因，见 app.CloseReasonDestroyed 等
 }
 
 type RecordingFile struct {
@@ -43,9 +49,10 @@ type RecordingFile struct {
 
 type RoomTokenRequest struct {
 	RoomName  string   `json:"roomName,omitempty" binding:"required"`
-	ExpiresAt int64    `json:"expiresAt,omitempty"`
-	Context   *Context `json:"context,omitempty"`
-	Anonymous bool     `json:"anonymous,omitempty"`
+	ExpiresAt int64    `json:"expiresAt,omitempty"` // 过期时间（Unix 秒），为空时使用默认有效期
+	Context   *Context `json:"context,omitempty"`   // 参会者的名称和头像，为空时使用当前用户的信息
+	Anonymous bool     `json:"anonymous,omitempty"` // 匿名参会，房间需要允许匿名
+	Moderator bool     `json:"moderator,omitempty"` // 主持人，需要房间的管理权限
 }
 
 type Context struct {
@@ -53,8 +60,26 @@ type Context struct {
 	Callee *ContextUserInfo `json:"callee,omitempty"`
 }
 
-type ContextUserInfo struct {
-	Id        string `json:"id,omitempty"`
-	Name      string `json:"name,omitempty"`
-	AvatarUrl string `json:"avatarUrl,omitempty"`
+type ContextUserInfo = app.RoomTokenUser
+
+// httpError 带 HTTP 状态码的错误
+type httpError struct {
+	status int
+	err    error
+}
+
+func newHTTPError(status int, err error) error {
+	return &httpError{status: status, err: err}
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+// errorStatus 错误对应的 HTTP 状态码，默认为 500
+func errorStatus(err error) int {
+	if e, ok := err.(*httpError); ok {
+		return e.status
+	}
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gocraft/dbr/v2"
+	"jhmeeting.com/adminserver/app"
+	"jhmeeting.com/adminserver/db"
+)
+
+// WebhookServer Webhook 订阅服务
+type WebhookServer struct {
+	*app.App
+}
+
+func NewWebhookServer(app *app.App) *WebhookServer {
+	return &WebhookServer{
+		App: app,
+	}
+}
+
+// Webhook 的请求参数，Secret 只写不读
+type webhookParam struct {
+	Id      int64          `json:"id,omitempty"`
+	OrgId   int64          `json:"orgId,omitempty"`
+	Url     string         `json:"url"`
+	Secret  string         `json:"secret"`
+	Events  app.StringList `json:"events"`
+	Enabled bool           `json:"enabled"`
+}
+
+// validate 校验参数，修改时 secret 为空表示不修改
+func (p webhookParam) validate(create bool) error {
+	u, err := url.Parse(p.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.New("接收地址无效")
+	}
+	if create && len(p.Secret) == 0 {
+		return errors.New("签名密钥不能为空")
+	}
+	for _, event := range p.Events {
+		if !app.WebhookEvents.Contains(event) {
+			return errors.New("不支持的事件: " + event)
+		}
+	}
+	return nil
+}
+
+// Create 创建 Webhook，指定 orgId 时需为组织管理员
+func (s WebhookServer) Create(c *gin.Context) {
+	var param webhookParam
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if err := param.validate(true); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	uid := c.GetInt64(app.UserID)
+	if param.OrgId > 0 && s.OrgRole(c, param.OrgId, uid) != app.OrgRoleAdmin {
+		c.AbortWithError(http.StatusForbidden, errors.New("没有组织的管理权限"))
+		return
+	}
+
+	webhook := app.Webhook{
+		Uid:     uid,
+		OrgId:   param.OrgId,
+		Url:     param.Url,
+		Secret:  param.Secret,
+		Events:  param.Events,
+		Enabled: param.Enabled,
+		Ctime:   time.Now(),
+	}
+	_, err := s.DB().InsertInto(app.WebhookTableName).
+		Columns(app.CommonUidCol, app.CommonOrgIdCol, app.WebhookUrlCol, app.WebhookSecretCol,
+			app.WebhookEventsCol, app.WebhookEnabledCol, app.CommonCtimeCol).
+		Record(&webhook).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id": webhook.Id,
+	})
+}
+
+// List Webhook 列表
+func (s WebhookServer) List(c *gin.Context) {
+	var param db.Pagination
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	scope, ok := ownerScope(c, s.App, true)
+	if !ok {
+		return
+	}
+
+	webhooks := []app.Webhook{}
+	result, err := db.NewSelector(s.DB()).From(app.WebhookTableName).
+		Where(scope).
+		Paginate(param.Page, param.PerPage).
+		OrderDesc(app.CommonIdCol).
+		LoadPage(&webhooks)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Modify 修改 Webhook，secret 为空时不修改
+func (s WebhookServer) Modify(c *gin.Context) {
+	var param webhookParam
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if err := param.validate(false); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	scope, ok := ownerScope(c, s.App, true)
+	if !ok {
+		return
+	}
+
+	stmt := s.DB().Update(app.WebhookTableName).
+		Set(app.WebhookUrlCol, param.Url).
+		Set(app.WebhookEventsCol, param.Events).
+		Set(app.WebhookEnabledCol, param.Enabled)
+	if len(param.Secret) > 0 {
+		stmt.Set(app.WebhookSecretCol, param.Secret)
+	}
+	_, err := stmt.Where(app.WhereCommonId, param.Id).Where(scope).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// Delete 删除 Webhook，未推送的记录不再推送
+func (s WebhookServer) Delete(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	scope, ok := ownerScope(c, s.App, true)
+	if !ok {
+		return
+	}
+	_, err := s.DB().DeleteFrom(app.WebhookTableName).Where(app.WhereCommonId, param.ID).Where(scope).ExecContext(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// Deliveries Webhook 的推送记录
+func (s WebhookServer) Deliveries(c *gin.Context) {
+	var param struct {
+		WebhookId int64  `json:"webhookId"`
+		Status    string `json:"status,omitempty"`
+		Page      uint64 `json:"page,omitempty"`
+		PerPage   uint64 `json:"perPage,omitempty"`
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+	if !s.ownWebhook(c, param.WebhookId) {
+		return
+	}
+
+	selector := db.NewSelector(s.DB())
+	if len(param.Status) > 0 {
+		selector.Conditions = append(selector.Conditions, db.Condition{
+			Col: app.DeliveryStatusCol,
+			Cmp: db.CmpEq,
+			Val: param.Status,
+		})
+	}
+	deliveries := []app.WebhookDelivery{}
+	result, err := selector.From(app.WebhookDeliveryTableName).
+		Where(dbr.Eq(app.DeliveryWebhookIdCol, param.WebhookId)).
+		Paginate(param.Page, param.PerPage).
+		OrderDesc(app.CommonIdCol).
+		LoadPage(&deliveries)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Redeliver 重新推送
+func (s WebhookServer) Redeliver(c *gin.Context) {
+	var param struct {
+		ID int64
+	}
+	if c.BindJSON(&param) != nil {
+		return
+	}
+
+	webhookID, err := s.DB().Select(app.DeliveryWebhookIdCol).From(app.WebhookDeliveryTableName).
+		Where(app.WhereCommonId, param.ID).ReturnInt64()
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, errors.New("推送记录不存在"))
+		return
+	}
+	if !s.ownWebhook(c, webhookID) {
+		return
+	}
+
+	delivery, err := s.RedeliverWebhook(c, param.ID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+// ownWebhook 当前用户是否可以管理 Webhook
+func (s WebhookServer) ownWebhook(c *gin.Context, webhookID int64) bool {
+	scope, ok := ownerScope(c, s.App, true)
+	if !ok {
+		return false
+	}
+	count, err := s.DB().Select("count(*)").From(app.WebhookTableName).
+		Where(app.WhereCommonId, webhookID).Where(scope).ReturnInt64()
+	if err != nil || count == 0 {
+		c.AbortWithError(http.StatusNotFound, errors.New("Webhook 不存在"))
+		return false
+	}
+	return true
+}
+
+// 会议室事件对应的 Webhook 事件
+var webhookActions = map[string]string{
+	MUC_ROOM_PRE_CREATE:     app.WebhookEventConferenceStarted,
+	MUC_OCCUPANT_JOINED:     app.WebhookEventParticipantJoined,
+	MUC_OCCUPANT_LEFT:       app.WebhookEventParticipantLeft,
+	MUC_ROOM_RECORDING_STOP: app.WebhookEventRecordingFinished,
+	MUC_ROOM_DESTROYED:      app.WebhookEventConferenceEnded,
+}
+
+// webhookData Webhook 推送的事件内容
+type webhookData struct {
+	Conference   app.ConferenceInfo `json:"conference"`
+	Jid          string             `json:"jid,omitempty"`
+	Nick         string             `json:"nick,omitempty"`
+	Participants int                `json:"participants"`
+	Recording    *RecordingFile     `json:"recording,omitempty"`
+}
+
+func (s ConferenceServer) registerWebhooks() {
+	for action, event := range webhookActions {
+		s.Subscribe(action, ActionHandlerFunc(s.webhookHandler(event)))
+	}
+}
+
+// webhookHandler 在事件的事务内创建推送记录，需在更新会议状态的处理器之后注册
+func (s ConferenceServer) webhookHandler(event string) func(ctx context.Context, req ActionRequest) (interface{}, error) {
+	return func(ctx context.Context, req ActionRequest) (interface{}, error) {
+		// 没有录像文件的录制结束事件只更新录制状态，不是录制完成
+		if event == app.WebhookEventRecordingFinished && req.Recording == nil {
+			return nil, nil
+		}
+		runner := ActionRunner(ctx, s.DB())
+
+		conference, err := actionConference(ctx, runner, req)
+		if conference == nil {
+			return nil, err
+		}
+
+		data := webhookData{
+			Conference:   *conference,
+			Jid:          req.Jid,
+			Nick:         req.Nick,
+			Participants: req.Participants,
+			Recording:    req.Recording,
+		}
+		return nil, s.EnqueueWebhook(ctx, runner, conference.Uid, conference.OrgId, event, data)
+	}
+}
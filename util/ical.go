@@ -0,0 +1,205 @@
+package util
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	iCalUTCFormat   = "20060102T150405Z"
+	iCalLocalFormat = "20060102T150405"
+	iCalLineLimit   = 75
+)
+
+// ICalEvent 日历中的一个日程，RRule 不为空时为重复日程
+type ICalEvent struct {
+	UID         string
+	Sequence    int
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Start       time.Time // 开始时间，重复日程按其时区展开
+	Duration    time.Duration
+	RRule       string
+	ExDates     []time.Time // 取消的日程开始时间
+	Organizer   string      // 组织者邮箱，邀请邮件中需要
+	Attendees   []string    // 参会者邮箱
+	Cancelled   bool
+	Created     time.Time
+	Modified    time.Time
+}
+
+// WriteICalendar 输出 RFC 5545 日历，method 为空时不输出 METHOD，下载和订阅时使用 PUBLISH，
+// 邀请邮件使用 REQUEST，取消会议使用 CANCEL
+func WriteICalendar(w io.Writer, name, method string, events []ICalEvent) error {
+	cw := &iCalWriter{w: bufio.NewWriter(w)}
+	cw.line("BEGIN:VCALENDAR")
+	cw.line("VERSION:2.0")
+	cw.line("PRODID:-//jhmeeting//adminserver//CN")
+	cw.line("CALSCALE:GREGORIAN")
+	if len(method) > 0 {
+		cw.line("METHOD:" + method)
+	}
+	if len(name) > 0 {
+		cw.line("X-WR-CALNAME:" + escapeICalText(name))
+	}
+
+	// 各时区只输出一次
+	zones := map[string]bool{}
+	for _, event := range events {
+		loc := event.Start.Location()
+		if loc == time.UTC || zones[loc.String()] {
+			continue
+		}
+		zones[loc.String()] = true
+		cw.timezone(event.Start)
+	}
+
+	for _, event := range events {
+		cw.event(event)
+	}
+	cw.line("END:VCALENDAR")
+
+	if cw.err != nil {
+		return cw.err
+	}
+	return cw.w.Flush()
+}
+
+type iCalWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// line 输出一行，超过 75 字节时按 RFC 5545 折行，不拆分 UTF-8 字符
+func (cw *iCalWriter) line(s string) {
+	if cw.err != nil {
+		return
+	}
+	limit := iCalLineLimit
+	for len(s) > limit {
+		n := limit
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		cw.write(s[:n] + "\r\n ")
+		s = s[n:]
+		// 续行以空格开头，占一个字节
+		limit = iCalLineLimit - 1
+	}
+	cw.write(s + "\r\n")
+}
+
+func (cw *iCalWriter) write(s string) {
+	if cw.err == nil {
+		_, cw.err = cw.w.WriteString(s)
+	}
+}
+
+// timezone 输出时区定义，使用 t 所在时间的偏移量
+func (cw *iCalWriter) timezone(t time.Time) {
+	abbr, offset := t.Zone()
+	cw.line("BEGIN:VTIMEZONE")
+	cw.line("TZID:" + t.Location().String())
+	cw.line("BEGIN:STANDARD")
+	cw.line("DTSTART:19700101T000000")
+	cw.line("TZOFFSETFROM:" + formatUTCOffset(offset))
+	cw.line("TZOFFSETTO:" + formatUTCOffset(offset))
+	cw.line("TZNAME:" + abbr)
+	cw.line("END:STANDARD")
+	cw.line("END:VTIMEZONE")
+}
+
+func (cw *iCalWriter) event(event ICalEvent) {
+	cw.line("BEGIN:VEVENT")
+	cw.line("UID:" + event.UID)
+	cw.line("SEQUENCE:" + strconv.Itoa(event.Sequence))
+	cw.line("DTSTAMP:" + event.Modified.UTC().Format(iCalUTCFormat))
+	if !event.Created.IsZero() {
+		cw.line("CREATED:" + event.Created.UTC().Format(iCalUTCFormat))
+	}
+	if !event.Modified.IsZero() {
+		cw.line("LAST-MODIFIED:" + event.Modified.UTC().Format(iCalUTCFormat))
+	}
+	cw.line(iCalTimeProperty("DTSTART", event.Start))
+	cw.line(iCalTimeProperty("DTEND", event.Start.Add(event.Duration)))
+	if len(event.RRule) > 0 {
+		cw.line("RRULE:" + event.RRule)
+	}
+	for _, exdate := range event.ExDates {
+		cw.line(iCalTimeProperty("EXDATE", exdate.In(event.Start.Location())))
+	}
+	cw.line("SUMMARY:" + escapeICalText(event.Summary))
+	if len(event.Description) > 0 {
+		cw.line("DESCRIPTION:" + escapeICalText(event.Description))
+	}
+	if len(event.Location) > 0 {
+		cw.line("LOCATION:" + escapeICalText(event.Location))
+	}
+	if len(event.URL) > 0 {
+		cw.line("URL:" + event.URL)
+	}
+	if len(event.Organizer) > 0 {
+		cw.line("ORGANIZER:mailto:" + event.Organizer)
+	}
+	for _, attendee := range event.Attendees {
+		cw.line("ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:" + attendee)
+	}
+	if event.Cancelled {
+		cw.line("STATUS:CANCELLED")
+	} else {
+		cw.line("STATUS:CONFIRMED")
+	}
+	cw.line("END:VEVENT")
+}
+
+// iCalTimeProperty UTC 时间使用 Z 后缀，其他时区使用 TZID
+func iCalTimeProperty(name string, t time.Time) string {
+	if t.Location() == time.UTC {
+		return name + ":" + t.Format(iCalUTCFormat)
+	}
+	return name + ";TZID=" + t.Location().String() + ":" + t.Format(iCalLocalFormat)
+}
+
+func formatUTCOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	hours, minutes := offset/3600, offset%3600/60
+	return sign + pad2(hours) + pad2(minutes)
+}
+
+func pad2(n int) string {
+	if n < 10 {
+		return "0" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+var iCalTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+func escapeICalText(s string) string {
+	return iCalTextEscaper.Replace(s)
+}
+
+func parseICalTime(s string) (time.Time, error) {
+	if strings.HasSuffix(s, "Z") {
+		return time.Parse(iCalUTCFormat, s)
+	}
+	if len(s) == 8 {
+		return time.Parse("20060102", s)
+	}
+	return time.Parse(iCalLocalFormat, s)
+}
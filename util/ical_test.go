@@ -0,0 +1,55 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteICalendar(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	require.NoError(t, err)
+	start := time.Date(2026, 1, 5, 9, 30, 0, 0, loc)
+	modified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	buf := &bytes.Buffer{}
+	err = WriteICalendar(buf, "会议", "PUBLISH", []ICalEvent{{
+		UID:         "meeting-1@jhmeeting",
+		Sequence:    2,
+		Summary:     "周会; 项目, 进度",
+		Description: strings.Repeat("长描述", 20) + "\n第二行",
+		Start:       start,
+		Duration:    time.Hour,
+		RRule:       "FREQ=WEEKLY;BYDAY=MO",
+		ExDates:     []time.Time{start.AddDate(0, 0, 7).UTC()},
+		Organizer:   "noreply@example.com",
+		Attendees:   []string{"a@example.com"},
+		Created:     modified,
+		Modified:    modified,
+	}})
+	require.NoError(t, err)
+
+	ics := buf.String()
+	require.True(t, strings.HasPrefix(ics, "BEGIN:VCALENDAR\r\n"))
+	require.True(t, strings.HasSuffix(ics, "END:VCALENDAR\r\n"))
+	require.Contains(t, ics, "TZID:Asia/Shanghai\r\n")
+	require.Contains(t, ics, "TZOFFSETTO:+0800\r\n")
+	require.Contains(t, ics, "DTSTART;TZID=Asia/Shanghai:20260105T093000\r\n")
+	require.Contains(t, ics, "DTEND;TZID=Asia/Shanghai:20260105T103000\r\n")
+	require.Contains(t, ics, "EXDATE;TZID=Asia/Shanghai:20260112T093000\r\n")
+	require.Contains(t, ics, "RRULE:FREQ=WEEKLY;BYDAY=MO\r\n")
+	require.Contains(t, ics, `SUMMARY:周会\; 项目\, 进度`)
+	require.Contains(t, ics, "SEQUENCE:2\r\n")
+	require.Contains(t, ics, "ORGANIZER:mailto:noreply@example.com\r\n")
+
+	// 折行后每行不超过 75 字节
+	for _, line := range strings.Split(ics, "\r\n") {
+		require.True(t, len(line) <= 75, line)
+	}
+	unfolded := strings.Replace(ics, "\r\n ", "", -1)
+	require.Contains(t, unfolded, "RSVP=TRUE:mailto:a@example.com\r\n")
+	require.Contains(t, unfolded, "DESCRIPTION:"+strings.Repeat("长描述", 20)+`\n第二行`)
+}
@@ -1,15 +1,162 @@
 package util
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// 密码哈希算法
+const (
+	PasswordAlgBcrypt   = "bcrypt"
+	PasswordAlgArgon2id = "argon2id"
+)
+
+// PasswordHasher 生成和校验密码哈希。哈希值自带算法和参数，
+// 调整算法或参数后旧的哈希仍可校验，NeedsRehash 用于登录时升级。
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, hash string) bool
+	// NeedsRehash 哈希使用的算法或参数与当前配置不同
+	NeedsRehash(hash string) bool
+}
+
+// NewPasswordHasher 按算法名称创建，参数为 0 时使用默认值
+func NewPasswordHasher(alg string, bcryptCost int, argon2 Argon2idHasher) (PasswordHasher, error) {
+	switch alg {
+	case "", PasswordAlgBcrypt:
+		if bcryptCost == 0 {
+			bcryptCost = bcrypt.DefaultCost
+		}
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("invalid bcrypt cost: %d", bcryptCost)
+		}
+		return BcryptHasher{Cost: bcryptCost}, nil
+	case PasswordAlgArgon2id:
+		return argon2.withDefaults(), nil
+	}
+	return nil, fmt.Errorf("unknown password algorithm: %s", alg)
+}
+
+// BcryptHasher 哈希格式为 $2a$cost$...
+type BcryptHasher struct {
+	Cost int
+}
+
+func (hasher BcryptHasher) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
 	return string(bytes), err
 }
 
+func (hasher BcryptHasher) Verify(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (hasher BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != hasher.Cost
+}
+
+// Argon2idHasher 哈希格式为 PHC 字符串 $argon2id$v=19$m=65536,t=3,p=4$salt$key
+type Argon2idHasher struct {
+	Time    uint32 `json:"time,omitempty"`    // 迭代次数，默认 3
+	Memory  uint32 `json:"memory,omitempty"`  // 内存（KiB），默认 65536
+	Threads uint8  `json:"threads,omitempty"` // 并行度，默认 4
+	KeyLen  uint32 `json:"keyLen,omitempty"`  // 哈希长度（字节），默认 32
+	SaltLen uint32 `json:"saltLen,omitempty"` // 盐长度（字节），默认 16
+}
+
+func (hasher Argon2idHasher) withDefaults() Argon2idHasher {
+	if hasher.Time == 0 {
+		hasher.Time = 3
+	}
+	if hasher.Memory == 0 {
+		hasher.Memory = 64 * 1024
+	}
+	if hasher.Threads == 0 {
+		hasher.Threads = 4
+	}
+	if hasher.KeyLen == 0 {
+		hasher.KeyLen = 32
+	}
+	if hasher.SaltLen == 0 {
+		hasher.SaltLen = 16
+	}
+	return hasher
+}
+
+func (hasher Argon2idHasher) Hash(password string) (string, error) {
+	hasher = hasher.withDefaults()
+	salt := make([]byte, hasher.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, hasher.Time, hasher.Memory, hasher.Threads, hasher.KeyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", PasswordAlgArgon2id, argon2.Version,
+		hasher.Memory, hasher.Time, hasher.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (hasher Argon2idHasher) Verify(password, hash string) bool {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (hasher Argon2idHasher) NeedsRehash(hash string) bool {
+	hasher = hasher.withDefaults()
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Time != hasher.Time || params.Memory != hasher.Memory || params.Threads != hasher.Threads ||
+		uint32(len(key)) != hasher.KeyLen || uint32(len(salt)) != hasher.SaltLen
+}
+
+func parseArgon2id(hash string) (params Argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordAlgArgon2id {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return
+	}
+	if params.Time == 0 || params.Threads == 0 || len(key) == 0 {
+		err = fmt.Errorf("invalid argon2id params")
+	}
+	return
+}
+
+// HashPassword 使用默认参数的 bcrypt 生成哈希
+func HashPassword(password string) (string, error) {
+	return BcryptHasher{Cost: bcrypt.DefaultCost}.Hash(password)
+}
+
+// CheckPasswordHash 按哈希的格式选择算法校验密码，支持 bcrypt 和 argon2id
 func CheckPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	if strings.HasPrefix(hash, "$"+PasswordAlgArgon2id+"$") {
+		return Argon2idHasher{}.Verify(password, hash)
+	}
+	return BcryptHasher{}.Verify(password, hash)
 }
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 测试使用较小的参数，避免耗时
+var testArgon2 = Argon2idHasher{Time: 1, Memory: 1024, Threads: 1}
+
+func TestPasswordHashers(t *testing.T) {
+	bcryptHasher, err := NewPasswordHasher(PasswordAlgBcrypt, bcrypt.MinCost, Argon2idHasher{})
+	require.NoError(t, err)
+	argon2Hasher, err := NewPasswordHasher(PasswordAlgArgon2id, 0, testArgon2)
+	require.NoError(t, err)
+
+	for _, hasher := range []PasswordHasher{bcryptHasher, argon2Hasher} {
+		hash, err := hasher.Hash("secret")
+		require.NoError(t, err)
+		require.True(t, hasher.Verify("secret", hash))
+		require.False(t, hasher.Verify("Secret", hash))
+		require.True(t, CheckPasswordHash("secret", hash))
+		require.False(t, CheckPasswordHash("secret2", hash))
+		require.False(t, hasher.NeedsRehash(hash))
+
+		other, _ := hasher.Hash("secret")
+		require.NotEqual(t, hash, other)
+	}
+
+	hash, _ := argon2Hasher.Hash("secret")
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	_, err = NewPasswordHasher("md5", 0, Argon2idHasher{})
+	require.Error(t, err)
+	_, err = NewPasswordHasher(PasswordAlgBcrypt, 64, Argon2idHasher{})
+	require.Error(t, err)
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	bcryptHash, err := HashPassword("secret")
+	require.NoError(t, err)
+	argon2Hash, err := testArgon2.Hash("secret")
+	require.NoError(t, err)
+
+	// 算法不同
+	require.True(t, testArgon2.NeedsRehash(bcryptHash))
+	require.True(t, BcryptHasher{Cost: bcrypt.DefaultCost}.NeedsRehash(argon2Hash))
+	// 参数不同
+	require.True(t, BcryptHasher{Cost: bcrypt.DefaultCost + 1}.NeedsRehash(bcryptHash))
+	stronger := testArgon2
+	stronger.Time = 2
+	require.True(t, stronger.NeedsRehash(argon2Hash))
+	require.True(t, testArgon2.NeedsRehash("$argon2id$v=19$m=1024,t=1,p=1$bad"))
+	require.False(t, CheckPasswordHash("secret", "$argon2id$v=19$m=1024,t=1,p=1$bad"))
+}
@@ -0,0 +1,243 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 重复规则的频率
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// 展开重复规则时最多遍历的周期数，避免不会产生日程的规则无限循环
+const rruleMaxPeriods = 10000
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// RRule RFC 5545 重复规则，支持 FREQ、INTERVAL、COUNT、UNTIL、BYDAY（不含序号）和 BYMONTHDAY
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []time.Weekday
+	ByMonthDay []int
+}
+
+// ParseRRule 解析重复规则，如 FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10
+func ParseRRule(s string) (*RRule, error) {
+	rule := &RRule{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("rrule: invalid part %q", part)
+		}
+		key, val := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		switch key {
+		case "FREQ":
+			switch val {
+			case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+				rule.Freq = val
+			default:
+				return nil, fmt.Errorf("rrule: unsupported FREQ %q", val)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("rrule: invalid INTERVAL %q", val)
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("rrule: invalid COUNT %q", val)
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := parseICalTime(val)
+			if err != nil {
+				return nil, fmt.Errorf("rrule: invalid UNTIL %q", val)
+			}
+			rule.Until = until
+		case "BYDAY":
+			for _, code := range strings.Split(val, ",") {
+				weekday, ok := weekdayCodes[code]
+				if !ok {
+					return nil, fmt.Errorf("rrule: unsupported BYDAY %q", code)
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(val, ",") {
+				n, err := strconv.Atoi(day)
+				if err != nil || n == 0 || n > 31 || n < -31 {
+					return nil, fmt.Errorf("rrule: invalid BYMONTHDAY %q", day)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, n)
+			}
+		case "WKST":
+			if val != "MO" {
+				return nil, errors.New("rrule: only WKST=MO is supported")
+			}
+		default:
+			return nil, fmt.Errorf("rrule: unsupported %s", key)
+		}
+	}
+
+	if len(rule.Freq) == 0 {
+		return nil, errors.New("rrule: FREQ is required")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return nil, errors.New("rrule: COUNT and UNTIL are exclusive")
+	}
+	return rule, nil
+}
+
+// String 规则的 RFC 5545 文本
+func (r *RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(iCalUTCFormat))
+	}
+	if len(r.ByDay) > 0 {
+		codes := []string{}
+		for _, weekday := range r.ByDay {
+			for code, day := range weekdayCodes {
+				if day == weekday {
+					codes = append(codes, code)
+				}
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(codes, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := []string{}
+		for _, day := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(day))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Between 按 dtstart 所在时区展开 [after, before) 之间的日程开始时间，最多返回 limit 个。
+// dtstart 总是第一次日程，COUNT 从 dtstart 开始计数。
+func (r *RRule) Between(dtstart, after, before time.Time, limit int) []time.Time {
+	result := []time.Time{}
+	count := 0
+
+	for period := 0; period < rruleMaxPeriods; period++ {
+		for _, t := range r.periodTimes(dtstart, period*r.Interval) {
+			if t.Before(dtstart) {
+				continue
+			}
+			if !r.Until.IsZero() && t.After(r.Until) {
+				return result
+			}
+			if !t.Before(before) {
+				return result
+			}
+			count++
+			if r.Count > 0 && count > r.Count {
+				return result
+			}
+			if !t.Before(after) {
+				result = append(result, t)
+				if limit > 0 && len(result) >= limit {
+					return result
+				}
+			}
+		}
+	}
+	return result
+}
+
+// periodTimes 第 n 个周期内的日程，按时间排序
+func (r *RRule) periodTimes(dtstart time.Time, n int) (times []time.Time) {
+	year, month, day := dtstart.Date()
+	hour, min, sec := dtstart.Clock()
+	loc := dtstart.Location()
+	date := func(y int, m time.Month, d int) (time.Time, bool) {
+		t := time.Date(y, m, d, hour, min, sec, 0, loc)
+		// 不存在的日期（如 2 月 30 日）被跳过
+		return t, t.Day() == d && t.Month() == m
+	}
+
+	switch r.Freq {
+	case FreqDaily:
+		t, _ := date(year, month, day+n)
+		if len(r.ByDay) == 0 || containsWeekday(r.ByDay, t.Weekday()) {
+			times = append(times, t)
+		}
+
+	case FreqWeekly:
+		// 周一为每周第一天
+		offset := (int(dtstart.Weekday()) + 6) % 7
+		weekdays := r.ByDay
+		if len(weekdays) == 0 {
+			weekdays = []time.Weekday{dtstart.Weekday()}
+		}
+		for _, weekday := range weekdays {
+			t, _ := date(year, month, day-offset+7*n+(int(weekday)+6)%7)
+			times = append(times, t)
+		}
+
+	case FreqMonthly:
+		first := time.Date(year, month+time.Month(n), 1, 0, 0, 0, 0, loc)
+		days := r.ByMonthDay
+		if len(days) == 0 {
+			days = []int{day}
+		}
+		lastDay := first.AddDate(0, 1, -1).Day()
+		for _, d := range days {
+			if d < 0 {
+				d = lastDay + d + 1
+			}
+			if t, ok := date(first.Year(), first.Month(), d); ok {
+				times = append(times, t)
+			}
+		}
+
+	case FreqYearly:
+		if t, ok := date(year+n, month, day); ok {
+			times = append(times, t)
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return
+}
+
+func containsWeekday(weekdays []time.Weekday, weekday time.Weekday) bool {
+	for _, d := range weekdays {
+		if d == weekday {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRRule(t *testing.T) {
+	rule, err := ParseRRule("FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=4")
+	require.NoError(t, err)
+	require.Equal(t, FreqWeekly, rule.Freq)
+	require.Equal(t, 2, rule.Interval)
+	require.Equal(t, 4, rule.Count)
+	require.Equal(t, []time.Weekday{time.Monday, time.Wednesday}, rule.ByDay)
+	require.Equal(t, "FREQ=WEEKLY;INTERVAL=2;COUNT=4;BYDAY=MO,WE", rule.String())
+
+	for _, s := range []string{"", "INTERVAL=2", "FREQ=HOURLY", "FREQ=DAILY;COUNT=0", "FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=DAILY;COUNT=2;UNTIL=20260101T000000Z"} {
+		_, err = ParseRRule(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestRRuleBetween(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	// 2026-01-05 是周一
+	dtstart := time.Date(2026, 1, 5, 9, 30, 0, 0, loc)
+	from, to := dtstart.AddDate(-1, 0, 0), dtstart.AddDate(2, 0, 0)
+
+	rule, _ := ParseRRule("FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=4")
+	require.Equal(t, []time.Time{
+		dtstart,
+		time.Date(2026, 1, 7, 9, 30, 0, 0, loc),
+		time.Date(2026, 1, 19, 9, 30, 0, 0, loc),
+		time.Date(2026, 1, 21, 9, 30, 0, 0, loc),
+	}, rule.Between(dtstart, from, to, 0))
+
+	// COUNT 从 dtstart 开始计数，与查询范围无关
+	require.Equal(t, []time.Time{
+		time.Date(2026, 1, 21, 9, 30, 0, 0, loc),
+	}, rule.Between(dtstart, time.Date(2026, 1, 20, 0, 0, 0, 0, loc), to, 0))
+
+	rule, _ = ParseRRule("FREQ=DAILY;UNTIL=20260108T013000Z")
+	require.Len(t, rule.Between(dtstart, from, to, 0), 4)
+
+	rule, _ = ParseRRule("FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR")
+	times := rule.Between(dtstart, from, to, 6)
+	require.Len(t, times, 6)
+	require.Equal(t, time.Date(2026, 1, 12, 9, 30, 0, 0, loc), times[5])
+
+	// 不存在的日期被跳过
+	dtstart = time.Date(2026, 1, 31, 10, 0, 0, 0, loc)
+	rule, _ = ParseRRule("FREQ=MONTHLY;COUNT=3")
+	require.Equal(t, []time.Time{
+		dtstart,
+		time.Date(2026, 3, 31, 10, 0, 0, 0, loc),
+		time.Date(2026, 5, 31, 10, 0, 0, 0, loc),
+	}, rule.Between(dtstart, from, to.AddDate(1, 0, 0), 0))
+
+	rule, _ = ParseRRule("FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=2")
+	require.Equal(t, []time.Time{
+		dtstart,
+		time.Date(2026, 2, 28, 10, 0, 0, 0, loc),
+	}, rule.Between(dtstart, from, to, 0))
+
+	dtstart = time.Date(2024, 2, 29, 10, 0, 0, 0, loc)
+	rule, _ = ParseRRule("FREQ=YEARLY;COUNT=2")
+	require.Equal(t, []time.Time{
+		dtstart,
+		time.Date(2028, 2, 29, 10, 0, 0, 0, loc),
+	}, rule.Between(dtstart, dtstart, dtstart.AddDate(10, 0, 0), 0))
+}
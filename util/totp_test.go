@@ -0,0 +1,53 @@
+package util
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// RFC 6238 附录 B 中 SHA1 的测试向量
+func TestHOTPVectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, c := range cases {
+		counter := TOTPCounter(time.Unix(c.unix, 0))
+		require.Equal(t, c.code, HOTP(key, uint64(counter), 8), c.unix)
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	code, err := TOTPCode(secret, now)
+	require.NoError(t, err)
+	require.Equal(t, "050471", code)
+
+	counter, ok := CheckTOTP(secret, code, now.Add(TOTPPeriod*time.Second), 1)
+	require.True(t, ok)
+	require.Equal(t, TOTPCounter(now), counter)
+	_, ok = CheckTOTP(secret, code, now.Add(2*TOTPPeriod*time.Second), 1)
+	require.False(t, ok)
+	_, ok = CheckTOTP(secret, "12345", now, 1)
+	require.False(t, ok)
+
+	secret, err = NewTOTPSecret()
+	require.NoError(t, err)
+	require.Len(t, secret, 32)
+	uri := TOTPProvisioningURI("会议系统", "alice", secret)
+	require.True(t, strings.HasPrefix(uri, "otpauth://totp/%E4%BC%9A%E8%AE%AE%E7%B3%BB%E7%BB%9F:alice?"))
+	require.Contains(t, uri, "secret="+secret)
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+)
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+	xlsxWorkbookHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="`
+	xlsxWorkbookFooter = `" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxSheetHeader    = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetFooter = `</sheetData></worksheet>`
+)
+
+// XlsxWriter 流式写入只有一个工作表的 xlsx 文件，不在内存中缓存数据
+type XlsxWriter struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	row   int
+}
+
+// NewXlsxWriter 创建 xlsx 写入器，写入完成后必须调用 Close
+func NewXlsxWriter(w io.Writer, sheetName string) (*XlsxWriter, error) {
+	zw := zip.NewWriter(w)
+
+	var workbook []byte
+	workbook = append(workbook, xlsxWorkbookHeader...)
+	workbook = append(workbook, escapeXML(sheetName)...)
+	workbook = append(workbook, xlsxWorkbookFooter...)
+
+	files := []struct {
+		name string
+		data string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", string(workbook)},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(fw, file.data); err != nil {
+			return nil, err
+		}
+	}
+
+	// 工作表必须是最后一个文件，之后的行数据直接写入
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.WriteString(sheet, xlsxSheetHeader); err != nil {
+		return nil, err
+	}
+
+	return &XlsxWriter{zw: zw, sheet: sheet}, nil
+}
+
+// Write 写入一行，整数写为数值单元格，其余写为文本单元格
+func (w *XlsxWriter) Write(record []string) error {
+	w.row++
+	rowNum := strconv.Itoa(w.row)
+
+	buf := []byte(`<row r="` + rowNum + `">`)
+	for i, value := range record {
+		ref := xlsxColumnName(i) + rowNum
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(n, 10) == value {
+			buf = append(buf, `<c r="`+ref+`"><v>`+value+`</v></c>`...)
+		} else {
+			buf = append(buf, `<c r="`+ref+`" t="inlineStr"><is><t xml:space="preserve">`...)
+			buf = append(buf, escapeXML(value)...)
+			buf = append(buf, `</t></is></c>`...)
+		}
+	}
+	buf = append(buf, `</row>`...)
+
+	_, err := w.sheet.Write(buf)
+	return err
+}
+
+// Close 写入文件结尾，不会关闭底层的 io.Writer
+func (w *XlsxWriter) Close() error {
+	if _, err := io.WriteString(w.sheet, xlsxSheetFooter); err != nil {
+		return err
+	}
+	return w.zw.Close()
+}
+
+// xlsxColumnName 列序号（从 0 开始）转换为列名，如 0 => A，26 => AA
+func xlsxColumnName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}
+
+func escapeXML(s string) []byte {
+	buf := bytes.Buffer{}
+	xml.EscapeText(&buf, []byte(s))
+	return buf.Bytes()
+}
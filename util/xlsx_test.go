@@ -0,0 +1,48 @@
+package util
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestXlsxWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	writer, err := NewXlsxWriter(&buf, "报表<1>")
+	require.NoError(t, err)
+	require.NoError(t, writer.Write([]string{"名称", "数量"}))
+	require.NoError(t, writer.Write([]string{"a&b", "42", "007", "'=1+1"}))
+	require.NoError(t, writer.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	files := map[string]string{}
+	for _, file := range zr.File {
+		rc, err := file.Open()
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		files[file.Name] = string(data)
+	}
+	require.Contains(t, files, "[Content_Types].xml")
+	require.Contains(t, files["xl/workbook.xml"], `name="报表&lt;1&gt;"`)
+
+	sheet := files["xl/worksheets/sheet1.xml"]
+	require.Contains(t, sheet, `<row r="1"><c r="A1" t="inlineStr"><is><t xml:space="preserve">名称</t></is></c>`)
+	require.Contains(t, sheet, `<t xml:space="preserve">a&amp;b</t>`)
+	// 整数写为数值，前导零的字符串保持文本
+	require.Contains(t, sheet, `<c r="B2"><v>42</v></c>`)
+	require.Contains(t, sheet, `<c r="C2" t="inlineStr"><is><t xml:space="preserve">007</t>`)
+	require.Contains(t, sheet, `<t xml:space="preserve">&#39;=1+1</t>`)
+	require.Contains(t, sheet, `</sheetData></worksheet>`)
+}
+
+func TestXlsxColumnName(t *testing.T) {
+	for index, name := range map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		require.Equal(t, name, xlsxColumnName(index))
+	}
+}